@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"dokeep/internal/config"
+)
+
+// runConfig implements "dokeep config print", which shows the effective
+// configuration after all sources have been applied.
+func runConfig(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dokeep config print [config flags]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "print" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(fs, args[1:])
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := cfg.Write(os.Stdout); err != nil {
+		log.Fatalf("could not print config: %v", err)
+	}
+}
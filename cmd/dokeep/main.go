@@ -1,37 +1,100 @@
 package main
 
 import (
-	"bytes"
-	"image/png"
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
-	"strconv"
+	"os"
 	"strings"
-	"time"
 
+	"dokeep/internal/auth"
+	"dokeep/internal/config"
 	"dokeep/internal/database"
+	"dokeep/internal/entities"
 	"dokeep/internal/handler"
 	"dokeep/internal/middleware"
+	"dokeep/internal/passkey"
+	"dokeep/internal/search"
+	"dokeep/internal/sso"
+	"dokeep/internal/storage"
+	"dokeep/internal/worker"
 	"dokeep/web/template"
 
 	"github.com/alexedwards/scs/postgresstore"
 	"github.com/alexedwards/scs/v2"
-	"github.com/pquerna/otp/totp"
 )
 
 var sessionManager *scs.SessionManager
 
 func main() {
-	db := database.InitDB()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+		case "config":
+			runConfig(os.Args[2:])
+		case "storage":
+			runStorage(os.Args[2:])
+		case "user":
+			runUser(os.Args[2:])
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		return
+	}
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	db := database.InitDB(cfg.Database)
 	defer db.Close()
 
 	// Initialize session manager
 	sessionManager = scs.New()
 	sessionManager.Store = postgresstore.New(db)
-	sessionManager.Lifetime = 12 * time.Hour
+	sessionManager.Lifetime = cfg.Session.Lifetime.Std()
+
+	store, err := storage.New(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("could not open file storage: %v", err)
+	}
 
-	authHandler := &handler.AuthHandler{DB: db, Session: sessionManager}
-	docHandler := &handler.DocumentHandler{DB: db, Session: sessionManager}
+	// Process queued documents in the background
+	worker.New(db, cfg, store).Start(context.Background())
+
+	passkeys, err := passkey.New(db, cfg.WebAuthn)
+	if err != nil {
+		log.Fatalf("could not set up passkeys: %v", err)
+	}
+
+	// Passwords are checked by the directory first, if there is one, then
+	// by Dokeep's own store
+	var authenticators auth.Chain
+	// The directory is also asked whether users may still sign in with
+	// passkeys, single sign-on and API tokens
+	var directory auth.Directory
+	if cfg.LDAP.Enabled {
+		ldapAuth := &auth.LDAPAuthenticator{DB: db, Config: cfg.LDAP}
+		authenticators = append(authenticators, ldapAuth)
+		directory = ldapAuth
+	}
+	localPasswords := !cfg.Login.DisablePassword && (!cfg.LDAP.Enabled || cfg.LDAP.LocalFallback)
+	if localPasswords {
+		authenticators = append(authenticators, &auth.LocalAuthenticator{DB: db})
+	}
+
+	authHandler := &handler.AuthHandler{DB: db, Session: sessionManager, Throttle: &auth.Throttle{DB: db, Config: cfg.Login}, Passkeys: passkeys, Directory: directory, DisablePassword: !localPasswords}
+	if len(authenticators) > 0 {
+		authHandler.Authenticator = authenticators
+	}
+	if cfg.OIDC.Enabled {
+		authHandler.SSO = sso.New(cfg.OIDC)
+	}
+	docHandler := &handler.DocumentHandler{DB: db, Session: sessionManager, Config: cfg, Storage: store}
 
 	mux := http.NewServeMux()
 
@@ -46,29 +109,78 @@ func main() {
 	mux.HandleFunc("/dashboard", middleware.RequireAuth(sessionManager, func(w http.ResponseWriter, r *http.Request) {
 		flashError := sessionManager.PopString(r.Context(), "flash_error")
 
-		query := r.URL.Query().Get("q")
-		pageStr := r.URL.Query().Get("page")
-		page, err := strconv.Atoi(pageStr)
-		if err != nil || page < 1 {
-			page = 1
-		}
-
 		username := sessionManager.GetString(r.Context(), "username")
-		docs, totalDocs, err := docHandler.List(w, r)
+		list, err := docHandler.List(w, r)
+		// A malformed query is shown next to the search box instead of failing the page.
+		var queryErr *search.Error
+		searchError := ""
+		if errors.As(err, &queryErr) {
+			searchError = queryErr.Error()
+			err = nil
+		}
 		if err != nil {
 			http.Error(w, "Failed to list documents", http.StatusInternalServerError)
 			return
 		}
 
-		totalPages := (totalDocs + 9) / 10
-		template.DashboardPage(username, docs, totalDocs, page, totalPages, query, flashError).Render(r.Context(), w)
+		tagTree, err := docHandler.TagTree(r)
+		if err != nil {
+			log.Printf("Error loading tag tree: %v", err)
+		}
+
+		views, err := docHandler.DashboardViews(r)
+		if err != nil {
+			log.Printf("Error loading dashboard views: %v", err)
+		}
+
+		correspondents, err := docHandler.Correspondents(r)
+		if err != nil {
+			log.Printf("Error loading correspondents: %v", err)
+		}
+
+		template.DashboardPage(username, list, r.URL.Query().Get("sort"), searchError, flashError, tagTree, views, correspondents).Render(r.Context(), w)
 	}))
 
 	mux.HandleFunc("/queue", middleware.RequireAuth(sessionManager, docHandler.Queue))
 	mux.HandleFunc("/queue/status", middleware.RequireAuth(sessionManager, docHandler.QueueStatus))
+	mux.HandleFunc("POST /queue/actions", middleware.RequireAuth(sessionManager, docHandler.BulkAction))
+	mux.HandleFunc("POST /uploads/rejected/{id}/store", middleware.RequireAuth(sessionManager, docHandler.StoreRejectedUpload))
+	mux.HandleFunc("POST /uploads/rejected/{id}/discard", middleware.RequireAuth(sessionManager, docHandler.DiscardRejectedUpload))
 
 	mux.HandleFunc("/document", middleware.RequireAuth(sessionManager, docHandler.Show))
 
+	mux.HandleFunc("GET /tags", middleware.RequireAuth(sessionManager, docHandler.Tags))
+	mux.HandleFunc("POST /tags/{id}", middleware.RequireAuth(sessionManager, docHandler.UpdateTag))
+	mux.HandleFunc("POST /tags/{id}/merge", middleware.RequireAuth(sessionManager, docHandler.MergeTag))
+	mux.HandleFunc("POST /tags/{id}/delete", middleware.RequireAuth(sessionManager, docHandler.DeleteTag))
+
+	for _, kind := range []entities.Kind{entities.Correspondents, entities.DocumentTypes} {
+		mux.HandleFunc("GET "+kind.Path, middleware.RequireAuth(sessionManager, docHandler.Entities(kind)))
+		mux.HandleFunc("POST "+kind.Path, middleware.RequireAuth(sessionManager, docHandler.CreateEntity(kind)))
+		mux.HandleFunc("POST "+kind.Path+"/{id}", middleware.RequireAuth(sessionManager, docHandler.RenameEntity(kind)))
+		mux.HandleFunc("POST "+kind.Path+"/{id}/delete", middleware.RequireAuth(sessionManager, docHandler.DeleteEntity(kind)))
+	}
+
+	mux.HandleFunc("GET /custom-fields", middleware.RequireAuth(sessionManager, docHandler.CustomFields))
+	mux.HandleFunc("POST /custom-fields", middleware.RequireAuth(sessionManager, docHandler.CreateCustomField))
+	mux.HandleFunc("POST /custom-fields/{id}", middleware.RequireAuth(sessionManager, docHandler.UpdateCustomField))
+	mux.HandleFunc("POST /custom-fields/{id}/delete", middleware.RequireAuth(sessionManager, docHandler.DeleteCustomField))
+
+	mux.HandleFunc("GET /search/suggest", middleware.RequireAuth(sessionManager, docHandler.Suggest))
+
+	mux.HandleFunc("GET /duplicates", middleware.RequireAuth(sessionManager, docHandler.Duplicates))
+	mux.HandleFunc("POST /duplicates/dismiss", middleware.RequireAuth(sessionManager, docHandler.DismissDuplicate))
+	mux.HandleFunc("POST /duplicates/merge", middleware.RequireAuth(sessionManager, docHandler.MergeDuplicate))
+	mux.HandleFunc("POST /duplicates/delete", middleware.RequireAuth(sessionManager, docHandler.DeleteDuplicate))
+
+	mux.HandleFunc("GET /saved-searches", middleware.RequireAuth(sessionManager, docHandler.SavedSearches))
+	mux.HandleFunc("POST /saved-searches", middleware.RequireAuth(sessionManager, docHandler.CreateSavedSearch))
+	mux.HandleFunc("POST /saved-searches/{id}", middleware.RequireAuth(sessionManager, docHandler.UpdateSavedSearch))
+	mux.HandleFunc("POST /saved-searches/{id}/delete", middleware.RequireAuth(sessionManager, docHandler.DeleteSavedSearch))
+
+	mux.HandleFunc("GET /document/{id}/file", middleware.RequireAuth(sessionManager, docHandler.Download))
+	mux.HandleFunc("GET /document/{id}/thumbnail", middleware.RequireAuth(sessionManager, docHandler.Thumbnail))
+
 	mux.HandleFunc("/document/", middleware.RequireAuth(sessionManager, func(w http.ResponseWriter, r *http.Request) {
 		// For POST requests, we need to parse the form to check for _method or other fields
 		if r.Method == http.MethodPost {
@@ -89,10 +201,18 @@ func main() {
 			} else {
 				http.NotFound(w, r)
 			}
+		case r.Method == http.MethodPost && strings.HasSuffix(trimmedPath, "/fields"):
+			docHandler.UpdateFields(w, r)
 		case strings.HasSuffix(trimmedPath, "/details"):
 			docHandler.UpdateDetails(w, r)
 		case strings.HasSuffix(trimmedPath, "/date"):
 			docHandler.UpdateDate(w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(trimmedPath, "/retry"):
+			docHandler.Retry(w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(trimmedPath, "/cancel"):
+			docHandler.Cancel(w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(trimmedPath, "/reprocess"):
+			docHandler.Reprocess(w, r)
 		case r.PostFormValue("_method") == "DELETE":
 			docHandler.Delete(w, r)
 		default:
@@ -100,14 +220,83 @@ func main() {
 		}
 	}))
 
+	// JSON API
+	apiHandler := &handler.APIHandler{Docs: docHandler}
+	api := func(next http.HandlerFunc) http.HandlerFunc {
+		return middleware.RequireAPIAuth(sessionManager, db, directory, next)
+	}
+	mux.HandleFunc("GET /api/v1/documents", api(apiHandler.ListDocuments))
+	mux.HandleFunc("POST /api/v1/documents", api(apiHandler.CreateDocument))
+	mux.HandleFunc("GET /api/v1/documents/{id}", api(apiHandler.GetDocument))
+	mux.HandleFunc("PATCH /api/v1/documents/{id}", api(apiHandler.UpdateDocument))
+	mux.HandleFunc("DELETE /api/v1/documents/{id}", api(apiHandler.DeleteDocument))
+	mux.HandleFunc("GET /api/v1/documents/{id}/tags", api(apiHandler.ListTags))
+	mux.HandleFunc("POST /api/v1/documents/{id}/tags", api(apiHandler.AddTags))
+	mux.HandleFunc("DELETE /api/v1/documents/{id}/tags/{tagID}", api(apiHandler.RemoveTag))
+	mux.HandleFunc("GET /api/v1/documents/{id}/file", api(docHandler.Download))
+	mux.HandleFunc("GET /api/v1/documents/{id}/thumbnail", api(docHandler.Thumbnail))
+	mux.HandleFunc("GET /api/v1/documents/{id}/history", api(apiHandler.DocumentHistory))
+	mux.HandleFunc("POST /api/v1/documents/{id}/retry", api(apiHandler.RetryDocument))
+	mux.HandleFunc("POST /api/v1/documents/{id}/cancel", api(apiHandler.CancelDocument))
+	mux.HandleFunc("POST /api/v1/documents/{id}/reprocess", api(apiHandler.ReprocessDocument))
+	mux.HandleFunc("GET /api/v1/documents/{id}/similar", api(apiHandler.SimilarDocuments))
+	mux.HandleFunc("POST /api/v1/documents/actions", api(apiHandler.BulkAction))
+	mux.HandleFunc("GET /api/v1/duplicates", api(apiHandler.ListDuplicates))
+	mux.HandleFunc("POST /api/v1/duplicates/merge", api(apiHandler.MergeDuplicates))
+	mux.HandleFunc("POST /api/v1/duplicates/dismiss", api(apiHandler.DismissDuplicate))
+	mux.HandleFunc("GET /api/v1/tags", api(apiHandler.ListAllTags))
+	mux.HandleFunc("GET /api/v1/tags/{id}", api(apiHandler.GetTag))
+	mux.HandleFunc("PATCH /api/v1/tags/{id}", api(apiHandler.UpdateTag))
+	mux.HandleFunc("DELETE /api/v1/tags/{id}", api(apiHandler.DeleteTag))
+	mux.HandleFunc("POST /api/v1/tags/{id}/merge", api(apiHandler.MergeTag))
+	for _, kind := range []entities.Kind{entities.Correspondents, entities.DocumentTypes} {
+		mux.HandleFunc("GET /api/v1"+kind.Path, api(apiHandler.ListEntities(kind)))
+		mux.HandleFunc("POST /api/v1"+kind.Path, api(apiHandler.CreateEntity(kind)))
+		mux.HandleFunc("GET /api/v1"+kind.Path+"/{id}", api(apiHandler.GetEntity(kind)))
+		mux.HandleFunc("PATCH /api/v1"+kind.Path+"/{id}", api(apiHandler.UpdateEntity(kind)))
+		mux.HandleFunc("DELETE /api/v1"+kind.Path+"/{id}", api(apiHandler.DeleteEntity(kind)))
+	}
+	mux.HandleFunc("GET /api/v1/custom-fields", api(apiHandler.ListCustomFields))
+	mux.HandleFunc("POST /api/v1/custom-fields", api(apiHandler.CreateCustomField))
+	mux.HandleFunc("GET /api/v1/custom-fields/{id}", api(apiHandler.GetCustomField))
+	mux.HandleFunc("PATCH /api/v1/custom-fields/{id}", api(apiHandler.UpdateCustomField))
+	mux.HandleFunc("DELETE /api/v1/custom-fields/{id}", api(apiHandler.DeleteCustomField))
+	mux.HandleFunc("GET /api/v1/saved-searches", api(apiHandler.ListSavedSearches))
+	mux.HandleFunc("POST /api/v1/saved-searches", api(apiHandler.CreateSavedSearch))
+	mux.HandleFunc("GET /api/v1/saved-searches/{id}", api(apiHandler.GetSavedSearch))
+	mux.HandleFunc("PATCH /api/v1/saved-searches/{id}", api(apiHandler.UpdateSavedSearch))
+	mux.HandleFunc("DELETE /api/v1/saved-searches/{id}", api(apiHandler.DeleteSavedSearch))
+	mux.HandleFunc("GET /api/v1/saved-searches/{id}/documents", api(apiHandler.SavedSearchDocuments))
+	mux.HandleFunc("GET /api/v1/export", api(apiHandler.Export))
+	mux.HandleFunc("GET /api/v1/queue", api(apiHandler.QueueStatus))
+	mux.HandleFunc("GET /api/v1/rejected-uploads", api(apiHandler.ListRejectedUploads))
+	mux.HandleFunc("POST /api/v1/rejected-uploads/{id}/store", api(apiHandler.StoreRejectedUpload))
+	mux.HandleFunc("DELETE /api/v1/rejected-uploads/{id}", api(apiHandler.DiscardRejectedUpload))
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}` + "\n"))
+	})
+
 	mux.HandleFunc("/train", middleware.RequireAuth(sessionManager, docHandler.Train))
 
 	mux.HandleFunc("/settings", middleware.RequireAuth(sessionManager, authHandler.ShowSettingsPage))
+	mux.HandleFunc("GET /settings/export", middleware.RequireAuth(sessionManager, docHandler.Export))
 	mux.HandleFunc("/settings/password", middleware.RequireAuth(sessionManager, authHandler.ChangePassword))
-
-	mux.HandleFunc("/uploads/", middleware.RequireAuth(sessionManager, func(w http.ResponseWriter, r *http.Request) {
-		http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads"))).ServeHTTP(w, r)
-	}))
+	mux.HandleFunc("POST /settings/totp/enroll", middleware.RequireAuth(sessionManager, authHandler.EnrollTOTP))
+	mux.HandleFunc("POST /settings/totp/recovery-codes", middleware.RequireAuth(sessionManager, authHandler.RegenerateRecoveryCodes))
+	mux.HandleFunc("POST /settings/totp/disable", middleware.RequireAuth(sessionManager, authHandler.DisableTOTP))
+	mux.HandleFunc("POST /settings/passkeys/register/begin", middleware.RequireAuth(sessionManager, authHandler.BeginPasskeyRegistration))
+	mux.HandleFunc("POST /settings/passkeys/register/finish", middleware.RequireAuth(sessionManager, authHandler.FinishPasskeyRegistration))
+	mux.HandleFunc("POST /settings/passkeys/{id}/rename", middleware.RequireAuth(sessionManager, authHandler.RenamePasskey))
+	mux.HandleFunc("POST /settings/passkeys/{id}/delete", middleware.RequireAuth(sessionManager, authHandler.DeletePasskey))
+	mux.HandleFunc("POST /settings/oidc/link", middleware.RequireAuth(sessionManager, authHandler.LinkSingleSignOn))
+	mux.HandleFunc("POST /settings/oidc/unlink", middleware.RequireAuth(sessionManager, authHandler.UnlinkSingleSignOn))
+	mux.HandleFunc("POST /settings/tokens", middleware.RequireAuth(sessionManager, authHandler.CreateToken))
+	mux.HandleFunc("POST /settings/tokens/{id}/revoke", middleware.RequireAuth(sessionManager, authHandler.RevokeToken))
+
+	mux.HandleFunc("GET /admin/users", middleware.RequireAdmin(sessionManager, db, directory, authHandler.ShowUsers))
+	mux.HandleFunc("POST /admin/users/{id}/reset-2fa", middleware.RequireAdmin(sessionManager, db, directory, authHandler.ResetUserTwoFactor))
 
 	mux.HandleFunc("/upload", middleware.RequireAuth(sessionManager, func(w http.ResponseWriter, r *http.Request) {
 		docHandler.Upload(w, r)
@@ -130,68 +319,28 @@ func main() {
 		}
 	})
 
-	mux.HandleFunc("/setup-totp", func(w http.ResponseWriter, r *http.Request) {
-		userID := sessionManager.Get(r.Context(), "userID")
-		var username string
-		err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
-		if err != nil {
-			log.Printf("Error fetching username for TOTP setup: %v", err)
-			http.Error(w, "Could not retrieve user information", http.StatusInternalServerError)
-			return
-		}
-
-		key, err := totp.Generate(totp.GenerateOpts{
-			Issuer:      "Dokeep",
-			AccountName: username,
-		})
-		if err != nil {
-			log.Printf("Error generating TOTP key: %v", err)
-			http.Error(w, "Could not generate TOTP key", http.StatusInternalServerError)
-			return
-		}
-
-		// Store the secret in the session so we can verify it later
-		sessionManager.Put(r.Context(), "totp_secret", key.Secret())
-
-		if r.Method == http.MethodPost {
-			if err := r.ParseForm(); err != nil {
-				log.Printf("Error parsing form for TOTP setup: %v", err)
-				http.Error(w, "Could not parse form", http.StatusBadRequest)
-				return
-			}
-			r.Form.Set("secret", key.Secret())
-			authHandler.SetupTOTP(w, r)
-			return
-		}
-
-		// Generate QR code
-		var buf bytes.Buffer
-		img, err := key.Image(200, 200)
-		if err != nil {
-			log.Printf("Error generating QR code image: %v", err)
-			http.Error(w, "Could not generate QR code", http.StatusInternalServerError)
-			return
-		}
-		png.Encode(&buf, img)
-
-		template.SetupTOTPPage(buf.String()).Render(r.Context(), w)
-	})
+	mux.HandleFunc("GET /setup-totp", middleware.RequireAuth(sessionManager, authHandler.ShowSetupTOTPForm))
+	mux.HandleFunc("POST /setup-totp", middleware.RequireAuth(sessionManager, authHandler.SetupTOTP))
 
 	mux.HandleFunc("/verify-totp", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			authHandler.VerifyTOTP(w, r)
 		} else {
-			template.VerifyTOTPPage().Render(r.Context(), w)
+			authHandler.ShowVerifyTOTPForm(w, r)
 		}
 	})
+	mux.HandleFunc("GET /login/oidc", authHandler.StartSingleSignOn)
+	mux.HandleFunc("GET /login/oidc/callback", authHandler.SingleSignOnCallback)
+	mux.HandleFunc("POST /login/passkey/begin", authHandler.BeginPasskeyLogin)
+	mux.HandleFunc("POST /login/passkey/finish", authHandler.FinishPasskeyLogin)
 
 	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
 		_ = sessionManager.Destroy(r.Context())
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 
-	log.Println("Server starting on :8081")
-	if err := http.ListenAndServe(":8081", sessionManager.LoadAndSave(mux)); err != nil {
-		log.Fatalf("could not listen on port 8081 %v", err)
+	log.Printf("Server starting on %s", cfg.Server.Addr)
+	if err := http.ListenAndServe(cfg.Server.Addr, sessionManager.LoadAndSave(docHandler.Sidebar(mux))); err != nil {
+		log.Fatalf("could not listen on %s %v", cfg.Server.Addr, err)
 	}
 }
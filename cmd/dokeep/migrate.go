@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"dokeep/internal/config"
+	"dokeep/internal/database"
+)
+
+// runMigrate implements "dokeep migrate up|down|status".
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	steps := fs.Int("steps", 1, "number of migrations to roll back with down")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dokeep migrate up|down|status [-steps n] [config flags]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	cfg, err := config.Load(fs, args[1:])
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	db := database.Connect(cfg.Database)
+	defer db.Close()
+
+	switch command {
+	case "up":
+		if err := database.MigrateUp(db); err != nil {
+			log.Fatalf("migrate up failed: %v", err)
+		}
+		log.Println("Database is up to date")
+	case "down":
+		if *steps < 1 {
+			log.Fatalf("-steps must be at least 1")
+		}
+		if err := database.MigrateDown(db, *steps); err != nil {
+			log.Fatalf("migrate down failed: %v", err)
+		}
+	case "status":
+		statuses, err := database.Status(db)
+		if err != nil {
+			log.Fatalf("migrate status failed: %v", err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-24s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
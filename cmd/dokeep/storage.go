@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"dokeep/internal/config"
+	"dokeep/internal/database"
+	"dokeep/internal/storage"
+)
+
+// runStorage implements "dokeep storage migrate", which copies every file
+// referenced by a document or a pending rejected upload from one storage
+// backend to another. Keys are the same in every backend, so the database
+// does not change; switch storage.backend once the copy has finished.
+func runStorage(args []string) {
+	fs := flag.NewFlagSet("storage", flag.ExitOnError)
+	from := fs.String("from", "local", "backend to copy files from (local or s3)")
+	to := fs.String("to", "s3", "backend to copy files to (local or s3)")
+	deleteSource := fs.Bool("delete", false, "delete each file from the source after it has been copied")
+	dryRun := fs.Bool("dry-run", false, "list the files that would be copied without copying them")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dokeep storage migrate -from local -to s3 [-delete] [-dry-run] [config flags]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "migrate" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cfg, err := config.Load(fs, args[1:])
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *from == *to {
+		log.Fatalf("-from and -to must name different backends")
+	}
+
+	ctx := context.Background()
+	src, err := storage.Open(ctx, cfg, *from)
+	if err != nil {
+		log.Fatalf("could not open %s storage: %v", *from, err)
+	}
+	dst, err := storage.Open(ctx, cfg, *to)
+	if err != nil {
+		log.Fatalf("could not open %s storage: %v", *to, err)
+	}
+
+	db := database.Connect(cfg.Database)
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT file_path FROM documents WHERE file_path <> ''
+		UNION
+		SELECT thumbnail FROM documents WHERE thumbnail <> ''
+		UNION
+		SELECT file_key FROM rejected_uploads WHERE file_key <> ''`)
+	if err != nil {
+		log.Fatalf("could not list files: %v", err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			log.Fatalf("could not list files: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Fatalf("could not list files: %v", err)
+	}
+
+	var copied, skipped, missing, failed int
+	for _, key := range keys {
+		if *dryRun {
+			fmt.Println(key)
+			continue
+		}
+		ok, err := storage.Copy(ctx, src, dst, key)
+		switch {
+		case errors.Is(err, storage.ErrNotExist):
+			log.Printf("%s: missing from %s storage", key, *from)
+			missing++
+			continue
+		case err != nil:
+			log.Printf("%s: %v", key, err)
+			failed++
+			continue
+		case ok:
+			copied++
+		default:
+			skipped++
+		}
+		if *deleteSource {
+			if err := src.Delete(ctx, key); err != nil {
+				log.Printf("%s: copied but could not delete from %s storage: %v", key, *from, err)
+			}
+		}
+	}
+	if *dryRun {
+		return
+	}
+
+	log.Printf("Copied %d files, %d already present, %d missing, %d failed", copied, skipped, missing, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
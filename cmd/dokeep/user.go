@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"dokeep/internal/auth"
+	"dokeep/internal/config"
+	"dokeep/internal/database"
+	"dokeep/internal/passkey"
+)
+
+// runUser implements the user commands:
+//
+//   - "dokeep user reset-2fa <username>" turns off two-factor authentication
+//     and removes the passkeys of a user who lost both their device and
+//     their recovery codes. They can then sign in with their password and
+//     enroll again from the settings page.
+//   - "dokeep user link-ldap <username>" hands a local account to the LDAP
+//     directory, which LDAP sign-in does not do by itself. The account's
+//     password, second factors, single sign-on links and API tokens are
+//     removed.
+func runUser(args []string) {
+	fs := flag.NewFlagSet("user", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dokeep user reset-2fa|link-ldap [config flags] <username>")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || (args[0] != "reset-2fa" && args[0] != "link-ldap") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cfg, err := config.Load(fs, args[1:])
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	username := fs.Arg(0)
+
+	db := database.Connect(cfg.Database)
+	defer db.Close()
+
+	if args[0] == "link-ldap" {
+		if !cfg.LDAP.Enabled {
+			log.Fatalf("LDAP is not enabled")
+		}
+		ldapAuth := &auth.LDAPAuthenticator{DB: db, Config: cfg.LDAP}
+		if err := ldapAuth.Link(username); err != nil {
+			log.Fatalf("could not link %s to the directory: %v", username, err)
+		}
+		log.Printf("%s now signs in with the directory; its password, second factors, single sign-on links and API tokens were removed", username)
+		return
+	}
+
+	var userID int
+	err = db.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		log.Fatalf("no user named %q", username)
+	}
+	if err != nil {
+		log.Fatalf("could not look up user: %v", err)
+	}
+	if err := auth.ResetTwoFactor(db, userID); err != nil {
+		log.Fatalf("could not reset two-factor authentication: %v", err)
+	}
+	if err := passkey.RemoveAll(db, userID); err != nil {
+		log.Fatalf("could not remove passkeys: %v", err)
+	}
+	log.Printf("Two-factor authentication was turned off and passkeys removed for %s", username)
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInvalidCredentials is returned when the user is known but the
+	// password is wrong or the user may not sign in.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUnknownUser is returned when an authenticator does not know the
+	// username, so that the next one can be asked.
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrAccountDisabled is returned when the directory no longer lets the
+	// user sign in.
+	ErrAccountDisabled = errors.New("the account is disabled in the directory")
+)
+
+// Authenticator checks a username and password and returns the ID of the
+// Dokeep user they belong to.
+type Authenticator interface {
+	Authenticate(username, password string) (userID int, err error)
+}
+
+// Directory decides whether a user may still sign in when the password is
+// not checked, e.g. with a passkey, single sign-on or an API token.
+type Directory interface {
+	// Allowed returns ErrAccountDisabled if the user may not sign in.
+	Allowed(userID int) error
+}
+
+// LocalAuthenticator checks passwords against the bcrypt hashes stored in
+// the users table.
+type LocalAuthenticator struct {
+	DB *sql.DB
+}
+
+func (a *LocalAuthenticator) Authenticate(username, password string) (int, error) {
+	var userID int
+	var hash string
+	err := a.DB.QueryRow("SELECT id, password_hash FROM users WHERE username = $1", username).Scan(&userID, &hash)
+	if err == sql.ErrNoRows {
+		return 0, ErrUnknownUser
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Accounts without a password of their own have an empty hash, which
+	// never matches
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return 0, ErrInvalidCredentials
+	}
+	return userID, nil
+}
+
+// Chain asks each authenticator in turn until one knows the user. If one
+// fails, e.g. because the directory is unreachable, the next is still asked,
+// so that local accounts keep working.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(username, password string) (int, error) {
+	var failure error
+	for _, a := range c {
+		userID, err := a.Authenticate(username, password)
+		if err == nil || errors.Is(err, ErrInvalidCredentials) {
+			return userID, err
+		}
+		if !errors.Is(err, ErrUnknownUser) {
+			log.Printf("Error authenticating %q: %v", username, err)
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+	if failure != nil {
+		return 0, failure
+	}
+	return 0, ErrUnknownUser
+}
@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"dokeep/internal/config"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// directoryRecheck is how long a directory check of a user is trusted
+// before the directory is asked again.
+const directoryRecheck = 5 * time.Minute
+
+// LocalAccountError is returned when the directory verifies a user whose
+// name a local account already has. The account is only handed to the
+// directory when an operator links it with "dokeep user link-ldap".
+type LocalAccountError struct {
+	Username string
+}
+
+func (e *LocalAccountError) Error() string {
+	return fmt.Sprintf("a local account named %q exists and is not linked to the directory", e.Username)
+}
+
+// LDAPAuthenticator checks passwords against an LDAP directory. Users it
+// verifies get a Dokeep account of the same name, created at their first
+// sign-in, whose administrator flag follows the configured admin groups.
+type LDAPAuthenticator struct {
+	DB     *sql.DB
+	Config config.LDAPConfig
+
+	// dial connects to the directory. It is replaced in tests.
+	dial func() (ldap.Client, error)
+
+	mu sync.Mutex
+	// checked holds when each user was last found allowed.
+	checked map[int]time.Time
+}
+
+// ldapUser is a directory entry found for a username.
+type ldapUser struct {
+	DN       string
+	Username string
+	// Groups holds the DN and cn of every group the user is a member of.
+	Groups []string
+}
+
+func (a *LDAPAuthenticator) Authenticate(username, password string) (int, error) {
+	conn, err := a.open()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	user, err := a.search(conn, username)
+	if err != nil {
+		return 0, err
+	}
+
+	// An empty password would be an unauthenticated bind, which servers
+	// accept without checking anything
+	if password == "" {
+		return 0, ErrInvalidCredentials
+	}
+	if err := conn.Bind(user.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return 0, ErrInvalidCredentials
+		}
+		return 0, fmt.Errorf("could not bind as %s: %w", user.DN, err)
+	}
+	if !a.allowed(user) {
+		return 0, ErrInvalidCredentials
+	}
+	userID, err := a.provision(user)
+	if err != nil {
+		return 0, err
+	}
+	a.remember(userID)
+	return userID, nil
+}
+
+// Allowed checks that the directory still lets a user sign in, for
+// sign-ins that do not bind with the user's password: passkeys, single
+// sign-on and API tokens. The entry must still match the user filter and
+// be in a required group. Local accounts are always allowed. The answer is
+// kept for a few minutes, and the administrator flag is updated with it.
+func (a *LDAPAuthenticator) Allowed(userID int) error {
+	var username string
+	var dn sql.NullString
+	err := a.DB.QueryRow("SELECT username, ldap_dn FROM users WHERE id = $1", userID).Scan(&username, &dn)
+	if err != nil {
+		return err
+	}
+	if !dn.Valid {
+		return nil
+	}
+	a.mu.Lock()
+	checked := a.checked[userID]
+	a.mu.Unlock()
+	if time.Since(checked) < directoryRecheck {
+		return nil
+	}
+
+	conn, err := a.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	user, err := a.search(conn, username)
+	if err == ErrUnknownUser || (err == nil && (!strings.EqualFold(user.DN, dn.String) || !a.allowed(user))) {
+		a.forget(userID)
+		return ErrAccountDisabled
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := a.DB.Exec("UPDATE users SET is_admin = $2 WHERE id = $1", userID, user.memberOf(a.Config.AdminGroups)); err != nil {
+		return err
+	}
+	a.remember(userID)
+	return nil
+}
+
+func (a *LDAPAuthenticator) remember(userID int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.checked == nil {
+		a.checked = make(map[int]time.Time)
+	}
+	a.checked[userID] = time.Now()
+}
+
+func (a *LDAPAuthenticator) forget(userID int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.checked, userID)
+}
+
+// allowed reports whether the user is in one of the required groups, if
+// there are any.
+func (a *LDAPAuthenticator) allowed(user *ldapUser) bool {
+	return len(a.Config.RequiredGroups) == 0 || user.memberOf(a.Config.RequiredGroups)
+}
+
+// open connects to the directory and binds as the service account.
+func (a *LDAPAuthenticator) open() (ldap.Client, error) {
+	dial := a.dial
+	if dial == nil {
+		dial = a.connect
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if a.Config.BindDN != "" {
+		if err := conn.Bind(a.Config.BindDN, a.Config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not bind as the LDAP service account: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) connect() (ldap.Client, error) {
+	u, err := url.Parse(a.Config.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: a.Config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(a.Config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.Config.Timeout.Std()}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to LDAP server: %w", err)
+	}
+	conn.SetTimeout(a.Config.Timeout.Std())
+	if a.Config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not start TLS with LDAP server: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// search finds the user's entry and groups. It returns ErrUnknownUser if
+// the directory has no such user.
+func (a *LDAPAuthenticator) search(conn ldap.Client, username string) (*ldapUser, error) {
+	filter := strings.ReplaceAll(a.Config.UserFilter, "{username}", ldap.EscapeFilter(username))
+	res, err := conn.Search(ldap.NewSearchRequest(a.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.Config.Timeout.Std().Seconds()), false, filter, []string{a.Config.UsernameAttribute}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("could not search for LDAP user: %w", err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+	default:
+		return nil, fmt.Errorf("LDAP user filter %q matches more than one entry", filter)
+	}
+	entry := res.Entries[0]
+	user := &ldapUser{DN: entry.DN, Username: entry.GetAttributeValue(a.Config.UsernameAttribute)}
+	if user.Username == "" {
+		return nil, fmt.Errorf("LDAP entry %s has no %s attribute", entry.DN, a.Config.UsernameAttribute)
+	}
+
+	if len(a.Config.RequiredGroups) == 0 && len(a.Config.AdminGroups) == 0 {
+		return user, nil
+	}
+	base := a.Config.GroupBaseDN
+	if base == "" {
+		base = a.Config.BaseDN
+	}
+	filter = strings.NewReplacer("{dn}", ldap.EscapeFilter(user.DN), "{username}", ldap.EscapeFilter(user.Username)).Replace(a.Config.GroupFilter)
+	res, err = conn.Search(ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(a.Config.Timeout.Std().Seconds()), false, filter, []string{"cn"}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("could not search for LDAP groups: %w", err)
+	}
+	for _, group := range res.Entries {
+		user.Groups = append(user.Groups, group.DN)
+		user.Groups = append(user.Groups, group.GetAttributeValues("cn")...)
+	}
+	return user, nil
+}
+
+// memberOf reports whether the user is in one of the groups, given by DN or
+// cn.
+func (u *ldapUser) memberOf(groups []string) bool {
+	for _, want := range groups {
+		for _, have := range u.Groups {
+			if strings.EqualFold(want, have) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provision creates or updates the Dokeep account for a verified directory
+// user. A local account of the same name is not taken over: it returns a
+// *LocalAccountError until an operator links it.
+func (a *LDAPAuthenticator) provision(user *ldapUser) (int, error) {
+	var userID int
+	err := a.DB.QueryRow(`
+		INSERT INTO users (username, password_hash, ldap_dn, is_admin) VALUES ($1, '', $2, $3)
+		ON CONFLICT (username) DO UPDATE SET ldap_dn = EXCLUDED.ldap_dn, is_admin = EXCLUDED.is_admin
+		WHERE users.ldap_dn IS NOT NULL
+		RETURNING id`, user.Username, user.DN, user.memberOf(a.Config.AdminGroups)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, &LocalAccountError{user.Username}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not save LDAP user %q: %w", user.Username, err)
+	}
+	return userID, nil
+}
+
+// Link hands the local account named username to the directory, which
+// checks its password from then on. Whoever set up the account may not be
+// the directory user, so its password, two-factor settings, passkeys,
+// single sign-on links and API tokens are removed with it.
+func (a *LDAPAuthenticator) Link(username string) error {
+	conn, err := a.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	user, err := a.search(conn, username)
+	if err != nil {
+		return err
+	}
+	if user.Username != username {
+		return fmt.Errorf("the directory names the user %q, not %q", user.Username, username)
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var userID int
+	err = tx.QueryRow(`
+		UPDATE users SET ldap_dn = $2, is_admin = $3, password_hash = '', totp_enabled = FALSE, totp_secret = NULL
+		WHERE username = $1 AND ldap_dn IS NULL RETURNING id`,
+		username, user.DN, user.memberOf(a.Config.AdminGroups)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no local account named %q", username)
+	}
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM totp_recovery_codes WHERE user_id = $1",
+		"DELETE FROM passkeys WHERE user_id = $1",
+		"DELETE FROM user_identities WHERE user_id = $1",
+		"UPDATE api_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL",
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
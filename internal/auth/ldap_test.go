@@ -0,0 +1,292 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"dokeep/internal/config"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	serviceDN = "cn=dokeep,dc=example,dc=org"
+	peopleDN  = "ou=people,dc=example,dc=org"
+	groupsDN  = "ou=groups,dc=example,dc=org"
+)
+
+// stubEntry is a user in stubDirectory.
+type stubEntry struct {
+	password string
+	groups   []string // cn of the groups
+}
+
+// stubDirectory is an ldap.Client serving users under peopleDN and their
+// groups under groupsDN. Methods the authenticator does not use panic.
+type stubDirectory struct {
+	ldap.Client
+	users  map[string]stubEntry
+	closed bool
+}
+
+func userDN(uid string) string {
+	return "uid=" + uid + "," + peopleDN
+}
+
+func (d *stubDirectory) Bind(dn, password string) error {
+	if dn == serviceDN && password == "service" {
+		return nil
+	}
+	uid, ok := strings.CutPrefix(strings.TrimSuffix(dn, ","+peopleDN), "uid=")
+	if u, found := d.users[uid]; ok && found && u.password == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (d *stubDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	res := &ldap.SearchResult{}
+	switch req.BaseDN {
+	case peopleDN:
+		uid := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(uid="), ")")
+		if _, ok := d.users[uid]; ok {
+			res.Entries = append(res.Entries, ldap.NewEntry(userDN(uid), map[string][]string{"uid": {uid}}))
+		}
+	case groupsDN:
+		dn := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(member="), ")")
+		for uid, u := range d.users {
+			if userDN(uid) != dn {
+				continue
+			}
+			for _, cn := range u.groups {
+				res.Entries = append(res.Entries, ldap.NewEntry("cn="+cn+","+groupsDN, map[string][]string{"cn": {cn}}))
+			}
+		}
+	default:
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+	return res, nil
+}
+
+func (d *stubDirectory) Close() error {
+	d.closed = true
+	return nil
+}
+
+func newTestLDAP(t *testing.T, users map[string]stubEntry) (*LDAPAuthenticator, *stubDirectory, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	dir := &stubDirectory{users: users}
+	a := &LDAPAuthenticator{DB: db, Config: config.LDAPConfig{
+		BindDN:            serviceDN,
+		BindPassword:      "service",
+		BaseDN:            peopleDN,
+		UserFilter:        "(uid={username})",
+		UsernameAttribute: "uid",
+		GroupBaseDN:       groupsDN,
+		GroupFilter:       "(member={dn})",
+		RequiredGroups:    []string{"dokeep"},
+		AdminGroups:       []string{"cn=dokeep-admins," + groupsDN},
+		Timeout:           config.Duration(time.Second),
+	}}
+	a.dial = func() (ldap.Client, error) {
+		dir.closed = false
+		return dir, nil
+	}
+	return a, dir, mock
+}
+
+var testUsers = map[string]stubEntry{
+	"alice": {password: "wonderland", groups: []string{"dokeep", "dokeep-admins"}},
+	"bob":   {password: "builder", groups: []string{"dokeep"}},
+	"eve":   {password: "eavesdrop"},
+}
+
+const provisionUser = `INSERT INTO users \(username, password_hash, ldap_dn, is_admin\)`
+
+func TestLDAPAuthenticate(t *testing.T) {
+	a, dir, mock := newTestLDAP(t, testUsers)
+
+	mock.ExpectQuery(provisionUser).WithArgs("alice", userDN("alice"), true).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	if id, err := a.Authenticate("alice", "wonderland"); err != nil || id != 1 {
+		t.Errorf("Authenticate(alice) = %d, %v, want 1", id, err)
+	}
+	if !dir.closed {
+		t.Error("the connection was not closed")
+	}
+	mock.ExpectQuery(provisionUser).WithArgs("bob", userDN("bob"), false).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	if id, err := a.Authenticate("bob", "builder"); err != nil || id != 2 {
+		t.Errorf("Authenticate(bob) = %d, %v, want 2", id, err)
+	}
+
+	rejected := []struct {
+		username, password string
+		err                error
+	}{
+		{"alice", "wrong", ErrInvalidCredentials},
+		{"alice", "", ErrInvalidCredentials},
+		{"eve", "eavesdrop", ErrInvalidCredentials}, // in no required group
+		{"mallory", "x", ErrUnknownUser},
+		{"*", "x", ErrUnknownUser},
+	}
+	for _, tt := range rejected {
+		if _, err := a.Authenticate(tt.username, tt.password); !errors.Is(err, tt.err) {
+			t.Errorf("Authenticate(%q, %q) error = %v, want %v", tt.username, tt.password, err, tt.err)
+		}
+	}
+}
+
+func TestLDAPServiceAccount(t *testing.T) {
+	a, _, _ := newTestLDAP(t, testUsers)
+	a.Config.BindPassword = "wrong"
+	_, err := a.Authenticate("alice", "wonderland")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrUnknownUser) {
+		t.Errorf("Authenticate with a wrong service password error = %v, want a connection error", err)
+	}
+}
+
+func TestLDAPLocalAccount(t *testing.T) {
+	a, _, mock := newTestLDAP(t, testUsers)
+	// The upsert does not touch a row without ldap_dn, so nothing is returned
+	mock.ExpectQuery(provisionUser+`.*WHERE users.ldap_dn IS NOT NULL`).WithArgs("bob", userDN("bob"), false).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	_, err := a.Authenticate("bob", "builder")
+	var local *LocalAccountError
+	if !errors.As(err, &local) || local.Username != "bob" {
+		t.Errorf("Authenticate over a local account error = %v, want *LocalAccountError", err)
+	}
+
+	// The chain then checks the local password
+	mock.ExpectQuery(provisionUser).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT id, password_hash FROM users WHERE username = \$1`).WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash"}).AddRow(2, ""))
+	if _, err := (Chain{a, &LocalAuthenticator{DB: a.DB}}).Authenticate("bob", "builder"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Chain error = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+const findDirectoryUser = `SELECT username, ldap_dn FROM users WHERE id = \$1`
+
+func expectDirectoryUser(mock sqlmock.Sqlmock, id int, username string, dn interface{}) {
+	mock.ExpectQuery(findDirectoryUser).WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "ldap_dn"}).AddRow(username, dn))
+}
+
+func TestLDAPAllowed(t *testing.T) {
+	users := map[string]stubEntry{
+		"alice": testUsers["alice"],
+		"bob":   testUsers["bob"],
+	}
+	a, _, mock := newTestLDAP(t, users)
+
+	expectDirectoryUser(mock, 9, "admin", nil)
+	if err := a.Allowed(9); err != nil {
+		t.Errorf("Allowed(local account) = %v", err)
+	}
+
+	expectDirectoryUser(mock, 1, "alice", userDN("alice"))
+	mock.ExpectExec(`UPDATE users SET is_admin = \$2 WHERE id = \$1`).WithArgs(1, true).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := a.Allowed(1); err != nil {
+		t.Errorf("Allowed(alice) = %v", err)
+	}
+	// The answer is kept for a while
+	expectDirectoryUser(mock, 1, "alice", userDN("alice"))
+	if err := a.Allowed(1); err != nil {
+		t.Errorf("Allowed(alice) again = %v", err)
+	}
+
+	// Removed from the admin group
+	users["alice"] = stubEntry{password: "wonderland", groups: []string{"dokeep"}}
+	a.checked[1] = time.Now().Add(-directoryRecheck)
+	expectDirectoryUser(mock, 1, "alice", userDN("alice"))
+	mock.ExpectExec(`UPDATE users SET is_admin`).WithArgs(1, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := a.Allowed(1); err != nil {
+		t.Errorf("Allowed(alice) after leaving the admin group = %v", err)
+	}
+
+	// Removed from the required group, from the directory, or replaced by
+	// another entry of the same name
+	users["alice"] = stubEntry{password: "wonderland"}
+	a.checked[1] = time.Now().Add(-directoryRecheck)
+	expectDirectoryUser(mock, 1, "alice", userDN("alice"))
+	if err := a.Allowed(1); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("Allowed(alice) outside the required groups = %v, want ErrAccountDisabled", err)
+	}
+	delete(users, "bob")
+	expectDirectoryUser(mock, 2, "bob", userDN("bob"))
+	if err := a.Allowed(2); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("Allowed(bob) after removal = %v, want ErrAccountDisabled", err)
+	}
+	users["bob"] = testUsers["bob"]
+	expectDirectoryUser(mock, 2, "bob", "uid=bob,ou=former,dc=example,dc=org")
+	if err := a.Allowed(2); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("Allowed(bob) with another entry = %v, want ErrAccountDisabled", err)
+	}
+
+	// An unreachable directory is not taken as a refusal, but not as an
+	// answer either
+	a.dial = func() (ldap.Client, error) { return nil, errors.New("connection refused") }
+	expectDirectoryUser(mock, 2, "bob", userDN("bob"))
+	if err := a.Allowed(2); err == nil || errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("Allowed with the directory down = %v, want a connection error", err)
+	}
+}
+
+func TestLDAPAuthenticateRemembers(t *testing.T) {
+	a, _, mock := newTestLDAP(t, testUsers)
+	mock.ExpectQuery(provisionUser).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	if _, err := a.Authenticate("bob", "builder"); err != nil {
+		t.Fatal(err)
+	}
+	// The sign-in that follows does not ask the directory again
+	a.dial = func() (ldap.Client, error) { return nil, errors.New("connection refused") }
+	expectDirectoryUser(mock, 2, "bob", userDN("bob"))
+	if err := a.Allowed(2); err != nil {
+		t.Errorf("Allowed after Authenticate = %v", err)
+	}
+}
+
+func TestLDAPLink(t *testing.T) {
+	a, _, mock := newTestLDAP(t, testUsers)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE users SET ldap_dn = \$2, is_admin = \$3, password_hash = '', totp_enabled = FALSE, totp_secret = NULL\s+WHERE username = \$1 AND ldap_dn IS NULL RETURNING id`).
+		WithArgs("alice", userDN("alice"), true).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	for _, query := range []string{
+		`DELETE FROM totp_recovery_codes WHERE user_id = \$1`,
+		`DELETE FROM passkeys WHERE user_id = \$1`,
+		`DELETE FROM user_identities WHERE user_id = \$1`,
+		`UPDATE api_tokens SET revoked_at = NOW\(\) WHERE user_id = \$1 AND revoked_at IS NULL`,
+	} {
+		mock.ExpectExec(query).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	if err := a.Link("alice"); err != nil {
+		t.Fatalf("Link(alice): %v", err)
+	}
+
+	// No local account of that name, or it is linked already
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE users SET ldap_dn`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+	if err := a.Link("bob"); err == nil {
+		t.Error("Link(bob) succeeded without a local account")
+	}
+
+	if err := a.Link("mallory"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("Link(mallory) error = %v, want ErrUnknownUser", err)
+	}
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+)
+
+// RecoveryCodeCount is the number of recovery codes issued at a time.
+const RecoveryCodeCount = 10
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// normalizeRecoveryCode lets users type a code in any case and with or
+// without the dashes and spaces it is shown with.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+// IsRecoveryCode reports whether a second-factor code the user entered has
+// the shape of a recovery code rather than a 6-digit TOTP code.
+func IsRecoveryCode(code string) bool {
+	return len(normalizeRecoveryCode(code)) > 8
+}
+
+// NewRecoveryCodes replaces the user's recovery codes with fresh ones and
+// returns them formatted for display. Each code carries 80 random bits, so a
+// fast hash is sufficient; the codes cannot be shown again.
+func NewRecoveryCodes(db *sql.DB, userID int) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 10)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := recoveryEncoding.EncodeToString(buf)
+		codes[i] = strings.ToLower(raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16])
+		if _, err := tx.Exec("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, HashToken(raw)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// UseRecoveryCode consumes one of the user's unused recovery codes. It
+// reports false if the code is unknown or was already used.
+func UseRecoveryCode(db *sql.DB, userID int, code string) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE totp_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes.
+func RecoveryCodesLeft(db *sql.DB, userID int) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM totp_recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID).Scan(&n)
+	return n, err
+}
+
+// ResetTwoFactor turns off TOTP for the user and deletes the secret and the
+// recovery codes. The user can enroll again afterwards.
+func ResetTwoFactor(db *sql.DB, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE users SET totp_enabled = FALSE, totp_secret = NULL WHERE id = $1", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
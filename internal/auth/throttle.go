@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"dokeep/internal/config"
+	"dokeep/internal/model"
+)
+
+// Sign-in steps recorded by Throttle.
+const (
+	AttemptPassword = "password"
+	AttemptTOTP     = "totp"
+	// AttemptRecoveryCode is a recovery code entered instead of a TOTP
+	// code.
+	AttemptRecoveryCode = "recovery_code"
+	// AttemptPasskey is a passkey used as the second factor or for
+	// passwordless sign-in.
+	AttemptPasskey = "passkey"
+	// AttemptSingleSignOn is a sign-in at the OpenID Connect provider. Only
+	// completed ones are recorded.
+	AttemptSingleSignOn = "oidc"
+)
+
+// attemptRetention is how long sign-in attempts are kept.
+const attemptRetention = 30 * 24 * time.Hour
+
+// Throttle slows down and locks out repeated failed sign-in attempts, both
+// for an account and for a client address. Attempts are stored in the
+// database so that every instance enforces the same limits.
+type Throttle struct {
+	DB     *sql.DB
+	Config config.LoginConfig
+}
+
+// ClientIP returns the address of the client that sent r.
+func (t *Throttle) ClientIP(r *http.Request) string {
+	if t.Config.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Begin records an attempt to sign in as username from ip before it is
+// checked, and returns it with how long the client must wait before it is
+// accepted, or zero. Counting after recording means that guesses sent in
+// parallel all see each other. The attempt counts as failed until Succeed is
+// called. An attempt that has to wait is refused without being checked and
+// is not kept, so that retrying does not prolong the wait. An empty username,
+// as in a passwordless sign-in, only checks the client address.
+func (t *Throttle) Begin(username, ip, kind string) (attempt int64, wait time.Duration, err error) {
+	username = normalizeUsername(username)
+	err = t.DB.QueryRow("INSERT INTO login_attempts (username, ip, kind, success) VALUES ($1, $2, $3, false) RETURNING id",
+		username, ip, kind).Scan(&attempt)
+	if err != nil {
+		return 0, 0, err
+	}
+	var account time.Duration
+	if username != "" {
+		if account, err = t.wait(attempt, "username", username, true, t.Config.MaxAttempts); err != nil {
+			return 0, 0, err
+		}
+	}
+	client, err := t.wait(attempt, "ip", ip, false, t.Config.MaxAttemptsPerIP)
+	if err != nil {
+		return 0, 0, err
+	}
+	if wait = max(account, client); wait > 0 {
+		return 0, wait, t.Discard(attempt)
+	}
+	return attempt, 0, nil
+}
+
+// wait computes the wait for the failures other than attempt recorded with
+// column = value. If sinceSuccess is set, only failures after the last
+// completed sign-in count. A completed sign-in from an address does not
+// reset its count, or an attacker could sign in to an account of their own
+// between guesses.
+func (t *Throttle) wait(attempt int64, column, value string, sinceSuccess bool, maxAttempts int) (time.Duration, error) {
+	query := `
+		SELECT count(*), extract(epoch FROM now() - max(created_at))::float8
+		FROM login_attempts
+		WHERE ` + column + ` = $1 AND id <> $2 AND NOT success AND created_at > now() - make_interval(secs => $3)`
+	if sinceSuccess {
+		query += `
+			AND id > coalesce((SELECT max(id) FROM login_attempts WHERE ` + column + ` = $1 AND success), 0)`
+	}
+	var failures int
+	var elapsed sql.NullFloat64
+	err := t.DB.QueryRow(query, value, attempt, t.Config.Window.Std().Seconds()).Scan(&failures, &elapsed)
+	if err != nil || failures == 0 {
+		return 0, err
+	}
+	d := time.Duration(elapsed.Float64 * float64(time.Second))
+	return max(t.delay(failures, maxAttempts)-d, 0), nil
+}
+
+// delay is the wait after the given number of consecutive failures. It
+// doubles with every failure and becomes the full lockout once maxAttempts
+// is reached.
+func (t *Throttle) delay(failures, maxAttempts int) time.Duration {
+	lockout := t.Config.Lockout.Std()
+	if failures >= maxAttempts {
+		return lockout
+	}
+	d := t.Config.Delay.Std()
+	for i := 1; i < failures && d < lockout; i++ {
+		d *= 2
+	}
+	return min(d, lockout)
+}
+
+// Fail completes a failed attempt, attributing it to the account it was
+// made for. userID is zero if the username is unknown.
+func (t *Throttle) Fail(attempt int64, username string, userID int, kind string) error {
+	return t.finish(attempt, username, userID, kind, false)
+}
+
+// Succeed completes an attempt as a successful sign-in, which resets the
+// failure count of the account, and prunes old attempts. A sign-in that was
+// not throttled, such as one at the single sign-on provider, is recorded
+// with attempt zero.
+func (t *Throttle) Succeed(attempt int64, username string, userID int, ip, kind string) error {
+	var err error
+	if attempt == 0 {
+		_, err = t.DB.Exec("INSERT INTO login_attempts (username, user_id, ip, kind, success) VALUES ($1, $2, $3, $4, true)",
+			normalizeUsername(username), userID, ip, kind)
+	} else {
+		err = t.finish(attempt, username, userID, kind, true)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = t.DB.Exec("DELETE FROM login_attempts WHERE created_at < now() - make_interval(secs => $1)", attemptRetention.Seconds())
+	return err
+}
+
+// Discard removes an attempt that neither failed nor completed a sign-in,
+// such as a correct password that still needs a second factor, or one that
+// could not be checked.
+func (t *Throttle) Discard(attempt int64) error {
+	_, err := t.DB.Exec("DELETE FROM login_attempts WHERE id = $1", attempt)
+	return err
+}
+
+func (t *Throttle) finish(attempt int64, username string, userID int, kind string, success bool) error {
+	var user interface{}
+	if userID != 0 {
+		user = userID
+	}
+	_, err := t.DB.Exec("UPDATE login_attempts SET username = $1, user_id = $2, kind = $3, success = $4 WHERE id = $5",
+		normalizeUsername(username), user, kind, success, attempt)
+	return err
+}
+
+// normalizeUsername returns the form usernames are counted under, so that
+// changing their case does not get around the limit.
+func normalizeUsername(username string) string {
+	return strings.ToLower(username)
+}
+
+// RecentFailures returns the failed attempts on the user's account since
+// the given time, newest first.
+func (t *Throttle) RecentFailures(userID int, since time.Time, limit int) ([]model.LoginAttempt, error) {
+	rows, err := t.DB.Query(`
+		SELECT kind, ip, success, created_at FROM login_attempts
+		WHERE user_id = $1 AND NOT success AND created_at > $2
+		ORDER BY created_at DESC LIMIT $3`, userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []model.LoginAttempt
+	for rows.Next() {
+		var a model.LoginAttempt
+		if err := rows.Scan(&a.Kind, &a.IP, &a.Success, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"dokeep/internal/model"
+)
+
+// Token scopes. Read-only tokens may only issue safe (GET/HEAD) requests.
+const (
+	ScopeRead      = "read"
+	ScopeReadWrite = "read-write"
+)
+
+const tokenPrefix = "dk_"
+
+// ErrInvalidToken is returned when a bearer token is unknown, revoked or expired.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// ValidScope reports whether scope is one of the supported token scopes.
+func ValidScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeReadWrite
+}
+
+// HashToken returns the hex-encoded SHA-256 of a raw token. Tokens carry 256
+// bits of randomness, so a fast hash is sufficient.
+func HashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken generates a new token for the user and stores its hash. The raw
+// token is returned once and cannot be recovered afterwards.
+func CreateToken(db *sql.DB, userID int, name, scope string, expiresAt *time.Time) (string, error) {
+	if !ValidScope(scope) {
+		return "", errors.New("invalid token scope")
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	raw := tokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	_, err := db.Exec(`
+		INSERT INTO api_tokens (user_id, name, token_prefix, token_hash, scope, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, userID, name, raw[:len(tokenPrefix)+6], HashToken(raw), scope, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// LookupToken resolves a raw bearer token to its owner and scope and records
+// the time it was used.
+func LookupToken(db *sql.DB, raw string) (userID int, scope string, err error) {
+	if !strings.HasPrefix(raw, tokenPrefix) {
+		return 0, "", ErrInvalidToken
+	}
+
+	var tokenID int
+	err = db.QueryRow(`
+		SELECT id, user_id, scope FROM api_tokens
+		WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+	`, HashToken(raw)).Scan(&tokenID, &userID, &scope)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrInvalidToken
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if _, err := db.Exec("UPDATE api_tokens SET last_used_at = NOW() WHERE id = $1", tokenID); err != nil {
+		log.Printf("Error updating last_used_at for token %d: %v", tokenID, err)
+	}
+	return userID, scope, nil
+}
+
+// ListTokens returns all tokens belonging to the user, newest first.
+func ListTokens(db *sql.DB, userID int) ([]model.APIToken, error) {
+	rows, err := db.Query(`
+		SELECT id, name, token_prefix, scope, expires_at, last_used_at, revoked_at, created_at
+		FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []model.APIToken
+	for rows.Next() {
+		var t model.APIToken
+		var expiresAt, lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, &t.Scope, &expiresAt, &lastUsedAt, &revokedAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			t.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			t.LastUsedAt = &lastUsedAt.Time
+		}
+		if revokedAt.Valid {
+			t.RevokedAt = &revokedAt.Time
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken marks a token owned by the user as revoked.
+func RevokeToken(db *sql.DB, userID, tokenID int) error {
+	res, err := db.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
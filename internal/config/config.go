@@ -0,0 +1,476 @@
+// Package config holds the application settings. Values are resolved from,
+// in increasing order of precedence: built-in defaults, a YAML file,
+// environment variables and command-line flags.
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environments accepted for the env setting. "docker" switches the default
+// service URLs to the docker-compose host names.
+const (
+	EnvLocal  = "local"
+	EnvDocker = "docker"
+)
+
+const redacted = "********"
+
+// Config is the effective application configuration.
+type Config struct {
+	Env       string          `yaml:"env"`
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Services  ServicesConfig  `yaml:"services"`
+	Session   SessionConfig   `yaml:"session"`
+	Uploads   UploadsConfig   `yaml:"uploads"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Documents DocumentsConfig `yaml:"documents"`
+	Worker    WorkerConfig    `yaml:"worker"`
+	Login     LoginConfig     `yaml:"login"`
+	WebAuthn  WebAuthnConfig  `yaml:"webauthn"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+	LDAP      LDAPConfig      `yaml:"ldap"`
+}
+
+type ServerConfig struct {
+	// Addr is the listen address, e.g. ":8081".
+	Addr string `yaml:"addr"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+// DSN returns the lib/pq connection string.
+func (c DatabaseConfig) DSN() string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=%s",
+		c.Host, c.User, c.Password, c.Name, c.SSLMode)
+}
+
+type ServicesConfig struct {
+	// ProcessURL is the base URL of the Python OCR service (py-service).
+	ProcessURL string `yaml:"process_url"`
+	// LLMURL is the base URL of the LLM analysis service (llm-service).
+	LLMURL string `yaml:"llm_url"`
+	// DisableAI skips the LLM analysis step.
+	DisableAI bool `yaml:"disable_ai"`
+}
+
+type SessionConfig struct {
+	Lifetime Duration `yaml:"lifetime"`
+}
+
+type UploadsConfig struct {
+	Dir       string `yaml:"dir"`
+	MaxSizeMB int64  `yaml:"max_size_mb"`
+}
+
+// MaxBytes returns the upload size limit in bytes.
+func (c UploadsConfig) MaxBytes() int64 {
+	return c.MaxSizeMB << 20
+}
+
+// StorageConfig selects where uploaded files and thumbnails are kept. The
+// local backend stores them in uploads.dir.
+type StorageConfig struct {
+	// Backend is "local" or "s3".
+	Backend string   `yaml:"backend"`
+	S3      S3Config `yaml:"s3"`
+}
+
+// S3Config configures an S3-compatible object store such as AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint is the host and optional port, e.g. "s3.amazonaws.com" or
+	// "localhost:9000".
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	UseSSL    bool   `yaml:"use_ssl"`
+	// SignedURLExpiry, if set, makes downloads redirect to a presigned URL
+	// valid this long instead of streaming the file through Dokeep. Anyone
+	// holding the URL can fetch the file until it expires.
+	SignedURLExpiry Duration `yaml:"signed_url_expiry"`
+}
+
+type DocumentsConfig struct {
+	// PageSize is the number of documents per dashboard and API page.
+	PageSize int `yaml:"page_size"`
+}
+
+// WorkerConfig controls the background job worker.
+type WorkerConfig struct {
+	// Concurrency is the number of jobs processed in parallel by this
+	// instance.
+	Concurrency int `yaml:"concurrency"`
+	// PollInterval is how long an idle worker waits before looking for new
+	// jobs.
+	PollInterval Duration `yaml:"poll_interval"`
+	// VisibilityTimeout is how long a job is leased to a worker. A job that
+	// is not finished by then is handed to another worker.
+	VisibilityTimeout Duration `yaml:"visibility_timeout"`
+	MaxAttempts       int      `yaml:"max_attempts"`
+	// BackoffBase is the delay before the first retry; it doubles with each
+	// further attempt up to BackoffMax.
+	BackoffBase Duration `yaml:"backoff_base"`
+	BackoffMax  Duration `yaml:"backoff_max"`
+}
+
+// LoginConfig limits failed sign-in attempts. Each failure within Window
+// doubles the wait before the next attempt, starting at Delay; after
+// MaxAttempts failures for an account, or MaxAttemptsPerIP from one client
+// address, further attempts are refused for Lockout. A completed sign-in
+// resets the account's count; an address's count only drops as its failures
+// leave the window. Usernames are counted regardless of case.
+type LoginConfig struct {
+	MaxAttempts      int      `yaml:"max_attempts"`
+	MaxAttemptsPerIP int      `yaml:"max_attempts_per_ip"`
+	Window           Duration `yaml:"window"`
+	Delay            Duration `yaml:"delay"`
+	Lockout          Duration `yaml:"lockout"`
+	// PendingTimeout is how long a correct password stays valid while the
+	// second factor is asked for.
+	PendingTimeout Duration `yaml:"pending_timeout"`
+	// TrustProxy takes the client address from X-Forwarded-For. Only
+	// enable it behind a reverse proxy that sets the header.
+	TrustProxy bool `yaml:"trust_proxy"`
+	// DisablePassword turns off sign-in and registration with a Dokeep
+	// password, leaving LDAP, single sign-on and passkeys.
+	DisablePassword bool `yaml:"disable_password"`
+}
+
+// WebAuthnConfig identifies the server to passkeys. A passkey is bound to
+// RPID, the host name users reach Dokeep under, and is only accepted from
+// one of Origins, e.g. "https://docs.example.com".
+type WebAuthnConfig struct {
+	RPID        string   `yaml:"rp_id"`
+	DisplayName string   `yaml:"display_name"`
+	Origins     []string `yaml:"origins"`
+}
+
+// OIDCConfig enables single sign-on with an OpenID Connect provider, using
+// the authorization code flow with PKCE. RedirectURL must be registered
+// with the provider and point to /login/oidc/callback.
+type OIDCConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Name is shown on the sign-in button, e.g. "Sign in with Keycloak".
+	Name         string   `yaml:"name"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
+	// UsernameClaim names the ID token claim used as the Dokeep username of
+	// new and matched accounts.
+	UsernameClaim string `yaml:"username_claim"`
+	// AutoCreate creates an account at the first sign-in of a user who has
+	// none.
+	AutoCreate bool `yaml:"auto_create"`
+	// LinkExisting links the first sign-in to the local account whose
+	// username is the email address in the ID token, if the provider marks
+	// it as verified (email_verified). Whoever controls that address at the
+	// provider takes over the account, so only enable it if the provider
+	// verifies addresses and usernames are the owners' email addresses.
+	LinkExisting bool `yaml:"link_existing"`
+}
+
+// LDAPConfig checks passwords against an LDAP directory such as OpenLDAP
+// or Active Directory. Dokeep binds as BindDN, searches BaseDN for the user
+// with UserFilter, in which {username} is replaced by the escaped username,
+// and binds as the entry found to verify the password. Accounts are created
+// at the first sign-in, named after UsernameAttribute.
+type LDAPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// URL is e.g. "ldap://localhost:389" or "ldaps://ldap.example.com".
+	URL                string   `yaml:"url"`
+	StartTLS           bool     `yaml:"start_tls"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+	Timeout            Duration `yaml:"timeout"`
+	BindDN             string   `yaml:"bind_dn"`
+	BindPassword       string   `yaml:"bind_password"`
+	BaseDN             string   `yaml:"base_dn"`
+	UserFilter         string   `yaml:"user_filter"`
+	UsernameAttribute  string   `yaml:"username_attribute"`
+	// GroupBaseDN and GroupFilter find the user's groups. In the filter,
+	// {dn} is replaced by the user's DN and {username} by the username.
+	GroupBaseDN string `yaml:"group_base_dn"`
+	GroupFilter string `yaml:"group_filter"`
+	// RequiredGroups, given by DN or cn, limits sign-in to their members,
+	// also with passkeys, single sign-on and API tokens. Empty allows every
+	// user found.
+	RequiredGroups []string `yaml:"required_groups"`
+	// Members of AdminGroups are administrators, who may open the Users
+	// page.
+	AdminGroups []string `yaml:"admin_groups"`
+	// LocalFallback lets users the directory does not know sign in with a
+	// Dokeep password, e.g. a local administrator account.
+	LocalFallback bool `yaml:"local_fallback"`
+}
+
+// Default returns the built-in configuration.
+func Default() *Config {
+	return &Config{
+		Env:    EnvLocal,
+		Server: ServerConfig{Addr: ":8081"},
+		Database: DatabaseConfig{
+			SSLMode: "disable",
+		},
+		Session: SessionConfig{Lifetime: Duration(12 * time.Hour)},
+		Uploads: UploadsConfig{Dir: "uploads", MaxSizeMB: 10},
+		Storage: StorageConfig{
+			Backend: "local",
+			S3:      S3Config{UseSSL: true},
+		},
+		Documents: DocumentsConfig{PageSize: 10},
+		Worker: WorkerConfig{
+			Concurrency:       2,
+			PollInterval:      Duration(5 * time.Second),
+			VisibilityTimeout: Duration(15 * time.Minute),
+			MaxAttempts:       5,
+			BackoffBase:       Duration(30 * time.Second),
+			BackoffMax:        Duration(time.Hour),
+		},
+		Login: LoginConfig{
+			MaxAttempts:      5,
+			MaxAttemptsPerIP: 20,
+			Window:           Duration(15 * time.Minute),
+			Delay:            Duration(time.Second),
+			Lockout:          Duration(15 * time.Minute),
+			PendingTimeout:   Duration(5 * time.Minute),
+		},
+		WebAuthn: WebAuthnConfig{
+			RPID:        "localhost",
+			DisplayName: "Dokeep",
+			Origins:     []string{"http://localhost:8081"},
+		},
+		OIDC: OIDCConfig{
+			Name:          "single sign-on",
+			RedirectURL:   "http://localhost:8081/login/oidc/callback",
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			AutoCreate:    true,
+		},
+		LDAP: LDAPConfig{
+			URL:               "ldap://localhost:389",
+			Timeout:           Duration(10 * time.Second),
+			UserFilter:        "(uid={username})",
+			UsernameAttribute: "uid",
+			GroupFilter:       "(|(member={dn})(uniqueMember={dn})(memberUid={username}))",
+			LocalFallback:     true,
+		},
+	}
+}
+
+// applyDerived fills in settings whose default depends on other settings.
+func (c *Config) applyDerived() {
+	if c.Services.ProcessURL == "" {
+		if c.Env == EnvDocker {
+			c.Services.ProcessURL = "http://dokeep-service:8000"
+		} else {
+			c.Services.ProcessURL = "http://localhost:8000"
+		}
+	}
+	if c.Services.LLMURL == "" {
+		if c.Env == EnvDocker {
+			c.Services.LLMURL = "http://llm-service:8001"
+		} else {
+			c.Services.LLMURL = "http://localhost:8001"
+		}
+	}
+}
+
+// Validate reports the first invalid setting.
+func (c *Config) Validate() error {
+	if c.Env != EnvLocal && c.Env != EnvDocker {
+		return fmt.Errorf("env must be %q or %q, got %q", EnvLocal, EnvDocker, c.Env)
+	}
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		return fmt.Errorf("server.addr %q is not a valid listen address: %v", c.Server.Addr, err)
+	}
+	switch c.Database.SSLMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("database.sslmode %q is not supported", c.Database.SSLMode)
+	}
+	if err := validateURL("services.process_url", c.Services.ProcessURL); err != nil {
+		return err
+	}
+	if err := validateURL("services.llm_url", c.Services.LLMURL); err != nil {
+		return err
+	}
+	if c.Session.Lifetime.Std() < time.Minute {
+		return fmt.Errorf("session.lifetime must be at least 1m, got %s", c.Session.Lifetime)
+	}
+	if c.Uploads.Dir == "" {
+		return fmt.Errorf("uploads.dir must not be empty")
+	}
+	if c.Uploads.MaxSizeMB < 1 {
+		return fmt.Errorf("uploads.max_size_mb must be at least 1, got %d", c.Uploads.MaxSizeMB)
+	}
+	switch c.Storage.Backend {
+	case "local":
+	case "s3":
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			return fmt.Errorf("storage.s3.endpoint and storage.s3.bucket are required for the s3 backend")
+		}
+		if d := c.Storage.S3.SignedURLExpiry.Std(); d < 0 || d > 7*24*time.Hour {
+			return fmt.Errorf("storage.s3.signed_url_expiry must be between 0 and 168h, got %s", c.Storage.S3.SignedURLExpiry)
+		}
+	default:
+		return fmt.Errorf("storage.backend must be \"local\" or \"s3\", got %q", c.Storage.Backend)
+	}
+	if c.Documents.PageSize < 1 || c.Documents.PageSize > 100 {
+		return fmt.Errorf("documents.page_size must be between 1 and 100, got %d", c.Documents.PageSize)
+	}
+	if c.Worker.Concurrency < 0 {
+		return fmt.Errorf("worker.concurrency must not be negative, got %d", c.Worker.Concurrency)
+	}
+	if c.Worker.PollInterval.Std() < 100*time.Millisecond {
+		return fmt.Errorf("worker.poll_interval must be at least 100ms, got %s", c.Worker.PollInterval)
+	}
+	if c.Worker.VisibilityTimeout.Std() < time.Minute {
+		return fmt.Errorf("worker.visibility_timeout must be at least 1m, got %s", c.Worker.VisibilityTimeout)
+	}
+	if c.Worker.MaxAttempts < 1 {
+		return fmt.Errorf("worker.max_attempts must be at least 1, got %d", c.Worker.MaxAttempts)
+	}
+	if c.Worker.BackoffBase.Std() <= 0 || c.Worker.BackoffMax.Std() < c.Worker.BackoffBase.Std() {
+		return fmt.Errorf("worker.backoff_base must be positive and not greater than worker.backoff_max")
+	}
+	if c.Login.MaxAttempts < 1 || c.Login.MaxAttemptsPerIP < 1 {
+		return fmt.Errorf("login.max_attempts and login.max_attempts_per_ip must be at least 1")
+	}
+	if c.Login.Window.Std() < time.Minute {
+		return fmt.Errorf("login.window must be at least 1m, got %s", c.Login.Window)
+	}
+	if c.Login.Delay.Std() < 0 || c.Login.Lockout.Std() < c.Login.Delay.Std() {
+		return fmt.Errorf("login.delay must not be negative and not greater than login.lockout")
+	}
+	if c.Login.PendingTimeout.Std() < 30*time.Second {
+		return fmt.Errorf("login.pending_timeout must be at least 30s, got %s", c.Login.PendingTimeout)
+	}
+	if c.WebAuthn.RPID == "" || len(c.WebAuthn.Origins) == 0 {
+		return fmt.Errorf("webauthn.rp_id and webauthn.origins must not be empty")
+	}
+	for _, origin := range c.WebAuthn.Origins {
+		if err := validateURL("webauthn.origins", origin); err != nil {
+			return err
+		}
+	}
+	if c.OIDC.Enabled {
+		if err := validateURL("oidc.issuer", c.OIDC.Issuer); err != nil {
+			return err
+		}
+		if err := validateURL("oidc.redirect_url", c.OIDC.RedirectURL); err != nil {
+			return err
+		}
+		if c.OIDC.ClientID == "" {
+			return fmt.Errorf("oidc.client_id must not be empty")
+		}
+		if !slices.Contains(c.OIDC.Scopes, "openid") {
+			return fmt.Errorf("oidc.scopes must include \"openid\"")
+		}
+		if c.OIDC.UsernameClaim == "" {
+			return fmt.Errorf("oidc.username_claim must not be empty")
+		}
+	}
+	if c.LDAP.Enabled {
+		u, err := url.Parse(c.LDAP.URL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return fmt.Errorf("ldap.url %q must be an ldap:// or ldaps:// URL", c.LDAP.URL)
+		}
+		if c.LDAP.BaseDN == "" {
+			return fmt.Errorf("ldap.base_dn must not be empty")
+		}
+		if !strings.Contains(c.LDAP.UserFilter, "{username}") {
+			return fmt.Errorf("ldap.user_filter %q must contain {username}", c.LDAP.UserFilter)
+		}
+		if c.LDAP.UsernameAttribute == "" {
+			return fmt.Errorf("ldap.username_attribute must not be empty")
+		}
+		if c.LDAP.Timeout.Std() <= 0 {
+			return fmt.Errorf("ldap.timeout must be positive, got %s", c.LDAP.Timeout)
+		}
+		if (len(c.LDAP.RequiredGroups) > 0 || len(c.LDAP.AdminGroups) > 0) && c.LDAP.GroupFilter == "" {
+			return fmt.Errorf("ldap.group_filter must not be empty when groups are configured")
+		}
+	}
+	if c.Login.DisablePassword && !c.OIDC.Enabled && !c.LDAP.Enabled {
+		return fmt.Errorf("login.disable_password requires oidc.enabled or ldap.enabled")
+	}
+	return nil
+}
+
+func validateURL(name, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s %q must be an absolute http(s) URL", name, raw)
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration that is safe to print.
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.Database.Password != "" {
+		r.Database.Password = redacted
+	}
+	if r.Storage.S3.SecretKey != "" {
+		r.Storage.S3.SecretKey = redacted
+	}
+	if r.OIDC.ClientSecret != "" {
+		r.OIDC.ClientSecret = redacted
+	}
+	if r.LDAP.BindPassword != "" {
+		r.LDAP.BindPassword = redacted
+	}
+	return &r
+}
+
+// Duration is a time.Duration written as "12h" or "30m" in YAML, flags and
+// environment variables.
+type Duration time.Duration
+
+// Std returns the value as a time.Duration.
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set implements flag.Value.
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// load runs Load on a fresh flag set with only the given environment
+// variables set, and with a config file holding yaml unless it is empty.
+func load(t *testing.T, yaml string, env map[string]string, args ...string) (*Config, *flag.FlagSet, error) {
+	t.Helper()
+	t.Setenv("DOKEEP_CONFIG", "")
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	if yaml != "" {
+		path := filepath.Join(t.TempDir(), "dokeep.yaml")
+		if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(bytes.Buffer))
+	cfg, err := Load(fs, args)
+	return cfg, fs, err
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	yaml := `
+server:
+  addr: ":9000"
+database:
+  host: file-host
+  name: file-db
+  user: file-user
+uploads:
+  max_size_mb: 20
+`
+	env := map[string]string{"DB_HOST": "env-host", "DB_NAME": "env-db"}
+	cfg, fs, err := load(t, yaml, env, "-db-name", "flag-db", "extra")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"default", cfg.Documents.PageSize, 10},
+		{"file over default", cfg.Server.Addr, ":9000"},
+		{"file over default", cfg.Uploads.MaxSizeMB, int64(20)},
+		{"file", cfg.Database.User, "file-user"},
+		{"env over file", cfg.Database.Host, "env-host"},
+		{"flag over env", cfg.Database.Name, "flag-db"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if args := fs.Args(); len(args) != 1 || args[0] != "extra" {
+		t.Errorf("fs.Args() = %q, want [extra]", args)
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "other.yaml")
+	if err := os.WriteFile(path, []byte("documents:\n  page_size: 25\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := load(t, "", map[string]string{"DOKEEP_CONFIG": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Documents.PageSize != 25 {
+		t.Errorf("documents.page_size = %d, want 25 from DOKEEP_CONFIG", cfg.Documents.PageSize)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown key", "server:\n  adress: \":9000\"\n", nil, nil, "field adress not found"},
+		{"unknown section", "databse:\n  host: db\n", nil, nil, "field databse not found"},
+		{"missing file", "", nil, []string{"-config", "/nonexistent/dokeep.yaml"}, "could not read config file"},
+		{"bad env value", "", map[string]string{"DOKEEP_MAX_UPLOAD_MB": "ten"}, nil, "invalid DOKEEP_MAX_UPLOAD_MB"},
+		{"bad flag value", "", nil, []string{"-session-lifetime", "forever"}, "invalid -session-lifetime"},
+		{"invalid result", "documents:\n  page_size: 0\n", nil, nil, "documents.page_size"},
+		{"unknown flag", "", nil, []string{"-no-such-flag"}, "no-such-flag"},
+	}
+	for _, tt := range tests {
+		_, _, err := load(t, tt.yaml, tt.env, tt.args...)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Load error = %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadDerived(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		process string
+		llm     string
+	}{
+		{"local", "", "http://localhost:8000", "http://localhost:8001"},
+		{"docker", "env: docker\n", "http://dokeep-service:8000", "http://llm-service:8001"},
+		{"explicit", "env: docker\nservices:\n  process_url: http://ocr:9000\n", "http://ocr:9000", "http://llm-service:8001"},
+	}
+	for _, tt := range tests {
+		cfg, _, err := load(t, tt.yaml, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if cfg.Services.ProcessURL != tt.process || cfg.Services.LLMURL != tt.llm {
+			t.Errorf("%s: services = %q, %q, want %q, %q", tt.name, cfg.Services.ProcessURL, cfg.Services.LLMURL, tt.process, tt.llm)
+		}
+	}
+}
+
+// secrets are the four settings that must never be printed.
+var secrets = map[string]string{
+	"DB_PASSWORD":               "db-secret",
+	"DOKEEP_S3_SECRET_KEY":      "s3-secret",
+	"DOKEEP_OIDC_CLIENT_SECRET": "oidc-secret",
+	"DOKEEP_LDAP_BIND_PASSWORD": "ldap-secret",
+}
+
+func TestRedacted(t *testing.T) {
+	cfg, _, err := load(t, "", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cfg.Redacted()
+	for name, got := range map[string]string{
+		"database.password":     r.Database.Password,
+		"storage.s3.secret_key": r.Storage.S3.SecretKey,
+		"oidc.client_secret":    r.OIDC.ClientSecret,
+		"ldap.bind_password":    r.LDAP.BindPassword,
+	} {
+		if got != redacted {
+			t.Errorf("Redacted %s = %q, want %q", name, got, redacted)
+		}
+	}
+	if cfg.Database.Password != "db-secret" {
+		t.Errorf("Redacted changed the original: database.password = %q", cfg.Database.Password)
+	}
+
+	// Unset secrets stay visibly unset
+	if got := Default().Redacted().Database.Password; got != "" {
+		t.Errorf("Redacted empty database.password = %q, want \"\"", got)
+	}
+}
+
+func TestWriteHidesSecrets(t *testing.T) {
+	cfg, _, err := load(t, "", secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := cfg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for env, secret := range secrets {
+		if strings.Contains(out, secret) {
+			t.Errorf("Write printed the value of %s", env)
+		}
+	}
+	if n := strings.Count(out, redacted); n != len(secrets) {
+		t.Errorf("Write printed %d redacted values, want %d:\n%s", n, len(secrets), out)
+	}
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is read when no config file is given explicitly. It is
+// optional; a missing default file is not an error.
+const DefaultFile = "dokeep.yaml"
+
+// setting describes one value that can be overridden from the environment
+// and from a command-line flag.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{"DOKEEP_ENV", "env", "deployment environment (local or docker)", func(c *Config, v string) error { c.Env = v; return nil }},
+	{"DOKEEP_ADDR", "addr", "HTTP listen address", func(c *Config, v string) error { c.Server.Addr = v; return nil }},
+	{"DB_HOST", "db-host", "PostgreSQL host", func(c *Config, v string) error { c.Database.Host = v; return nil }},
+	{"DB_USER", "db-user", "PostgreSQL user", func(c *Config, v string) error { c.Database.User = v; return nil }},
+	{"DB_PASSWORD", "db-password", "PostgreSQL password", func(c *Config, v string) error { c.Database.Password = v; return nil }},
+	{"DB_NAME", "db-name", "PostgreSQL database name", func(c *Config, v string) error { c.Database.Name = v; return nil }},
+	{"DB_SSLMODE", "db-sslmode", "PostgreSQL sslmode", func(c *Config, v string) error { c.Database.SSLMode = v; return nil }},
+	{"DOKEEP_PROCESS_URL", "process-url", "base URL of the OCR processing service", func(c *Config, v string) error { c.Services.ProcessURL = v; return nil }},
+	{"DOKEEP_LLM_URL", "llm-url", "base URL of the LLM analysis service", func(c *Config, v string) error { c.Services.LLMURL = v; return nil }},
+	{"DISABLE_AI", "disable-ai", "skip LLM analysis (true or 1)", func(c *Config, v string) (err error) {
+		c.Services.DisableAI, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"DOKEEP_SESSION_LIFETIME", "session-lifetime", "session lifetime, e.g. 12h", func(c *Config, v string) error { return c.Session.Lifetime.Set(v) }},
+	{"DOKEEP_UPLOAD_DIR", "upload-dir", "directory for uploaded files", func(c *Config, v string) error { c.Uploads.Dir = v; return nil }},
+	{"DOKEEP_MAX_UPLOAD_MB", "max-upload-mb", "maximum upload size in MB", func(c *Config, v string) (err error) {
+		c.Uploads.MaxSizeMB, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}},
+	{"DOKEEP_STORAGE_BACKEND", "storage-backend", "file storage backend (local or s3)", func(c *Config, v string) error { c.Storage.Backend = v; return nil }},
+	{"DOKEEP_S3_ENDPOINT", "s3-endpoint", "S3 endpoint host[:port]", func(c *Config, v string) error { c.Storage.S3.Endpoint = v; return nil }},
+	{"DOKEEP_S3_BUCKET", "s3-bucket", "S3 bucket name", func(c *Config, v string) error { c.Storage.S3.Bucket = v; return nil }},
+	{"DOKEEP_S3_REGION", "s3-region", "S3 region", func(c *Config, v string) error { c.Storage.S3.Region = v; return nil }},
+	{"DOKEEP_S3_ACCESS_KEY", "s3-access-key", "S3 access key ID", func(c *Config, v string) error { c.Storage.S3.AccessKey = v; return nil }},
+	{"DOKEEP_S3_SECRET_KEY", "s3-secret-key", "S3 secret access key", func(c *Config, v string) error { c.Storage.S3.SecretKey = v; return nil }},
+	{"DOKEEP_S3_USE_SSL", "s3-use-ssl", "connect to S3 over HTTPS (true or false)", func(c *Config, v string) (err error) {
+		c.Storage.S3.UseSSL, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"DOKEEP_S3_SIGNED_URL_EXPIRY", "s3-signed-url-expiry", "redirect downloads to presigned URLs valid this long, e.g. 5m (0 streams them)", func(c *Config, v string) error { return c.Storage.S3.SignedURLExpiry.Set(v) }},
+	{"DOKEEP_PAGE_SIZE", "page-size", "documents per page", func(c *Config, v string) (err error) {
+		c.Documents.PageSize, err = strconv.Atoi(v)
+		return err
+	}},
+	{"DOKEEP_WORKER_CONCURRENCY", "worker-concurrency", "jobs processed in parallel (0 disables the worker)", func(c *Config, v string) (err error) {
+		c.Worker.Concurrency, err = strconv.Atoi(v)
+		return err
+	}},
+	{"DOKEEP_WORKER_VISIBILITY_TIMEOUT", "worker-visibility-timeout", "how long a job is leased to a worker", func(c *Config, v string) error { return c.Worker.VisibilityTimeout.Set(v) }},
+	{"DOKEEP_WORKER_MAX_ATTEMPTS", "worker-max-attempts", "attempts before a job is dead-lettered", func(c *Config, v string) (err error) {
+		c.Worker.MaxAttempts, err = strconv.Atoi(v)
+		return err
+	}},
+	{"DOKEEP_LOGIN_MAX_ATTEMPTS", "login-max-attempts", "failed sign-ins per account before a lockout", func(c *Config, v string) (err error) {
+		c.Login.MaxAttempts, err = strconv.Atoi(v)
+		return err
+	}},
+	{"DOKEEP_LOGIN_MAX_ATTEMPTS_PER_IP", "login-max-attempts-per-ip", "failed sign-ins per client address before a lockout", func(c *Config, v string) (err error) {
+		c.Login.MaxAttemptsPerIP, err = strconv.Atoi(v)
+		return err
+	}},
+	{"DOKEEP_LOGIN_LOCKOUT", "login-lockout", "how long sign-in is refused after too many failures", func(c *Config, v string) error { return c.Login.Lockout.Set(v) }},
+	{"DOKEEP_LOGIN_TRUST_PROXY", "login-trust-proxy", "take the client address from X-Forwarded-For (true or false)", func(c *Config, v string) (err error) {
+		c.Login.TrustProxy, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"DOKEEP_WEBAUTHN_RP_ID", "webauthn-rp-id", "host name passkeys are bound to", func(c *Config, v string) error { c.WebAuthn.RPID = v; return nil }},
+	{"DOKEEP_WEBAUTHN_ORIGINS", "webauthn-origins", "comma-separated origins passkeys are accepted from", func(c *Config, v string) error { c.WebAuthn.Origins = splitList(v); return nil }},
+	{"DOKEEP_LOGIN_DISABLE_PASSWORD", "login-disable-password", "turn off sign-in with a Dokeep password (true or false)", func(c *Config, v string) (err error) {
+		c.Login.DisablePassword, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"DOKEEP_OIDC_ENABLED", "oidc-enabled", "enable OpenID Connect single sign-on (true or false)", func(c *Config, v string) (err error) {
+		c.OIDC.Enabled, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"DOKEEP_OIDC_NAME", "oidc-name", "identity provider name shown on the sign-in page", func(c *Config, v string) error { c.OIDC.Name = v; return nil }},
+	{"DOKEEP_OIDC_ISSUER", "oidc-issuer", "OpenID Connect issuer URL", func(c *Config, v string) error { c.OIDC.Issuer = v; return nil }},
+	{"DOKEEP_OIDC_CLIENT_ID", "oidc-client-id", "OpenID Connect client ID", func(c *Config, v string) error { c.OIDC.ClientID = v; return nil }},
+	{"DOKEEP_OIDC_CLIENT_SECRET", "oidc-client-secret", "OpenID Connect client secret", func(c *Config, v string) error { c.OIDC.ClientSecret = v; return nil }},
+	{"DOKEEP_OIDC_REDIRECT_URL", "oidc-redirect-url", "URL of /login/oidc/callback registered with the provider", func(c *Config, v string) error { c.OIDC.RedirectURL = v; return nil }},
+	{"DOKEEP_OIDC_SCOPES", "oidc-scopes", "comma-separated scopes to request", func(c *Config, v string) error { c.OIDC.Scopes = splitList(v); return nil }},
+	{"DOKEEP_LDAP_ENABLED", "ldap-enabled", "check passwords against an LDAP directory (true or false)", func(c *Config, v string) (err error) {
+		c.LDAP.Enabled, err = strconv.ParseBool(v)
+		return err
+	}},
+	{"DOKEEP_LDAP_URL", "ldap-url", "LDAP server URL", func(c *Config, v string) error { c.LDAP.URL = v; return nil }},
+	{"DOKEEP_LDAP_BIND_DN", "ldap-bind-dn", "DN of the LDAP service account", func(c *Config, v string) error { c.LDAP.BindDN = v; return nil }},
+	{"DOKEEP_LDAP_BIND_PASSWORD", "ldap-bind-password", "password of the LDAP service account", func(c *Config, v string) error { c.LDAP.BindPassword = v; return nil }},
+	{"DOKEEP_LDAP_BASE_DN", "ldap-base-dn", "LDAP base DN to search for users", func(c *Config, v string) error { c.LDAP.BaseDN = v; return nil }},
+	{"DOKEEP_LDAP_USER_FILTER", "ldap-user-filter", "LDAP filter finding a user, with {username}", func(c *Config, v string) error { c.LDAP.UserFilter = v; return nil }},
+	{"DOKEEP_LDAP_REQUIRED_GROUPS", "ldap-required-groups", "comma-separated LDAP groups allowed to sign in", func(c *Config, v string) error { c.LDAP.RequiredGroups = splitList(v); return nil }},
+	{"DOKEEP_LDAP_ADMIN_GROUPS", "ldap-admin-groups", "comma-separated LDAP groups whose members are administrators", func(c *Config, v string) error { c.LDAP.AdminGroups = splitList(v); return nil }},
+}
+
+// splitList parses a comma-separated setting. Empty entries are dropped.
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Load resolves the configuration for a command. It registers the config
+// flags on fs, parses args and returns the validated result. Any arguments
+// left after flag parsing are available through fs.Args().
+//
+// Precedence, lowest first: defaults, the YAML file (-config, DOKEEP_CONFIG
+// or ./dokeep.yaml if present), environment variables, flags.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	configFile := fs.String("config", "", "path to a YAML config file (env DOKEEP_CONFIG)")
+	for _, s := range settings {
+		fs.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	path, required := *configFile, true
+	if path == "" {
+		path = os.Getenv("DOKEEP_CONFIG")
+	}
+	if path == "" {
+		path, required = DefaultFile, false
+	}
+	if err := cfg.loadFile(path, required); err != nil {
+		return nil, err
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && flagErr == nil {
+				if err := s.set(cfg, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("invalid -%s: %v", s.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	cfg.applyDerived()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !required {
+			return nil
+		}
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Write prints the configuration as YAML with secrets redacted.
+func (c *Config) Write(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,212 @@
+// Package customfield validates the values of user-defined document fields.
+// Values are stored as text in a canonical form per type so that they can be
+// compared and cast in SQL without further checks.
+package customfield
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"dokeep/internal/model"
+)
+
+// Field types.
+const (
+	Text    = "text"
+	Number  = "number"
+	Money   = "money"
+	Date    = "date"
+	Boolean = "boolean"
+	Select  = "select"
+	URL     = "url"
+)
+
+// Types lists every field type in the order offered to users.
+var Types = []string{Text, Number, Money, Date, Boolean, Select, URL}
+
+// ValidType reports whether t is a known field type.
+func ValidType(t string) bool {
+	for _, known := range Types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeName trims a field name and collapses runs of whitespace.
+func NormalizeName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// Key derives the search key of a field from its name: "Invoice Number"
+// becomes "invoice_number". It returns "" if the name has no letters or
+// digits.
+func Key(name string) string {
+	var b strings.Builder
+	pending := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if pending && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+			pending = false
+		} else {
+			pending = true
+		}
+	}
+	return b.String()
+}
+
+// NormalizeOptions trims the options of a select field, dropping blanks and
+// case-insensitive duplicates.
+func NormalizeOptions(options []string) []string {
+	seen := make(map[string]bool)
+	out := []string{}
+	for _, o := range options {
+		o = NormalizeName(o)
+		if o == "" || seen[strings.ToLower(o)] {
+			continue
+		}
+		seen[strings.ToLower(o)] = true
+		out = append(out, o)
+	}
+	return out
+}
+
+var (
+	numberPattern    = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`)
+	thousandsPattern = regexp.MustCompile(`^[+-]?\d{1,3}(,\d{3})+(\.\d*)?$`)
+	currencyPattern  = regexp.MustCompile(`^[A-Za-z]{3}$`)
+)
+
+// Value checks raw against the field's type and returns it in canonical
+// form. An empty (or blank) value is returned as "" and means "unset".
+func Value(f model.CustomField, raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	switch f.Type {
+	case Text:
+		return raw, nil
+	case Number:
+		n, ok := canonicalNumber(raw)
+		if !ok {
+			return "", fmt.Errorf("%s: %q is not a number", f.Name, raw)
+		}
+		return n, nil
+	case Money:
+		return money(f.Name, raw)
+	case Date:
+		d, err := time.Parse("2006-01-02", raw)
+		if err != nil {
+			return "", fmt.Errorf("%s: %q is not a date (use YYYY-MM-DD)", f.Name, raw)
+		}
+		return d.Format("2006-01-02"), nil
+	case Boolean:
+		switch strings.ToLower(raw) {
+		case "true", "yes", "on", "1":
+			return "true", nil
+		case "false", "no", "off", "0":
+			return "false", nil
+		}
+		return "", fmt.Errorf("%s: %q is not yes or no", f.Name, raw)
+	case Select:
+		for _, o := range f.Options {
+			if strings.EqualFold(o, NormalizeName(raw)) {
+				return o, nil
+			}
+		}
+		return "", fmt.Errorf("%s: %q is not one of the options", f.Name, raw)
+	case URL:
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("%s: %q is not an http or https URL", f.Name, raw)
+		}
+		return u.String(), nil
+	}
+	return "", fmt.Errorf("%s: unknown field type %q", f.Name, f.Type)
+}
+
+// canonicalNumber accepts a decimal number, optionally with thousands
+// separators such as "1,234.5", and returns it without sign noise or
+// redundant zeros. A decimal comma ("12,50") is rejected rather than guessed.
+func canonicalNumber(s string) (string, bool) {
+	if strings.Contains(s, ",") {
+		if !thousandsPattern.MatchString(s) {
+			return "", false
+		}
+		s = strings.ReplaceAll(s, ",", "")
+	}
+	if !numberPattern.MatchString(s) {
+		return "", false
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")
+	whole, frac, _ := strings.Cut(s, ".")
+	whole = strings.TrimLeft(whole, "0")
+	frac = strings.TrimRight(frac, "0")
+	if whole == "" {
+		whole = "0"
+	}
+	if frac != "" {
+		whole += "." + frac
+	}
+	if neg && whole != "0" {
+		whole = "-" + whole
+	}
+	return whole, true
+}
+
+// money accepts an amount with an optional three-letter currency code
+// before or after it ("12.50 EUR", "EUR 12.50") and returns "12.50 EUR".
+// Amounts are kept to two decimal places.
+func money(name, raw string) (string, error) {
+	parts := strings.Fields(raw)
+	var amount, currency string
+	switch {
+	case len(parts) == 1:
+		amount = parts[0]
+	case len(parts) == 2 && currencyPattern.MatchString(parts[1]):
+		amount, currency = parts[0], parts[1]
+	case len(parts) == 2 && currencyPattern.MatchString(parts[0]):
+		currency, amount = parts[0], parts[1]
+	default:
+		return "", fmt.Errorf("%s: %q is not an amount (use e.g. 12.50 or 12.50 EUR)", name, raw)
+	}
+	n, ok := canonicalNumber(amount)
+	if !ok {
+		return "", fmt.Errorf("%s: %q is not an amount (use e.g. 12.50 or 12.50 EUR)", name, raw)
+	}
+	whole, frac, _ := strings.Cut(n, ".")
+	if len(frac) > 2 {
+		return "", fmt.Errorf("%s: %q has more than two decimal places", name, raw)
+	}
+	n = whole + "." + frac + strings.Repeat("0", 2-len(frac))
+	if currency != "" {
+		n += " " + strings.ToUpper(currency)
+	}
+	return n, nil
+}
+
+// SortExpr returns an SQL expression that orders the canonical values in
+// column by the natural order of the field type.
+func SortExpr(fieldType, column string) string {
+	switch fieldType {
+	case Number:
+		return column + "::numeric"
+	case Money:
+		return "split_part(" + column + ", ' ', 1)::numeric"
+	case Date:
+		return column + "::date"
+	case Boolean:
+		return "(" + column + " = 'true')"
+	}
+	return "lower(" + column + ")"
+}
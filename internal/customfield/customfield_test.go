@@ -0,0 +1,103 @@
+package customfield
+
+import (
+	"testing"
+
+	"dokeep/internal/model"
+)
+
+func TestCanonicalNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"42", "42", true},
+		{"-12.30", "-12.3", true},
+		{"+007.50", "7.5", true},
+		{".5", "0.5", true},
+		{"5.", "5", true},
+		{"-0", "0", true},
+		{"-0.00", "0", true},
+		{"1,234.5", "1234.5", true},
+		{"1,234,567", "1234567", true},
+		{"-1,000", "-1000", true},
+		{"12,50", "", false},
+		{"1,23", "", false},
+		{"1234,567", "", false},
+		{"1.234,5", "", false},
+		{"1e3", "", false},
+		{"12 50", "", false},
+		{"-", "", false},
+		{"abc", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := canonicalNumber(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("canonicalNumber(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"12", "12.00", false},
+		{"12.5", "12.50", false},
+		{"12.50 EUR", "12.50 EUR", false},
+		{"12.5 eur", "12.50 EUR", false},
+		{"EUR 12.50", "12.50 EUR", false},
+		{"usd 1,234.5", "1234.50 USD", false},
+		{"-3.1", "-3.10", false},
+		{"-0", "0.00", false},
+		{"0.10", "0.10", false},
+		{"12.505", "", true},
+		{"12,50 EUR", "", true},
+		{"12.50 EURO", "", true},
+		{"EUR", "", true},
+		{"12.50 EUR USD", "", true},
+		{"€12.50", "", true},
+	}
+	for _, tt := range tests {
+		got, err := money("Amount", tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("money(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	choice := model.CustomField{Name: "Status", Type: Select, Options: []string{"Paid", "Open"}}
+	tests := []struct {
+		field   model.CustomField
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{model.CustomField{Type: Text}, "  anything  ", "anything", false},
+		{model.CustomField{Type: Number}, "  ", "", false},
+		{model.CustomField{Type: Number}, "1,500", "1500", false},
+		{model.CustomField{Type: Number}, "1,5", "", true},
+		{model.CustomField{Type: Money}, "EUR 9.9", "9.90 EUR", false},
+		{model.CustomField{Type: Date}, "2023-04-01", "2023-04-01", false},
+		{model.CustomField{Type: Date}, "01.04.2023", "", true},
+		{model.CustomField{Type: Boolean}, "Yes", "true", false},
+		{model.CustomField{Type: Boolean}, "0", "false", false},
+		{model.CustomField{Type: Boolean}, "maybe", "", true},
+		{choice, "paid", "Paid", false},
+		{choice, "Closed", "", true},
+		{model.CustomField{Type: URL}, "https://example.com/a", "https://example.com/a", false},
+		{model.CustomField{Type: URL}, "ftp://example.com", "", true},
+		{model.CustomField{Type: URL}, "example.com", "", true},
+		{model.CustomField{Type: "colour"}, "red", "", true},
+	}
+	for _, tt := range tests {
+		got, err := Value(tt.field, tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("Value(%s, %q) = %q, %v, want %q, error %v", tt.field.Type, tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestDB connects to the scratch database in DOKEEP_TEST_DATABASE_URL
+// and gives the test a schema of its own, dropped afterwards. Tests that
+// need it are skipped when the variable is not set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("DOKEEP_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("DOKEEP_TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// search_path is per connection, so keep to one
+	db.SetMaxOpenConns(1)
+	schema := fmt.Sprintf("dokeep_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		db.Close()
+	})
+	if _, err := db.Exec("SET search_path TO " + schema + ", public"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+	}
+}
+
+func TestTagHierarchyMigration(t *testing.T) {
+	db := openTestDB(t)
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(m Migration) {
+		t.Helper()
+		if _, err := db.Exec(m.Up); err != nil {
+			t.Fatalf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+	}
+	var hierarchy Migration
+	for _, m := range migrations {
+		if m.Version < 8 {
+			run(m)
+		} else if m.Version == 8 {
+			hierarchy = m
+		}
+	}
+
+	var userID int
+	if err := db.QueryRow("INSERT INTO users (username, password_hash) VALUES ('alice', '') RETURNING id").Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]int{}
+	for _, name := range []string{"Tax", "TAX", "Finance / Tax", "finance/TAX", "home", "Home"} {
+		var id int
+		if err := db.QueryRow("INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id", userID, name).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	run(hierarchy)
+
+	names := map[int]string{}
+	parents := map[string]sql.NullInt64{}
+	rows, err := db.Query("SELECT id, name, parent_id FROM tags WHERE user_id = $1", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		var parentID sql.NullInt64
+		if err := rows.Scan(&id, &name, &parentID); err != nil {
+			t.Fatal(err)
+		}
+		names[id] = name
+		parents[name] = parentID
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for before, want := range map[string]string{
+		"Tax":           "tax",
+		"TAX":           "TAX",
+		"Finance / Tax": "finance/tax",
+		"finance/TAX":   "finance/TAX",
+		"home":          "home",
+		"Home":          "Home",
+	} {
+		if got := names[ids[before]]; got != want {
+			t.Errorf("tag %q was renamed to %q, want %q", before, got, want)
+		}
+	}
+	finance, ok := parents["finance"]
+	if !ok {
+		t.Fatal("ancestor \"finance\" was not created")
+	}
+	if finance.Valid {
+		t.Errorf("\"finance\" has parent %d, want none", finance.Int64)
+	}
+	if p := parents["finance/tax"]; !p.Valid || names[int(p.Int64)] != "finance" {
+		t.Errorf("\"finance/tax\" has parent %v, want \"finance\"", p)
+	}
+}
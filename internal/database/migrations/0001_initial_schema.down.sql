@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS document_tags;
+DROP TABLE IF EXISTS tags;
+DROP TABLE IF EXISTS documents;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
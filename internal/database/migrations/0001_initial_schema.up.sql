@@ -0,0 +1,44 @@
+-- The schema created by InitDB before versioned migrations were introduced.
+-- Databases that already contain these tables are baselined at this version.
+
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	username TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	totp_secret TEXT,
+	totp_enabled BOOLEAN DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	token TEXT PRIMARY KEY,
+	data BYTEA NOT NULL,
+	expiry TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS documents (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER REFERENCES users(id),
+	title TEXT NOT NULL,
+	original_filename TEXT,
+	file_path TEXT NOT NULL,
+	content TEXT,
+	thumbnail TEXT,
+	summary TEXT,
+	file_hash TEXT,
+	status TEXT NOT NULL DEFAULT 'queued',
+	status_message TEXT,
+	created_date DATE,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, file_hash)
+);
+
+CREATE TABLE IF NOT EXISTS tags (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS document_tags (
+	document_id INTEGER REFERENCES documents(id) ON DELETE CASCADE,
+	tag_id INTEGER REFERENCES tags(id) ON DELETE CASCADE,
+	PRIMARY KEY (document_id, tag_id)
+);
@@ -0,0 +1,9 @@
+DROP TRIGGER IF EXISTS tags_search_vector_update ON tags;
+DROP TRIGGER IF EXISTS document_tags_search_vector_update ON document_tags;
+DROP TRIGGER IF EXISTS documents_search_vector_update ON documents;
+DROP FUNCTION IF EXISTS tags_search_vector_trigger();
+DROP FUNCTION IF EXISTS document_tags_search_vector_trigger();
+DROP FUNCTION IF EXISTS documents_search_vector_trigger();
+DROP FUNCTION IF EXISTS document_search_vector(INTEGER, TEXT, TEXT, TEXT);
+DROP INDEX IF EXISTS documents_search_vector_idx;
+ALTER TABLE documents DROP COLUMN IF EXISTS search_vector;
@@ -0,0 +1,68 @@
+-- Full-text search: a weighted tsvector over title (A), tag names (B),
+-- summary (C) and OCR content (D), kept up to date by triggers on
+-- documents, document_tags and tags.
+
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS search_vector tsvector;
+
+CREATE OR REPLACE FUNCTION document_search_vector(doc_id INTEGER, title TEXT, summary TEXT, content TEXT)
+RETURNS tsvector AS $$
+	SELECT
+		setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce((
+			SELECT string_agg(t.name, ' ')
+			FROM document_tags dt JOIN tags t ON t.id = dt.tag_id
+			WHERE dt.document_id = doc_id
+		), '')), 'B') ||
+		setweight(to_tsvector('english', coalesce(summary, '')), 'C') ||
+		setweight(to_tsvector('english', coalesce(content, '')), 'D')
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION documents_search_vector_trigger() RETURNS trigger AS $$
+BEGIN
+	NEW.search_vector := document_search_vector(NEW.id, NEW.title, NEW.summary, NEW.content);
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS documents_search_vector_update ON documents;
+CREATE TRIGGER documents_search_vector_update
+	BEFORE INSERT OR UPDATE OF title, summary, content ON documents
+	FOR EACH ROW EXECUTE FUNCTION documents_search_vector_trigger();
+
+CREATE OR REPLACE FUNCTION document_tags_search_vector_trigger() RETURNS trigger AS $$
+DECLARE
+	target INTEGER;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		target := OLD.document_id;
+	ELSE
+		target := NEW.document_id;
+	END IF;
+	UPDATE documents d SET search_vector = document_search_vector(d.id, d.title, d.summary, d.content)
+	WHERE d.id = target;
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS document_tags_search_vector_update ON document_tags;
+CREATE TRIGGER document_tags_search_vector_update
+	AFTER INSERT OR DELETE ON document_tags
+	FOR EACH ROW EXECUTE FUNCTION document_tags_search_vector_trigger();
+
+CREATE OR REPLACE FUNCTION tags_search_vector_trigger() RETURNS trigger AS $$
+BEGIN
+	UPDATE documents d SET search_vector = document_search_vector(d.id, d.title, d.summary, d.content)
+	WHERE d.id IN (SELECT document_id FROM document_tags WHERE tag_id = NEW.id);
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tags_search_vector_update ON tags;
+CREATE TRIGGER tags_search_vector_update
+	AFTER UPDATE OF name ON tags
+	FOR EACH ROW EXECUTE FUNCTION tags_search_vector_trigger();
+
+UPDATE documents SET search_vector = document_search_vector(id, title, summary, content)
+WHERE search_vector IS NULL;
+
+CREATE INDEX IF NOT EXISTS documents_search_vector_idx ON documents USING GIN (search_vector);
@@ -0,0 +1,23 @@
+-- Background processing jobs. Workers lease jobs with
+-- SELECT ... FOR UPDATE SKIP LOCKED; a running job whose lease has expired
+-- is considered abandoned and becomes available again.
+CREATE TABLE IF NOT EXISTS jobs (
+	id BIGSERIAL PRIMARY KEY,
+	document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+	kind TEXT NOT NULL,
+	state TEXT NOT NULL DEFAULT 'pending',
+	payload JSONB NOT NULL DEFAULT '{}',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL DEFAULT 5,
+	run_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	locked_by TEXT,
+	locked_until TIMESTAMPTZ,
+	last_error TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CHECK (state IN ('pending', 'running', 'done', 'dead'))
+);
+
+CREATE INDEX IF NOT EXISTS jobs_pending_idx ON jobs (run_at) WHERE state = 'pending';
+CREATE INDEX IF NOT EXISTS jobs_running_idx ON jobs (locked_until) WHERE state = 'running';
+CREATE INDEX IF NOT EXISTS jobs_document_id_idx ON jobs (document_id);
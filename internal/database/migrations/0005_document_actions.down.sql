@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS document_status_history;
+
+UPDATE jobs SET state = 'dead' WHERE state = 'cancelled';
+ALTER TABLE jobs DROP CONSTRAINT IF EXISTS jobs_state_check;
+ALTER TABLE jobs ADD CONSTRAINT jobs_state_check CHECK (state IN ('pending', 'running', 'done', 'dead'));
@@ -0,0 +1,17 @@
+-- Queued jobs can be cancelled by the user.
+ALTER TABLE jobs DROP CONSTRAINT IF EXISTS jobs_state_check;
+ALTER TABLE jobs ADD CONSTRAINT jobs_state_check CHECK (state IN ('pending', 'running', 'done', 'dead', 'cancelled'));
+
+-- Audit trail of processing status changes. user_id is NULL for changes
+-- made by the background worker.
+CREATE TABLE IF NOT EXISTS document_status_history (
+	id BIGSERIAL PRIMARY KEY,
+	document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	action TEXT NOT NULL,
+	status TEXT NOT NULL,
+	message TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS document_status_history_document_id_idx ON document_status_history (document_id, created_at);
@@ -0,0 +1,2 @@
+UPDATE documents SET file_path = 'uploads/' || file_path WHERE file_path <> '' AND file_path NOT LIKE 'uploads/%';
+UPDATE documents SET thumbnail = 'uploads/' || thumbnail WHERE thumbnail <> '' AND thumbnail NOT LIKE 'uploads/%';
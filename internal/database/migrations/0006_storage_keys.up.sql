@@ -0,0 +1,4 @@
+-- Files are addressed by storage keys relative to the storage root instead
+-- of paths that include the uploads directory.
+UPDATE documents SET file_path = substr(file_path, 9) WHERE file_path LIKE 'uploads/%';
+UPDATE documents SET thumbnail = substr(thumbnail, 9) WHERE thumbnail LIKE 'uploads/%';
@@ -0,0 +1,15 @@
+-- Tags with the same name are merged back into a single shared row.
+
+UPDATE document_tags dt SET tag_id = k.keep_id
+FROM tags t, (SELECT name, MIN(id) AS keep_id FROM tags GROUP BY name) k
+WHERE t.id = dt.tag_id AND k.name = t.name AND dt.tag_id <> k.keep_id;
+
+DELETE FROM tags t
+USING (SELECT name, MIN(id) AS keep_id FROM tags GROUP BY name) k
+WHERE k.name = t.name AND t.id <> k.keep_id;
+
+ALTER TABLE tags DROP CONSTRAINT IF EXISTS tags_user_id_name_key;
+ALTER TABLE tags DROP COLUMN IF EXISTS description;
+ALTER TABLE tags DROP COLUMN IF EXISTS color;
+ALTER TABLE tags DROP COLUMN IF EXISTS user_id;
+ALTER TABLE tags ADD CONSTRAINT tags_name_key UNIQUE (name);
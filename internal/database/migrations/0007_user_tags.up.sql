@@ -0,0 +1,36 @@
+-- Tags belong to a user. Tags that were shared between users are split: the
+-- owner with the lowest ID keeps the existing row and every other owner gets
+-- a copy, to which their documents are moved.
+
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS color TEXT NOT NULL DEFAULT '';
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE tags DROP CONSTRAINT IF EXISTS tags_name_key;
+
+CREATE TEMP TABLE tag_owners ON COMMIT DROP AS
+SELECT DISTINCT dt.tag_id, d.user_id
+FROM document_tags dt JOIN documents d ON d.id = dt.document_id
+WHERE d.user_id IS NOT NULL;
+
+UPDATE tags t SET user_id = o.user_id
+FROM (SELECT tag_id, MIN(user_id) AS user_id FROM tag_owners GROUP BY tag_id) o
+WHERE t.id = o.tag_id;
+
+INSERT INTO tags (user_id, name)
+SELECT o.user_id, t.name
+FROM tag_owners o JOIN tags t ON t.id = o.tag_id
+WHERE o.user_id <> t.user_id;
+
+UPDATE document_tags dt SET tag_id = copy.id
+FROM documents d, tags orig, tags copy
+WHERE d.id = dt.document_id
+  AND orig.id = dt.tag_id
+  AND orig.user_id <> d.user_id
+  AND copy.user_id = d.user_id
+  AND copy.name = orig.name;
+
+-- Tags that are not attached to any document have no owner to give them to.
+DELETE FROM tags WHERE user_id IS NULL;
+
+ALTER TABLE tags ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE tags ADD CONSTRAINT tags_user_id_name_key UNIQUE (user_id, name);
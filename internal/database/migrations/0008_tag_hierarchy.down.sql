@@ -0,0 +1,23 @@
+-- Tag names keep their full paths; only the parent links are dropped.
+
+CREATE OR REPLACE FUNCTION document_search_vector(doc_id INTEGER, title TEXT, summary TEXT, content TEXT)
+RETURNS tsvector AS $$
+	SELECT
+		setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce((
+			SELECT string_agg(t.name, ' ')
+			FROM document_tags dt JOIN tags t ON t.id = dt.tag_id
+			WHERE dt.document_id = doc_id
+		), '')), 'B') ||
+		setweight(to_tsvector('english', coalesce(summary, '')), 'C') ||
+		setweight(to_tsvector('english', coalesce(content, '')), 'D')
+$$ LANGUAGE sql STABLE;
+
+UPDATE documents d SET search_vector = document_search_vector(d.id, d.title, d.summary, d.content)
+WHERE EXISTS (
+	SELECT 1 FROM document_tags dt JOIN tags t ON t.id = dt.tag_id
+	WHERE dt.document_id = d.id AND t.name LIKE '%/%'
+);
+
+DROP INDEX IF EXISTS tags_parent_id_idx;
+ALTER TABLE tags DROP COLUMN IF EXISTS parent_id;
@@ -0,0 +1,55 @@
+-- Tags form a tree. A tag's name is its full path ("finance/tax/2023") and
+-- parent_id points at the tag for the path without its last segment.
+
+ALTER TABLE tags ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES tags(id);
+CREATE INDEX IF NOT EXISTS tags_parent_id_idx ON tags (parent_id);
+
+-- Tidy existing names that were used as paths: lowercase, no blanks around
+-- separators and no empty segments. Names that would collide with an
+-- existing tag are left alone, and of several names that tidy to the same
+-- path, such as "Tax" and "TAX", only the oldest is renamed.
+UPDATE tags t SET name = c.clean
+FROM (
+	SELECT DISTINCT ON (user_id, clean) id, user_id, clean
+	FROM (
+		SELECT id, user_id, name, trim(BOTH '/' FROM regexp_replace(regexp_replace(lower(name), '\s*/\s*', '/', 'g'), '/{2,}', '/', 'g')) AS clean
+		FROM tags
+	) n
+	WHERE clean <> name AND clean <> ''
+	ORDER BY user_id, clean, id
+) c
+WHERE c.id = t.id
+  AND NOT EXISTS (SELECT 1 FROM tags o WHERE o.user_id = c.user_id AND o.name = c.clean);
+
+-- Create the missing ancestors of every tag.
+INSERT INTO tags (user_id, name)
+SELECT DISTINCT t.user_id, array_to_string((string_to_array(t.name, '/'))[1:n], '/')
+FROM tags t, generate_series(1, array_length(string_to_array(t.name, '/'), 1) - 1) n
+WHERE t.name LIKE '%/%'
+ON CONFLICT (user_id, name) DO NOTHING;
+
+UPDATE tags c SET parent_id = p.id
+FROM tags p
+WHERE p.user_id = c.user_id AND c.name LIKE '%/%'
+  AND p.name = regexp_replace(c.name, '/[^/]*$', '');
+
+-- Index path segments as separate words so that searching for "tax" finds
+-- documents tagged "finance/tax/2023".
+CREATE OR REPLACE FUNCTION document_search_vector(doc_id INTEGER, title TEXT, summary TEXT, content TEXT)
+RETURNS tsvector AS $$
+	SELECT
+		setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce((
+			SELECT string_agg(replace(t.name, '/', ' '), ' ')
+			FROM document_tags dt JOIN tags t ON t.id = dt.tag_id
+			WHERE dt.document_id = doc_id
+		), '')), 'B') ||
+		setweight(to_tsvector('english', coalesce(summary, '')), 'C') ||
+		setweight(to_tsvector('english', coalesce(content, '')), 'D')
+$$ LANGUAGE sql STABLE;
+
+UPDATE documents d SET search_vector = document_search_vector(d.id, d.title, d.summary, d.content)
+WHERE EXISTS (
+	SELECT 1 FROM document_tags dt JOIN tags t ON t.id = dt.tag_id
+	WHERE dt.document_id = d.id AND t.name LIKE '%/%'
+);
@@ -0,0 +1,4 @@
+ALTER TABLE documents DROP COLUMN IF EXISTS document_type_id;
+ALTER TABLE documents DROP COLUMN IF EXISTS correspondent_id;
+DROP TABLE IF EXISTS document_types;
+DROP TABLE IF EXISTS correspondents;
@@ -0,0 +1,24 @@
+-- Correspondents (who sent a document) and document types (what kind of
+-- document it is) are owned by a user. A document has at most one of each.
+
+CREATE TABLE IF NOT EXISTS correspondents (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS document_types (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, name)
+);
+
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS correspondent_id INTEGER REFERENCES correspondents(id) ON DELETE SET NULL;
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS document_type_id INTEGER REFERENCES document_types(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS documents_correspondent_id_idx ON documents (correspondent_id);
+CREATE INDEX IF NOT EXISTS documents_document_type_id_idx ON documents (document_type_id);
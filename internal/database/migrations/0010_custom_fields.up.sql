@@ -0,0 +1,24 @@
+-- Custom fields are user-defined metadata such as an invoice number or a due
+-- date. Values are stored as text in the canonical form for the field type
+-- (see package customfield), so they can be cast when filtering and sorting.
+
+CREATE TABLE IF NOT EXISTS custom_fields (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	key TEXT NOT NULL,
+	type TEXT NOT NULL CHECK (type IN ('text', 'number', 'money', 'date', 'boolean', 'select', 'url')),
+	options TEXT[] NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, name),
+	UNIQUE (user_id, key)
+);
+
+CREATE TABLE IF NOT EXISTS custom_field_values (
+	document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+	field_id INTEGER NOT NULL REFERENCES custom_fields(id) ON DELETE CASCADE,
+	value TEXT NOT NULL,
+	PRIMARY KEY (document_id, field_id)
+);
+
+CREATE INDEX IF NOT EXISTS custom_field_values_field_id_idx ON custom_field_values (field_id);
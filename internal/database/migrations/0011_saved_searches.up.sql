@@ -0,0 +1,13 @@
+-- Saved searches store a dashboard query and sort order under a name.
+
+CREATE TABLE IF NOT EXISTS saved_searches (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	query TEXT NOT NULL DEFAULT '',
+	sort TEXT NOT NULL DEFAULT '',
+	pinned BOOLEAN NOT NULL DEFAULT FALSE,
+	show_on_dashboard BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, name)
+);
@@ -0,0 +1,3 @@
+-- Saved searches keep the dashboard filters next to the query.
+
+ALTER TABLE saved_searches ADD COLUMN IF NOT EXISTS filters JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS correspondents_name_trgm_idx;
+DROP INDEX IF EXISTS tags_name_trgm_idx;
+DROP INDEX IF EXISTS documents_content_trgm_idx;
+DROP INDEX IF EXISTS documents_summary_trgm_idx;
+DROP INDEX IF EXISTS documents_title_trgm_idx;
+DROP EXTENSION IF EXISTS pg_trgm;
@@ -0,0 +1,10 @@
+-- Trigram indexes for typo-tolerant matching of titles, content, tag names
+-- and correspondents, used by search and autocomplete.
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS documents_title_trgm_idx ON documents USING GIN (title gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS documents_summary_trgm_idx ON documents USING GIN (summary gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS documents_content_trgm_idx ON documents USING GIN (content gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS tags_name_trgm_idx ON tags USING GIN (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS correspondents_name_trgm_idx ON correspondents USING GIN (name gin_trgm_ops);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS duplicate_dismissals;
+ALTER TABLE documents DROP COLUMN IF EXISTS fingerprint;
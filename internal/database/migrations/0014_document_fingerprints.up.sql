@@ -0,0 +1,12 @@
+-- Content fingerprints (SimHash of the extracted text) for finding similar
+-- documents and near-duplicates, and the pairs a user decided to keep.
+
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS fingerprint BIGINT;
+
+CREATE TABLE IF NOT EXISTS duplicate_dismissals (
+	document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+	other_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (document_id, other_id),
+	CHECK (document_id < other_id)
+);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS rejected_uploads;
+ALTER TABLE documents DROP COLUMN IF EXISTS version_of;
+DROP INDEX IF EXISTS documents_user_file_hash_idx;
+ALTER TABLE documents ADD CONSTRAINT documents_user_id_file_hash_key UNIQUE (user_id, file_hash);
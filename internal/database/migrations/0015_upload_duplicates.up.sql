@@ -0,0 +1,25 @@
+-- Uploads are checked for duplicates before they are queued. A file that is
+-- already stored is set aside in rejected_uploads until the user discards it
+-- or stores it anyway as a new version of the existing document, so the same
+-- file may now appear more than once per user.
+
+ALTER TABLE documents DROP CONSTRAINT IF EXISTS documents_user_id_file_hash_key;
+CREATE INDEX IF NOT EXISTS documents_user_file_hash_idx ON documents (user_id, file_hash);
+
+ALTER TABLE documents ADD COLUMN IF NOT EXISTS version_of INTEGER REFERENCES documents(id) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS rejected_uploads (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	existing_document_id INTEGER REFERENCES documents(id) ON DELETE SET NULL,
+	title TEXT NOT NULL DEFAULT '',
+	original_filename TEXT NOT NULL DEFAULT '',
+	file_hash TEXT NOT NULL,
+	file_key TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'stored', 'discarded')),
+	document_id INTEGER REFERENCES documents(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS rejected_uploads_user_idx ON rejected_uploads (user_id, created_at DESC);
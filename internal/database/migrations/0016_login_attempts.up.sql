@@ -0,0 +1,17 @@
+-- Sign-in attempts, used to slow down and lock out password and second
+-- factor guessing per account and per client address, and to show users
+-- recent failures on their account.
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id BIGSERIAL PRIMARY KEY,
+	username TEXT NOT NULL,
+	user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	ip TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	success BOOLEAN NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_username_idx ON login_attempts (username, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_user_idx ON login_attempts (user_id, created_at);
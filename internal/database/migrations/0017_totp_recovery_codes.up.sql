@@ -0,0 +1,11 @@
+-- One-time recovery codes that replace a TOTP code when the device is lost.
+-- Only a SHA-256 hash of each code is stored.
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	used_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, code_hash)
+);
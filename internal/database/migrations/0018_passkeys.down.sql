@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS passkeys;
+ALTER TABLE users DROP COLUMN IF EXISTS webauthn_id;
@@ -0,0 +1,18 @@
+-- WebAuthn credentials (passkeys). webauthn_id is the random user handle
+-- passed to authenticators, which identifies the account at passwordless
+-- sign-in. The credential column holds the library's JSON encoding of the
+-- public key, flags and signature counter.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS webauthn_id BYTEA UNIQUE;
+
+CREATE TABLE IF NOT EXISTS passkeys (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	credential_id BYTEA NOT NULL UNIQUE,
+	credential JSONB NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS passkeys_user_idx ON passkeys (user_id);
@@ -0,0 +1,16 @@
+-- Accounts at an OpenID Connect provider linked to Dokeep users. An
+-- identity is the provider's issuer and its stable subject identifier; the
+-- email is kept for display only. Accounts created at single sign-on have
+-- an empty password_hash, which never matches a password.
+
+CREATE TABLE IF NOT EXISTS user_identities (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	email TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMPTZ,
+	UNIQUE (issuer, subject),
+	UNIQUE (user_id, issuer)
+);
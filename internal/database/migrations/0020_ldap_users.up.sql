@@ -0,0 +1,8 @@
+-- Users signing in through LDAP. ldap_dn is the directory entry the account
+-- belongs to, or NULL for local accounts; such accounts have an empty
+-- password_hash, since the directory checks their password. is_admin is
+-- taken from the configured admin groups at every directory check and
+-- opens the Users page.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ldap_dn TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
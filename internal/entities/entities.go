@@ -0,0 +1,66 @@
+// Package entities handles correspondents and document types, the named
+// records a user can assign to each document alongside its tags.
+package entities
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Kind describes one kind of entity and where it is stored.
+type Kind struct {
+	// Table holds the entities; Column is the reference in documents.
+	Table  string
+	Column string
+	// Singular and Plural are used in messages and page titles.
+	Singular string
+	Plural   string
+	// Path is where the management page is served.
+	Path string
+}
+
+var (
+	Correspondents = Kind{Table: "correspondents", Column: "correspondent_id", Singular: "correspondent", Plural: "Correspondents", Path: "/correspondents"}
+	DocumentTypes  = Kind{Table: "document_types", Column: "document_type_id", Singular: "document type", Plural: "Document Types", Path: "/document-types"}
+)
+
+// queryer is satisfied by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Normalize trims a name and collapses runs of whitespace.
+func Normalize(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// Resolve returns the ID of the user's entity for a proposed name, such as
+// one suggested during analysis, creating it only if nothing matches. Names
+// match case-insensitively; failing that, an existing entry whose name
+// contains the proposal or is contained in it is used, so "ACME Bank Ltd."
+// matches an existing "ACME Bank". The longest such name wins; names shorter
+// than three characters only match exactly.
+func Resolve(q queryer, kind Kind, userID int, name string) (int, error) {
+	name = Normalize(name)
+	var id int
+	err := q.QueryRow(`
+		SELECT id FROM `+kind.Table+`
+		WHERE user_id = $1 AND (
+			lower(name) = lower($2)
+			OR (length(name) >= 3 AND strpos(lower($2), lower(name)) > 0)
+			OR (length($2) >= 3 AND strpos(lower(name), lower($2)) > 0)
+		)
+		ORDER BY lower(name) = lower($2) DESC, length(name) DESC, id
+		LIMIT 1`, userID, name).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	err = q.QueryRow(`
+		WITH created AS (
+			INSERT INTO `+kind.Table+` (user_id, name) VALUES ($1, $2)
+			ON CONFLICT (user_id, name) DO NOTHING RETURNING id
+		)
+		SELECT id FROM created UNION ALL SELECT id FROM `+kind.Table+` WHERE user_id = $1 AND name = $2
+		LIMIT 1`, userID, name).Scan(&id)
+	return id, err
+}
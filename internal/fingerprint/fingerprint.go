@@ -0,0 +1,78 @@
+// Package fingerprint computes SimHash fingerprints of extracted document
+// text. Two scans of the same paper produce different files, and OCR never
+// reads them exactly alike, but their fingerprints differ in only a few of
+// their 64 bits, while unrelated texts differ in about half of them.
+package fingerprint
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+)
+
+const (
+	// NearDuplicate is the largest distance at which two documents are
+	// offered for duplicate review.
+	NearDuplicate = 8
+	// Similar is the largest distance at which a document is listed as
+	// similar to another.
+	Similar = 16
+
+	// minWords is the shortest text that is fingerprinted. Shorter texts,
+	// such as a photo with a caption, match too easily.
+	minWords = 12
+)
+
+// Of returns the SimHash of text, or false if the text is too short.
+func Of(text string) (uint64, bool) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	// Single characters are mostly OCR noise.
+	kept := words[:0]
+	for _, w := range words {
+		if len([]rune(w)) > 1 {
+			kept = append(kept, w)
+		}
+	}
+	words = kept
+	if len(words) < minWords {
+		return 0, false
+	}
+
+	// Each word votes on every bit. Hashing single words rather than word
+	// sequences keeps a misread word from changing more than one vote.
+	var weights [64]int
+	h := fnv.New64a()
+	for _, w := range words {
+		h.Reset()
+		h.Write([]byte(w))
+		sum := h.Sum64()
+		for b := 0; b < 64; b++ {
+			if sum&(1<<b) != 0 {
+				weights[b]++
+			} else {
+				weights[b]--
+			}
+		}
+	}
+	var fp uint64
+	for b, w := range weights {
+		if w > 0 {
+			fp |= 1 << b
+		}
+	}
+	return fp, true
+}
+
+// Distance returns the number of bits in which two fingerprints differ.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Similarity turns a distance into a score between 0 and 1, where 1 means
+// the fingerprints are equal.
+func Similarity(distance int) float64 {
+	return 1 - float64(distance)/64
+}
@@ -0,0 +1,101 @@
+package fingerprint
+
+import (
+	"strings"
+	"testing"
+)
+
+const invoice = `Stadtwerke Musterstadt GmbH, Hauptstrasse 12, 12345 Musterstadt.
+Invoice number 2023-0471 dated 14 March 2023. Customer number 88120394.
+Electricity supply for the billing period from 1 January 2022 to 31 December 2022.
+Meter number 4711-0815, previous reading 23410 kWh, current reading 26985 kWh,
+consumption 3575 kWh at a working price of 32.45 cents per kWh.
+Basic charge for twelve months 118.80 EUR. Net amount 1278.89 EUR,
+value added tax 19 percent 242.99 EUR, total amount 1521.88 EUR.
+The amount will be debited from your account ending in 4410 on 28 March 2023.
+Your new monthly instalment from April 2023 is 127.00 EUR.
+Please keep this invoice for your records. Questions about your bill can be
+sent to service at stadtwerke-musterstadt.de or by phone to 0800 123 456.`
+
+// misread replaces a few words as OCR of another scan might read them.
+var misread = strings.NewReplacer(
+	"Musterstadt GmbH", "Musterstadt GmhH",
+	"consumption", "consurnption",
+	"debited", "dcbited",
+	"instalment", "instalrnent",
+	"0800", "O8OO",
+).Replace(invoice)
+
+const letter = `Dear Mrs Keller, thank you for your application for the position of
+junior accountant at our office in Hamburg. We were impressed by your
+experience with payroll and year-end closing and would like to invite you to
+an interview on Tuesday afternoon. Please bring copies of your certificates and
+a form of identification. Our office is on the third floor next to the train
+station, and visitor parking is available behind the building. If the date
+does not suit you, call our human resources team so that we can find another
+time. We look forward to meeting you. Kind regards, Thomas Brandt, head of finance.`
+
+func TestOfShortText(t *testing.T) {
+	tests := []string{
+		"",
+		"Holiday photo, beach at sunset",
+		// Single characters do not count as words
+		"a b c d e f g h i j k l m n o p q r s t u v w x y z one two three",
+		"one two three four five six seven eight nine ten eleven",
+	}
+	for _, text := range tests {
+		if _, ok := Of(text); ok {
+			t.Errorf("Of(%q) = _, true, want false", text)
+		}
+	}
+	if _, ok := Of("one two three four five six seven eight nine ten eleven twelve"); !ok {
+		t.Error("Of(twelve words) = _, false, want true")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	fp := func(text string) uint64 {
+		t.Helper()
+		f, ok := Of(text)
+		if !ok {
+			t.Fatalf("Of(%.20q...) = _, false", text)
+		}
+		return f
+	}
+	a, b, c := fp(invoice), fp(misread), fp(letter)
+
+	if d := Distance(a, a); d != 0 {
+		t.Errorf("Distance of a text to itself = %d, want 0", d)
+	}
+	if a2 := fp(strings.ToUpper(invoice)); a2 != a {
+		t.Errorf("Of is not case-insensitive: distance %d", Distance(a, a2))
+	}
+	if d := Distance(a, b); d > NearDuplicate {
+		t.Errorf("Distance to a misread copy = %d, want at most %d", d, NearDuplicate)
+	}
+	// Common words pull unrelated texts below the 32 bits of random
+	// fingerprints, but they stay clear of Similar
+	if d := Distance(a, c); d <= Similar+4 {
+		t.Errorf("Distance to an unrelated text = %d, want more than %d", d, Similar+4)
+	}
+	if Distance(a, c) != Distance(c, a) {
+		t.Error("Distance is not symmetric")
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		distance int
+		want     float64
+	}{
+		{0, 1},
+		{16, 0.75},
+		{32, 0.5},
+		{64, 0},
+	}
+	for _, tt := range tests {
+		if got := Similarity(tt.distance); got != tt.want {
+			t.Errorf("Similarity(%d) = %v, want %v", tt.distance, got, tt.want)
+		}
+	}
+}
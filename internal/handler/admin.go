@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+
+	"dokeep/internal/auth"
+	"dokeep/internal/model"
+	"dokeep/internal/passkey"
+	"dokeep/web/template"
+)
+
+// ShowUsers handles GET /admin/users, which lists the accounts for
+// administrators.
+func (h *AuthHandler) ShowUsers(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.DB.Query(`
+		SELECT u.id, u.username, u.ldap_dn IS NOT NULL, u.is_admin, COALESCE(u.totp_enabled, FALSE),
+			(SELECT COUNT(*) FROM passkeys p WHERE p.user_id = u.id)
+		FROM users u ORDER BY lower(u.username)`)
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var users []model.UserAccount
+	for rows.Next() {
+		var u model.UserAccount
+		if err := rows.Scan(&u.ID, &u.Username, &u.Directory, &u.Admin, &u.TwoFactor, &u.Passkeys); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	template.UsersPage(users).Render(r.Context(), w)
+}
+
+// ResetUserTwoFactor handles POST /admin/users/{id}/reset-2fa, the web
+// counterpart of "dokeep user reset-2fa". It asks for the administrator's
+// password, like the user's own two-factor settings.
+func (h *AuthHandler) ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	targetID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.confirmPassword(w, r, h.Session.GetInt(r.Context(), "userID")); !ok {
+		return
+	}
+	err = auth.ResetTwoFactor(h.DB, targetID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error resetting two-factor authentication for user %d: %v", targetID, err)
+		http.Error(w, "Failed to reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if err := passkey.RemoveAll(h.DB, targetID); err != nil {
+		log.Printf("Error removing passkeys of user %d: %v", targetID, err)
+		http.Error(w, "Failed to remove passkeys", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
@@ -0,0 +1,1044 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dokeep/internal/entities"
+	"dokeep/internal/middleware"
+	"dokeep/internal/model"
+	"dokeep/internal/search"
+)
+
+// APIHandler serves the versioned JSON API under /api/v1. It reuses the
+// DocumentHandler queries so that ownership checks are shared with the HTML
+// pages.
+type APIHandler struct {
+	Docs *DocumentHandler
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type documentResponse struct {
+	model.Document
+	Tags []model.Tag `json:"tags"`
+}
+
+// bulkActionRequest is the body of POST /api/v1/documents/actions.
+type bulkActionRequest struct {
+	Action string `json:"action"`
+	IDs    []int  `json:"ids"`
+	ReprocessOptions
+}
+
+// bulkActionResult reports the outcome for one document of a bulk action.
+type bulkActionResult struct {
+	ID    int    `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type queueResponse struct {
+	Stats     model.QueueStats `json:"stats"`
+	Documents []model.Document `json:"documents"`
+}
+
+// documentPatch holds the fields accepted by PATCH /api/v1/documents/{id}.
+// Fields left out of the request body keep their current value; an ID of 0
+// clears the correspondent or document type. CustomFields maps field keys to
+// values, where "" removes the value.
+type documentPatch struct {
+	Title           *string           `json:"title"`
+	Summary         *string           `json:"summary"`
+	CreatedDate     *string           `json:"created_date"`
+	CorrespondentID *int              `json:"correspondent_id"`
+	DocumentTypeID  *int              `json:"document_type_id"`
+	CustomFields    map[string]string `json:"custom_fields"`
+}
+
+// entityRequest is the body for creating or renaming a correspondent or
+// document type.
+type entityRequest struct {
+	Name string `json:"name"`
+}
+
+type tagRequest struct {
+	Name  string   `json:"name"`
+	Names []string `json:"names"`
+}
+
+// tagMergeRequest is the body of POST /api/v1/tags/{id}/merge.
+type tagMergeRequest struct {
+	Into int `json:"into"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
+
+// writeDocumentError maps errors from the DocumentHandler helpers to JSON
+// responses.
+func writeDocumentError(w http.ResponseWriter, err error) {
+	if err == errDocumentNotFound {
+		writeJSONError(w, http.StatusNotFound, "document not found")
+		return
+	}
+	if err == errTagNotFound {
+		writeJSONError(w, http.StatusNotFound, "tag not found")
+		return
+	}
+	if err == errEntityNotFound {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err == errFieldNotFound {
+		writeJSONError(w, http.StatusNotFound, "custom field not found")
+		return
+	}
+	if err == errSavedSearchNotFound {
+		writeJSONError(w, http.StatusNotFound, "saved search not found")
+		return
+	}
+	if err == errRejectedUploadNotFound {
+		writeJSONError(w, http.StatusNotFound, "rejected upload not found")
+		return
+	}
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		writeJSONError(w, http.StatusConflict, conflict.msg)
+		return
+	}
+	log.Printf("API error: %v", err)
+	writeJSONError(w, http.StatusInternalServerError, "internal server error")
+}
+
+func (h *APIHandler) userID(r *http.Request) int {
+	return middleware.UserID(r.Context())
+}
+
+func pathID(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue(name))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid "+name)
+		return 0, false
+	}
+	return id, true
+}
+
+// ListDocuments handles GET /api/v1/documents. It accepts the same search,
+// filter, sort and paging parameters as the dashboard (see
+// DocumentHandler.List).
+func (h *APIHandler) ListDocuments(w http.ResponseWriter, r *http.Request) {
+	list, err := h.Docs.List(w, r)
+	var queryErr *search.Error
+	if errors.As(err, &queryErr) {
+		writeJSONError(w, http.StatusBadRequest, "invalid query: "+queryErr.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("API error listing documents: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list documents")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// duplicateResponse is the body of the 409 returned when an uploaded file
+// is already stored.
+type duplicateResponse struct {
+	Error              string `json:"error"`
+	ExistingDocumentID int    `json:"existing_document_id"`
+	RejectedUploadID   int    `json:"rejected_upload_id"`
+}
+
+// CreateDocument handles POST /api/v1/documents with a multipart body
+// containing "file" and an optional "title". A file the user already has is
+// rejected with 409 unless "allow_duplicate" is set, in which case it is
+// stored as a new version of the existing document.
+func (h *APIHandler) CreateDocument(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(h.Docs.Config.Uploads.MaxBytes()); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "expected a multipart form")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "missing file")
+		return
+	}
+	defer file.Close()
+
+	userID := h.userID(r)
+	docID, err := h.Docs.createDocument(userID, uploadFromForm(r.FormValue("title"), file, header), r.FormValue("allow_duplicate") == "true")
+	var duplicate *duplicateError
+	if errors.As(err, &duplicate) {
+		writeJSON(w, http.StatusConflict, duplicateResponse{
+			Error:              duplicate.Error(),
+			ExistingDocumentID: duplicate.Existing.ID,
+			RejectedUploadID:   duplicate.RejectedID,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("API error creating document for user %d: %v", userID, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to queue document for processing")
+		return
+	}
+
+	doc, err := h.Docs.getDocument(userID, int(docID))
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/documents/"+strconv.FormatInt(docID, 10))
+	writeJSON(w, http.StatusCreated, documentResponse{Document: doc, Tags: []model.Tag{}})
+}
+
+// GetDocument handles GET /api/v1/documents/{id}.
+func (h *APIHandler) GetDocument(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	h.writeDocument(w, h.userID(r), id)
+}
+
+func (h *APIHandler) writeDocument(w http.ResponseWriter, userID, id int) {
+	doc, err := h.Docs.getDocument(userID, id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	tags, err := h.Docs.GetTags(id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	if tags == nil {
+		tags = []model.Tag{}
+	}
+	writeJSON(w, http.StatusOK, documentResponse{Document: doc, Tags: tags})
+}
+
+// UpdateDocument handles PATCH /api/v1/documents/{id}.
+func (h *APIHandler) UpdateDocument(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var patch documentPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	userID := h.userID(r)
+	doc, err := h.Docs.getDocument(userID, id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+
+	if patch.Title != nil {
+		doc.Title = *patch.Title
+	}
+	if patch.Summary != nil {
+		doc.Summary = *patch.Summary
+	}
+	var createdDate *time.Time
+	if !doc.CreatedDate.IsZero() {
+		createdDate = &doc.CreatedDate
+	}
+	if patch.CreatedDate != nil {
+		createdDate = nil
+		if *patch.CreatedDate != "" {
+			parsed, err := time.Parse("2006-01-02", *patch.CreatedDate)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "created_date must be formatted as YYYY-MM-DD")
+				return
+			}
+			createdDate = &parsed
+		}
+	}
+
+	// Check the whole patch before saving any of it, so that a bad value
+	// does not leave the document half updated
+	if patch.CorrespondentID != nil && *patch.CorrespondentID != 0 {
+		if err := h.Docs.checkEntity(entities.Correspondents, userID, *patch.CorrespondentID); err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+	}
+	if patch.DocumentTypeID != nil && *patch.DocumentTypeID != 0 {
+		if err := h.Docs.checkEntity(entities.DocumentTypes, userID, *patch.DocumentTypeID); err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+	}
+	var values map[int]string
+	if len(patch.CustomFields) > 0 {
+		fields, err := h.Docs.customFieldsByKey(userID)
+		if err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+		byID := make(map[int]model.CustomField, len(patch.CustomFields))
+		values = make(map[int]string, len(patch.CustomFields))
+		for key, value := range patch.CustomFields {
+			f, ok := fields[key]
+			if !ok {
+				writeJSONError(w, http.StatusBadRequest, "unknown custom field "+strconv.Quote(key))
+				return
+			}
+			byID[f.ID] = f
+			values[f.ID] = value
+		}
+		if _, err := customFieldValues(byID, values); err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+	}
+
+	if err := h.Docs.updateDetails(userID, id, doc.Title, doc.Summary, createdDate); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	if patch.CorrespondentID != nil {
+		if err := h.Docs.setDocumentEntity(entities.Correspondents, userID, id, *patch.CorrespondentID); err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+	}
+	if patch.DocumentTypeID != nil {
+		if err := h.Docs.setDocumentEntity(entities.DocumentTypes, userID, id, *patch.DocumentTypeID); err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+	}
+	if values != nil {
+		if err := h.Docs.setCustomFieldValues(userID, id, values); err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+	}
+	h.GetDocument(w, r)
+}
+
+// DeleteDocument handles DELETE /api/v1/documents/{id}.
+func (h *APIHandler) DeleteDocument(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := h.Docs.deleteDocument(h.userID(r), id); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListTags handles GET /api/v1/documents/{id}/tags.
+func (h *APIHandler) ListTags(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := h.Docs.ownsDocument(h.userID(r), id); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	h.writeTags(w, http.StatusOK, id)
+}
+
+// AddTags handles POST /api/v1/documents/{id}/tags. The body may contain a
+// single "name" or a list of "names".
+func (h *APIHandler) AddTags(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var req tagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	names := req.Names
+	if req.Name != "" {
+		names = append(names, req.Name)
+	}
+	if len(names) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "name or names is required")
+		return
+	}
+
+	if err := h.Docs.ownsDocument(h.userID(r), id); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	h.Docs.addTagsToDocument(h.userID(r), id, names)
+	h.writeTags(w, http.StatusCreated, id)
+}
+
+// RemoveTag handles DELETE /api/v1/documents/{id}/tags/{tagID}.
+func (h *APIHandler) RemoveTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	tagID, ok := pathID(w, r, "tagID")
+	if !ok {
+		return
+	}
+	if err := h.Docs.removeTag(h.userID(r), id, tagID); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) writeTags(w http.ResponseWriter, status int, documentID int) {
+	tags, err := h.Docs.GetTags(documentID)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	if tags == nil {
+		tags = []model.Tag{}
+	}
+	writeJSON(w, status, tags)
+}
+
+// ListAllTags handles GET /api/v1/tags. It lists the user's tags with the
+// number of documents using each.
+func (h *APIHandler) ListAllTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := h.Docs.listTags(h.userID(r))
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	if tags == nil {
+		tags = []model.TagUsage{}
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
+
+// GetTag handles GET /api/v1/tags/{id}.
+func (h *APIHandler) GetTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	tag, err := h.Docs.getTag(h.userID(r), id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tag)
+}
+
+// UpdateTag handles PATCH /api/v1/tags/{id}. The body may change the
+// "name", "color" and "description".
+func (h *APIHandler) UpdateTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var update tagUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if err := h.Docs.updateTag(h.userID(r), id, update); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	h.GetTag(w, r)
+}
+
+// MergeTag handles POST /api/v1/tags/{id}/merge. The documents of the tag are
+// moved to the tag given as "into", which is returned.
+func (h *APIHandler) MergeTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var req tagMergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	userID := h.userID(r)
+	if err := h.Docs.mergeTag(userID, id, req.Into); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	tag, err := h.Docs.getTag(userID, req.Into)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tag)
+}
+
+// DeleteTag handles DELETE /api/v1/tags/{id}.
+func (h *APIHandler) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := h.Docs.deleteTag(h.userID(r), id); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListEntities handles GET /api/v1/correspondents and
+// GET /api/v1/document-types.
+func (h *APIHandler) ListEntities(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := h.Docs.listEntities(kind, h.userID(r))
+		if err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+		if list == nil {
+			list = []model.Entity{}
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+// GetEntity handles GET /api/v1/correspondents/{id} and
+// GET /api/v1/document-types/{id}.
+func (h *APIHandler) GetEntity(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r, "id")
+		if !ok {
+			return
+		}
+		h.writeEntity(w, http.StatusOK, kind, h.userID(r), id)
+	}
+}
+
+// CreateEntity handles POST /api/v1/correspondents and
+// POST /api/v1/document-types with a {"name": "..."} body.
+func (h *APIHandler) CreateEntity(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req entityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		userID := h.userID(r)
+		id, err := h.Docs.createEntity(kind, userID, req.Name)
+		if err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/api/v1"+kind.Path+"/"+strconv.Itoa(id))
+		h.writeEntity(w, http.StatusCreated, kind, userID, id)
+	}
+}
+
+// UpdateEntity handles PATCH /api/v1/correspondents/{id} and
+// PATCH /api/v1/document-types/{id} with a {"name": "..."} body.
+func (h *APIHandler) UpdateEntity(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r, "id")
+		if !ok {
+			return
+		}
+		var req entityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		userID := h.userID(r)
+		if err := h.Docs.renameEntity(kind, userID, id, req.Name); err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+		h.writeEntity(w, http.StatusOK, kind, userID, id)
+	}
+}
+
+// DeleteEntity handles DELETE /api/v1/correspondents/{id} and
+// DELETE /api/v1/document-types/{id}.
+func (h *APIHandler) DeleteEntity(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := pathID(w, r, "id")
+		if !ok {
+			return
+		}
+		if err := h.Docs.deleteEntity(kind, h.userID(r), id); err != nil {
+			writeDocumentError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *APIHandler) writeEntity(w http.ResponseWriter, status int, kind entities.Kind, userID, id int) {
+	e, err := h.Docs.getEntity(kind, userID, id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, status, e)
+}
+
+// ListCustomFields handles GET /api/v1/custom-fields.
+func (h *APIHandler) ListCustomFields(w http.ResponseWriter, r *http.Request) {
+	fields, err := h.Docs.listCustomFields(h.userID(r))
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	if fields == nil {
+		fields = []model.CustomField{}
+	}
+	writeJSON(w, http.StatusOK, fields)
+}
+
+// GetCustomField handles GET /api/v1/custom-fields/{id}.
+func (h *APIHandler) GetCustomField(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	h.writeCustomField(w, http.StatusOK, h.userID(r), id)
+}
+
+// CreateCustomField handles POST /api/v1/custom-fields with a body such as
+// {"name": "Due date", "type": "date"}. Select fields also need "options".
+func (h *APIHandler) CreateCustomField(w http.ResponseWriter, r *http.Request) {
+	var req model.CustomField
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	userID := h.userID(r)
+	id, err := h.Docs.createCustomField(userID, model.CustomField{Name: req.Name, Type: req.Type, Options: req.Options})
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/custom-fields/"+strconv.Itoa(id))
+	h.writeCustomField(w, http.StatusCreated, userID, id)
+}
+
+// UpdateCustomField handles PATCH /api/v1/custom-fields/{id}. The body may
+// change the "name", "type" and "options"; existing values must be valid for
+// the new type, otherwise the request fails with 409 Conflict.
+func (h *APIHandler) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var update customFieldUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	userID := h.userID(r)
+	if err := h.Docs.updateCustomField(userID, id, update); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	h.writeCustomField(w, http.StatusOK, userID, id)
+}
+
+// DeleteCustomField handles DELETE /api/v1/custom-fields/{id}.
+func (h *APIHandler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := h.Docs.deleteCustomField(h.userID(r), id); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) writeCustomField(w http.ResponseWriter, status int, userID, id int) {
+	f, err := h.Docs.getCustomField(userID, id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, status, f)
+}
+
+// ListSavedSearches handles GET /api/v1/saved-searches.
+func (h *APIHandler) ListSavedSearches(w http.ResponseWriter, r *http.Request) {
+	list, err := h.Docs.listSavedSearches(h.userID(r), "")
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	if list == nil {
+		list = []model.SavedSearch{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GetSavedSearch handles GET /api/v1/saved-searches/{id}.
+func (h *APIHandler) GetSavedSearch(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	h.writeSavedSearch(w, http.StatusOK, h.userID(r), id)
+}
+
+// CreateSavedSearch handles POST /api/v1/saved-searches with a body such as
+// {"name": "Unpaid", "query": "tag:invoice -tag:paid", "pinned": true}.
+func (h *APIHandler) CreateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	var req model.SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	userID := h.userID(r)
+	id, err := h.Docs.createSavedSearch(userID, req)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/saved-searches/"+strconv.Itoa(id))
+	h.writeSavedSearch(w, http.StatusCreated, userID, id)
+}
+
+// UpdateSavedSearch handles PATCH /api/v1/saved-searches/{id}.
+func (h *APIHandler) UpdateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var update savedSearchUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	userID := h.userID(r)
+	if err := h.Docs.updateSavedSearch(userID, id, update); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	h.writeSavedSearch(w, http.StatusOK, userID, id)
+}
+
+// DeleteSavedSearch handles DELETE /api/v1/saved-searches/{id}.
+func (h *APIHandler) DeleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := h.Docs.deleteSavedSearch(h.userID(r), id); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SavedSearchDocuments handles GET /api/v1/saved-searches/{id}/documents,
+// which runs the saved search. It accepts the page, per_page, after and before
+// parameters of ListDocuments.
+func (h *APIHandler) SavedSearchDocuments(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	userID := h.userID(r)
+	s, err := h.Docs.getSavedSearch(userID, id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	page, _ := strconv.Atoi(q.Get("page"))
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	list, err := h.Docs.listDocuments(userID, listOptions{
+		Query:    s.Query,
+		Sort:     s.Sort,
+		Filters:  s.Filters,
+		Page:     page,
+		PerPage:  perPage,
+		After:    q.Get("after"),
+		Before:   q.Get("before"),
+		Snippets: true,
+	})
+	var queryErr *search.Error
+	if errors.As(err, &queryErr) {
+		writeJSONError(w, http.StatusConflict, "saved query is no longer valid: "+queryErr.Error())
+		return
+	}
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *APIHandler) writeSavedSearch(w http.ResponseWriter, status int, userID, id int) {
+	s, err := h.Docs.getSavedSearch(userID, id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, status, s)
+}
+
+// Export handles GET /api/v1/export (see DocumentHandler.Export).
+func (h *APIHandler) Export(w http.ResponseWriter, r *http.Request) {
+	export, err := h.Docs.exportAccount(h.userID(r))
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, export)
+}
+
+// SimilarDocuments handles GET /api/v1/documents/{id}/similar.
+func (h *APIHandler) SimilarDocuments(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	similar, err := h.Docs.similarDocuments(h.userID(r), id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	if similar == nil {
+		similar = []model.SimilarDocument{}
+	}
+	writeJSON(w, http.StatusOK, similar)
+}
+
+// ListDuplicates handles GET /api/v1/duplicates, which lists pairs of
+// documents that are probably the same paper.
+func (h *APIHandler) ListDuplicates(w http.ResponseWriter, r *http.Request) {
+	pairs, err := h.Docs.duplicatePairs(h.userID(r))
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pairs)
+}
+
+type duplicateRequest struct {
+	Keep       int `json:"keep"`
+	Remove     int `json:"remove"`
+	DocumentID int `json:"document_id"`
+	OtherID    int `json:"other_id"`
+}
+
+// MergeDuplicates handles POST /api/v1/duplicates/merge, which merges the
+// document "remove" into "keep" and returns the kept document.
+func (h *APIHandler) MergeDuplicates(w http.ResponseWriter, r *http.Request) {
+	var req duplicateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	userID := h.userID(r)
+	if err := h.Docs.mergeDocuments(userID, req.Keep, req.Remove); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	h.writeDocument(w, userID, req.Keep)
+}
+
+// DismissDuplicate handles POST /api/v1/duplicates/dismiss, which marks
+// "document_id" and "other_id" as different documents.
+func (h *APIHandler) DismissDuplicate(w http.ResponseWriter, r *http.Request) {
+	var req duplicateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if err := h.Docs.dismissDuplicate(h.userID(r), req.DocumentID, req.OtherID); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListRejectedUploads handles GET /api/v1/rejected-uploads, the most recent
+// uploads that were not stored because they duplicate an existing document.
+func (h *APIHandler) ListRejectedUploads(w http.ResponseWriter, r *http.Request) {
+	list, err := h.Docs.listRejectedUploads(h.userID(r), rejectedUploadsShown)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// StoreRejectedUpload handles POST /api/v1/rejected-uploads/{id}/store, which
+// stores a rejected upload as a new version of the document it duplicates
+// and returns the new document.
+func (h *APIHandler) StoreRejectedUpload(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	userID := h.userID(r)
+	docID, err := h.Docs.storeRejectedUpload(userID, id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	doc, err := h.Docs.getDocument(userID, int(docID))
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/documents/"+strconv.FormatInt(docID, 10))
+	writeJSON(w, http.StatusCreated, documentResponse{Document: doc, Tags: []model.Tag{}})
+}
+
+// DiscardRejectedUpload handles DELETE /api/v1/rejected-uploads/{id}, which
+// deletes the kept file. The record stays in the list.
+func (h *APIHandler) DiscardRejectedUpload(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := h.Docs.discardRejectedUpload(h.userID(r), id); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// QueueStatus handles GET /api/v1/queue.
+func (h *APIHandler) QueueStatus(w http.ResponseWriter, r *http.Request) {
+	userID := h.userID(r)
+	docs, err := h.Docs.pendingDocuments(userID)
+	if err != nil {
+		log.Printf("API error retrieving queue for user %d: %v", userID, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to retrieve queue")
+		return
+	}
+	if docs == nil {
+		docs = []model.Document{}
+	}
+	writeJSON(w, http.StatusOK, queueResponse{Stats: h.Docs.queueStats(userID), Documents: docs})
+}
+
+// DocumentHistory handles GET /api/v1/documents/{id}/history.
+func (h *APIHandler) DocumentHistory(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	events, err := h.Docs.statusHistory(h.userID(r), id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	if events == nil {
+		events = []model.StatusEvent{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// RetryDocument handles POST /api/v1/documents/{id}/retry.
+func (h *APIHandler) RetryDocument(w http.ResponseWriter, r *http.Request) {
+	h.documentAction(w, r, "retry", ReprocessOptions{})
+}
+
+// CancelDocument handles POST /api/v1/documents/{id}/cancel.
+func (h *APIHandler) CancelDocument(w http.ResponseWriter, r *http.Request) {
+	h.documentAction(w, r, "cancel", ReprocessOptions{})
+}
+
+// ReprocessDocument handles POST /api/v1/documents/{id}/reprocess. The
+// optional JSON body selects the steps; by default OCR and analysis are rerun
+// and user edits are kept.
+func (h *APIHandler) ReprocessDocument(w http.ResponseWriter, r *http.Request) {
+	opts := ReprocessOptions{OCR: true, LLM: true, KeepEdits: true}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	}
+	h.documentAction(w, r, "reprocess", opts)
+}
+
+func (h *APIHandler) documentAction(w http.ResponseWriter, r *http.Request, action string, opts ReprocessOptions) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	userID := h.userID(r)
+	if err := h.Docs.documentAction(userID, id, action, opts); err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	doc, err := h.Docs.getDocument(userID, id)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// BulkAction handles POST /api/v1/documents/actions. Each document is handled
+// on its own; the response lists the outcome per ID.
+func (h *APIHandler) BulkAction(w http.ResponseWriter, r *http.Request) {
+	req := bulkActionRequest{ReprocessOptions: ReprocessOptions{OCR: true, LLM: true, KeepEdits: true}}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	switch req.Action {
+	case "retry", "cancel", "reprocess":
+	default:
+		writeJSONError(w, http.StatusBadRequest, "action must be retry, cancel or reprocess")
+		return
+	}
+	if len(req.IDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "ids must not be empty")
+		return
+	}
+
+	userID := h.userID(r)
+	results := make([]bulkActionResult, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		result := bulkActionResult{ID: id, OK: true}
+		err := h.Docs.documentAction(userID, id, req.Action, req.ReprocessOptions)
+		var conflict *conflictError
+		switch {
+		case err == nil:
+		case err == errDocumentNotFound:
+			result.OK, result.Error = false, "document not found"
+		case errors.As(err, &conflict):
+			result.OK, result.Error = false, conflict.msg
+		default:
+			log.Printf("API error running %s for document %d: %v", req.Action, id, err)
+			result.OK, result.Error = false, "internal server error"
+		}
+		results = append(results, result)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
@@ -2,25 +2,59 @@ package handler
 
 import (
 	"database/sql"
+	"dokeep/internal/auth"
+	"dokeep/internal/model"
+	"dokeep/internal/passkey"
+	"dokeep/internal/sso"
 	"dokeep/web/template"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"github.com/skip2/go-qrcode"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	DB      *sql.DB
-	Session *scs.SessionManager
+	DB       *sql.DB
+	Session  *scs.SessionManager
+	Throttle *auth.Throttle
+	Passkeys *passkey.Service
+	// Authenticator checks passwords at sign-in. It is nil if password
+	// sign-in is turned off.
+	Authenticator auth.Authenticator
+	// SSO is nil unless single sign-on is enabled.
+	SSO *sso.Provider
+	// Directory, if set, is asked at every sign-in whether the user may
+	// still sign in.
+	Directory auth.Directory
+	// DisablePassword turns off registration and Dokeep's own passwords.
+	DisablePassword bool
 }
 
+// recentFailuresShown is the number of failed sign-in attempts listed on the
+// settings page.
+const recentFailuresShown = 10
+
 func (h *AuthHandler) ShowRegistrationForm(w http.ResponseWriter, r *http.Request) {
+	if h.DisablePassword {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 	template.RegisterPage().Render(r.Context(), w)
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
+	if h.DisablePassword {
+		http.Error(w, "Accounts are created at single sign-on", http.StatusForbidden)
+		return
+	}
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
@@ -46,10 +80,18 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *AuthHandler) ShowLoginForm(w http.ResponseWriter, r *http.Request) {
-	template.LoginPage().Render(r.Context(), w)
+	ssoName := ""
+	if h.SSO != nil {
+		ssoName = h.SSO.Config.Name
+	}
+	template.LoginPage(h.Authenticator != nil, !h.DisablePassword, ssoName).Render(r.Context(), w)
 }
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	if h.Authenticator == nil {
+		http.Error(w, "Password sign-in is disabled. Use single sign-on.", http.StatusForbidden)
+		return
+	}
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
@@ -57,42 +99,58 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
+	ip := h.Throttle.ClientIP(r)
+	attempt, ok := h.allowAttempt(w, username, ip, auth.AttemptPassword)
+	if !ok {
+		return
+	}
 
-	var storedPasswordHash string
-	var userID int
-	var totpEnabled bool
-	err := h.DB.QueryRow("SELECT id, password_hash, totp_enabled FROM users WHERE username = $1", username).Scan(&userID, &storedPasswordHash, &totpEnabled)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
-		} else {
-			http.Error(w, "Database error", http.StatusInternalServerError)
+	userID, err := h.Authenticator.Authenticate(username, password)
+	if errors.Is(err, auth.ErrInvalidCredentials) || errors.Is(err, auth.ErrUnknownUser) {
+		// Attribute the failure to the account if there is one
+		var knownID int
+		if err := h.DB.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&knownID); err != nil && err != sql.ErrNoRows {
+			log.Printf("Error looking up user %q: %v", username, err)
 		}
+		h.recordFailure(attempt, username, knownID, auth.AttemptPassword)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	var local *auth.LocalAccountError
+	if errors.As(err, &local) {
+		h.discardAttempt(attempt)
+		http.Error(w, "Could not sign in: "+local.Error()+". Ask an administrator to link it.", http.StatusForbidden)
 		return
 	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(storedPasswordHash), []byte(password))
 	if err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		h.discardAttempt(attempt)
+		http.Error(w, "Sign-in is not available right now", http.StatusInternalServerError)
 		return
 	}
 
-	// Store temporary user ID for TOTP verification
-	h.Session.Put(r.Context(), "tempUserID", userID)
-
-	if totpEnabled {
-		http.Redirect(w, r, "/verify-totp", http.StatusSeeOther)
+	var secondFactor bool
+	err = h.DB.QueryRow(`
+		SELECT totp_enabled OR EXISTS (SELECT 1 FROM passkeys p WHERE p.user_id = users.id)
+		FROM users WHERE id = $1`, userID).Scan(&secondFactor)
+	if err != nil {
+		h.discardAttempt(attempt)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
-	if err := h.Session.RenewToken(r.Context()); err != nil {
-		http.Error(w, "Failed to renew session token", http.StatusInternalServerError)
+	if secondFactor {
+		// The password only counts once the second factor is given too
+		h.discardAttempt(attempt)
+		// Store temporary user ID for the TOTP code or passkey. It is only
+		// valid for a short time, so a known password does not give
+		// unlimited time to guess the code.
+		h.Session.Put(r.Context(), "tempUserID", userID)
+		h.Session.Put(r.Context(), "tempUserSince", time.Now())
+		http.Redirect(w, r, "/verify-totp", http.StatusSeeOther)
 		return
 	}
 
-	h.Session.Remove(r.Context(), "tempUserID")
-	h.Session.Put(r.Context(), "userID", userID)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	h.completeLogin(w, r, attempt, userID, username, ip, auth.AttemptPassword)
 }
 
 func (h *AuthHandler) VerifyTOTP(w http.ResponseWriter, r *http.Request) {
@@ -102,46 +160,176 @@ func (h *AuthHandler) VerifyTOTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	totpCode := r.FormValue("totp_code")
-	userID := h.Session.GetInt(r.Context(), "tempUserID")
+	userID := h.pendingUser(r)
+	if userID == 0 {
+		http.Error(w, "Your sign-in has expired. Please sign in again.", http.StatusUnauthorized)
+		return
+	}
 
-	var secret string
-	err := h.DB.QueryRow("SELECT totp_secret FROM users WHERE id = $1", userID).Scan(&secret)
+	var username, secret string
+	var totpEnabled bool
+	err := h.DB.QueryRow("SELECT username, totp_enabled, coalesce(totp_secret, '') FROM users WHERE id = $1", userID).Scan(&username, &totpEnabled, &secret)
 	if err != nil {
 		http.Error(w, "Failed to retrieve user data", http.StatusInternalServerError)
 		return
 	}
+	if !totpEnabled {
+		http.Error(w, "Two-factor codes are not enabled for this account. Use your passkey.", http.StatusBadRequest)
+		return
+	}
+	ip := h.Throttle.ClientIP(r)
+	attempt, ok := h.allowAttempt(w, username, ip, auth.AttemptTOTP)
+	if !ok {
+		return
+	}
 
-	valid := totp.Validate(totpCode, secret)
+	// A lost device can be replaced by one of the one-time recovery codes
+	kind := auth.AttemptTOTP
+	var valid bool
+	if auth.IsRecoveryCode(totpCode) {
+		kind = auth.AttemptRecoveryCode
+		valid, err = auth.UseRecoveryCode(h.DB, userID, totpCode)
+		if err != nil {
+			h.discardAttempt(attempt)
+			http.Error(w, "Failed to check recovery code", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		valid = totp.Validate(totpCode, secret)
+	}
 	if !valid {
+		h.recordFailure(attempt, username, userID, kind)
 		http.Error(w, "Invalid TOTP code", http.StatusBadRequest)
 		return
 	}
 
+	h.completeLogin(w, r, attempt, userID, username, ip, kind)
+}
+
+// ShowVerifyTOTPForm handles GET /verify-totp, which asks for the second
+// factor the user has set up.
+func (h *AuthHandler) ShowVerifyTOTPForm(w http.ResponseWriter, r *http.Request) {
+	userID := h.pendingUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	var totpEnabled bool
+	if err := h.DB.QueryRow("SELECT totp_enabled FROM users WHERE id = $1", userID).Scan(&totpEnabled); err != nil {
+		http.Error(w, "Failed to retrieve user data", http.StatusInternalServerError)
+		return
+	}
+	passkeys, err := h.Passkeys.Count(userID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve user data", http.StatusInternalServerError)
+		return
+	}
+	template.VerifyTOTPPage(totpEnabled, passkeys > 0).Render(r.Context(), w)
+}
+
+// allowAttempt records a sign-in attempt and refuses it while the account or
+// client address has to wait after failed attempts.
+func (h *AuthHandler) allowAttempt(w http.ResponseWriter, username, ip, kind string) (int64, bool) {
+	attempt, wait, err := h.Throttle.Begin(username, ip, kind)
+	if err != nil {
+		log.Printf("Error checking sign-in attempts for %q from %s: %v", username, ip, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if wait <= 0 {
+		return attempt, true
+	}
+	seconds := int(wait.Round(time.Second).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many failed sign-in attempts. Try again in "+(time.Duration(seconds)*time.Second).String()+".", http.StatusTooManyRequests)
+	return 0, false
+}
+
+func (h *AuthHandler) recordFailure(attempt int64, username string, userID int, kind string) {
+	if err := h.Throttle.Fail(attempt, username, userID, kind); err != nil {
+		log.Printf("Error recording failed sign-in for %q: %v", username, err)
+	}
+}
+
+func (h *AuthHandler) discardAttempt(attempt int64) {
+	if err := h.Throttle.Discard(attempt); err != nil {
+		log.Printf("Error discarding sign-in attempt %d: %v", attempt, err)
+	}
+}
+
+// completeLogin signs the user in after the last required step succeeded.
+// attempt is the step's attempt from allowAttempt, or zero if it was not
+// throttled.
+func (h *AuthHandler) completeLogin(w http.ResponseWriter, r *http.Request, attempt int64, userID int, username, ip, kind string) {
+	if h.Directory != nil {
+		err := h.Directory.Allowed(userID)
+		if errors.Is(err, auth.ErrAccountDisabled) {
+			if attempt != 0 {
+				h.recordFailure(attempt, username, userID, kind)
+			}
+			http.Error(w, "Could not sign in: "+err.Error()+".", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking the directory for %q: %v", username, err)
+			if attempt != 0 {
+				h.discardAttempt(attempt)
+			}
+			http.Error(w, "Sign-in is not available right now", http.StatusInternalServerError)
+			return
+		}
+	}
 	if err := h.Session.RenewToken(r.Context()); err != nil {
+		if attempt != 0 {
+			h.discardAttempt(attempt)
+		}
 		http.Error(w, "Failed to renew session token", http.StatusInternalServerError)
 		return
 	}
+	if err := h.Throttle.Succeed(attempt, username, userID, ip, kind); err != nil {
+		log.Printf("Error recording sign-in for %q: %v", username, err)
+	}
 
 	h.Session.Remove(r.Context(), "tempUserID")
+	h.Session.Remove(r.Context(), "tempUserSince")
 	h.Session.Put(r.Context(), "userID", userID)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (h *AuthHandler) ShowSetupTOTPForm(w http.ResponseWriter, r *http.Request) {
+// EnrollTOTP handles POST /settings/totp/enroll. After the password is
+// confirmed it generates a new secret, which only replaces the current one
+// once a code from the new device has been verified on /setup-totp.
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := h.Session.GetInt(r.Context(), "userID")
+	username, ok := h.confirmPassword(w, r, userID)
+	if !ok {
+		return
+	}
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      "Dokeep",
-		AccountName: "user@dokeep.com", // This should be dynamic based on the logged-in user
+		AccountName: username,
 	})
 	if err != nil {
 		http.Error(w, "Failed to generate TOTP key", http.StatusInternalServerError)
 		return
 	}
 
-	// Store the secret in the session for verification
-	h.Session.Put(r.Context(), "totpSecret", key.Secret())
+	// Keep the new key in the session until it is verified
+	h.Session.Put(r.Context(), "totp_key_url", key.URL())
+	http.Redirect(w, r, "/setup-totp", http.StatusSeeOther)
+}
 
-	var png []byte
-	png, err = qrcode.Encode(key.URL(), qrcode.Medium, 256)
+func (h *AuthHandler) ShowSetupTOTPForm(w http.ResponseWriter, r *http.Request) {
+	keyURL := h.Session.GetString(r.Context(), "totp_key_url")
+	if keyURL == "" {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	png, err := qrcode.Encode(keyURL, qrcode.Medium, 256)
 	if err != nil {
 		http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
 		return
@@ -156,11 +344,12 @@ func (h *AuthHandler) SetupTOTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	secret := h.Session.GetString(r.Context(), "totp_secret")
-	if secret == "" {
+	key, err := otp.NewKeyFromURL(h.Session.GetString(r.Context(), "totp_key_url"))
+	if err != nil {
 		http.Error(w, "Could not find TOTP secret. Please try again.", http.StatusBadRequest)
 		return
 	}
+	secret := key.Secret()
 
 	code := r.FormValue("totp_code")
 	valid := totp.Validate(code, secret)
@@ -170,18 +359,190 @@ func (h *AuthHandler) SetupTOTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID := h.Session.GetInt(r.Context(), "userID")
-	_, err := h.DB.Exec("UPDATE users SET totp_secret = $1, totp_enabled = TRUE WHERE id = $2", secret, userID)
+	_, err = h.DB.Exec("UPDATE users SET totp_secret = $1, totp_enabled = TRUE WHERE id = $2", secret, userID)
 	if err != nil {
 		http.Error(w, "Failed to save TOTP secret", http.StatusInternalServerError)
 		return
 	}
+	h.Session.Remove(r.Context(), "totp_key_url")
+
+	codes, err := auth.NewRecoveryCodes(h.DB, userID)
+	if err != nil {
+		log.Printf("Error creating recovery codes for user %d: %v", userID, err)
+		http.Error(w, "Two-factor authentication is enabled, but recovery codes could not be created. Generate them on the settings page.", http.StatusInternalServerError)
+		return
+	}
+	template.RecoveryCodesPage(codes).Render(r.Context(), w)
+}
+
+// RegenerateRecoveryCodes handles POST /settings/totp/recovery-codes. The
+// previous codes stop working.
+func (h *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := h.Session.GetInt(r.Context(), "userID")
+	if _, ok := h.confirmPassword(w, r, userID); !ok {
+		return
+	}
+	var enabled bool
+	if err := h.DB.QueryRow("SELECT totp_enabled FROM users WHERE id = $1", userID).Scan(&enabled); err != nil {
+		http.Error(w, "Failed to retrieve user data", http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	codes, err := auth.NewRecoveryCodes(h.DB, userID)
+	if err != nil {
+		log.Printf("Error creating recovery codes for user %d: %v", userID, err)
+		http.Error(w, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	template.RecoveryCodesPage(codes).Render(r.Context(), w)
+}
 
-	h.Session.Put(r.Context(), "totp_enabled", true)
-	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+// DisableTOTP handles POST /settings/totp/disable.
+func (h *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID := h.Session.GetInt(r.Context(), "userID")
+	if _, ok := h.confirmPassword(w, r, userID); !ok {
+		return
+	}
+	if err := auth.ResetTwoFactor(h.DB, userID); err != nil {
+		log.Printf("Error disabling two-factor authentication for user %d: %v", userID, err)
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// confirmPassword checks the "current_password" form value before a change
+// to the user's second factor and returns the username.
+func (h *AuthHandler) confirmPassword(w http.ResponseWriter, r *http.Request, userID int) (string, bool) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return "", false
+	}
+
+	var username string
+	err := h.DB.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username)
+	if err != nil {
+		http.Error(w, "Failed to retrieve user data", http.StatusInternalServerError)
+		return "", false
+	}
+	if h.Authenticator == nil {
+		http.Error(w, "This account has no password", http.StatusUnauthorized)
+		return "", false
+	}
+	// The password is checked where sign-in checks it, e.g. in LDAP
+	id, err := h.Authenticator.Authenticate(username, r.FormValue("current_password"))
+	if err != nil && !errors.Is(err, auth.ErrInvalidCredentials) && !errors.Is(err, auth.ErrUnknownUser) {
+		http.Error(w, "Failed to check password", http.StatusInternalServerError)
+		return "", false
+	}
+	if err != nil || id != userID {
+		http.Error(w, "Incorrect current password", http.StatusUnauthorized)
+		return "", false
+	}
+	return username, true
 }
 
 func (h *AuthHandler) ShowSettingsPage(w http.ResponseWriter, r *http.Request) {
-	template.SettingsPage().Render(r.Context(), w)
+	userID := h.Session.GetInt(r.Context(), "userID")
+
+	tokens, err := auth.ListTokens(h.DB, userID)
+	if err != nil {
+		log.Printf("Error listing API tokens for user %d: %v", userID, err)
+		// Non-fatal, the rest of the settings page still works
+	}
+
+	// A freshly created token is only shown once.
+	newToken := h.Session.PopString(r.Context(), "new_api_token")
+
+	failures, err := h.Throttle.RecentFailures(userID, time.Now().AddDate(0, 0, -30), recentFailuresShown)
+	if err != nil {
+		log.Printf("Error listing failed sign-ins for user %d: %v", userID, err)
+	}
+
+	var twoFactor model.TwoFactorStatus
+	if err := h.DB.QueryRow("SELECT totp_enabled FROM users WHERE id = $1", userID).Scan(&twoFactor.Enabled); err != nil {
+		log.Printf("Error reading two-factor status for user %d: %v", userID, err)
+	}
+	if twoFactor.Enabled {
+		if twoFactor.RecoveryCodesLeft, err = auth.RecoveryCodesLeft(h.DB, userID); err != nil {
+			log.Printf("Error counting recovery codes for user %d: %v", userID, err)
+		}
+	}
+
+	passkeys, err := h.Passkeys.List(userID)
+	if err != nil {
+		log.Printf("Error listing passkeys for user %d: %v", userID, err)
+	}
+
+	var singleSignOn model.SingleSignOnStatus
+	if h.SSO != nil {
+		singleSignOn = model.SingleSignOnStatus{Enabled: true, Name: h.SSO.Config.Name}
+		if singleSignOn.Identity, err = sso.Linked(h.DB, userID, h.SSO.Config.Issuer); err != nil {
+			log.Printf("Error reading linked account for user %d: %v", userID, err)
+		}
+	}
+
+	template.SettingsPage(tokens, newToken, failures, twoFactor, passkeys, singleSignOn).Render(r.Context(), w)
+}
+
+// CreateToken issues a new personal access token for the logged-in user.
+func (h *AuthHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+	scope := r.FormValue("scope")
+	if !auth.ValidScope(scope) {
+		http.Error(w, "Invalid token scope", http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt *time.Time
+	if days, _ := strconv.Atoi(r.FormValue("expires_in_days")); days > 0 {
+		t := time.Now().AddDate(0, 0, days)
+		expiresAt = &t
+	}
+
+	userID := h.Session.GetInt(r.Context(), "userID")
+	raw, err := auth.CreateToken(h.DB, userID, name, scope, expiresAt)
+	if err != nil {
+		log.Printf("Error creating API token for user %d: %v", userID, err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	h.Session.Put(r.Context(), "new_api_token", raw)
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// RevokeToken revokes one of the logged-in user's tokens.
+func (h *AuthHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := h.Session.GetInt(r.Context(), "userID")
+	if err := auth.RevokeToken(h.DB, userID, tokenID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Token not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
 }
 
 func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
@@ -195,11 +556,16 @@ func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	userID := h.Session.GetInt(r.Context(), "userID")
 
 	var storedPasswordHash string
-	err := h.DB.QueryRow("SELECT password_hash FROM users WHERE id = $1", userID).Scan(&storedPasswordHash)
+	var directory bool
+	err := h.DB.QueryRow("SELECT password_hash, ldap_dn IS NOT NULL FROM users WHERE id = $1", userID).Scan(&storedPasswordHash, &directory)
 	if err != nil {
 		http.Error(w, "Failed to retrieve user data", http.StatusInternalServerError)
 		return
 	}
+	if directory {
+		http.Error(w, "Your password is managed in the company directory", http.StatusConflict)
+		return
+	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(storedPasswordHash), []byte(currentPassword))
 	if err != nil {
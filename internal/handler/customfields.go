@@ -0,0 +1,465 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dokeep/internal/customfield"
+	"dokeep/internal/model"
+	"dokeep/web/template"
+
+	"github.com/lib/pq"
+)
+
+// errFieldNotFound is returned when a custom field does not exist or is not
+// owned by the requesting user.
+var errFieldNotFound = errors.New("custom field not found")
+
+// customFieldUpdate holds the definition fields that can be changed. Nil
+// fields keep their current value.
+type customFieldUpdate struct {
+	Name    *string   `json:"name"`
+	Type    *string   `json:"type"`
+	Options *[]string `json:"options"`
+}
+
+const customFieldColumns = `f.id, f.name, f.key, f.type, f.options,
+	(SELECT COUNT(*) FROM custom_field_values WHERE field_id = f.id)`
+
+func scanCustomField(row interface{ Scan(...interface{}) error }) (model.CustomField, error) {
+	var f model.CustomField
+	err := row.Scan(&f.ID, &f.Name, &f.Key, &f.Type, pq.Array(&f.Options), &f.DocumentCount)
+	return f, err
+}
+
+// listCustomFields returns the user's custom field definitions.
+func (h *DocumentHandler) listCustomFields(userID int) ([]model.CustomField, error) {
+	rows, err := h.DB.Query(`SELECT `+customFieldColumns+` FROM custom_fields f WHERE f.user_id = $1 ORDER BY lower(f.name)`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fields []model.CustomField
+	for rows.Next() {
+		f, err := scanCustomField(rows)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+// customFieldsByKey returns the user's custom fields indexed by key, as
+// expected by search.Parse.
+func (h *DocumentHandler) customFieldsByKey(userID int) (map[string]model.CustomField, error) {
+	fields, err := h.listCustomFields(userID)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]model.CustomField, len(fields))
+	for _, f := range fields {
+		byKey[f.Key] = f
+	}
+	return byKey, nil
+}
+
+// getCustomField returns one of the user's custom fields.
+func (h *DocumentHandler) getCustomField(userID, id int) (model.CustomField, error) {
+	f, err := scanCustomField(h.DB.QueryRow(`SELECT `+customFieldColumns+` FROM custom_fields f WHERE f.id = $1 AND f.user_id = $2`, id, userID))
+	if err == sql.ErrNoRows {
+		return f, errFieldNotFound
+	}
+	return f, err
+}
+
+// checkCustomField normalizes a definition and checks that it is complete.
+func checkCustomField(f *model.CustomField) error {
+	f.Name = customfield.NormalizeName(f.Name)
+	f.Key = customfield.Key(f.Name)
+	if f.Key == "" {
+		return &conflictError{"the name must contain letters or digits"}
+	}
+	if !customfield.ValidType(f.Type) {
+		return &conflictError{fmt.Sprintf("unknown field type %q (expected one of %s)", f.Type, strings.Join(customfield.Types, ", "))}
+	}
+	if f.Type == customfield.Select {
+		f.Options = customfield.NormalizeOptions(f.Options)
+		if len(f.Options) == 0 {
+			return &conflictError{"a select field needs at least one option"}
+		}
+	} else {
+		f.Options = []string{}
+	}
+	return nil
+}
+
+// customFieldNameError turns a unique violation into a conflict.
+func customFieldNameError(f model.CustomField, err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return &conflictError{fmt.Sprintf("a field named %q (or with the key %q) already exists", f.Name, f.Key)}
+	}
+	return err
+}
+
+// createCustomField adds a custom field definition and returns its ID.
+func (h *DocumentHandler) createCustomField(userID int, f model.CustomField) (int, error) {
+	if err := checkCustomField(&f); err != nil {
+		return 0, err
+	}
+	var id int
+	err := h.DB.QueryRow("INSERT INTO custom_fields (user_id, name, key, type, options) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		userID, f.Name, f.Key, f.Type, pq.Array(f.Options)).Scan(&id)
+	return id, customFieldNameError(f, err)
+}
+
+// updateCustomField changes a custom field definition. When the type or the
+// options change, every stored value is checked against the new definition
+// and rewritten in its canonical form; if any value does not fit, nothing is
+// changed and the error names an offending document.
+func (h *DocumentHandler) updateCustomField(userID, id int, u customFieldUpdate) error {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var f model.CustomField
+	err = tx.QueryRow("SELECT id, name, key, type, options FROM custom_fields WHERE id = $1 AND user_id = $2 FOR UPDATE", id, userID).
+		Scan(&f.ID, &f.Name, &f.Key, &f.Type, pq.Array(&f.Options))
+	if err == sql.ErrNoRows {
+		return errFieldNotFound
+	}
+	if err != nil {
+		return err
+	}
+	oldType, oldOptions := f.Type, strings.Join(f.Options, "\x00")
+
+	if u.Name != nil {
+		f.Name = *u.Name
+	}
+	if u.Type != nil {
+		f.Type = *u.Type
+	}
+	if u.Options != nil {
+		f.Options = *u.Options
+	}
+	if err := checkCustomField(&f); err != nil {
+		return err
+	}
+
+	if f.Type != oldType || strings.Join(f.Options, "\x00") != oldOptions {
+		if err := revalidateValues(tx, f); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE custom_fields SET name = $1, key = $2, type = $3, options = $4 WHERE id = $5",
+		f.Name, f.Key, f.Type, pq.Array(f.Options), f.ID)
+	if err != nil {
+		return customFieldNameError(f, err)
+	}
+	return tx.Commit()
+}
+
+// revalidateValues converts the stored values of a field to its new
+// definition.
+func revalidateValues(tx *sql.Tx, f model.CustomField) error {
+	rows, err := tx.Query("SELECT document_id, value FROM custom_field_values WHERE field_id = $1 ORDER BY document_id", f.ID)
+	if err != nil {
+		return err
+	}
+	type change struct {
+		documentID int
+		value      string
+	}
+	var changes []change
+	invalid, firstDoc, firstValue := 0, 0, ""
+	for rows.Next() {
+		var c change
+		var old string
+		if err := rows.Scan(&c.documentID, &old); err != nil {
+			rows.Close()
+			return err
+		}
+		value, err := customfield.Value(f, old)
+		if err != nil || value == "" {
+			if invalid == 0 {
+				firstDoc, firstValue = c.documentID, old
+			}
+			invalid++
+			continue
+		}
+		if value != old {
+			c.value = value
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return &conflictError{fmt.Sprintf("%d document(s) have values that are not valid for a %s field, such as %q on document %d", invalid, f.Type, firstValue, firstDoc)}
+	}
+
+	for _, c := range changes {
+		if _, err := tx.Exec("UPDATE custom_field_values SET value = $1 WHERE document_id = $2 AND field_id = $3", c.value, c.documentID, f.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCustomField removes a custom field and its values.
+func (h *DocumentHandler) deleteCustomField(userID, id int) error {
+	res, err := h.DB.Exec("DELETE FROM custom_fields WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errFieldNotFound
+	}
+	return nil
+}
+
+// customFieldValues returns the custom field values of the given documents,
+// keyed by document ID.
+func (h *DocumentHandler) customFieldValues(documentIDs []int) (map[int][]model.CustomFieldValue, error) {
+	values := make(map[int][]model.CustomFieldValue)
+	if len(documentIDs) == 0 {
+		return values, nil
+	}
+	rows, err := h.DB.Query(`
+		SELECT v.document_id, f.id, f.name, f.key, f.type, v.value
+		FROM custom_field_values v
+		JOIN custom_fields f ON f.id = v.field_id
+		WHERE v.document_id = ANY($1)
+		ORDER BY lower(f.name)`, pq.Array(documentIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var documentID int
+		var v model.CustomFieldValue
+		if err := rows.Scan(&documentID, &v.FieldID, &v.Name, &v.Key, &v.Type, &v.Value); err != nil {
+			return nil, err
+		}
+		values[documentID] = append(values[documentID], v)
+	}
+	return values, rows.Err()
+}
+
+// setCustomFieldValues validates and stores custom field values for a
+// document owned by the user. values maps field IDs to raw input; an empty
+// value removes the field from the document. Fields not in values are left
+// alone. Nothing is stored unless every value is valid.
+func (h *DocumentHandler) setCustomFieldValues(userID, documentID int, values map[int]string) error {
+	if err := h.ownsDocument(userID, documentID); err != nil {
+		return err
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Validate against definitions that cannot change or disappear before
+	// the values are stored
+	rows, err := tx.Query(`SELECT `+customFieldColumns+` FROM custom_fields f WHERE f.user_id = $1 FOR SHARE OF f`, userID)
+	if err != nil {
+		return err
+	}
+	byID := make(map[int]model.CustomField)
+	for rows.Next() {
+		f, err := scanCustomField(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		byID[f.ID] = f
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	canonical, err := customFieldValues(byID, values)
+	if err != nil {
+		return err
+	}
+
+	for id, value := range canonical {
+		if value == "" {
+			_, err = tx.Exec("DELETE FROM custom_field_values WHERE document_id = $1 AND field_id = $2", documentID, id)
+		} else {
+			_, err = tx.Exec(`
+				INSERT INTO custom_field_values (document_id, field_id, value) VALUES ($1, $2, $3)
+				ON CONFLICT (document_id, field_id) DO UPDATE SET value = EXCLUDED.value`, documentID, id, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// customFieldValues validates raw values, keyed by field ID, against the
+// fields and returns them in canonical form. The error names every invalid
+// value.
+func customFieldValues(fields map[int]model.CustomField, values map[int]string) (map[int]string, error) {
+	canonical := make(map[int]string, len(values))
+	var problems []string
+	for id, raw := range values {
+		f, ok := fields[id]
+		if !ok {
+			return nil, &conflictError{fmt.Sprintf("unknown custom field %d", id)}
+		}
+		value, err := customfield.Value(f, raw)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		canonical[id] = value
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, &conflictError{strings.Join(problems, "; ")}
+	}
+	return canonical, nil
+}
+
+// customSortSQL returns an ORDER BY expression for a custom field. The cast
+// only applies to the field's own values, as in search.
+func customSortSQL(f model.CustomField, args []interface{}) (string, []interface{}) {
+	args = append(args, f.ID)
+	value := fmt.Sprintf("CASE WHEN v.field_id = $%d THEN v.value END", len(args))
+	return fmt.Sprintf("(SELECT %s FROM custom_field_values v WHERE v.document_id = d.id AND v.field_id = $%d)",
+		customfield.SortExpr(f.Type, value), len(args)), args
+}
+
+// CustomFields handles GET /custom-fields, the page for managing custom
+// field definitions.
+func (h *DocumentHandler) CustomFields(w http.ResponseWriter, r *http.Request) {
+	userID := h.userID(r)
+	fields, err := h.listCustomFields(userID)
+	if err != nil {
+		log.Printf("Error listing custom fields for user %d: %v", userID, err)
+		http.Error(w, "Failed to list custom fields", http.StatusInternalServerError)
+		return
+	}
+	username := h.Session.GetString(r.Context(), "username")
+	if err := template.CustomFieldsPage(username, fields, customfield.Types, h.Session.PopString(r.Context(), "flash_error")).Render(r.Context(), w); err != nil {
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
+
+// splitOptions reads the options of a select field from a form, one per line
+// or separated by commas.
+func splitOptions(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' })
+}
+
+// CreateCustomField handles POST /custom-fields.
+func (h *DocumentHandler) CreateCustomField(w http.ResponseWriter, r *http.Request) {
+	_, err := h.createCustomField(h.userID(r), model.CustomField{
+		Name:    r.FormValue("name"),
+		Type:    r.FormValue("type"),
+		Options: splitOptions(r.FormValue("options")),
+	})
+	h.finishCustomFieldAction(w, r, "create", err)
+}
+
+// UpdateCustomField handles POST /custom-fields/{id}.
+func (h *DocumentHandler) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
+	id, ok := entityPathID(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	name, fieldType, options := r.FormValue("name"), r.FormValue("type"), splitOptions(r.FormValue("options"))
+	h.finishCustomFieldAction(w, r, "update", h.updateCustomField(h.userID(r), id, customFieldUpdate{Name: &name, Type: &fieldType, Options: &options}))
+}
+
+// DeleteCustomField handles POST /custom-fields/{id}/delete.
+func (h *DocumentHandler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
+	id, ok := entityPathID(w, r)
+	if !ok {
+		return
+	}
+	h.finishCustomFieldAction(w, r, "delete", h.deleteCustomField(h.userID(r), id))
+}
+
+func (h *DocumentHandler) finishCustomFieldAction(w http.ResponseWriter, r *http.Request, action string, err error) {
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errFieldNotFound:
+		http.Error(w, "Custom field not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not "+action+" custom field: "+conflict.msg+".")
+	default:
+		log.Printf("Error running custom field %s: %v", action, err)
+		http.Error(w, "Failed to "+action+" custom field", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/custom-fields", http.StatusSeeOther)
+}
+
+// UpdateFields handles POST /document/{id}/fields from the document page.
+// Each input is named field_<id>.
+func (h *DocumentHandler) UpdateFields(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 {
+		http.Error(w, "Invalid URL path", http.StatusBadRequest)
+		return
+	}
+	documentID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "Invalid document ID", http.StatusBadRequest)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	values := make(map[int]string)
+	for name, v := range r.PostForm {
+		id, err := strconv.Atoi(strings.TrimPrefix(name, "field_"))
+		if err != nil || !strings.HasPrefix(name, "field_") || len(v) == 0 {
+			continue
+		}
+		values[id] = v[0]
+	}
+
+	err = h.setCustomFieldValues(h.userID(r), documentID, values)
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errDocumentNotFound:
+		http.Error(w, "Document not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not update custom fields: "+conflict.msg+".")
+	default:
+		log.Printf("Error updating custom fields of document %d: %v", documentID, err)
+		http.Error(w, "Failed to update custom fields", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/document?id=%d", documentID), http.StatusSeeOther)
+}
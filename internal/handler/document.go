@@ -2,109 +2,339 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"dokeep/internal/config"
+	"dokeep/internal/entities"
+	"dokeep/internal/jobs"
+	"dokeep/internal/middleware"
 	"dokeep/internal/model"
+	"dokeep/internal/search"
+	"dokeep/internal/storage"
+	"dokeep/internal/tagpath"
 	"dokeep/web/template"
 	"log"
 
-	"mime/multipart"
-
 	"github.com/alexedwards/scs/v2"
 )
 
 type DocumentHandler struct {
 	DB      *sql.DB
 	Session *scs.SessionManager
+	Config  *config.Config
+	Storage storage.Storage
 }
 
-type OcrResult struct {
-	Content       string `json:"text"`
-	ThumbnailPath string `json:"thumbnail_path"`
-	ExtractedDate string `json:"extracted_date"`
-	FileHash      string `json:"file_hash"`
+// errDocumentNotFound is returned when a document does not exist or is not
+// owned by the requesting user.
+var errDocumentNotFound = errors.New("document not found")
+
+// userID returns the authenticated user for the request. API requests carry it
+// in the context (session or bearer token); HTML requests use the session.
+func (h *DocumentHandler) userID(r *http.Request) int {
+	if id := middleware.UserID(r.Context()); id != 0 {
+		return id
+	}
+	return h.Session.GetInt(r.Context(), "userID")
 }
 
-type LlmAnalysisResult struct {
-	ExtractedDate string   `json:"extracted_date"`
-	Tags          []string `json:"tags"`
-	Summary       string   `json:"summary"`
+// maxPerPage bounds the per_page parameter of List.
+const maxPerPage = 100
+
+// sortOrder is an ORDER BY expression. Orders with a cast support cursor
+// pagination: the expression's value for the last row, read back as text
+// and cast to that type, marks where the next page starts.
+type sortOrder struct {
+	expr string
+	cast string
+	desc bool
 }
 
-func (h *DocumentHandler) List(w http.ResponseWriter, r *http.Request) ([]model.Document, int, error) {
-	userID := h.Session.GetInt(r.Context(), "userID")
-	query := r.URL.Query().Get("q")
-	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-	if page < 1 {
-		page = 1
+// sortOrders are the built-in orderings accepted by List's sort parameter.
+// Missing document dates sort as the oldest.
+var sortOrders = map[string]sortOrder{
+	"created":  {expr: "coalesce(d.created_date, DATE '0001-01-01')", cast: "date"},
+	"uploaded": {expr: "coalesce(d.created_at, '-infinity')", cast: "timestamptz"},
+	"title":    {expr: "coalesce(lower(d.title), '')", cast: "text"},
+}
+
+// listOptions selects one page of a document list.
+type listOptions struct {
+	Query   string
+	Sort    string
+	Filters model.DocumentFilters
+	Page    int
+	PerPage int
+	// After and Before are cursors from a previous page; see DocumentList.
+	After  string
+	Before string
+	// Facets also computes tag and year counts for the whole list.
+	Facets bool
+	// Snippets adds the passages matching the query's free text to each
+	// document.
+	Snippets bool
+	// Suggest looks for a corrected spelling of a query that finds nothing.
+	Suggest bool
+}
+
+// List returns a page of the user's documents matching the q parameter (see
+// package search) and the filters read by model.FiltersFromQuery. The
+// optional sort parameter orders the results by relevance, created,
+// uploaded, title or field.<key>, descending with a leading "-"; documents
+// without a custom field value come last. Pages are selected with page, or with the after
+// and before cursors of a previous page, and hold per_page documents.
+func (h *DocumentHandler) List(w http.ResponseWriter, r *http.Request) (model.DocumentList, error) {
+	q := r.URL.Query()
+	page, _ := strconv.Atoi(q.Get("page"))
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	return h.listDocuments(h.userID(r), listOptions{
+		Query:    q.Get("q"),
+		Sort:     q.Get("sort"),
+		Filters:  model.FiltersFromQuery(q),
+		Page:     page,
+		PerPage:  perPage,
+		After:    q.Get("after"),
+		Before:   q.Get("before"),
+		Facets:   true,
+		Snippets: true,
+		Suggest:  true,
+	})
+}
+
+// documentFilter holds the WHERE conditions for a user's search, with the
+// documents table aliased as "d".
+type documentFilter struct {
+	where  []string
+	args   []interface{}
+	parsed search.Node
+	fields map[string]model.CustomField
+}
+
+// filterDocuments parses a query for the user (see package search) and adds
+// the filters to it. Invalid queries and filters are returned as
+// *search.Error so callers can show them to the user.
+func (h *DocumentHandler) filterDocuments(userID int, query string, filters model.DocumentFilters) (documentFilter, error) {
+	f := documentFilter{where: []string{"d.user_id = $1"}, args: []interface{}{userID}}
+	fields, err := h.customFieldsByKey(userID)
+	if err != nil {
+		return f, err
+	}
+	f.fields = fields
+	f.parsed, err = search.Parse(query, fields)
+	if err != nil {
+		return f, err
 	}
-	limit := 10
-	offset := (page - 1) * limit
 
-	var documents []model.Document
-	var totalDocs int
+	var terms []search.Node
+	if f.parsed != nil {
+		terms = append(terms, f.parsed)
+	}
+	add := func(field, op, value string) {
+		if value == "" || err != nil {
+			return
+		}
+		var n search.Node
+		if n, err = search.Filter(field, op, value); err == nil {
+			terms = append(terms, n)
+		}
+	}
+	for _, tag := range filters.Tags {
+		add("tag", ":", tag)
+	}
+	add("created", ">=", filters.From)
+	add("created", "<=", filters.To)
+	add("status", ":", filters.Status)
+	add("filetype", ":", filters.FileType)
+	add("correspondent", ":", filters.Correspondent)
+	if err != nil {
+		return f, err
+	}
 
-	// Base query components
-	baseSelect := "SELECT DISTINCT d.id, d.title, d.file_path, d.thumbnail, d.content, d.summary, d.created_date, d.created_at"
-	baseFrom := "FROM documents d LEFT JOIN document_tags dt ON d.id = dt.document_id LEFT JOIN tags t ON dt.tag_id = t.id"
-	countSelect := "SELECT COUNT(DISTINCT d.id)"
+	for _, n := range terms {
+		var condition string
+		condition, f.args = search.SQL(n, f.args)
+		f.where = append(f.where, condition)
+	}
+	return f, nil
+}
 
-	// Dynamic WHERE clause
-	whereClauses := []string{"d.user_id = $1"}
-	args := []interface{}{userID}
+// countDocuments returns how many of the user's documents match a query and
+// filters.
+func (h *DocumentHandler) countDocuments(userID int, query string, filters model.DocumentFilters) (int, error) {
+	f, err := h.filterDocuments(userID, query, filters)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = h.DB.QueryRow("SELECT COUNT(*) FROM documents d WHERE "+strings.Join(f.where, " AND "), f.args...).Scan(&count)
+	return count, err
+}
 
-	if query != "" {
-		likeQuery := "%" + query + "%"
-		searchCondition := fmt.Sprintf(`(
-			d.title ILIKE $%d OR
-			d.content ILIKE $%d OR
-			d.summary ILIKE $%d OR
-			t.name ILIKE $%d
-		)`, len(args)+1, len(args)+2, len(args)+3, len(args)+4)
-		whereClauses = append(whereClauses, searchCondition)
-		args = append(args, likeQuery, likeQuery, likeQuery, likeQuery)
+// resolveSort turns a sort parameter into an ORDER BY expression, appending
+// any parameters it needs to args. Unknown keys fall back to the default:
+// relevance when the query has free text, newest first otherwise.
+func resolveSort(sort string, filter documentFilter, args []interface{}) (sortOrder, string, []interface{}) {
+	key := strings.TrimPrefix(sort, "-")
+	desc := key != sort
+	text := ""
+	if filter.parsed != nil {
+		text = search.FreeText(filter.parsed)
+	}
+	if order, ok := sortOrders[key]; ok {
+		order.desc = desc
+		return order, sort, args
+	}
+	if name, ok := strings.CutPrefix(key, "field."); ok {
+		if f, ok := filter.fields[name]; ok {
+			var expr string
+			expr, args = customSortSQL(f, args)
+			return sortOrder{expr: expr, desc: desc}, sort, args
+		}
 	}
+	if text != "" {
+		// Results are ranked by relevance against the weighted search vector.
+		args = append(args, text)
+		return sortOrder{expr: fmt.Sprintf("ts_rank_cd(d.search_vector, websearch_to_tsquery('english', $%d))", len(args)), desc: true}, "relevance", args
+	}
+	order := sortOrders["created"]
+	order.desc = true
+	return order, "-created", args
+}
 
-	fullWhere := ""
-	if len(whereClauses) > 0 {
-		fullWhere = "WHERE " + strings.Join(whereClauses, " AND ")
+// encodeCursor and decodeCursor convert the sort value and ID of a row to
+// and from an opaque cursor.
+func encodeCursor(value string, id int) string {
+	b, _ := json.Marshal([]interface{}{value, id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (string, int, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, false
 	}
+	var parts []interface{}
+	if json.Unmarshal(b, &parts) != nil || len(parts) != 2 {
+		return "", 0, false
+	}
+	value, ok1 := parts[0].(string)
+	id, ok2 := parts[1].(float64)
+	return value, int(id), ok1 && ok2
+}
 
-	// Get total count for pagination first
-	countQuery := countSelect + " " + baseFrom + " " + fullWhere
-	err := h.DB.QueryRow(countQuery, args...).Scan(&totalDocs)
+// listDocuments returns one page of the user's documents (see List).
+func (h *DocumentHandler) listDocuments(userID int, opts listOptions) (model.DocumentList, error) {
+	list := model.DocumentList{Query: opts.Query, Filters: opts.Filters, Page: opts.Page, PerPage: opts.PerPage}
+	if list.Page < 1 {
+		list.Page = 1
+	}
+	if list.PerPage < 1 || list.PerPage > maxPerPage {
+		list.PerPage = h.Config.Documents.PageSize
+	}
+
+	// Base query components
+	baseFrom := "FROM documents d LEFT JOIN correspondents c ON c.id = d.correspondent_id LEFT JOIN document_types ty ON ty.id = d.document_type_id"
+
+	filter, err := h.filterDocuments(userID, opts.Query, opts.Filters)
 	if err != nil {
-		return nil, 0, err
+		return list, err
+	}
+	whereClauses, args := filter.where, filter.args
+
+	// Get the total and the facets first, before the ordering adds its own
+	// parameters.
+	if err := h.DB.QueryRow("SELECT COUNT(*) FROM documents d WHERE "+strings.Join(whereClauses, " AND "), args...).Scan(&list.Total); err != nil {
+		return list, err
+	}
+	list.TotalPages = (list.Total + list.PerPage - 1) / list.PerPage
+	if list.Total == 0 && opts.Suggest && filter.parsed != nil && search.FreeText(filter.parsed) != "" {
+		if list.Suggestion, err = h.didYouMean(userID, opts.Query, opts.Filters, filter.fields); err != nil {
+			return list, err
+		}
+	}
+	if opts.Facets {
+		facets, err := h.documentFacets(filter)
+		if err != nil {
+			return list, err
+		}
+		list.Facets = &facets
+	}
+
+	var order sortOrder
+	order, list.Sort, args = resolveSort(opts.Sort, filter, args)
+
+	// Cursor pagination seeks past the cursor row using the sort value and
+	// the ID as a tie-breaker. Paging backwards runs the query in reverse.
+	reverse := false
+	cursor, cursorID, haveCursor := "", 0, false
+	if order.cast != "" {
+		if opts.After != "" {
+			cursor, cursorID, haveCursor = decodeCursor(opts.After)
+		} else if opts.Before != "" {
+			cursor, cursorID, haveCursor = decodeCursor(opts.Before)
+			reverse = haveCursor
+		}
+	}
+	desc := order.desc != reverse
+	direction, cmp := "ASC", ">"
+	if desc {
+		direction, cmp = "DESC", "<"
+	}
+	if haveCursor {
+		args = append(args, cursor, cursorID)
+		whereClauses = append(whereClauses, fmt.Sprintf("(%s, d.id) %s ($%d::%s, $%d)", order.expr, cmp, len(args)-1, order.cast, len(args)))
 	}
+	orderBy := fmt.Sprintf("ORDER BY %s %s NULLS LAST, d.id %s", order.expr, direction, direction)
 
-	// Now, build the final query for the documents
-	orderBy := fmt.Sprintf("ORDER BY d.created_date DESC, d.created_at DESC LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
-	args = append(args, limit, offset)
+	// One extra row tells whether there is another page in that direction.
+	var limitClause string
+	if haveCursor || order.cast != "" && list.Page == 1 {
+		args = append(args, list.PerPage+1)
+		limitClause = fmt.Sprintf("LIMIT $%d", len(args))
+	} else {
+		args = append(args, list.PerPage+1, (list.Page-1)*list.PerPage)
+		limitClause = fmt.Sprintf("LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
 
-	sqlQuery := baseSelect + " " + baseFrom + " " + fullWhere + " " + orderBy
+	sortKey := "NULL"
+	if order.cast != "" {
+		sortKey = "(" + order.expr + ")::text"
+	}
+	sqlQuery := "SELECT d.id, d.title, d.file_path, d.thumbnail, d.content, d.summary, d.created_date, d.created_at, d.correspondent_id, c.name, d.document_type_id, ty.name, " + sortKey +
+		" " + baseFrom + " WHERE " + strings.Join(whereClauses, " AND ") + " " + orderBy + " " + limitClause
 
 	rows, err := h.DB.Query(sqlQuery, args...)
 	if err != nil {
-		return nil, 0, err
+		return list, err
 	}
 	defer rows.Close()
 
+	var documents []model.Document
+	var sortKeys []string
 	for rows.Next() {
 		var doc model.Document
 		var createdDate sql.NullTime
-		var content, summary, filePath, thumbnail sql.NullString
-		if err := rows.Scan(&doc.ID, &doc.Title, &filePath, &thumbnail, &content, &summary, &createdDate, &doc.CreatedAt); err != nil {
-			return nil, 0, err
+		var content, summary, filePath, thumbnail, correspondent, documentType, key sql.NullString
+		var correspondentID, documentTypeID sql.NullInt64
+		if err := rows.Scan(&doc.ID, &doc.Title, &filePath, &thumbnail, &content, &summary, &createdDate, &doc.CreatedAt,
+			&correspondentID, &correspondent, &documentTypeID, &documentType, &key); err != nil {
+			return list, err
 		}
+		doc.CorrespondentID = nullableID(correspondentID)
+		doc.Correspondent = correspondent.String
+		doc.DocumentTypeID = nullableID(documentTypeID)
+		doc.DocumentType = documentType.String
 		if createdDate.Valid {
 			doc.CreatedDate = createdDate.Time
 		}
@@ -113,17 +343,103 @@ func (h *DocumentHandler) List(w http.ResponseWriter, r *http.Request) ([]model.
 		doc.FilePath = filePath.String
 		doc.Thumbnail = thumbnail.String
 		documents = append(documents, doc)
+		sortKeys = append(sortKeys, key.String)
+	}
+	if err := rows.Err(); err != nil {
+		return list, err
 	}
 
-	return documents, totalDocs, nil
+	more := len(documents) > list.PerPage
+	if more {
+		documents, sortKeys = documents[:list.PerPage], sortKeys[:list.PerPage]
+	}
+	if reverse {
+		for i, j := 0, len(documents)-1; i < j; i, j = i+1, j-1 {
+			documents[i], documents[j] = documents[j], documents[i]
+			sortKeys[i], sortKeys[j] = sortKeys[j], sortKeys[i]
+		}
+	}
+	if order.cast != "" && len(documents) > 0 {
+		first, last := 0, len(documents)-1
+		// Going forward there is a previous page whenever we started from a
+		// cursor; going backwards there is always a next page.
+		if (haveCursor && !reverse) || (reverse && more) {
+			list.PrevCursor = encodeCursor(sortKeys[first], documents[first].ID)
+		}
+		if (!reverse && more) || reverse {
+			list.NextCursor = encodeCursor(sortKeys[last], documents[last].ID)
+		}
+	}
+
+	ids := make([]int, len(documents))
+	for i, doc := range documents {
+		ids[i] = doc.ID
+	}
+	values, err := h.customFieldValues(ids)
+	if err != nil {
+		return list, err
+	}
+	var snippets map[int][]model.Highlight
+	if opts.Snippets && filter.parsed != nil {
+		if snippets, err = h.documentSnippets(ids, search.FreeText(filter.parsed)); err != nil {
+			return list, err
+		}
+	}
+	for i := range documents {
+		documents[i].CustomFields = values[documents[i].ID]
+		documents[i].Snippet = snippets[documents[i].ID]
+	}
+	list.Documents = documents
+	if list.Documents == nil {
+		list.Documents = []model.Document{}
+	}
+	return list, nil
+}
+
+// maxTagFacets is the number of tags listed as facets.
+const maxTagFacets = 15
+
+// documentFacets counts the documents matching a filter per tag and per year
+// of the document date.
+func (h *DocumentHandler) documentFacets(f documentFilter) (model.Facets, error) {
+	facets := model.Facets{Tags: []model.Facet{}, Years: []model.Facet{}}
+	where := strings.Join(f.where, " AND ")
+	scan := func(query string, into *[]model.Facet) error {
+		rows, err := h.DB.Query(query, f.args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var facet model.Facet
+			if err := rows.Scan(&facet.Value, &facet.Count); err != nil {
+				return err
+			}
+			*into = append(*into, facet)
+		}
+		return rows.Err()
+	}
+	err := scan(fmt.Sprintf(`
+		SELECT t.name, COUNT(*) FROM document_tags dt JOIN tags t ON t.id = dt.tag_id
+		WHERE dt.document_id IN (SELECT d.id FROM documents d WHERE %s)
+		GROUP BY t.name ORDER BY COUNT(*) DESC, t.name LIMIT %d`, where, maxTagFacets), &facets.Tags)
+	if err != nil {
+		return facets, err
+	}
+	err = scan(`
+		SELECT EXTRACT(YEAR FROM d.created_date)::int::text, COUNT(*) FROM documents d
+		WHERE `+where+` AND d.created_date IS NOT NULL
+		GROUP BY 1 ORDER BY 1 DESC`, &facets.Years)
+	return facets, err
 }
 
 func (h *DocumentHandler) GetTags(documentID int) ([]model.Tag, error) {
 	rows, err := h.DB.Query(`
-		SELECT t.id, t.name
+		SELECT t.id, t.name, t.color, t.description
 		FROM tags t
 		JOIN document_tags dt ON t.id = dt.tag_id
 		WHERE dt.document_id = $1
+		ORDER BY t.name
 	`, documentID)
 	if err != nil {
 		return nil, err
@@ -133,7 +449,7 @@ func (h *DocumentHandler) GetTags(documentID int) ([]model.Tag, error) {
 	var tags []model.Tag
 	for rows.Next() {
 		var tag model.Tag
-		if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Description); err != nil {
 			return nil, err
 		}
 		tags = append(tags, tag)
@@ -141,25 +457,18 @@ func (h *DocumentHandler) GetTags(documentID int) ([]model.Tag, error) {
 	return tags, nil
 }
 
-func (h *DocumentHandler) addTagsToDocument(docID int, tags []string) {
+// addTagsToDocument attaches tags to a document. Names are matched against
+// the user's tag hierarchy (see tagpath.Resolve) and missing tags are created.
+func (h *DocumentHandler) addTagsToDocument(userID, docID int, tags []string) {
 	for _, tagName := range tags {
-		// Normalize the tag: trim whitespace and convert to lowercase
-		normalizedTag := strings.TrimSpace(strings.ToLower(tagName))
+		normalizedTag := tagpath.Normalize(tagName)
 		if normalizedTag == "" {
 			continue // Skip empty tags
 		}
 
-		// Check if tag exists, otherwise create it
-		var tagID int
-		err := h.DB.QueryRow("SELECT id FROM tags WHERE name = $1", normalizedTag).Scan(&tagID)
-		if err == sql.ErrNoRows {
-			err = h.DB.QueryRow("INSERT INTO tags (name) VALUES ($1) RETURNING id", normalizedTag).Scan(&tagID)
-			if err != nil {
-				log.Printf("Error inserting new tag '%s': %v", normalizedTag, err)
-				continue
-			}
-		} else if err != nil {
-			log.Printf("Error querying for tag '%s': %v", normalizedTag, err)
+		tagID, err := tagpath.Resolve(h.DB, userID, tagName)
+		if err != nil {
+			log.Printf("Error resolving tag '%s': %v", normalizedTag, err)
 			continue
 		}
 
@@ -182,15 +491,79 @@ func (h *DocumentHandler) AddTag(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
+
+	userID := h.userID(r)
+	if err := h.ownsDocument(userID, documentID); err != nil {
+		http.Error(w, "Document not found or access denied", http.StatusNotFound)
+		return
+	}
+
 	tagName := r.FormValue("tag")
 	if tagName == "" {
 		http.Redirect(w, r, fmt.Sprintf("/document?id=%d", documentID), http.StatusSeeOther)
 		return
 	}
-	h.addTagsToDocument(documentID, []string{tagName})
+	h.addTagsToDocument(userID, documentID, []string{tagName})
 	http.Redirect(w, r, fmt.Sprintf("/document?id=%d", documentID), http.StatusSeeOther)
 }
 
+// ownsDocument returns errDocumentNotFound unless the document exists and
+// belongs to the given user.
+func (h *DocumentHandler) ownsDocument(userID, documentID int) error {
+	var exists bool
+	err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1 AND user_id = $2)", documentID, userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errDocumentNotFound
+	}
+	return nil
+}
+
+// getDocument loads a single document owned by the given user.
+func (h *DocumentHandler) getDocument(userID, documentID int) (model.Document, error) {
+	var doc model.Document
+	var createdDate sql.NullTime
+	var originalFilename, content, summary, filePath, thumbnail, statusMessage, correspondent, documentType sql.NullString
+	var correspondentID, documentTypeID, versionOf sql.NullInt64
+	err := h.DB.QueryRow(`
+		SELECT d.id, d.title, d.original_filename, d.file_path, d.thumbnail, d.content, d.summary, d.status, d.status_message, d.created_date, d.created_at,
+			d.correspondent_id, c.name, d.document_type_id, ty.name, d.version_of
+		FROM documents d
+		LEFT JOIN correspondents c ON c.id = d.correspondent_id
+		LEFT JOIN document_types ty ON ty.id = d.document_type_id
+		WHERE d.id = $1 AND d.user_id = $2
+	`, documentID, userID).Scan(&doc.ID, &doc.Title, &originalFilename, &filePath, &thumbnail, &content, &summary, &doc.Status, &statusMessage, &createdDate, &doc.CreatedAt,
+		&correspondentID, &correspondent, &documentTypeID, &documentType, &versionOf)
+	if err == sql.ErrNoRows {
+		return doc, errDocumentNotFound
+	}
+	if err != nil {
+		return doc, err
+	}
+	if createdDate.Valid {
+		doc.CreatedDate = createdDate.Time
+	}
+	doc.OriginalFilename = originalFilename.String
+	doc.Content = content.String
+	doc.Summary = summary.String
+	doc.FilePath = filePath.String
+	doc.Thumbnail = thumbnail.String
+	doc.StatusMessage = statusMessage.String
+	doc.CorrespondentID = nullableID(correspondentID)
+	doc.Correspondent = correspondent.String
+	doc.DocumentTypeID = nullableID(documentTypeID)
+	doc.DocumentType = documentType.String
+	doc.VersionOf = nullableID(versionOf)
+	values, err := h.customFieldValues([]int{doc.ID})
+	if err != nil {
+		return doc, err
+	}
+	doc.CustomFields = values[doc.ID]
+	return doc, nil
+}
+
 func (h *DocumentHandler) Show(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.URL.Query().Get("id"))
 	if err != nil {
@@ -198,27 +571,17 @@ func (h *DocumentHandler) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := h.Session.GetInt(r.Context(), "userID")
+	userID := h.userID(r)
 
-	var doc model.Document
-	var createdDate sql.NullTime
-	var content, summary, filePath, thumbnail sql.NullString
-	err = h.DB.QueryRow("SELECT id, title, file_path, thumbnail, content, summary, created_date, created_at FROM documents WHERE id = $1 AND user_id = $2", id, userID).Scan(&doc.ID, &doc.Title, &filePath, &thumbnail, &content, &summary, &createdDate, &doc.CreatedAt)
+	doc, err := h.getDocument(userID, id)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == errDocumentNotFound {
 			http.Error(w, "Document not found", http.StatusNotFound)
 		} else {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 		}
 		return
 	}
-	if createdDate.Valid {
-		doc.CreatedDate = createdDate.Time
-	}
-	doc.Content = content.String
-	doc.Summary = summary.String
-	doc.FilePath = filePath.String
-	doc.Thumbnail = thumbnail.String
 
 	tags, err := h.GetTags(id)
 	if err != nil {
@@ -226,21 +589,51 @@ func (h *DocumentHandler) Show(w http.ResponseWriter, r *http.Request) {
 		// Non-fatal, we can still render the page
 	}
 
-	if err := template.DocumentPage(doc.Title, doc, tags).Render(r.Context(), w); err != nil {
+	history, err := h.statusHistory(userID, id)
+	if err != nil {
+		log.Printf("Error getting status history for document %d: %v", id, err)
+	}
+
+	correspondents, err := h.listEntities(entities.Correspondents, userID)
+	if err != nil {
+		log.Printf("Error listing correspondents for user %d: %v", userID, err)
+	}
+	documentTypes, err := h.listEntities(entities.DocumentTypes, userID)
+	if err != nil {
+		log.Printf("Error listing document types for user %d: %v", userID, err)
+	}
+
+	fields, err := h.listCustomFields(userID)
+	if err != nil {
+		log.Printf("Error listing custom fields for user %d: %v", userID, err)
+	}
+
+	// Opened from a search, the text panel highlights what matched.
+	query := r.URL.Query().Get("q")
+	matches, err := h.highlightContent(userID, id, h.searchText(userID, query))
+	if err != nil {
+		log.Printf("Error highlighting document %d: %v", id, err)
+	}
+
+	similar, err := h.similarDocuments(userID, id)
+	if err != nil {
+		log.Printf("Error finding documents similar to %d: %v", id, err)
+	}
+
+	if err := template.DocumentPage(doc.Title, doc, tags, history, correspondents, documentTypes, fields, similar, query, matches, h.Session.PopString(r.Context(), "flash_error")).Render(r.Context(), w); err != nil {
 		http.Error(w, "Error rendering document page", http.StatusInternalServerError)
 	}
 }
 
 func (h *DocumentHandler) Queue(w http.ResponseWriter, r *http.Request) {
-	userID := h.Session.GetInt(r.Context(), "userID")
+	userID := h.userID(r)
 	username := h.Session.GetString(r.Context(), "username")
+	flashError := h.Session.PopString(r.Context(), "flash_error")
 
 	// Get counts for the stat cards
-	queuedCount, _ := h.getDocumentCountByStatus(userID, "queued")
-	processingCount, _ := h.getDocumentCountByStatus(userID, "processing")
-	failedCount, _ := h.getDocumentCountByStatus(userID, "failed")
+	stats := h.queueStats(userID)
 
-	rows, err := h.DB.Query("SELECT id, title, original_filename, status, status_message FROM documents WHERE user_id = $1 AND status IN ('queued', 'processing', 'failed') ORDER BY created_at ASC", userID)
+	rows, err := h.DB.Query("SELECT id, title, original_filename, status, status_message FROM documents WHERE user_id = $1 AND status IN ('queued', 'processing', 'failed', 'cancelled') ORDER BY created_at ASC", userID)
 	if err != nil {
 		http.Error(w, "Failed to retrieve queued documents", http.StatusInternalServerError)
 		return
@@ -264,13 +657,12 @@ func (h *DocumentHandler) Queue(w http.ResponseWriter, r *http.Request) {
 		documents = append(documents, doc)
 	}
 
-	stats := model.QueueStats{
-		Waiting:    queuedCount,
-		Processing: processingCount,
-		Failed:     failedCount,
+	rejected, err := h.listRejectedUploads(userID, rejectedUploadsShown)
+	if err != nil {
+		log.Printf("Error listing rejected uploads for user %d: %v", userID, err)
 	}
 
-	if err := template.QueuePage(username, documents, stats).Render(r.Context(), w); err != nil {
+	if err := template.QueuePage(username, documents, stats, rejected, flashError).Render(r.Context(), w); err != nil {
 		http.Error(w, "Error rendering queue page", http.StatusInternalServerError)
 	}
 }
@@ -283,15 +675,28 @@ func (h *DocumentHandler) getDocumentCountByStatus(userID int, status string) (i
 }
 
 func (h *DocumentHandler) QueueStatus(w http.ResponseWriter, r *http.Request) {
-	userID := h.Session.GetInt(r.Context(), "userID")
+	userID := h.userID(r)
 
-	rows, err := h.DB.Query("SELECT id, title, original_filename, status, status_message FROM documents WHERE user_id = $1 AND status != 'completed' ORDER BY created_at ASC", userID)
+	documents, err := h.pendingDocuments(userID)
 	if err != nil {
 		// We don't write an error to the response here because this is for polling.
 		// A client-side error will be logged.
 		log.Printf("Error retrieving queue status for user %d: %v", userID, err)
 		return
 	}
+
+	// Render only the rows, not the whole page
+	for _, doc := range documents {
+		template.QueueRow(doc).Render(r.Context(), w)
+	}
+}
+
+// pendingDocuments returns the user's documents that have not finished processing.
+func (h *DocumentHandler) pendingDocuments(userID int) ([]model.Document, error) {
+	rows, err := h.DB.Query("SELECT id, title, original_filename, status, status_message FROM documents WHERE user_id = $1 AND status != 'completed' ORDER BY created_at ASC", userID)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var documents []model.Document
@@ -310,15 +715,25 @@ func (h *DocumentHandler) QueueStatus(w http.ResponseWriter, r *http.Request) {
 		}
 		documents = append(documents, doc)
 	}
+	return documents, nil
+}
 
-	// Render only the rows, not the whole page
-	for _, doc := range documents {
-		template.QueueRow(doc).Render(r.Context(), w)
+// queueStats returns the per-status counts shown on the queue page.
+func (h *DocumentHandler) queueStats(userID int) model.QueueStats {
+	queuedCount, _ := h.getDocumentCountByStatus(userID, "queued")
+	processingCount, _ := h.getDocumentCountByStatus(userID, "processing")
+	failedCount, _ := h.getDocumentCountByStatus(userID, "failed")
+	cancelledCount, _ := h.getDocumentCountByStatus(userID, "cancelled")
+	return model.QueueStats{
+		Waiting:    queuedCount,
+		Processing: processingCount,
+		Failed:     failedCount,
+		Cancelled:  cancelledCount,
 	}
 }
 
 func (h *DocumentHandler) Upload(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
+	if err := r.ParseMultipartForm(h.Config.Uploads.MaxBytes()); err != nil {
 		http.Error(w, "Error parsing multipart form", http.StatusBadRequest)
 		return
 	}
@@ -331,115 +746,92 @@ func (h *DocumentHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	userID := h.Session.GetInt(r.Context(), "userID")
+	userID := h.userID(r)
 
-	// 1. Save a record to the database first to get an ID
-	var docID int64
-	err = h.DB.QueryRow("INSERT INTO documents (user_id, title, original_filename, file_path) VALUES ($1, $2, $3, $4) RETURNING id",
-		userID, title, header.Filename, "").Scan(&docID)
-	if err != nil {
-		log.Printf("Error creating initial document record: %v", err)
-		http.Error(w, "Could not create document record", http.StatusInternalServerError)
-		return
-	}
-
-	// 2. Save the file to a permanent location with a unique name based on the ID
-	uploadDir := filepath.Join(".", "uploads")
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		http.Error(w, "Unable to create uploads directory", http.StatusInternalServerError)
+	_, err = h.createDocument(userID, uploadFromForm(title, file, header), r.FormValue("allow_duplicate") != "")
+	var duplicate *duplicateError
+	if errors.As(err, &duplicate) {
+		h.Session.Put(r.Context(), "flash_error", fmt.Sprintf("%q was not stored because it is identical to %q. It is listed under rejected duplicates below.", header.Filename, duplicate.Existing.Title))
+	} else if err != nil {
+		log.Printf("Error creating document for user %d: %v", userID, err)
+		http.Error(w, "Failed to queue document for processing.", http.StatusInternalServerError)
 		return
 	}
 
-	ext := filepath.Ext(header.Filename)
-	newFileName := fmt.Sprintf("%d%s", docID, ext)
-	filePath := filepath.Join(uploadDir, newFileName)
+	// Redirect to the queue page
+	http.Redirect(w, r, "/queue", http.StatusSeeOther)
+}
 
-	savedFile, err := os.Create(filePath)
+// createDocument stores an uploaded file, records it in the database and
+// queues it for processing. If the user already has a file with the same
+// content, the upload is set aside as a rejected upload and a
+// *duplicateError is returned, unless allowDuplicate is set; then the file is
+// stored as a new version of the existing document.
+func (h *DocumentHandler) createDocument(userID int, u upload, allowDuplicate bool) (int64, error) {
+	hash, err := hashUpload(u.Body)
 	if err != nil {
-		http.Error(w, "Could not save uploaded file", http.StatusInternalServerError)
-		return
-	}
-	defer savedFile.Close()
-
-	// Reset file pointer and copy to the new file
-	file.Seek(0, io.SeekStart)
-	if _, err := io.Copy(savedFile, file); err != nil {
-		http.Error(w, "Could not copy file content", http.StatusInternalServerError)
-		return
+		return 0, fmt.Errorf("could not read uploaded file: %w", err)
 	}
-
-	// 3. Update the file_path in the database
-	_, err = h.DB.Exec("UPDATE documents SET file_path = $1 WHERE id = $2", filePath, docID)
+	tx, err := h.DB.Begin()
 	if err != nil {
-		log.Printf("Error updating file path for document %d: %v", docID, err)
-		os.Remove(filePath) // Cleanup
-		http.Error(w, "Could not update document record", http.StatusInternalServerError)
-		return
+		return 0, err
 	}
-
-	// 4. Call the Python service to queue the file for processing
-	if err := h.callProcessService(filePath, docID); err != nil {
-		log.Printf("Error calling process service for document %d: %v", docID, err)
-		os.Remove(filePath) // Cleanup
-		// Also delete the DB record
-		h.DB.Exec("DELETE FROM documents WHERE id = $1", docID)
-		http.Error(w, "Failed to queue document for processing.", http.StatusInternalServerError)
-		return
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1, $2)", uploadLockClass, userID); err != nil {
+		return 0, err
 	}
-
-	// 5. Redirect to the queue page
-	http.Redirect(w, r, "/queue", http.StatusSeeOther)
-}
-
-// callProcessService sends the file to the Python service to be queued.
-func (h *DocumentHandler) callProcessService(filePath string, docID int64) error {
-	file, err := os.Open(filePath)
+	existing, err := documentByHash(tx, userID, hash)
 	if err != nil {
-		return fmt.Errorf("could not open file for processing service: %w", err)
+		return 0, err
 	}
-	defer file.Close()
-
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Add the doc_id as a form field
-	if err := writer.WriteField("doc_id", strconv.FormatInt(docID, 10)); err != nil {
-		return fmt.Errorf("could not write doc_id field: %w", err)
+	var versionOf interface{}
+	if existing != nil {
+		if !allowDuplicate {
+			tx.Rollback()
+			return 0, h.rejectUpload(userID, u, hash, *existing)
+		}
+		versionOf = existing.ID
 	}
 
-	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
+	// 1. Save a record to the database first to get an ID
+	var docID int64
+	err = tx.QueryRow("INSERT INTO documents (user_id, title, original_filename, file_path, file_hash, version_of) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		userID, u.Title, u.Filename, "", hash, versionOf).Scan(&docID)
 	if err != nil {
-		return fmt.Errorf("could not create form file: %w", err)
+		return 0, fmt.Errorf("could not create document record: %w", err)
 	}
-	if _, err := io.Copy(part, file); err != nil {
-		return fmt.Errorf("could not copy file to form: %w", err)
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("could not create document record: %w", err)
 	}
-	writer.Close()
 
-	serviceURL := "http://dokeep-service:8000/process"
-	if os.Getenv("DOKEEP_ENV") != "docker" {
-		serviceURL = "http://localhost:8000/process"
+	// 2. Store the file under a unique key based on the ID
+	key := fmt.Sprintf("%d%s", docID, strings.ToLower(filepath.Ext(u.Filename)))
+	u.Body.Seek(0, io.SeekStart)
+	if err := h.Storage.Put(context.Background(), key, u.Body, u.Size, u.ContentType); err != nil {
+		h.DB.Exec("DELETE FROM documents WHERE id = $1", docID)
+		return 0, fmt.Errorf("could not save uploaded file: %w", err)
 	}
-
-	req, err := http.NewRequest("POST", serviceURL, body)
-	if err != nil {
-		return fmt.Errorf("could not create request to process service: %w", err)
+	cleanup := func() {
+		if err := h.Storage.Delete(context.Background(), key); err != nil {
+			log.Printf("Error removing file %s: %v", key, err)
+		}
+		h.DB.Exec("DELETE FROM documents WHERE id = $1", docID)
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	client := &http.Client{Timeout: 1 * time.Minute} // 1 minute timeout should be plenty
-	resp, err := client.Do(req)
+	// 3. Update the file_path in the database
+	_, err = h.DB.Exec("UPDATE documents SET file_path = $1 WHERE id = $2", key, docID)
 	if err != nil {
-		return fmt.Errorf("process service request failed: %w", err)
+		cleanup()
+		return 0, fmt.Errorf("could not update file path: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("process service returned non-OK status: %s - %s", resp.Status, string(respBody))
+	// 4. Queue the document for processing by the background worker
+	if err := jobs.Enqueue(h.DB, int(docID), jobs.KindOCR, nil, h.Config.Worker.MaxAttempts); err != nil {
+		cleanup()
+		return 0, fmt.Errorf("could not queue document for processing: %w", err)
 	}
 
-	return nil
+	return docID, nil
 }
 
 func (h *DocumentHandler) Train(w http.ResponseWriter, r *http.Request) {
@@ -448,8 +840,8 @@ func (h *DocumentHandler) Train(w http.ResponseWriter, r *http.Request) {
 		FROM documents d
 		JOIN document_tags dt ON d.id = dt.document_id
 		JOIN tags t ON dt.tag_id = t.id
-		WHERE d.content != ""
-	`)
+		WHERE d.user_id = $1 AND d.content <> ''
+	`, h.userID(r))
 	if err != nil {
 		http.Error(w, "Failed to fetch training data", http.StatusInternalServerError)
 		return
@@ -479,7 +871,7 @@ func (h *DocumentHandler) Train(w http.ResponseWriter, r *http.Request) {
 
 	body := &bytes.Buffer{}
 	json.NewEncoder(body).Encode(trainingData)
-	req, _ := http.NewRequest("POST", "http://localhost:8000/train", body)
+	req, _ := http.NewRequest("POST", h.Config.Services.ProcessURL+"/train", body)
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
@@ -504,30 +896,34 @@ func (h *DocumentHandler) RemoveTag(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid document ID", http.StatusBadRequest)
 		return
 	}
-	tagName := parts[1]
-
-	// Normalize the tag name before searching for it
-	normalizedTag := strings.TrimSpace(strings.ToLower(tagName))
-
-	// Get tag ID
-	var tagID int
-	err = h.DB.QueryRow("SELECT id FROM tags WHERE name = $1", normalizedTag).Scan(&tagID)
+	tagID, err := strconv.Atoi(parts[1])
 	if err != nil {
-		log.Printf("Attempted to remove non-existent tag '%s' (normalized: '%s')", tagName, normalizedTag)
-		http.Error(w, "Tag not found", http.StatusNotFound)
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
 		return
 	}
 
-	// Remove association
-	_, err = h.DB.Exec("DELETE FROM document_tags WHERE document_id = $1 AND tag_id = $2", documentID, tagID)
-	if err != nil {
-		http.Error(w, "Failed to remove tag association", http.StatusInternalServerError)
+	userID := h.userID(r)
+	if err := h.removeTag(userID, documentID, tagID); err != nil {
+		if err == errDocumentNotFound {
+			http.Error(w, "Document not found or access denied", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to remove tag association", http.StatusInternalServerError)
+		}
 		return
 	}
 
 	http.Redirect(w, r, fmt.Sprintf("/document?id=%d", documentID), http.StatusSeeOther)
 }
 
+// removeTag detaches a tag from a document owned by the given user.
+func (h *DocumentHandler) removeTag(userID, documentID, tagID int) error {
+	if err := h.ownsDocument(userID, documentID); err != nil {
+		return err
+	}
+	_, err := h.DB.Exec("DELETE FROM document_tags WHERE document_id = $1 AND tag_id = $2", documentID, tagID)
+	return err
+}
+
 func (h *DocumentHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 	if len(parts) < 2 {
@@ -542,46 +938,83 @@ func (h *DocumentHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := h.Session.GetInt(r.Context(), "userID")
+	userID := h.userID(r)
 
-	// First, verify the user owns the document and get the file paths
-	var filePath, thumbnailPath sql.NullString
-	err = h.DB.QueryRow("SELECT file_path, thumbnail FROM documents WHERE id = $1 AND user_id = $2", documentID, userID).Scan(&filePath, &thumbnailPath)
-	if err != nil {
-		log.Printf("Delete handler: Document not found or access denied for doc %d and user %d. Error: %v", documentID, userID, err)
-		http.Error(w, "Document not found or access denied", http.StatusNotFound)
+	if err := h.deleteDocument(userID, documentID); err != nil {
+		if err == errDocumentNotFound {
+			http.Error(w, "Document not found or access denied", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to delete document from database", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	// Delete the document record from the database
-	_, err = h.DB.Exec("DELETE FROM documents WHERE id = $1", documentID)
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// deleteDocument removes a document owned by the given user together with its
+// tag associations and files.
+func (h *DocumentHandler) deleteDocument(userID, documentID int) error {
+	tx, err := h.DB.Begin()
 	if err != nil {
-		log.Printf("Delete handler: Failed to delete document %d from database. Error: %v", documentID, err)
-		http.Error(w, "Failed to delete document from database", http.StatusInternalServerError)
-		return
+		return err
 	}
+	defer tx.Rollback()
 
-	// Also delete the associated tags in the same transaction
-	_, err = h.DB.Exec("DELETE FROM document_tags WHERE document_id = $1", documentID)
+	files, err := deleteDocumentTx(tx, userID, documentID)
 	if err != nil {
-		log.Printf("Delete handler: Failed to delete tags for document %d. Error: %v", documentID, err)
-		// Log this error, but don't block the user
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
+	h.deleteFiles(files)
+
+	log.Printf("Delete handler: Successfully deleted document %d", documentID)
+	return nil
+}
 
-	// Delete the actual files from the filesystem
-	if filePath.Valid {
-		if err := os.Remove(filePath.String); err != nil {
-			log.Printf("Delete handler: Failed to remove file %s. Error: %v", filePath.String, err)
+// deleteDocumentTx deletes the rows of a document owned by the given user
+// within tx. It returns the document's stored files, which the caller removes
+// with deleteFiles once tx has committed.
+func deleteDocumentTx(tx *sql.Tx, userID, documentID int) ([]string, error) {
+	// First, verify the user owns the document and get the file paths
+	var filePath, thumbnailPath sql.NullString
+	err := tx.QueryRow("SELECT file_path, thumbnail FROM documents WHERE id = $1 AND user_id = $2 FOR UPDATE", documentID, userID).Scan(&filePath, &thumbnailPath)
+	if err != nil {
+		log.Printf("Delete handler: Document not found or access denied for doc %d and user %d. Error: %v", documentID, userID, err)
+		if err == sql.ErrNoRows {
+			return nil, errDocumentNotFound
 		}
+		return nil, err
 	}
-	if thumbnailPath.Valid {
-		if err := os.Remove(thumbnailPath.String); err != nil {
-			log.Printf("Delete handler: Failed to remove thumbnail %s. Error: %v", thumbnailPath.String, err)
+
+	if _, err := tx.Exec("DELETE FROM document_tags WHERE document_id = $1", documentID); err != nil {
+		log.Printf("Delete handler: Failed to delete tags for document %d. Error: %v", documentID, err)
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM documents WHERE id = $1", documentID); err != nil {
+		log.Printf("Delete handler: Failed to delete document %d from database. Error: %v", documentID, err)
+		return nil, err
+	}
+
+	var files []string
+	for _, path := range []sql.NullString{filePath, thumbnailPath} {
+		if path.String != "" {
+			files = append(files, path.String)
 		}
 	}
+	return files, nil
+}
 
-	log.Printf("Delete handler: Successfully deleted document %d", documentID)
-	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+// deleteFiles removes the stored files of a deleted document. Failures are
+// only logged, since the rows are already gone for good.
+func (h *DocumentHandler) deleteFiles(files []string) {
+	for _, path := range files {
+		if err := h.Storage.Delete(context.Background(), path); err != nil {
+			log.Printf("Delete handler: Failed to remove file %s. Error: %v", path, err)
+		}
+	}
 }
 
 func (h *DocumentHandler) UpdateDate(w http.ResponseWriter, r *http.Request) {
@@ -610,7 +1043,7 @@ func (h *DocumentHandler) UpdateDate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := h.Session.GetInt(r.Context(), "userID")
+	userID := h.userID(r)
 	_, err = h.DB.Exec("UPDATE documents SET created_date = $1 WHERE id = $2 AND user_id = $3", createdDate, documentID, userID)
 	if err != nil {
 		log.Printf("UpdateDate handler: Failed to update date for doc %d and user %d. Error: %v", documentID, userID, err)
@@ -648,13 +1081,53 @@ func (h *DocumentHandler) UpdateDetails(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID := h.Session.GetInt(r.Context(), "userID")
-	_, err = h.DB.Exec("UPDATE documents SET title = $1, summary = $2, created_date = $3 WHERE id = $4 AND user_id = $5",
-		title, summary, createdDate, documentID, userID)
-	if err != nil {
+	correspondentID, _ := strconv.Atoi(r.FormValue("correspondent_id"))
+	documentTypeID, _ := strconv.Atoi(r.FormValue("document_type_id"))
+
+	userID := h.userID(r)
+	// Check both choices before saving anything, so that an unknown one
+	// does not leave the document half updated
+	if correspondentID != 0 {
+		err = h.checkEntity(entities.Correspondents, userID, correspondentID)
+	}
+	if err == nil && documentTypeID != 0 {
+		err = h.checkEntity(entities.DocumentTypes, userID, documentTypeID)
+	}
+	if err == nil {
+		err = h.updateDetails(userID, documentID, title, summary, &createdDate)
+	}
+	if err == nil {
+		err = h.setDocumentEntity(entities.Correspondents, userID, documentID, correspondentID)
+	}
+	if err == nil {
+		err = h.setDocumentEntity(entities.DocumentTypes, userID, documentID, documentTypeID)
+	}
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errDocumentNotFound:
+		http.Error(w, "Document not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not update document: "+conflict.msg+".")
+	default:
 		http.Error(w, "Failed to update document details", http.StatusInternalServerError)
 		return
 	}
 
 	http.Redirect(w, r, fmt.Sprintf("/document?id=%d", documentID), http.StatusSeeOther)
 }
+
+// updateDetails sets the editable fields of a document owned by the given
+// user. A nil createdDate clears the date.
+func (h *DocumentHandler) updateDetails(userID, documentID int, title, summary string, createdDate *time.Time) error {
+	res, err := h.DB.Exec("UPDATE documents SET title = $1, summary = $2, created_date = $3 WHERE id = $4 AND user_id = $5",
+		title, summary, createdDate, documentID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errDocumentNotFound
+	}
+	return nil
+}
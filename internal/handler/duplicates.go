@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"dokeep/internal/fingerprint"
+	"dokeep/internal/jobs"
+	"dokeep/internal/model"
+	"dokeep/web/template"
+)
+
+// maxSimilarDocuments is the number of documents in the similar documents
+// panel.
+const maxSimilarDocuments = 5
+
+// maxDuplicatePairs is the number of pairs shown for review at a time.
+const maxDuplicatePairs = 50
+
+type fingerprinted struct {
+	id int
+	fp uint64
+}
+
+// fingerprints returns the content fingerprints of the user's documents.
+// Comparing them in Go is fast enough even for tens of thousands of
+// documents.
+func (h *DocumentHandler) fingerprints(userID int) ([]fingerprinted, error) {
+	rows, err := h.DB.Query("SELECT id, fingerprint FROM documents WHERE user_id = $1 AND fingerprint IS NOT NULL ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []fingerprinted
+	for rows.Next() {
+		var f fingerprinted
+		var fp int64
+		if err := rows.Scan(&f.id, &fp); err != nil {
+			return nil, err
+		}
+		f.fp = uint64(fp)
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
+
+// pairKey orders a pair of document IDs as stored in duplicate_dismissals.
+func pairKey(a, b int) [2]int {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]int{a, b}
+}
+
+// dismissedPairs returns the pairs the user chose to keep, optionally only
+// those involving one document.
+func (h *DocumentHandler) dismissedPairs(userID, documentID int) (map[[2]int]bool, error) {
+	rows, err := h.DB.Query(`
+		SELECT x.document_id, x.other_id FROM duplicate_dismissals x
+		JOIN documents d ON d.id = x.document_id
+		WHERE d.user_id = $1 AND ($2 = 0 OR $2 IN (x.document_id, x.other_id))`, userID, documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	dismissed := make(map[[2]int]bool)
+	for rows.Next() {
+		var a, b int
+		if err := rows.Scan(&a, &b); err != nil {
+			return nil, err
+		}
+		dismissed[[2]int{a, b}] = true
+	}
+	return dismissed, rows.Err()
+}
+
+// similarDocuments returns the documents whose text is most like the given
+// document's, closest first.
+func (h *DocumentHandler) similarDocuments(userID, documentID int) ([]model.SimilarDocument, error) {
+	var fp sql.NullInt64
+	err := h.DB.QueryRow("SELECT fingerprint FROM documents WHERE id = $1 AND user_id = $2", documentID, userID).Scan(&fp)
+	if err == sql.ErrNoRows {
+		return nil, errDocumentNotFound
+	}
+	if err != nil || !fp.Valid {
+		return nil, err
+	}
+	all, err := h.fingerprints(userID)
+	if err != nil {
+		return nil, err
+	}
+	dismissed, err := h.dismissedPairs(userID, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	type match struct{ id, distance int }
+	var matches []match
+	for _, f := range all {
+		if f.id == documentID {
+			continue
+		}
+		if d := fingerprint.Distance(uint64(fp.Int64), f.fp); d <= fingerprint.Similar {
+			matches = append(matches, match{f.id, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].id < matches[j].id
+	})
+	if len(matches) > maxSimilarDocuments {
+		matches = matches[:maxSimilarDocuments]
+	}
+
+	similar := make([]model.SimilarDocument, 0, len(matches))
+	for _, m := range matches {
+		s := model.SimilarDocument{
+			ID:         m.id,
+			Similarity: fingerprint.Similarity(m.distance),
+			Duplicate:  m.distance <= fingerprint.NearDuplicate && !dismissed[pairKey(documentID, m.id)],
+		}
+		var title, thumbnail sql.NullString
+		var createdDate sql.NullTime
+		if err := h.DB.QueryRow("SELECT title, thumbnail, created_date FROM documents WHERE id = $1", m.id).Scan(&title, &thumbnail, &createdDate); err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return nil, err
+		}
+		s.Title, s.Thumbnail, s.CreatedDate = title.String, thumbnail.String, createdDate.Time
+		similar = append(similar, s)
+	}
+	return similar, nil
+}
+
+// duplicatePairs returns the pairs of the user's documents that are probably
+// the same paper and have not been dismissed, most alike first.
+func (h *DocumentHandler) duplicatePairs(userID int) ([]model.DuplicatePair, error) {
+	all, err := h.fingerprints(userID)
+	if err != nil {
+		return nil, err
+	}
+	dismissed, err := h.dismissedPairs(userID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	type match struct{ a, b, distance int }
+	var matches []match
+	for i := range all {
+		for j := i + 1; j < len(all); j++ {
+			d := fingerprint.Distance(all[i].fp, all[j].fp)
+			if d <= fingerprint.NearDuplicate && !dismissed[pairKey(all[i].id, all[j].id)] {
+				matches = append(matches, match{all[i].id, all[j].id, d})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+	if len(matches) > maxDuplicatePairs {
+		matches = matches[:maxDuplicatePairs]
+	}
+
+	pairs := make([]model.DuplicatePair, 0, len(matches))
+	for _, m := range matches {
+		a, err := h.getDocument(userID, m.a)
+		if err == errDocumentNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := h.getDocument(userID, m.b)
+		if err == errDocumentNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, model.DuplicatePair{Document: a, Other: b, Similarity: fingerprint.Similarity(m.distance)})
+	}
+	return pairs, nil
+}
+
+// dismissDuplicate records that two documents are not duplicates, so they
+// are no longer offered for review.
+func (h *DocumentHandler) dismissDuplicate(userID, documentID, otherID int) error {
+	if documentID == otherID {
+		return &conflictError{"a document cannot be a duplicate of itself"}
+	}
+	for _, id := range []int{documentID, otherID} {
+		if err := h.ownsDocument(userID, id); err != nil {
+			return err
+		}
+	}
+	key := pairKey(documentID, otherID)
+	_, err := h.DB.Exec("INSERT INTO duplicate_dismissals (document_id, other_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", key[0], key[1])
+	return err
+}
+
+// mergeDocuments folds a duplicate into the document being kept and then
+// deletes the duplicate. The kept document gains the duplicate's tags and
+// custom field values, and its correspondent, document type, date and
+// summary where it has none of its own. The duplicate is deleted in the same
+// transaction; its files are removed once that has committed.
+func (h *DocumentHandler) mergeDocuments(userID, keepID, removeID int) error {
+	if keepID == removeID {
+		return &conflictError{"a document cannot be merged into itself"}
+	}
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, err := lockDocument(tx, userID, keepID)
+	if err != nil {
+		return err
+	}
+	var removedTitle string
+	err = tx.QueryRow("SELECT coalesce(title, '') FROM documents WHERE id = $1 AND user_id = $2 FOR UPDATE", removeID, userID).Scan(&removedTitle)
+	if err == sql.ErrNoRows {
+		return errDocumentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO document_tags (document_id, tag_id)
+		SELECT $1, tag_id FROM document_tags WHERE document_id = $2
+		ON CONFLICT DO NOTHING`, keepID, removeID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO custom_field_values (document_id, field_id, value)
+		SELECT $1, field_id, value FROM custom_field_values WHERE document_id = $2
+		ON CONFLICT DO NOTHING`, keepID, removeID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE documents k SET
+			correspondent_id = coalesce(k.correspondent_id, r.correspondent_id),
+			document_type_id = coalesce(k.document_type_id, r.document_type_id),
+			created_date = coalesce(k.created_date, r.created_date),
+			summary = CASE WHEN coalesce(k.summary, '') = '' THEN r.summary ELSE k.summary END
+		FROM documents r
+		WHERE k.id = $1 AND r.id = $2`, keepID, removeID); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Merged duplicate %q (document %d) into this document", removedTitle, removeID)
+	if err := jobs.RecordStatus(tx, keepID, userID, "merged", status, message); err != nil {
+		return err
+	}
+	files, err := deleteDocumentTx(tx, userID, removeID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	h.deleteFiles(files)
+	return nil
+}
+
+// Duplicates handles GET /duplicates, the near-duplicate review page.
+func (h *DocumentHandler) Duplicates(w http.ResponseWriter, r *http.Request) {
+	userID := h.userID(r)
+	pairs, err := h.duplicatePairs(userID)
+	if err != nil {
+		log.Printf("Error finding duplicates for user %d: %v", userID, err)
+		http.Error(w, "Failed to find duplicates", http.StatusInternalServerError)
+		return
+	}
+	username := h.Session.GetString(r.Context(), "username")
+	if err := template.DuplicatesPage(username, pairs, h.Session.PopString(r.Context(), "flash_error")).Render(r.Context(), w); err != nil {
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
+
+// formID reads a document ID from a form field.
+func formID(r *http.Request, name string) int {
+	id, _ := strconv.Atoi(r.FormValue(name))
+	return id
+}
+
+// DismissDuplicate handles POST /duplicates/dismiss, which keeps both
+// documents of a pair.
+func (h *DocumentHandler) DismissDuplicate(w http.ResponseWriter, r *http.Request) {
+	h.finishDuplicateAction(w, r, "keep both documents", h.dismissDuplicate(h.userID(r), formID(r, "document_id"), formID(r, "other_id")))
+}
+
+// MergeDuplicate handles POST /duplicates/merge, which merges the document
+// "remove" into "keep".
+func (h *DocumentHandler) MergeDuplicate(w http.ResponseWriter, r *http.Request) {
+	h.finishDuplicateAction(w, r, "merge", h.mergeDocuments(h.userID(r), formID(r, "keep"), formID(r, "remove")))
+}
+
+// DeleteDuplicate handles POST /duplicates/delete, which deletes one
+// document of a pair.
+func (h *DocumentHandler) DeleteDuplicate(w http.ResponseWriter, r *http.Request) {
+	h.finishDuplicateAction(w, r, "delete", h.deleteDocument(h.userID(r), formID(r, "remove")))
+}
+
+func (h *DocumentHandler) finishDuplicateAction(w http.ResponseWriter, r *http.Request, action string, err error) {
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errDocumentNotFound:
+		http.Error(w, "Document not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not "+action+": "+conflict.msg+".")
+	default:
+		log.Printf("Error running duplicate action %s: %v", action, err)
+		http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, localRedirect(r.FormValue("redirect"), "/duplicates"), http.StatusSeeOther)
+}
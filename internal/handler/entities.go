@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"dokeep/internal/entities"
+	"dokeep/internal/model"
+	"dokeep/web/template"
+
+	"github.com/lib/pq"
+)
+
+// errEntityNotFound is returned when a correspondent or document type does
+// not exist or is not owned by the requesting user.
+var errEntityNotFound = errors.New("entity not found")
+
+// nullableID converts a nullable foreign key to a pointer.
+func nullableID(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	id := int(n.Int64)
+	return &id
+}
+
+// listEntities returns the user's correspondents or document types with the
+// number of documents assigned to each.
+func (h *DocumentHandler) listEntities(kind entities.Kind, userID int) ([]model.Entity, error) {
+	rows, err := h.DB.Query(`
+		SELECT e.id, e.name, (SELECT COUNT(*) FROM documents WHERE `+kind.Column+` = e.id)
+		FROM `+kind.Table+` e
+		WHERE e.user_id = $1
+		ORDER BY lower(e.name)`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []model.Entity
+	for rows.Next() {
+		var e model.Entity
+		if err := rows.Scan(&e.ID, &e.Name, &e.DocumentCount); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// Correspondents returns the requesting user's correspondents for the
+// dashboard filters.
+func (h *DocumentHandler) Correspondents(r *http.Request) ([]model.Entity, error) {
+	return h.listEntities(entities.Correspondents, h.userID(r))
+}
+
+// getEntity returns one of the user's correspondents or document types.
+func (h *DocumentHandler) getEntity(kind entities.Kind, userID, id int) (model.Entity, error) {
+	var e model.Entity
+	err := h.DB.QueryRow(`
+		SELECT e.id, e.name, (SELECT COUNT(*) FROM documents WHERE `+kind.Column+` = e.id)
+		FROM `+kind.Table+` e
+		WHERE e.id = $1 AND e.user_id = $2`, id, userID).Scan(&e.ID, &e.Name, &e.DocumentCount)
+	if err == sql.ErrNoRows {
+		return e, errEntityNotFound
+	}
+	return e, err
+}
+
+// entityNameError turns a unique violation into a conflict.
+func entityNameError(kind entities.Kind, name string, err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return &conflictError{fmt.Sprintf("a %s named %q already exists", kind.Singular, name)}
+	}
+	return err
+}
+
+// createEntity adds a correspondent or document type and returns its ID.
+func (h *DocumentHandler) createEntity(kind entities.Kind, userID int, name string) (int, error) {
+	name = entities.Normalize(name)
+	if name == "" {
+		return 0, &conflictError{"the name must not be empty"}
+	}
+	var id int
+	err := h.DB.QueryRow("INSERT INTO "+kind.Table+" (user_id, name) VALUES ($1, $2) RETURNING id", userID, name).Scan(&id)
+	return id, entityNameError(kind, name, err)
+}
+
+// renameEntity renames one of the user's correspondents or document types.
+func (h *DocumentHandler) renameEntity(kind entities.Kind, userID, id int, name string) error {
+	name = entities.Normalize(name)
+	if name == "" {
+		return &conflictError{"the name must not be empty"}
+	}
+	res, err := h.DB.Exec("UPDATE "+kind.Table+" SET name = $1 WHERE id = $2 AND user_id = $3", name, id, userID)
+	if err != nil {
+		return entityNameError(kind, name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errEntityNotFound
+	}
+	return nil
+}
+
+// deleteEntity deletes one of the user's correspondents or document types.
+// Documents that used it keep no correspondent or type.
+func (h *DocumentHandler) deleteEntity(kind entities.Kind, userID, id int) error {
+	res, err := h.DB.Exec("DELETE FROM "+kind.Table+" WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errEntityNotFound
+	}
+	return nil
+}
+
+// checkEntity returns a conflictError unless the user has a correspondent or
+// document type with the ID.
+func (h *DocumentHandler) checkEntity(kind entities.Kind, userID, id int) error {
+	var exists bool
+	if err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM "+kind.Table+" WHERE id = $1 AND user_id = $2)", id, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return &conflictError{fmt.Sprintf("unknown %s %d", kind.Singular, id)}
+	}
+	return nil
+}
+
+// setDocumentEntity assigns a correspondent or document type to a document
+// owned by the user. An ID of 0 clears it.
+func (h *DocumentHandler) setDocumentEntity(kind entities.Kind, userID, documentID, id int) error {
+	var value interface{}
+	if id != 0 {
+		if err := h.checkEntity(kind, userID, id); err != nil {
+			return err
+		}
+		value = id
+	}
+	res, err := h.DB.Exec("UPDATE documents SET "+kind.Column+" = $1 WHERE id = $2 AND user_id = $3", value, documentID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errDocumentNotFound
+	}
+	return nil
+}
+
+// Entities handles GET {kind.Path}, the management page for correspondents
+// or document types.
+func (h *DocumentHandler) Entities(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := h.userID(r)
+		list, err := h.listEntities(kind, userID)
+		if err != nil {
+			log.Printf("Error listing %s for user %d: %v", kind.Table, userID, err)
+			http.Error(w, "Failed to list "+kind.Table, http.StatusInternalServerError)
+			return
+		}
+		username := h.Session.GetString(r.Context(), "username")
+		if err := template.EntitiesPage(username, kind, list, h.Session.PopString(r.Context(), "flash_error")).Render(r.Context(), w); err != nil {
+			http.Error(w, "Error rendering page", http.StatusInternalServerError)
+		}
+	}
+}
+
+// CreateEntity handles POST {kind.Path}.
+func (h *DocumentHandler) CreateEntity(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := h.createEntity(kind, h.userID(r), r.FormValue("name"))
+		h.finishEntityAction(w, r, kind, "create", err)
+	}
+}
+
+// RenameEntity handles POST {kind.Path}/{id}.
+func (h *DocumentHandler) RenameEntity(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := entityPathID(w, r)
+		if !ok {
+			return
+		}
+		h.finishEntityAction(w, r, kind, "rename", h.renameEntity(kind, h.userID(r), id, r.FormValue("name")))
+	}
+}
+
+// DeleteEntity handles POST {kind.Path}/{id}/delete.
+func (h *DocumentHandler) DeleteEntity(kind entities.Kind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := entityPathID(w, r)
+		if !ok {
+			return
+		}
+		h.finishEntityAction(w, r, kind, "delete", h.deleteEntity(kind, h.userID(r), id))
+	}
+}
+
+func (h *DocumentHandler) finishEntityAction(w http.ResponseWriter, r *http.Request, kind entities.Kind, action string, err error) {
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errEntityNotFound:
+		http.Error(w, "Not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not "+action+" "+kind.Singular+": "+conflict.msg+".")
+	default:
+		log.Printf("Error running %s %s: %v", kind.Singular, action, err)
+		http.Error(w, "Failed to "+action+" "+kind.Singular, http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, kind.Path, http.StatusSeeOther)
+}
+
+// entityPathID reads the {id} path value.
+func entityPathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
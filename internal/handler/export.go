@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"dokeep/internal/entities"
+	"dokeep/internal/model"
+)
+
+// exportPageSize is the number of documents read per query while exporting.
+const exportPageSize = 100
+
+// accountExport is everything a user has stored apart from the files
+// themselves, as returned by GET /api/v1/export.
+type accountExport struct {
+	ExportedAt     time.Time           `json:"exported_at"`
+	Username       string              `json:"username"`
+	Documents      []documentResponse  `json:"documents"`
+	Tags           []model.TagUsage    `json:"tags"`
+	Correspondents []model.Entity      `json:"correspondents"`
+	DocumentTypes  []model.Entity      `json:"document_types"`
+	CustomFields   []model.CustomField `json:"custom_fields"`
+	SavedSearches  []model.SavedSearch `json:"saved_searches"`
+}
+
+// exportAccount collects the user's data for export.
+func (h *DocumentHandler) exportAccount(userID int) (accountExport, error) {
+	export := accountExport{ExportedAt: time.Now().UTC(), Documents: []documentResponse{}}
+	if err := h.DB.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&export.Username); err != nil {
+		return export, err
+	}
+
+	opts := listOptions{Sort: "uploaded", PerPage: exportPageSize}
+	for {
+		list, err := h.listDocuments(userID, opts)
+		if err != nil {
+			return export, err
+		}
+		for _, d := range list.Documents {
+			// Load each document in full, including its processing status.
+			doc, err := h.getDocument(userID, d.ID)
+			if err != nil {
+				return export, err
+			}
+			tags, err := h.GetTags(doc.ID)
+			if err != nil {
+				return export, err
+			}
+			if tags == nil {
+				tags = []model.Tag{}
+			}
+			export.Documents = append(export.Documents, documentResponse{Document: doc, Tags: tags})
+		}
+		if list.NextCursor == "" {
+			break
+		}
+		opts.After = list.NextCursor
+	}
+
+	var err error
+	if export.Tags, err = h.listTags(userID); err != nil {
+		return export, err
+	}
+	if export.Correspondents, err = h.listEntities(entities.Correspondents, userID); err != nil {
+		return export, err
+	}
+	if export.DocumentTypes, err = h.listEntities(entities.DocumentTypes, userID); err != nil {
+		return export, err
+	}
+	if export.CustomFields, err = h.listCustomFields(userID); err != nil {
+		return export, err
+	}
+	if export.SavedSearches, err = h.listSavedSearches(userID, ""); err != nil {
+		return export, err
+	}
+	return export, nil
+}
+
+// Export handles GET /settings/export and downloads the user's data as a
+// JSON file. Document files are not included; they can be downloaded one by
+// one through the API.
+func (h *DocumentHandler) Export(w http.ResponseWriter, r *http.Request) {
+	userID := h.userID(r)
+	export, err := h.exportAccount(userID)
+	if err != nil {
+		log.Printf("Error exporting data for user %d: %v", userID, err)
+		http.Error(w, "Failed to export data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="dokeep-export-%s.json"`, export.ExportedAt.Format("2006-01-02")))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		log.Printf("Error writing export for user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"dokeep/internal/storage"
+)
+
+// Download handles GET /document/{id}/file. It serves the original upload to
+// its owner, inline unless ?download=1 is given. Range and conditional
+// requests are handled by http.ServeContent, so PDF viewers can fetch pages
+// on demand and browsers can revalidate cached copies with the ETag.
+func (h *DocumentHandler) Download(w http.ResponseWriter, r *http.Request) {
+	documentID, ok := documentPathID(w, r)
+	if !ok {
+		return
+	}
+	var key, originalFilename sql.NullString
+	err := h.DB.QueryRow("SELECT file_path, original_filename FROM documents WHERE id = $1 AND user_id = $2",
+		documentID, h.userID(r)).Scan(&key, &originalFilename)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up file for document %d: %v", documentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "1" {
+		disposition = "attachment"
+	}
+	name := originalFilename.String
+	if name == "" {
+		name = path.Base(key.String)
+	}
+	h.serveStored(w, r, key.String, disposition, name)
+}
+
+// Thumbnail handles GET /document/{id}/thumbnail.
+func (h *DocumentHandler) Thumbnail(w http.ResponseWriter, r *http.Request) {
+	documentID, ok := documentPathID(w, r)
+	if !ok {
+		return
+	}
+	var key sql.NullString
+	err := h.DB.QueryRow("SELECT thumbnail FROM documents WHERE id = $1 AND user_id = $2",
+		documentID, h.userID(r)).Scan(&key)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up thumbnail for document %d: %v", documentID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	h.serveStored(w, r, key.String, "inline", path.Base(key.String))
+}
+
+// documentPathID reads the {id} path value.
+func documentPathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid document ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// serveStored streams a stored object with the given Content-Disposition.
+func (h *DocumentHandler) serveStored(w http.ResponseWriter, r *http.Request, key, disposition, filename string) {
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if target, ok := h.signedURL(r, key, disposition, filename); ok {
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	obj, info, err := h.Storage.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error opening stored file %q: %v", key, err)
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	contentType := info.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = mime.TypeByExtension(strings.ToLower(path.Ext(filename)))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	header.Set("X-Content-Type-Options", "nosniff")
+	// Files are private to their owner and must not be kept by shared caches.
+	header.Set("Cache-Control", "private, no-cache")
+	if info.ETag != "" {
+		etag := info.ETag
+		if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+			etag = `"` + etag + `"`
+		}
+		header.Set("ETag", etag)
+	}
+	http.ServeContent(w, r, "", info.ModTime, obj)
+}
+
+// signedURL returns a presigned URL for the object if
+// storage.s3.signed_url_expiry is set and the backend supports them.
+func (h *DocumentHandler) signedURL(r *http.Request, key, disposition, filename string) (string, bool) {
+	expiry := h.Config.Storage.S3.SignedURLExpiry.Std()
+	if expiry <= 0 {
+		return "", false
+	}
+	contentType := mime.TypeByExtension(strings.ToLower(path.Ext(filename)))
+	target, err := h.Storage.SignedURL(r.Context(), key, expiry, contentType,
+		mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotSupported) {
+			log.Printf("Error signing URL for %q: %v", key, err)
+		}
+		return "", false
+	}
+	return target, true
+}
@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dokeep/internal/auth"
+	"dokeep/internal/passkey"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Session keys holding the state of a WebAuthn ceremony between its begin
+// and finish requests.
+const (
+	passkeyRegistrationKey = "passkey_registration"
+	passkeyLoginKey        = "passkey_login"
+)
+
+func (h *AuthHandler) putCeremony(r *http.Request, key string, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	h.Session.Put(r.Context(), key, data)
+	return nil
+}
+
+// takeCeremony returns the state stored by putCeremony. It can only be used
+// once.
+func (h *AuthHandler) takeCeremony(r *http.Request, key string) (webauthn.SessionData, bool) {
+	var session webauthn.SessionData
+	data := h.Session.PopBytes(r.Context(), key)
+	if data == nil || json.Unmarshal(data, &session) != nil {
+		return session, false
+	}
+	return session, true
+}
+
+// BeginPasskeyRegistration handles POST /settings/passkeys/register/begin.
+// It asks for the current password and answers with the options for
+// navigator.credentials.create.
+func (h *AuthHandler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID := h.Session.GetInt(r.Context(), "userID")
+	if _, ok := h.confirmPassword(w, r, userID); !ok {
+		return
+	}
+	options, session, err := h.Passkeys.BeginRegistration(userID)
+	if err == nil {
+		err = h.putCeremony(r, passkeyRegistrationKey, session)
+	}
+	if err != nil {
+		log.Printf("Error starting passkey registration for user %d: %v", userID, err)
+		http.Error(w, "Failed to start passkey registration", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, options)
+}
+
+// FinishPasskeyRegistration handles POST
+// /settings/passkeys/register/finish?name=..., whose body is the credential
+// created by the browser.
+func (h *AuthHandler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	userID := h.Session.GetInt(r.Context(), "userID")
+	session, ok := h.takeCeremony(r, passkeyRegistrationKey)
+	if !ok {
+		http.Error(w, "Passkey registration was not started or has expired. Please try again.", http.StatusBadRequest)
+		return
+	}
+	p, err := h.Passkeys.FinishRegistration(userID, r.URL.Query().Get("name"), session, r)
+	if err != nil {
+		log.Printf("Error registering passkey for user %d: %v", userID, err)
+		http.Error(w, "The passkey could not be registered", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// RenamePasskey handles POST /settings/passkeys/{id}/rename.
+func (h *AuthHandler) RenamePasskey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+	userID := h.Session.GetInt(r.Context(), "userID")
+	h.finishPasskeyAction(w, r, "rename", h.Passkeys.Rename(userID, id, r.FormValue("name")))
+}
+
+// DeletePasskey handles POST /settings/passkeys/{id}/delete. Like turning
+// off TOTP, it asks for the current password.
+func (h *AuthHandler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+	userID := h.Session.GetInt(r.Context(), "userID")
+	if _, ok := h.confirmPassword(w, r, userID); !ok {
+		return
+	}
+	h.finishPasskeyAction(w, r, "remove", h.Passkeys.Delete(userID, id))
+}
+
+func (h *AuthHandler) finishPasskeyAction(w http.ResponseWriter, r *http.Request, action string, err error) {
+	switch {
+	case err == nil:
+	case err == passkey.ErrNotFound:
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	default:
+		log.Printf("Error running passkey %s: %v", action, err)
+		http.Error(w, "Failed to "+action+" passkey", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// pendingUser returns the user who entered a correct password and still has
+// to give a second factor, or zero if there is none or it expired.
+func (h *AuthHandler) pendingUser(r *http.Request) int {
+	userID := h.Session.GetInt(r.Context(), "tempUserID")
+	since := h.Session.GetTime(r.Context(), "tempUserSince")
+	if userID == 0 || time.Since(since) > h.Throttle.Config.PendingTimeout.Std() {
+		h.Session.Remove(r.Context(), "tempUserID")
+		h.Session.Remove(r.Context(), "tempUserSince")
+		return 0
+	}
+	return userID
+}
+
+// BeginPasskeyLogin handles POST /login/passkey/begin. After a correct
+// password it asks for one of the user's passkeys as the second factor;
+// otherwise it starts a passwordless sign-in.
+func (h *AuthHandler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	userID := h.pendingUser(r)
+
+	var options interface{}
+	var session *webauthn.SessionData
+	var err error
+	if userID != 0 {
+		options, session, err = h.Passkeys.BeginLogin(userID)
+	} else {
+		options, session, err = h.Passkeys.BeginDiscoverableLogin()
+	}
+	if errors.Is(err, passkey.ErrNoPasskeys) {
+		http.Error(w, "You have not registered a passkey", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = h.putCeremony(r, passkeyLoginKey, session)
+	}
+	if err != nil {
+		log.Printf("Error starting passkey sign-in: %v", err)
+		http.Error(w, "Failed to start passkey sign-in", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, options)
+}
+
+// FinishPasskeyLogin handles POST /login/passkey/finish, whose body is the
+// assertion returned by the browser. On success it signs the user in.
+func (h *AuthHandler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.takeCeremony(r, passkeyLoginKey)
+	if !ok {
+		http.Error(w, "Passkey sign-in was not started or has expired. Please try again.", http.StatusBadRequest)
+		return
+	}
+	ip := h.Throttle.ClientIP(r)
+
+	// The account is only known up front for a second factor
+	userID := h.pendingUser(r)
+	var username string
+	if userID != 0 {
+		if err := h.DB.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username); err != nil {
+			http.Error(w, "Failed to retrieve user data", http.StatusInternalServerError)
+			return
+		}
+	}
+	attempt, ok := h.allowAttempt(w, username, ip, auth.AttemptPasskey)
+	if !ok {
+		return
+	}
+
+	var err error
+	if userID != 0 {
+		err = h.Passkeys.FinishLogin(userID, session, r)
+	} else {
+		userID, err = h.Passkeys.FinishDiscoverableLogin(session, r)
+	}
+
+	if userID != 0 && username == "" {
+		if err := h.DB.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username); err != nil {
+			h.discardAttempt(attempt)
+			http.Error(w, "Failed to retrieve user data", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Passkey sign-in failed from %s: %v", ip, err)
+		h.recordFailure(attempt, username, userID, auth.AttemptPasskey)
+		http.Error(w, "The passkey could not be verified", http.StatusUnauthorized)
+		return
+	}
+	h.completeLogin(w, r, attempt, userID, username, ip, auth.AttemptPasskey)
+}
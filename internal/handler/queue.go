@@ -0,0 +1,351 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"dokeep/internal/jobs"
+	"dokeep/internal/model"
+)
+
+// conflictError is returned when an action does not apply to a document in
+// its current state, e.g. retrying a document that has not failed.
+type conflictError struct {
+	msg string
+}
+
+func (e *conflictError) Error() string { return e.msg }
+
+// ReprocessOptions selects the steps rerun by reprocessDocument.
+type ReprocessOptions struct {
+	// OCR reruns text extraction and thumbnail generation.
+	OCR bool `json:"ocr"`
+	// LLM reruns the analysis that suggests the title, summary, date and
+	// tags.
+	LLM bool `json:"llm"`
+	// KeepEdits keeps the current title, summary, date and tags and only
+	// fills in fields that are empty.
+	KeepEdits bool `json:"keep_edits"`
+}
+
+func (o ReprocessOptions) String() string {
+	var steps []string
+	if o.OCR {
+		steps = append(steps, "OCR")
+	}
+	if o.LLM {
+		steps = append(steps, "analysis")
+	}
+	s := strings.Join(steps, " and ")
+	if o.LLM && o.KeepEdits {
+		s += ", keeping edits"
+	}
+	return s
+}
+
+// lockDocument locks a document owned by userID for the rest of tx and returns
+// its status.
+func lockDocument(tx *sql.Tx, userID, documentID int) (string, error) {
+	var status string
+	err := tx.QueryRow("SELECT status FROM documents WHERE id = $1 AND user_id = $2 FOR UPDATE", documentID, userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", errDocumentNotFound
+	}
+	return status, err
+}
+
+// setDocumentStatus updates a document's status and records the change in its
+// history.
+func setDocumentStatus(tx *sql.Tx, userID, documentID int, action, status, message string) error {
+	if _, err := tx.Exec("UPDATE documents SET status = $1, status_message = $2 WHERE id = $3", status, message, documentID); err != nil {
+		return err
+	}
+	return jobs.RecordStatus(tx, documentID, userID, action, status, message)
+}
+
+// retryDocument queues a failed or cancelled document again. The job that
+// stopped is resumed with a fresh set of attempts, so a document whose
+// analysis failed does not repeat OCR.
+func (h *DocumentHandler) retryDocument(userID, documentID int) error {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, err := lockDocument(tx, userID, documentID)
+	if err != nil {
+		return err
+	}
+	if status != "failed" && status != "cancelled" {
+		return &conflictError{fmt.Sprintf("only failed or cancelled documents can be retried, this one is %s", status)}
+	}
+
+	requeued, err := jobs.Requeue(tx, documentID)
+	if err != nil {
+		return err
+	}
+	if !requeued {
+		if err := jobs.Enqueue(tx, documentID, jobs.KindOCR, nil, h.Config.Worker.MaxAttempts); err != nil {
+			return err
+		}
+	}
+	if err := setDocumentStatus(tx, userID, documentID, "retry", "queued", ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// cancelDocument withdraws a queued document's pending jobs. A document that
+// a worker has already picked up cannot be cancelled.
+func (h *DocumentHandler) cancelDocument(userID, documentID int) error {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, err := lockDocument(tx, userID, documentID)
+	if err != nil {
+		return err
+	}
+	if status != "queued" {
+		return &conflictError{fmt.Sprintf("only queued documents can be cancelled, this one is %s", status)}
+	}
+
+	n, err := jobs.CancelPending(tx, documentID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return &conflictError{"the document is already being processed"}
+	}
+	if err := setDocumentStatus(tx, userID, documentID, "cancel", "cancelled", "Cancelled by user"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reprocessDocument reruns OCR and/or analysis for a document that is not
+// currently queued or processing.
+func (h *DocumentHandler) reprocessDocument(userID, documentID int, opts ReprocessOptions) error {
+	if !opts.OCR && !opts.LLM {
+		return &conflictError{"choose OCR, analysis or both to reprocess"}
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, err := lockDocument(tx, userID, documentID)
+	if err != nil {
+		return err
+	}
+	if status == "queued" || status == "processing" {
+		return &conflictError{fmt.Sprintf("the document is already %s", status)}
+	}
+
+	if opts.OCR {
+		err = jobs.Enqueue(tx, documentID, jobs.KindOCR, jobs.OCRPayload{SkipAnalysis: !opts.LLM, Overwrite: !opts.KeepEdits}, h.Config.Worker.MaxAttempts)
+	} else {
+		err = jobs.Enqueue(tx, documentID, jobs.KindAnalyze, jobs.AnalyzePayload{Overwrite: !opts.KeepEdits}, h.Config.Worker.MaxAttempts)
+	}
+	if err != nil {
+		return err
+	}
+	if err := setDocumentStatus(tx, userID, documentID, "reprocess", "queued", "Reprocessing "+opts.String()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// statusHistory returns a document's status changes, newest first.
+func (h *DocumentHandler) statusHistory(userID, documentID int) ([]model.StatusEvent, error) {
+	if err := h.ownsDocument(userID, documentID); err != nil {
+		return nil, err
+	}
+	rows, err := h.DB.Query(`
+		SELECT s.id, s.action, s.status, s.message, COALESCE(u.username, ''), s.created_at
+		FROM document_status_history s
+		LEFT JOIN users u ON u.id = s.user_id
+		WHERE s.document_id = $1
+		ORDER BY s.created_at DESC, s.id DESC`, documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []model.StatusEvent
+	for rows.Next() {
+		var e model.StatusEvent
+		if err := rows.Scan(&e.ID, &e.Action, &e.Status, &e.Message, &e.Username, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// documentAction applies a queue action to one document.
+func (h *DocumentHandler) documentAction(userID, documentID int, action string, opts ReprocessOptions) error {
+	switch action {
+	case "retry":
+		return h.retryDocument(userID, documentID)
+	case "cancel":
+		return h.cancelDocument(userID, documentID)
+	case "reprocess":
+		return h.reprocessDocument(userID, documentID, opts)
+	}
+	return &conflictError{fmt.Sprintf("unknown action %q", action)}
+}
+
+// reprocessOptions reads the reprocess checkboxes of a form.
+func reprocessOptions(r *http.Request) ReprocessOptions {
+	return ReprocessOptions{
+		OCR:       r.FormValue("ocr") != "",
+		LLM:       r.FormValue("llm") != "",
+		KeepEdits: r.FormValue("keep_edits") != "",
+	}
+}
+
+// localRedirect returns target if it is a path on this site, otherwise
+// fallback.
+func localRedirect(target, fallback string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return fallback
+	}
+	return target
+}
+
+// Retry handles POST /document/{id}/retry.
+func (h *DocumentHandler) Retry(w http.ResponseWriter, r *http.Request) {
+	h.handleAction(w, r, "retry")
+}
+
+// Cancel handles POST /document/{id}/cancel.
+func (h *DocumentHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	h.handleAction(w, r, "cancel")
+}
+
+// Reprocess handles POST /document/{id}/reprocess.
+func (h *DocumentHandler) Reprocess(w http.ResponseWriter, r *http.Request) {
+	h.handleAction(w, r, "reprocess")
+}
+
+func (h *DocumentHandler) handleAction(w http.ResponseWriter, r *http.Request, action string) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 {
+		http.Error(w, "Invalid URL path", http.StatusBadRequest)
+		return
+	}
+	documentID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "Invalid document ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := h.userID(r)
+	redirect := localRedirect(r.FormValue("redirect"), "/queue")
+
+	err = h.documentAction(userID, documentID, action, reprocessOptions(r))
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errDocumentNotFound:
+		http.Error(w, "Document not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not "+action+" document: "+conflict.msg+".")
+	default:
+		log.Printf("Error running %s for document %d: %v", action, documentID, err)
+		http.Error(w, "Failed to "+action+" document", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// BulkAction handles POST /queue/actions. It applies action to every
+// selected document, or with all=failed to every failed document, and
+// reports the documents it could not change.
+func (h *DocumentHandler) BulkAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	userID := h.userID(r)
+	action := r.FormValue("action")
+	redirect := localRedirect(r.FormValue("redirect"), "/queue")
+
+	var ids []int
+	if r.FormValue("all") == "failed" {
+		var err error
+		if ids, err = h.documentIDsByStatus(userID, "failed"); err != nil {
+			log.Printf("Error listing failed documents for user %d: %v", userID, err)
+			http.Error(w, "Failed to list documents", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		for _, v := range r.Form["ids"] {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid document ID", http.StatusBadRequest)
+				return
+			}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		h.Session.Put(r.Context(), "flash_error", "No documents selected.")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	opts := reprocessOptions(r)
+	var failed []string
+	for _, id := range ids {
+		err := h.documentAction(userID, id, action, opts)
+		var conflict *conflictError
+		switch {
+		case err == nil:
+		case err == errDocumentNotFound:
+			failed = append(failed, fmt.Sprintf("#%d: not found", id))
+		case errors.As(err, &conflict):
+			failed = append(failed, fmt.Sprintf("#%d: %s", id, conflict.msg))
+		default:
+			log.Printf("Error running %s for document %d: %v", action, id, err)
+			failed = append(failed, fmt.Sprintf("#%d: internal error", id))
+		}
+	}
+	if len(failed) > 0 {
+		h.Session.Put(r.Context(), "flash_error", fmt.Sprintf("%d of %d documents could not be changed (%s).", len(failed), len(ids), strings.Join(failed, "; ")))
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// documentIDsByStatus returns the IDs of the user's documents in a status.
+func (h *DocumentHandler) documentIDsByStatus(userID int, status string) ([]int, error) {
+	rows, err := h.DB.Query("SELECT id FROM documents WHERE user_id = $1 AND status = $2 ORDER BY id", userID, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"dokeep/internal/model"
+	"dokeep/internal/search"
+	"dokeep/web/template"
+
+	"github.com/lib/pq"
+)
+
+// errSavedSearchNotFound is returned when a saved search does not exist or
+// is not owned by the requesting user.
+var errSavedSearchNotFound = errors.New("saved search not found")
+
+// dashboardViewSize is the number of documents shown in a dashboard widget.
+const dashboardViewSize = 5
+
+// savedSearchUpdate holds the saved search fields that can be changed. Nil
+// fields keep their current value.
+type savedSearchUpdate struct {
+	Name            *string                `json:"name"`
+	Query           *string                `json:"query"`
+	Sort            *string                `json:"sort"`
+	Filters         *model.DocumentFilters `json:"filters"`
+	Pinned          *bool                  `json:"pinned"`
+	ShowOnDashboard *bool                  `json:"show_on_dashboard"`
+}
+
+const savedSearchColumns = "id, name, query, sort, filters, pinned, show_on_dashboard, created_at"
+
+func scanSavedSearch(row interface{ Scan(...interface{}) error }) (model.SavedSearch, error) {
+	var s model.SavedSearch
+	var filters []byte
+	err := row.Scan(&s.ID, &s.Name, &s.Query, &s.Sort, &filters, &s.Pinned, &s.ShowOnDashboard, &s.CreatedAt)
+	if err == nil {
+		err = json.Unmarshal(filters, &s.Filters)
+	}
+	return s, err
+}
+
+// listSavedSearches returns the user's saved searches, optionally only those
+// matching an extra condition on the saved_searches table, each with its
+// current number of matching documents.
+func (h *DocumentHandler) listSavedSearches(userID int, condition string) ([]model.SavedSearch, error) {
+	where := "user_id = $1"
+	if condition != "" {
+		where += " AND " + condition
+	}
+	rows, err := h.DB.Query("SELECT "+savedSearchColumns+" FROM saved_searches WHERE "+where+" ORDER BY lower(name)", userID)
+	if err != nil {
+		return nil, err
+	}
+	var list []model.SavedSearch
+	for rows.Next() {
+		s, err := scanSavedSearch(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range list {
+		list[i].DocumentCount = h.savedSearchCount(userID, list[i])
+	}
+	return list, nil
+}
+
+// savedSearchCount counts the documents matching a saved search. A query
+// that no longer parses, for example because a custom field it uses was
+// deleted, matches nothing.
+func (h *DocumentHandler) savedSearchCount(userID int, s model.SavedSearch) int {
+	count, err := h.countDocuments(userID, s.Query, s.Filters)
+	var queryErr *search.Error
+	if err != nil && !errors.As(err, &queryErr) {
+		log.Printf("Error counting saved search %d: %v", s.ID, err)
+	}
+	return count
+}
+
+// getSavedSearch returns one of the user's saved searches.
+func (h *DocumentHandler) getSavedSearch(userID, id int) (model.SavedSearch, error) {
+	s, err := scanSavedSearch(h.DB.QueryRow("SELECT "+savedSearchColumns+" FROM saved_searches WHERE id = $1 AND user_id = $2", id, userID))
+	if err == sql.ErrNoRows {
+		return s, errSavedSearchNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+	s.DocumentCount = h.savedSearchCount(userID, s)
+	return s, nil
+}
+
+// checkSavedSearch normalizes a saved search and rejects queries and filters
+// that are invalid, so that a saved search always opens a working result list.
+func (h *DocumentHandler) checkSavedSearch(userID int, s *model.SavedSearch) error {
+	s.Name = strings.Join(strings.Fields(s.Name), " ")
+	s.Query = strings.TrimSpace(s.Query)
+	s.Sort = strings.TrimSpace(s.Sort)
+	if s.Name == "" {
+		return &conflictError{"the name must not be empty"}
+	}
+	_, err := h.filterDocuments(userID, s.Query, s.Filters)
+	var queryErr *search.Error
+	if errors.As(err, &queryErr) {
+		return &conflictError{"invalid query: " + queryErr.Error()}
+	}
+	return err
+}
+
+// savedSearchNameError turns a unique violation into a conflict.
+func savedSearchNameError(name string, err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return &conflictError{fmt.Sprintf("a saved search named %q already exists", name)}
+	}
+	return err
+}
+
+// createSavedSearch stores a new saved search and returns its ID.
+func (h *DocumentHandler) createSavedSearch(userID int, s model.SavedSearch) (int, error) {
+	if err := h.checkSavedSearch(userID, &s); err != nil {
+		return 0, err
+	}
+	filters, err := json.Marshal(s.Filters)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = h.DB.QueryRow(`
+		INSERT INTO saved_searches (user_id, name, query, sort, filters, pinned, show_on_dashboard)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		userID, s.Name, s.Query, s.Sort, filters, s.Pinned, s.ShowOnDashboard).Scan(&id)
+	return id, savedSearchNameError(s.Name, err)
+}
+
+// updateSavedSearch changes one of the user's saved searches.
+func (h *DocumentHandler) updateSavedSearch(userID, id int, u savedSearchUpdate) error {
+	s, err := h.getSavedSearch(userID, id)
+	if err != nil {
+		return err
+	}
+	if u.Name != nil {
+		s.Name = *u.Name
+	}
+	if u.Query != nil {
+		s.Query = *u.Query
+	}
+	if u.Sort != nil {
+		s.Sort = *u.Sort
+	}
+	if u.Filters != nil {
+		s.Filters = *u.Filters
+	}
+	if u.Pinned != nil {
+		s.Pinned = *u.Pinned
+	}
+	if u.ShowOnDashboard != nil {
+		s.ShowOnDashboard = *u.ShowOnDashboard
+	}
+	if err := h.checkSavedSearch(userID, &s); err != nil {
+		return err
+	}
+	filters, err := json.Marshal(s.Filters)
+	if err != nil {
+		return err
+	}
+	res, err := h.DB.Exec(`
+		UPDATE saved_searches SET name = $1, query = $2, sort = $3, filters = $4, pinned = $5, show_on_dashboard = $6
+		WHERE id = $7 AND user_id = $8`,
+		s.Name, s.Query, s.Sort, filters, s.Pinned, s.ShowOnDashboard, id, userID)
+	if err != nil {
+		return savedSearchNameError(s.Name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errSavedSearchNotFound
+	}
+	return nil
+}
+
+// deleteSavedSearch removes one of the user's saved searches.
+func (h *DocumentHandler) deleteSavedSearch(userID, id int) error {
+	res, err := h.DB.Exec("DELETE FROM saved_searches WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errSavedSearchNotFound
+	}
+	return nil
+}
+
+// DashboardViews returns the saved searches the user shows on the dashboard,
+// each with its most relevant documents.
+func (h *DocumentHandler) DashboardViews(r *http.Request) ([]model.SavedView, error) {
+	userID := h.userID(r)
+	list, err := h.listSavedSearches(userID, "show_on_dashboard")
+	if err != nil {
+		return nil, err
+	}
+	views := make([]model.SavedView, 0, len(list))
+	for _, s := range list {
+		list, err := h.listDocuments(userID, listOptions{Query: s.Query, Sort: s.Sort, Filters: s.Filters, PerPage: dashboardViewSize})
+		var queryErr *search.Error
+		if err != nil && !errors.As(err, &queryErr) {
+			return nil, err
+		}
+		views = append(views, model.SavedView{SavedSearch: s, Documents: list.Documents})
+	}
+	return views, nil
+}
+
+// Sidebar makes the signed-in user's pinned searches available to the page
+// layout. They are only loaded if a page actually renders the sidebar.
+func (h *DocumentHandler) Sidebar(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := h.Session.GetInt(r.Context(), "userID")
+		if userID == 0 || strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := template.WithPinnedSearches(r.Context(), func() []model.SavedSearch {
+			list, err := h.listSavedSearches(userID, "pinned")
+			if err != nil {
+				log.Printf("Error loading pinned searches for user %d: %v", userID, err)
+			}
+			return list
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SavedSearches handles GET /saved-searches, the page for managing saved
+// searches.
+func (h *DocumentHandler) SavedSearches(w http.ResponseWriter, r *http.Request) {
+	userID := h.userID(r)
+	list, err := h.listSavedSearches(userID, "")
+	if err != nil {
+		log.Printf("Error listing saved searches for user %d: %v", userID, err)
+		http.Error(w, "Failed to list saved searches", http.StatusInternalServerError)
+		return
+	}
+	username := h.Session.GetString(r.Context(), "username")
+	if err := template.SavedSearchesPage(username, list, h.Session.PopString(r.Context(), "flash_error")).Render(r.Context(), w); err != nil {
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
+
+// CreateSavedSearch handles POST /saved-searches, used by the "Save search"
+// form on the dashboard.
+func (h *DocumentHandler) CreateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	_, err := h.createSavedSearch(h.userID(r), model.SavedSearch{
+		Name:            r.FormValue("name"),
+		Query:           r.FormValue("q"),
+		Sort:            r.FormValue("sort"),
+		Filters:         model.FiltersFromQuery(r.Form),
+		Pinned:          r.FormValue("pinned") != "",
+		ShowOnDashboard: r.FormValue("show_on_dashboard") != "",
+	})
+	h.finishSavedSearchAction(w, r, "save", err)
+}
+
+// UpdateSavedSearch handles POST /saved-searches/{id}.
+func (h *DocumentHandler) UpdateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	id, ok := entityPathID(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	name, query, sort := r.FormValue("name"), r.FormValue("q"), r.FormValue("sort")
+	filters := model.FiltersFromQuery(r.Form)
+	pinned, showOnDashboard := r.FormValue("pinned") != "", r.FormValue("show_on_dashboard") != ""
+	h.finishSavedSearchAction(w, r, "update", h.updateSavedSearch(h.userID(r), id, savedSearchUpdate{
+		Name: &name, Query: &query, Sort: &sort, Filters: &filters, Pinned: &pinned, ShowOnDashboard: &showOnDashboard,
+	}))
+}
+
+// DeleteSavedSearch handles POST /saved-searches/{id}/delete.
+func (h *DocumentHandler) DeleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	id, ok := entityPathID(w, r)
+	if !ok {
+		return
+	}
+	h.finishSavedSearchAction(w, r, "delete", h.deleteSavedSearch(h.userID(r), id))
+}
+
+func (h *DocumentHandler) finishSavedSearchAction(w http.ResponseWriter, r *http.Request, action string, err error) {
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errSavedSearchNotFound:
+		http.Error(w, "Saved search not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not "+action+" search: "+conflict.msg+".")
+	default:
+		log.Printf("Error running saved search %s: %v", action, err)
+		http.Error(w, "Failed to "+action+" search", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/saved-searches", http.StatusSeeOther)
+}
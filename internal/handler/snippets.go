@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"strings"
+
+	"dokeep/internal/model"
+	"dokeep/internal/search"
+
+	"github.com/lib/pq"
+)
+
+// Matches in ts_headline output are wrapped in control characters that do
+// not occur in extracted text, so the result can be split into plain text
+// and matches without trusting it as HTML.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// snippetOptions configure ts_headline for result snippets: up to two short
+// passages around the matches.
+var snippetOptions = `StartSel="` + highlightStart + `", StopSel="` + highlightStop + `", MaxFragments=2, MaxWords=18, MinWords=6, FragmentDelimiter=" … "`
+
+// fullTextOptions highlight every match in a document's whole text.
+var fullTextOptions = `StartSel="` + highlightStart + `", StopSel="` + highlightStop + `", HighlightAll=true`
+
+// splitHighlights turns ts_headline output into text parts.
+func splitHighlights(s string) []model.Highlight {
+	var parts []model.Highlight
+	match := false
+	for s != "" {
+		sep := highlightStart
+		if match {
+			sep = highlightStop
+		}
+		text, rest, found := strings.Cut(s, sep)
+		if text != "" {
+			parts = append(parts, model.Highlight{Text: text, Match: match})
+		}
+		if !found {
+			break
+		}
+		s, match = rest, !match
+	}
+	return parts
+}
+
+// hasMatch reports whether any part is a match.
+func hasMatch(parts []model.Highlight) bool {
+	for _, p := range parts {
+		if p.Match {
+			return true
+		}
+	}
+	return false
+}
+
+// searchText returns the free text of a query for highlighting, or "" if
+// the query has none or does not parse.
+func (h *DocumentHandler) searchText(userID int, query string) string {
+	if strings.TrimSpace(query) == "" {
+		return ""
+	}
+	fields, err := h.customFieldsByKey(userID)
+	if err != nil {
+		return ""
+	}
+	parsed, err := search.Parse(query, fields)
+	if err != nil || parsed == nil {
+		return ""
+	}
+	return search.FreeText(parsed)
+}
+
+// documentSnippets returns, for each document matching the free text, the
+// passages of its content that match best. Documents whose content does not
+// match fall back to their summary; those that matched only by title or tag
+// get no snippet.
+func (h *DocumentHandler) documentSnippets(ids []int, text string) (map[int][]model.Highlight, error) {
+	snippets := make(map[int][]model.Highlight)
+	if len(ids) == 0 || text == "" {
+		return snippets, nil
+	}
+	rows, err := h.DB.Query(`
+		WITH q AS (SELECT websearch_to_tsquery('english', $2) AS query)
+		SELECT d.id,
+			CASE WHEN to_tsvector('english', coalesce(d.content, '')) @@ q.query
+				THEN ts_headline('english', d.content, q.query, $3)
+				ELSE ts_headline('english', coalesce(d.summary, ''), q.query, $3)
+			END
+		FROM documents d, q
+		WHERE d.id = ANY($1)`, pq.Array(ids), text, snippetOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var headline string
+		if err := rows.Scan(&id, &headline); err != nil {
+			return nil, err
+		}
+		if parts := splitHighlights(headline); hasMatch(parts) {
+			snippets[id] = parts
+		}
+	}
+	return snippets, rows.Err()
+}
+
+// highlightContent returns a document's whole text with the matches of the
+// free text marked, or nil if nothing matches.
+func (h *DocumentHandler) highlightContent(userID, id int, text string) ([]model.Highlight, error) {
+	if text == "" {
+		return nil, nil
+	}
+	var headline string
+	err := h.DB.QueryRow(`
+		SELECT ts_headline('english', coalesce(content, ''), websearch_to_tsquery('english', $3), $4)
+		FROM documents WHERE id = $1 AND user_id = $2`, id, userID, text, fullTextOptions).Scan(&headline)
+	if err != nil {
+		return nil, err
+	}
+	if parts := splitHighlights(headline); hasMatch(parts) {
+		return parts, nil
+	}
+	return nil, nil
+}
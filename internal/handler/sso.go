@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"net/http"
+
+	"dokeep/internal/auth"
+	"dokeep/internal/sso"
+
+	"golang.org/x/oauth2"
+)
+
+// Session keys holding the state of a single sign-on between the redirect to
+// the provider and its callback.
+const (
+	ssoStateKey    = "oidc_state"
+	ssoNonceKey    = "oidc_nonce"
+	ssoVerifierKey = "oidc_verifier"
+	// ssoLinkKey holds the user whose account the sign-in is linked to,
+	// instead of signing in.
+	ssoLinkKey = "oidc_link"
+)
+
+// StartSingleSignOn handles GET /login/oidc and redirects to the provider's
+// sign-in page.
+func (h *AuthHandler) StartSingleSignOn(w http.ResponseWriter, r *http.Request) {
+	if h.SSO == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.Session.Remove(r.Context(), ssoLinkKey)
+	h.redirectToProvider(w, r)
+}
+
+func (h *AuthHandler) redirectToProvider(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := rand.Text(), rand.Text(), oauth2.GenerateVerifier()
+	target, err := h.SSO.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		log.Printf("Error starting single sign-on: %v", err)
+		http.Error(w, "The identity provider is not available", http.StatusBadGateway)
+		return
+	}
+	h.Session.Put(r.Context(), ssoStateKey, state)
+	h.Session.Put(r.Context(), ssoNonceKey, nonce)
+	h.Session.Put(r.Context(), ssoVerifierKey, verifier)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// SingleSignOnCallback handles GET /login/oidc/callback, where the provider
+// redirects back to. The provider is trusted to have checked any second
+// factor, so Dokeep's TOTP and passkeys are not asked for.
+func (h *AuthHandler) SingleSignOnCallback(w http.ResponseWriter, r *http.Request) {
+	if h.SSO == nil {
+		http.NotFound(w, r)
+		return
+	}
+	state := h.Session.PopString(r.Context(), ssoStateKey)
+	nonce := h.Session.PopString(r.Context(), ssoNonceKey)
+	verifier := h.Session.PopString(r.Context(), ssoVerifierKey)
+	linkUserID := h.Session.PopInt(r.Context(), ssoLinkKey)
+
+	query := r.URL.Query()
+	if msg := query.Get("error"); msg != "" {
+		if desc := query.Get("error_description"); desc != "" {
+			msg = desc
+		}
+		http.Error(w, "Single sign-on failed: "+msg, http.StatusUnauthorized)
+		return
+	}
+	if state == "" || query.Get("state") != state {
+		http.Error(w, "Single sign-on was not started or has expired. Please try again.", http.StatusBadRequest)
+		return
+	}
+
+	id, err := h.SSO.Exchange(r.Context(), query.Get("code"), nonce, verifier)
+	if errors.Is(err, sso.ErrNoUsername) {
+		http.Error(w, "Single sign-on failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error completing single sign-on: %v", err)
+		http.Error(w, "Single sign-on failed", http.StatusUnauthorized)
+		return
+	}
+
+	if linkUserID != 0 {
+		h.finishLinkSingleSignOn(w, r, linkUserID, id)
+		return
+	}
+
+	userID, username, err := sso.SignIn(h.DB, h.SSO.Config, id)
+	var taken *sso.UsernameTakenError
+	switch {
+	case err == nil:
+	case errors.Is(err, sso.ErrNoAccount), errors.Is(err, sso.ErrAlreadyLinked), errors.As(err, &taken):
+		http.Error(w, "Could not sign in: "+err.Error()+".", http.StatusForbidden)
+		return
+	default:
+		log.Printf("Error signing in %q with single sign-on: %v", id.Username, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	h.completeLogin(w, r, 0, userID, username, h.Throttle.ClientIP(r), auth.AttemptSingleSignOn)
+}
+
+// LinkSingleSignOn handles POST /settings/oidc/link. After the password is
+// confirmed it signs in at the provider and links that account to the
+// current user.
+func (h *AuthHandler) LinkSingleSignOn(w http.ResponseWriter, r *http.Request) {
+	if h.SSO == nil {
+		http.NotFound(w, r)
+		return
+	}
+	userID := h.Session.GetInt(r.Context(), "userID")
+	if _, ok := h.confirmPassword(w, r, userID); !ok {
+		return
+	}
+	h.Session.Put(r.Context(), ssoLinkKey, userID)
+	h.redirectToProvider(w, r)
+}
+
+func (h *AuthHandler) finishLinkSingleSignOn(w http.ResponseWriter, r *http.Request, userID int, id sso.Identity) {
+	if h.Session.GetInt(r.Context(), "userID") != userID {
+		http.Error(w, "Your session has changed. Please try again.", http.StatusBadRequest)
+		return
+	}
+	err := sso.Link(h.DB, userID, id)
+	if errors.Is(err, sso.ErrAlreadyLinked) {
+		http.Error(w, "Could not link account: "+err.Error()+".", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error linking single sign-on for user %d: %v", userID, err)
+		http.Error(w, "Failed to link account", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// UnlinkSingleSignOn handles POST /settings/oidc/unlink. It asks for the
+// current password, which also keeps accounts created at single sign-on,
+// which have none, from locking themselves out.
+func (h *AuthHandler) UnlinkSingleSignOn(w http.ResponseWriter, r *http.Request) {
+	if h.SSO == nil {
+		http.NotFound(w, r)
+		return
+	}
+	userID := h.Session.GetInt(r.Context(), "userID")
+	if _, ok := h.confirmPassword(w, r, userID); !ok {
+		return
+	}
+	if err := sso.Unlink(h.DB, userID, h.SSO.Config.Issuer); err != nil {
+		log.Printf("Error unlinking single sign-on for user %d: %v", userID, err)
+		http.Error(w, "Failed to unlink account", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"dokeep/internal/config"
+	"dokeep/internal/sso"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+// newSSOHandler returns a handler for a provider whose token endpoint
+// rejects every code.
+func newSSOHandler(t *testing.T) *AuthHandler {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":                 srv.URL,
+				"authorization_endpoint": srv.URL + "/auth",
+				"token_endpoint":         srv.URL + "/token",
+				"jwks_uri":               srv.URL + "/keys",
+			})
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &AuthHandler{
+		Session: scs.New(),
+		SSO:     sso.New(config.OIDCConfig{Issuer: srv.URL, ClientID: "dokeep", RedirectURL: "http://localhost:8081/login/oidc/callback"}),
+	}
+}
+
+// serve runs handler with the session in cookie, and returns the response
+// and the session cookie afterwards.
+func serve(h *AuthHandler, handler http.HandlerFunc, target string, cookie *http.Cookie) (*httptest.ResponseRecorder, *http.Cookie) {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.Session.LoadAndSave(handler).ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == h.Session.Cookie.Name {
+			cookie = c
+		}
+	}
+	return w, cookie
+}
+
+// start begins a sign-on and returns the state sent to the provider.
+func start(t *testing.T, h *AuthHandler) (string, *http.Cookie) {
+	t.Helper()
+	w, cookie := serve(h, h.StartSingleSignOn, "/login/oidc", nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("StartSingleSignOn = %d %s", w.Code, w.Body)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("state") == "" || q.Get("nonce") == "" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("redirected to %s", u)
+	}
+	return q.Get("state"), cookie
+}
+
+func TestSingleSignOnCallbackState(t *testing.T) {
+	h := newSSOHandler(t)
+
+	state, cookie := start(t, h)
+	w, cookie := serve(h, h.SingleSignOnCallback, "/login/oidc/callback?code=c&state=forged", cookie)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("callback with another state = %d, want 400", w.Code)
+	}
+	// The state was used up by the failed attempt
+	if w, _ := serve(h, h.SingleSignOnCallback, "/login/oidc/callback?code=c&state="+state, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("callback after a failed attempt = %d, want 400", w.Code)
+	}
+
+	if w, _ := serve(h, h.SingleSignOnCallback, "/login/oidc/callback?code=c&state=", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("callback without a session = %d, want 400", w.Code)
+	}
+
+	_, cookie = start(t, h)
+	w, _ = serve(h, h.SingleSignOnCallback, "/login/oidc/callback?error=access_denied&error_description=Denied", cookie)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Denied") {
+		t.Errorf("callback with an error = %d %q", w.Code, w.Body)
+	}
+}
+
+func TestSingleSignOnCallbackRejectedCode(t *testing.T) {
+	h := newSSOHandler(t)
+	state, cookie := start(t, h)
+	w, _ := serve(h, h.SingleSignOnCallback, "/login/oidc/callback?code=c&state="+state, cookie)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("callback with a code the provider rejects = %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"dokeep/internal/model"
+	"dokeep/internal/search"
+)
+
+// suggestionLimit is the number of completions returned per kind.
+const suggestionLimit = 5
+
+// suggestion is an autocomplete entry for the search box. Choosing it either
+// replaces the query with Query or, for a title, opens the document at URL.
+type suggestion struct {
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+	Query string `json:"query,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+// correctedWord returns the word from the user's titles, tags and
+// correspondents that is most similar to word, or "" if none is close.
+func (h *DocumentHandler) correctedWord(userID int, word string) (string, error) {
+	rows, err := h.DB.Query(`
+		SELECT w FROM (
+			SELECT regexp_split_to_table(lower(title), '[^[:alnum:]]+') AS w FROM documents WHERE user_id = $1
+			UNION SELECT regexp_split_to_table(lower(name), '[^[:alnum:]]+') FROM tags WHERE user_id = $1
+			UNION SELECT regexp_split_to_table(lower(name), '[^[:alnum:]]+') FROM correspondents WHERE user_id = $1
+		) words
+		WHERE length(w) >= 3 AND w % lower($2)
+		ORDER BY similarity(w, lower($2)) DESC, w
+		LIMIT 1`, userID, word)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var best string
+	if rows.Next() {
+		if err := rows.Scan(&best); err != nil {
+			return "", err
+		}
+	}
+	return best, rows.Err()
+}
+
+// didYouMean suggests a spelling of a query that finds documents, or ""
+// if there is none. Only bare words are corrected.
+func (h *DocumentHandler) didYouMean(userID int, query string, filters model.DocumentFilters, fields map[string]model.CustomField) (string, error) {
+	var err error
+	suggested, rewriteErr := search.Rewrite(query, fields, func(word string) string {
+		if err != nil || utf8.RuneCountInString(word) < 3 {
+			return word
+		}
+		var best string
+		if best, err = h.correctedWord(userID, word); err != nil || best == "" || best == strings.ToLower(word) {
+			return word
+		}
+		return best
+	})
+	if err != nil {
+		return "", err
+	}
+	if rewriteErr != nil || suggested == query {
+		return "", nil
+	}
+	count, err := h.countDocuments(userID, suggested, filters)
+	if err != nil || count == 0 {
+		return "", err
+	}
+	return suggested, nil
+}
+
+// lastToken splits a query being typed into the text before the word under
+// the cursor, the field that word is typed into, if any, and the partial
+// value itself. An open quote makes the rest of the query the partial value.
+func lastToken(q string) (prefix, field, partial string) {
+	start := strings.LastIndexFunc(q, unicode.IsSpace) + 1
+	if strings.Count(q, `"`)%2 == 1 {
+		start = strings.LastIndex(q, `"`)
+		partial = q[start+1:]
+		// Include a field directly before the quote.
+		fieldStart := start
+		if fieldStart > 0 && q[fieldStart-1] == ':' {
+			fieldStart = strings.LastIndexFunc(q[:fieldStart-1], func(r rune) bool { return !unicode.IsLetter(r) }) + 1
+			field = strings.ToLower(q[fieldStart : start-1])
+		}
+		return q[:fieldStart], field, partial
+	}
+	token := q[start:]
+	if name, value, ok := strings.Cut(token, ":"); ok && name != "" && strings.IndexFunc(name, func(r rune) bool { return !unicode.IsLetter(r) }) < 0 {
+		return q[:start], strings.ToLower(name), value
+	}
+	if strings.HasPrefix(token, "-") {
+		return q[:start+1], "", token[1:]
+	}
+	return q[:start], "", token
+}
+
+// quoteValue quotes a field value that contains spaces.
+func quoteValue(v string) string {
+	if strings.ContainsAny(v, " \t()") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// suggestions completes the partial word at the end of a query from the
+// user's tags, correspondents and titles. Names starting with the partial
+// word come first, followed by similar spellings.
+func (h *DocumentHandler) suggestions(userID int, q string) ([]suggestion, error) {
+	prefix, field, partial := lastToken(q)
+	partial = strings.TrimSpace(partial)
+	list := []suggestion{}
+	if utf8.RuneCountInString(partial) < 2 {
+		return list, nil
+	}
+
+	lookup := func(kind, table, column, searchField string) error {
+		rows, err := h.DB.Query(fmt.Sprintf(`
+			SELECT id, %[1]s FROM %[2]s
+			WHERE user_id = $1 AND (%[1]s ILIKE $2::text || '%%' OR %[1]s %% $3)
+			ORDER BY %[1]s ILIKE $2::text || '%%' DESC, similarity(%[1]s, $3) DESC, lower(%[1]s)
+			LIMIT $4`, column, table), userID, search.EscapeLike(partial), partial, suggestionLimit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err != nil {
+				return err
+			}
+			s := suggestion{Kind: kind, Label: name}
+			if searchField == "" {
+				s.URL = fmt.Sprintf("/document?id=%d", id)
+			} else {
+				s.Query = prefix + searchField + ":" + quoteValue(name) + " "
+			}
+			list = append(list, s)
+		}
+		return rows.Err()
+	}
+
+	switch field {
+	case "":
+		for _, l := range [][4]string{
+			{"tag", "tags", "name", "tag"},
+			{"correspondent", "correspondents", "name", "correspondent"},
+			{"title", "documents", "title", ""},
+		} {
+			if err := lookup(l[0], l[1], l[2], l[3]); err != nil {
+				return nil, err
+			}
+		}
+	case "tag", "tags":
+		// lookup appends to list, so it has to run before list is returned
+		err := lookup("tag", "tags", "name", "tag")
+		return list, err
+	case "correspondent", "from":
+		err := lookup("correspondent", "correspondents", "name", "correspondent")
+		return list, err
+	case "title":
+		err := lookup("title", "documents", "title", "")
+		return list, err
+	}
+	return list, nil
+}
+
+// Suggest handles GET /search/suggest, which autocompletes the q parameter
+// as it is typed into the dashboard search box.
+func (h *DocumentHandler) Suggest(w http.ResponseWriter, r *http.Request) {
+	userID := h.userID(r)
+	list, err := h.suggestions(userID, r.URL.Query().Get("q"))
+	if err != nil {
+		log.Printf("Error suggesting completions for user %d: %v", userID, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to load suggestions")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,385 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dokeep/internal/model"
+	"dokeep/internal/tagpath"
+	"dokeep/web/template"
+
+	"github.com/lib/pq"
+)
+
+// errTagNotFound is returned when a tag does not exist or is not owned by the
+// requesting user.
+var errTagNotFound = errors.New("tag not found")
+
+var tagColorPattern = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// tagUpdate holds the tag fields that can be changed. Nil fields keep their
+// current value. Name is the full path, so changing it can also move the tag
+// to another parent.
+type tagUpdate struct {
+	Name        *string `json:"name"`
+	Color       *string `json:"color"`
+	Description *string `json:"description"`
+}
+
+// tagUsageColumns selects a tag t with its direct and subtree document counts.
+const tagUsageColumns = `t.id, t.name, t.parent_id, t.color, t.description,
+	(SELECT COUNT(*) FROM document_tags WHERE tag_id = t.id),
+	(SELECT COUNT(DISTINCT dt.document_id) FROM document_tags dt JOIN tags s ON s.id = dt.tag_id
+	 WHERE s.user_id = t.user_id AND (s.id = t.id OR starts_with(s.name, t.name || '/')))`
+
+func scanTagUsage(row interface{ Scan(...interface{}) error }) (model.TagUsage, error) {
+	var t model.TagUsage
+	var parentID sql.NullInt64
+	err := row.Scan(&t.ID, &t.Name, &parentID, &t.Color, &t.Description, &t.DocumentCount, &t.TotalCount)
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		t.ParentID = &id
+	}
+	return t, err
+}
+
+// listTags returns the user's tags with the number of documents using each,
+// ordered so that every tag follows its parent.
+func (h *DocumentHandler) listTags(userID int) ([]model.TagUsage, error) {
+	rows, err := h.DB.Query("SELECT "+tagUsageColumns+" FROM tags t WHERE t.user_id = $1 ORDER BY string_to_array(t.name, '/')", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []model.TagUsage
+	for rows.Next() {
+		t, err := scanTagUsage(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// tagTree arranges tags as returned by listTags into a tree.
+func tagTree(tags []model.TagUsage) []model.TagNode {
+	children := make(map[int][]model.TagUsage)
+	var roots []model.TagUsage
+	for _, t := range tags {
+		if t.ParentID == nil {
+			roots = append(roots, t)
+		} else {
+			children[*t.ParentID] = append(children[*t.ParentID], t)
+		}
+	}
+	var build func([]model.TagUsage) []model.TagNode
+	build = func(level []model.TagUsage) []model.TagNode {
+		nodes := make([]model.TagNode, 0, len(level))
+		for _, t := range level {
+			nodes = append(nodes, model.TagNode{TagUsage: t, Children: build(children[t.ID])})
+		}
+		return nodes
+	}
+	return build(roots)
+}
+
+// TagTree returns the requesting user's tags as a tree for the dashboard.
+func (h *DocumentHandler) TagTree(r *http.Request) ([]model.TagNode, error) {
+	tags, err := h.listTags(h.userID(r))
+	if err != nil {
+		return nil, err
+	}
+	return tagTree(tags), nil
+}
+
+// getTag returns one of the user's tags.
+func (h *DocumentHandler) getTag(userID, tagID int) (model.TagUsage, error) {
+	t, err := scanTagUsage(h.DB.QueryRow("SELECT "+tagUsageColumns+" FROM tags t WHERE t.id = $1 AND t.user_id = $2", tagID, userID))
+	if err == sql.ErrNoRows {
+		return t, errTagNotFound
+	}
+	return t, err
+}
+
+// lockTag returns the path of one of the user's tags and locks its row until
+// the transaction ends.
+func lockTag(tx *sql.Tx, userID, tagID int) (string, error) {
+	var name string
+	err := tx.QueryRow("SELECT name FROM tags WHERE id = $1 AND user_id = $2 FOR UPDATE", tagID, userID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", errTagNotFound
+	}
+	return name, err
+}
+
+// moveTag changes the path of a tag from oldPath to newPath, which must not
+// exist yet, creating missing ancestors of newPath and renaming every
+// descendant along with it.
+func moveTag(tx *sql.Tx, userID, tagID int, oldPath, newPath string) error {
+	var parentID interface{}
+	if parent := tagpath.Parent(newPath); parent != "" {
+		id, err := tagpath.Ensure(tx, userID, parent)
+		if err != nil {
+			return err
+		}
+		parentID = id
+	}
+	if _, err := tx.Exec("UPDATE tags SET name = $1, parent_id = $2 WHERE id = $3", newPath, parentID, tagID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		UPDATE tags SET name = $1 || substr(name, length($2) + 1)
+		WHERE user_id = $3 AND starts_with(name, $2 || '/')`, newPath, oldPath, userID)
+	return err
+}
+
+// updateTag renames, moves, recolors or describes a tag. Renaming a tag to
+// the path of another of the user's tags is a conflict; merge the tags
+// instead.
+func (h *DocumentHandler) updateTag(userID, tagID int, u tagUpdate) error {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldPath, err := lockTag(tx, userID, tagID)
+	if err != nil {
+		return err
+	}
+
+	if u.Name != nil {
+		newPath := tagpath.Normalize(*u.Name)
+		switch {
+		case newPath == "":
+			return &conflictError{"the tag name must not be empty"}
+		case newPath != oldPath && tagpath.IsWithin(newPath, oldPath):
+			return &conflictError{"a tag cannot be moved below itself"}
+		case newPath != oldPath:
+			err := moveTag(tx, userID, tagID, oldPath, newPath)
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				return &conflictError{fmt.Sprintf("a tag named %q already exists; merge the tags instead", newPath)}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var sets []string
+	var args []interface{}
+	if u.Color != nil {
+		color := strings.ToLower(strings.TrimSpace(*u.Color))
+		if color != "" && !tagColorPattern.MatchString(color) {
+			return &conflictError{"the color must be empty or look like #1a2b3c"}
+		}
+		args = append(args, color)
+		sets = append(sets, fmt.Sprintf("color = $%d", len(args)))
+	}
+	if u.Description != nil {
+		args = append(args, strings.TrimSpace(*u.Description))
+		sets = append(sets, fmt.Sprintf("description = $%d", len(args)))
+	}
+	if len(sets) > 0 {
+		args = append(args, tagID)
+		query := fmt.Sprintf("UPDATE tags SET %s WHERE id = $%d", strings.Join(sets, ", "), len(args))
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// mergeTag moves every document from the source tag to the target tag and
+// deletes the source tag. Child tags of the source move below the target and
+// are merged with the target's children of the same name.
+func (h *DocumentHandler) mergeTag(userID, sourceID, targetID int) error {
+	if sourceID == targetID {
+		return &conflictError{"a tag cannot be merged into itself"}
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sourcePath, err := lockTag(tx, userID, sourceID)
+	if err != nil {
+		return err
+	}
+	targetPath, err := lockTag(tx, userID, targetID)
+	if err != nil {
+		return err
+	}
+	if tagpath.IsWithin(targetPath, sourcePath) {
+		return &conflictError{"a tag cannot be merged into one of its own children"}
+	}
+	if err := mergeTagTx(tx, userID, sourceID, targetID, targetPath); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func mergeTagTx(tx *sql.Tx, userID, sourceID, targetID int, targetPath string) error {
+	rows, err := tx.Query("SELECT id, name FROM tags WHERE parent_id = $1", sourceID)
+	if err != nil {
+		return err
+	}
+	var children []model.Tag
+	for rows.Next() {
+		var c model.Tag
+		if err := rows.Scan(&c.ID, &c.Name); err != nil {
+			rows.Close()
+			return err
+		}
+		children = append(children, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range children {
+		newPath := targetPath + tagpath.Separator + c.Leaf()
+		var existingID int
+		err := tx.QueryRow("SELECT id FROM tags WHERE user_id = $1 AND name = $2", userID, newPath).Scan(&existingID)
+		switch {
+		case err == sql.ErrNoRows:
+			err = moveTag(tx, userID, c.ID, c.Name, newPath)
+		case err == nil:
+			err = mergeTagTx(tx, userID, c.ID, existingID, newPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO document_tags (document_id, tag_id)
+		SELECT document_id, $1 FROM document_tags WHERE tag_id = $2
+		ON CONFLICT DO NOTHING`, targetID, sourceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM document_tags WHERE tag_id = $1", sourceID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM tags WHERE id = $1", sourceID)
+	return err
+}
+
+// deleteTag removes a tag from all of the user's documents and deletes it.
+// Tags with children cannot be deleted.
+func (h *DocumentHandler) deleteTag(userID, tagID int) error {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockTag(tx, userID, tagID); err != nil {
+		return err
+	}
+	var hasChildren bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM tags WHERE parent_id = $1)", tagID).Scan(&hasChildren); err != nil {
+		return err
+	}
+	if hasChildren {
+		return &conflictError{"the tag has child tags; delete, move or merge them first"}
+	}
+	if _, err := tx.Exec("DELETE FROM document_tags WHERE tag_id = $1", tagID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM tags WHERE id = $1", tagID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Tags handles GET /tags, the tag management page.
+func (h *DocumentHandler) Tags(w http.ResponseWriter, r *http.Request) {
+	userID := h.userID(r)
+	username := h.Session.GetString(r.Context(), "username")
+	tags, err := h.listTags(userID)
+	if err != nil {
+		log.Printf("Error listing tags for user %d: %v", userID, err)
+		http.Error(w, "Failed to list tags", http.StatusInternalServerError)
+		return
+	}
+	if err := template.TagsPage(username, tags, h.Session.PopString(r.Context(), "flash_error")).Render(r.Context(), w); err != nil {
+		http.Error(w, "Error rendering tags page", http.StatusInternalServerError)
+	}
+}
+
+// UpdateTag handles POST /tags/{id}.
+func (h *DocumentHandler) UpdateTag(w http.ResponseWriter, r *http.Request) {
+	tagID, ok := tagPathID(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	name, color, description := r.FormValue("name"), r.FormValue("color"), r.FormValue("description")
+	h.finishTagAction(w, r, "update", h.updateTag(h.userID(r), tagID, tagUpdate{Name: &name, Color: &color, Description: &description}))
+}
+
+// MergeTag handles POST /tags/{id}/merge.
+func (h *DocumentHandler) MergeTag(w http.ResponseWriter, r *http.Request) {
+	tagID, ok := tagPathID(w, r)
+	if !ok {
+		return
+	}
+	targetID, err := strconv.Atoi(r.FormValue("into"))
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return
+	}
+	h.finishTagAction(w, r, "merge", h.mergeTag(h.userID(r), tagID, targetID))
+}
+
+// DeleteTag handles POST /tags/{id}/delete.
+func (h *DocumentHandler) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	tagID, ok := tagPathID(w, r)
+	if !ok {
+		return
+	}
+	h.finishTagAction(w, r, "delete", h.deleteTag(h.userID(r), tagID))
+}
+
+func (h *DocumentHandler) finishTagAction(w http.ResponseWriter, r *http.Request, action string, err error) {
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errTagNotFound:
+		http.Error(w, "Tag not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not "+action+" tag: "+conflict.msg+".")
+	default:
+		log.Printf("Error running tag %s: %v", action, err)
+		http.Error(w, "Failed to "+action+" tag", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/tags", http.StatusSeeOther)
+}
+
+// tagPathID reads the {id} path value.
+func tagPathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,268 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"dokeep/internal/model"
+)
+
+// errRejectedUploadNotFound is returned when a rejected upload does not exist
+// or is not owned by the requesting user.
+var errRejectedUploadNotFound = errors.New("rejected upload not found")
+
+// rejectedUploadsShown is the number of rejected uploads listed on the queue
+// page.
+const rejectedUploadsShown = 20
+
+// upload is a file received from the user.
+type upload struct {
+	Title       string
+	Filename    string
+	ContentType string
+	// Size is the length of Body, or -1 if it is not known.
+	Size int64
+	Body io.ReadSeeker
+}
+
+func uploadFromForm(title string, file multipart.File, header *multipart.FileHeader) upload {
+	return upload{
+		Title:       title,
+		Filename:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Size:        header.Size,
+		Body:        file,
+	}
+}
+
+// duplicateError is returned by createDocument when the user already has a
+// file with the same content as the upload.
+type duplicateError struct {
+	Existing model.Document
+	// RejectedID identifies the upload that was set aside.
+	RejectedID int
+}
+
+func (e *duplicateError) Error() string {
+	return fmt.Sprintf("this file has already been uploaded as %q", e.Existing.Title)
+}
+
+// hashUpload returns the hex SHA-256 of the upload, the same hash the
+// processing service records for a document, and rewinds it.
+func hashUpload(body io.ReadSeeker) (string, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, body); err != nil {
+		return "", err
+	}
+	_, err := body.Seek(0, io.SeekStart)
+	return hex.EncodeToString(sum.Sum(nil)), err
+}
+
+// uploadLockClass is the first key of the pg_advisory_xact_lock(int, int)
+// held for a user, the second key, while an upload is checked for duplicates
+// and recorded, so that the same file uploaded twice at once is not stored
+// twice.
+const uploadLockClass = 7201305
+
+// documentByHash returns the user's document with the given file hash, or
+// nil. Originals are preferred over versions stored later.
+func documentByHash(tx *sql.Tx, userID int, hash string) (*model.Document, error) {
+	var doc model.Document
+	err := tx.QueryRow(`
+		SELECT id, title FROM documents WHERE user_id = $1 AND file_hash = $2
+		ORDER BY version_of IS NOT NULL, id LIMIT 1`, userID, hash).Scan(&doc.ID, &doc.Title)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not look up file hash: %w", err)
+	}
+	return &doc, nil
+}
+
+// rejectUpload records an upload that duplicates an existing document and
+// keeps its file until the user decides what to do with it. It returns the
+// *duplicateError to report to the user.
+func (h *DocumentHandler) rejectUpload(userID int, u upload, hash string, existing model.Document) error {
+	var id int
+	err := h.DB.QueryRow(`
+		INSERT INTO rejected_uploads (user_id, existing_document_id, title, original_filename, file_hash)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		userID, existing.ID, u.Title, u.Filename, hash).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("could not record rejected upload: %w", err)
+	}
+	key := fmt.Sprintf("rejected/%d%s", id, strings.ToLower(filepath.Ext(u.Filename)))
+	if err := h.Storage.Put(context.Background(), key, u.Body, u.Size, u.ContentType); err != nil {
+		h.DB.Exec("DELETE FROM rejected_uploads WHERE id = $1", id)
+		return fmt.Errorf("could not save rejected upload: %w", err)
+	}
+	if _, err := h.DB.Exec("UPDATE rejected_uploads SET file_key = $1 WHERE id = $2", key, id); err != nil {
+		h.removeFile(key)
+		h.DB.Exec("DELETE FROM rejected_uploads WHERE id = $1", id)
+		return fmt.Errorf("could not update rejected upload: %w", err)
+	}
+	return &duplicateError{Existing: existing, RejectedID: id}
+}
+
+func (h *DocumentHandler) removeFile(key string) {
+	if err := h.Storage.Delete(context.Background(), key); err != nil {
+		log.Printf("Error removing file %s: %v", key, err)
+	}
+}
+
+// listRejectedUploads returns the user's most recent rejected uploads, newest
+// first.
+func (h *DocumentHandler) listRejectedUploads(userID, limit int) ([]model.RejectedUpload, error) {
+	rows, err := h.DB.Query(`
+		SELECT r.id, r.title, r.original_filename, r.file_hash, r.existing_document_id, d.title,
+			r.status, r.document_id, r.created_at, r.resolved_at
+		FROM rejected_uploads r
+		LEFT JOIN documents d ON d.id = r.existing_document_id
+		WHERE r.user_id = $1
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []model.RejectedUpload{}
+	for rows.Next() {
+		var u model.RejectedUpload
+		var existingID, documentID sql.NullInt64
+		var existingTitle sql.NullString
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&u.ID, &u.Title, &u.OriginalFilename, &u.FileHash, &existingID, &existingTitle,
+			&u.Status, &documentID, &u.CreatedAt, &resolvedAt); err != nil {
+			return nil, err
+		}
+		u.ExistingDocumentID = nullableID(existingID)
+		u.ExistingTitle = existingTitle.String
+		u.DocumentID = nullableID(documentID)
+		if resolvedAt.Valid {
+			u.ResolvedAt = &resolvedAt.Time
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+// resolveRejectedUpload marks a pending rejected upload as stored or
+// discarded and returns what is needed to act on it. Claiming the upload
+// first keeps a double submit from storing it twice.
+func (h *DocumentHandler) resolveRejectedUpload(userID, id int, status string) (u upload, key string, err error) {
+	err = h.DB.QueryRow(`
+		UPDATE rejected_uploads SET status = $1, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND user_id = $3 AND status = 'pending'
+		RETURNING title, original_filename, file_key`, status, id, userID).Scan(&u.Title, &u.Filename, &key)
+	if err != sql.ErrNoRows {
+		return u, key, err
+	}
+	var current string
+	err = h.DB.QueryRow("SELECT status FROM rejected_uploads WHERE id = $1 AND user_id = $2", id, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return u, key, errRejectedUploadNotFound
+	}
+	if err != nil {
+		return u, key, err
+	}
+	return u, key, &conflictError{"this upload was already " + current}
+}
+
+// storeRejectedUpload stores a rejected upload as a new version of the
+// document it duplicates and returns the new document's ID.
+func (h *DocumentHandler) storeRejectedUpload(userID, id int) (int64, error) {
+	u, key, err := h.resolveRejectedUpload(userID, id, "stored")
+	if err != nil {
+		return 0, err
+	}
+	reopen := func() {
+		h.DB.Exec("UPDATE rejected_uploads SET status = 'pending', resolved_at = NULL WHERE id = $1", id)
+	}
+
+	obj, info, err := h.Storage.Get(context.Background(), key)
+	if err != nil {
+		reopen()
+		return 0, fmt.Errorf("could not open rejected upload %d: %w", id, err)
+	}
+	defer obj.Close()
+	u.Body, u.Size, u.ContentType = obj, info.Size, info.ContentType
+
+	docID, err := h.createDocument(userID, u, true)
+	if err != nil {
+		reopen()
+		return 0, err
+	}
+	if _, err := h.DB.Exec("UPDATE rejected_uploads SET document_id = $1, file_key = '' WHERE id = $2", docID, id); err != nil {
+		log.Printf("Error updating rejected upload %d: %v", id, err)
+	}
+	h.removeFile(key)
+	return docID, nil
+}
+
+// discardRejectedUpload deletes the file of a rejected upload. The record is
+// kept.
+func (h *DocumentHandler) discardRejectedUpload(userID, id int) error {
+	_, key, err := h.resolveRejectedUpload(userID, id, "discarded")
+	if err != nil {
+		return err
+	}
+	if _, err := h.DB.Exec("UPDATE rejected_uploads SET file_key = '' WHERE id = $1", id); err != nil {
+		return err
+	}
+	if key != "" {
+		h.removeFile(key)
+	}
+	return nil
+}
+
+// StoreRejectedUpload handles POST /uploads/rejected/{id}/store, the "Store
+// anyway" button on the queue page.
+func (h *DocumentHandler) StoreRejectedUpload(w http.ResponseWriter, r *http.Request) {
+	id, ok := entityPathID(w, r)
+	if !ok {
+		return
+	}
+	_, err := h.storeRejectedUpload(h.userID(r), id)
+	h.finishRejectedUploadAction(w, r, "store", err)
+}
+
+// DiscardRejectedUpload handles POST /uploads/rejected/{id}/discard.
+func (h *DocumentHandler) DiscardRejectedUpload(w http.ResponseWriter, r *http.Request) {
+	id, ok := entityPathID(w, r)
+	if !ok {
+		return
+	}
+	h.finishRejectedUploadAction(w, r, "discard", h.discardRejectedUpload(h.userID(r), id))
+}
+
+func (h *DocumentHandler) finishRejectedUploadAction(w http.ResponseWriter, r *http.Request, action string, err error) {
+	var conflict *conflictError
+	switch {
+	case err == nil:
+	case err == errRejectedUploadNotFound:
+		http.Error(w, "Upload not found or access denied", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		h.Session.Put(r.Context(), "flash_error", "Could not "+action+" upload: "+conflict.msg+".")
+	default:
+		log.Printf("Error running rejected upload %s: %v", action, err)
+		http.Error(w, "Failed to "+action+" upload", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/queue", http.StatusSeeOther)
+}
@@ -0,0 +1,231 @@
+// Package jobs implements a durable job queue on top of the jobs table.
+//
+// Jobs are leased with SELECT ... FOR UPDATE SKIP LOCKED so that any number
+// of workers, in one or several processes, can share the table. A lease
+// lasts for the visibility timeout; a job whose lease expires without being
+// completed (for example because its worker crashed) is handed out again.
+// Failed jobs are retried with exponential backoff until they run out of
+// attempts, at which point they are moved to the dead state.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job kinds, one per processing step.
+const (
+	KindOCR     = "ocr"
+	KindAnalyze = "analyze"
+)
+
+// Job states. Dead jobs have exhausted their attempts and are kept for
+// inspection; cancelled jobs were withdrawn by the user before they ran.
+const (
+	StatePending   = "pending"
+	StateRunning   = "running"
+	StateDone      = "done"
+	StateDead      = "dead"
+	StateCancelled = "cancelled"
+)
+
+// OCRPayload configures an OCR job.
+type OCRPayload struct {
+	// SkipAnalysis completes the document after OCR instead of queueing an
+	// analyze job.
+	SkipAnalysis bool `json:"skip_analysis,omitempty"`
+	// Overwrite is passed on to the analyze job.
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// AnalyzePayload configures an analyze job.
+type AnalyzePayload struct {
+	// ExtractedDate is the date found by OCR, used when the LLM finds none.
+	ExtractedDate string `json:"extracted_date,omitempty"`
+	// Overwrite replaces the title, summary, date and tags with the analysis
+	// results. Otherwise only fields that are still empty are filled in, so
+	// edits made by the user are kept.
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// ErrLeaseLost is returned when a job is completed or failed by a worker
+// that no longer holds its lease.
+var ErrLeaseLost = errors.New("job lease lost")
+
+// Job is a leased unit of work.
+type Job struct {
+	ID          int64
+	DocumentID  int
+	Kind        string
+	Payload     json.RawMessage
+	Attempts    int
+	MaxAttempts int
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Enqueue adds a job that is ready to run immediately. payload may be nil.
+func Enqueue(db execer, documentID int, kind string, payload interface{}, maxAttempts int) error {
+	data := []byte("{}")
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("INSERT INTO jobs (document_id, kind, payload, max_attempts) VALUES ($1, $2, $3, $4)",
+		documentID, kind, string(data), maxAttempts)
+	return err
+}
+
+// Requeue makes the most recent dead or cancelled job of a document runnable
+// again with a fresh set of attempts. It reports whether there was such a
+// job.
+func Requeue(db execer, documentID int) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE jobs SET state = 'pending', attempts = 0, run_at = now(), last_error = NULL, updated_at = now()
+		WHERE id = (
+			SELECT id FROM jobs WHERE document_id = $1 AND state IN ('dead', 'cancelled')
+			ORDER BY id DESC LIMIT 1
+		)`, documentID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// CancelPending cancels a document's jobs that have not started yet and
+// returns how many were cancelled. Running jobs are not affected.
+func CancelPending(db execer, documentID int) (int64, error) {
+	res, err := db.Exec("UPDATE jobs SET state = 'cancelled', updated_at = now() WHERE document_id = $1 AND state = 'pending'", documentID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RecordStatus appends an entry to a document's status history. userID is 0
+// for changes made by the worker.
+func RecordStatus(db execer, documentID, userID int, action, status, message string) error {
+	var user interface{}
+	if userID != 0 {
+		user = userID
+	}
+	_, err := db.Exec("INSERT INTO document_status_history (document_id, user_id, action, status, message) VALUES ($1, $2, $3, $4, $5)",
+		documentID, user, action, status, message)
+	return err
+}
+
+// permanentError marks an error that retrying cannot fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Fail moves the job straight to the dead state.
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// Queue leases and settles jobs on behalf of one worker process.
+type Queue struct {
+	DB *sql.DB
+	// WorkerID identifies the lease holder, e.g. "hostname:pid".
+	WorkerID string
+	// VisibilityTimeout is how long a leased job stays invisible to other
+	// workers.
+	VisibilityTimeout time.Duration
+	// BackoffBase and BackoffMax bound the delay before a failed job is
+	// retried: BackoffBase * 2^(attempts-1), capped at BackoffMax.
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+}
+
+// Lease claims the next runnable job, or returns nil if there is none. A job
+// is runnable when it is pending and due, or running with an expired lease.
+func (q *Queue) Lease(ctx context.Context) (*Job, error) {
+	var job Job
+	var payload []byte
+	err := q.DB.QueryRowContext(ctx, `
+		UPDATE jobs SET
+			state = 'running',
+			attempts = attempts + 1,
+			locked_by = $1,
+			locked_until = now() + make_interval(secs => $2),
+			updated_at = now()
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (state = 'pending' AND run_at <= now())
+			   OR (state = 'running' AND locked_until < now())
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, document_id, kind, payload, attempts, max_attempts
+	`, q.WorkerID, q.VisibilityTimeout.Seconds()).Scan(&job.ID, &job.DocumentID, &job.Kind, &payload, &job.Attempts, &job.MaxAttempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.Payload = payload
+	return &job, nil
+}
+
+// Complete marks a leased job as done.
+func (q *Queue) Complete(job *Job) error {
+	return q.settle(job, "UPDATE jobs SET state = 'done', locked_by = NULL, locked_until = NULL, last_error = NULL, updated_at = now() WHERE id = $1 AND locked_by = $2 AND attempts = $3")
+}
+
+// Fail records a failed attempt. The job is rescheduled with backoff unless
+// the error is permanent or the job has run out of attempts, in which case it
+// becomes dead. It reports whether the job is dead.
+func (q *Queue) Fail(job *Job, cause error) (dead bool, err error) {
+	var permanent permanentError
+	dead = errors.As(cause, &permanent) || job.Attempts >= job.MaxAttempts
+	if dead {
+		err = q.settle(job, "UPDATE jobs SET state = 'dead', locked_by = NULL, locked_until = NULL, last_error = $4, updated_at = now() WHERE id = $1 AND locked_by = $2 AND attempts = $3", cause.Error())
+		return dead, err
+	}
+	err = q.settle(job, "UPDATE jobs SET state = 'pending', locked_by = NULL, locked_until = NULL, last_error = $4, run_at = $5, updated_at = now() WHERE id = $1 AND locked_by = $2 AND attempts = $3",
+		cause.Error(), time.Now().Add(q.Backoff(job.Attempts)))
+	return dead, err
+}
+
+// Backoff returns the delay before retrying after the given attempt.
+func (q *Queue) Backoff(attempt int) time.Duration {
+	delay := q.BackoffBase
+	for i := 1; i < attempt && delay < q.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > q.BackoffMax {
+		delay = q.BackoffMax
+	}
+	return delay
+}
+
+// settle updates a job only while this worker still holds the lease from the
+// given attempt, so a worker that overran its visibility timeout cannot
+// overwrite the outcome of the attempt that replaced it.
+func (q *Queue) settle(job *Job, query string, extra ...interface{}) error {
+	args := append([]interface{}{job.ID, q.WorkerID, job.Attempts}, extra...)
+	res, err := q.DB.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("could not update job %d: %w", job.ID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
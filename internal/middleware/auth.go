@@ -1,11 +1,28 @@
 package middleware
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
 	"net/http"
+	"strings"
+
+	"dokeep/internal/auth"
 
 	"github.com/alexedwards/scs/v2"
 )
 
+type contextKey string
+
+const userIDKey contextKey = "userID"
+
+// UserID returns the ID of the user authenticated by RequireAPIAuth.
+func UserID(ctx context.Context) int {
+	id, _ := ctx.Value(userIDKey).(int)
+	return id
+}
+
 func RequireAuth(session *scs.SessionManager, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !session.Exists(r.Context(), "userID") {
@@ -15,3 +32,89 @@ func RequireAuth(session *scs.SessionManager, next http.HandlerFunc) http.Handle
 		next.ServeHTTP(w, r)
 	}
 }
+
+// RequireAdmin is RequireAuth for pages only administrators may open. If
+// directory is not nil, it is asked first, which also brings the
+// administrator flag up to date.
+func RequireAdmin(session *scs.SessionManager, db *sql.DB, directory auth.Directory, next http.HandlerFunc) http.HandlerFunc {
+	return RequireAuth(session, func(w http.ResponseWriter, r *http.Request) {
+		userID := session.GetInt(r.Context(), "userID")
+		if directory != nil {
+			if err := directory.Allowed(userID); err != nil {
+				if err != auth.ErrAccountDisabled {
+					log.Printf("Error checking the directory for user %d: %v", userID, err)
+				}
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		var admin bool
+		if err := db.QueryRow("SELECT is_admin FROM users WHERE id = $1", userID).Scan(&admin); err != nil && err != sql.ErrNoRows {
+			log.Printf("Error checking administrator flag of user %d: %v", userID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !admin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAPIAuth is the JSON counterpart of RequireAuth. It accepts either a
+// session cookie or an "Authorization: Bearer" personal access token, and
+// answers with a JSON error instead of redirecting to the login page.
+//
+// Tokens are issued from the settings page of an already fully authenticated
+// session, so they are accepted without a second factor. If directory is not
+// nil, it must still allow the token's owner to sign in.
+func RequireAPIAuth(session *scs.SessionManager, db *sql.DB, directory auth.Directory, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Authorization"); header != "" {
+			raw, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				writeError(w, http.StatusUnauthorized, "unsupported authorization scheme")
+				return
+			}
+			userID, scope, err := auth.LookupToken(db, strings.TrimSpace(raw))
+			if err != nil {
+				if err != auth.ErrInvalidToken {
+					log.Printf("Error looking up API token: %v", err)
+				}
+				writeError(w, http.StatusUnauthorized, "invalid or expired token")
+				return
+			}
+			if directory != nil {
+				if err := directory.Allowed(userID); err != nil {
+					if err != auth.ErrAccountDisabled {
+						log.Printf("Error checking the directory for user %d: %v", userID, err)
+						writeError(w, http.StatusServiceUnavailable, "the directory is not available")
+						return
+					}
+					writeError(w, http.StatusForbidden, err.Error())
+					return
+				}
+			}
+			if scope == auth.ScopeRead && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				writeError(w, http.StatusForbidden, "token is read-only")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDKey, userID)))
+			return
+		}
+
+		if !session.Exists(r.Context(), "userID") {
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		userID := session.GetInt(r.Context(), "userID")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDKey, userID)))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
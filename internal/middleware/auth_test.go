@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"dokeep/internal/auth"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alexedwards/scs/v2"
+)
+
+// directory answers Allowed with err.
+type directory struct {
+	err error
+}
+
+func (d directory) Allowed(userID int) error { return d.err }
+
+func TestRequireAPIAuthDirectory(t *testing.T) {
+	const token = "dk_secret"
+	tests := []struct {
+		directory auth.Directory
+		status    int
+	}{
+		{nil, http.StatusOK},
+		{directory{nil}, http.StatusOK},
+		{directory{auth.ErrAccountDisabled}, http.StatusForbidden},
+		{directory{errors.New("connection refused")}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery(`SELECT id, user_id, scope FROM api_tokens`).WithArgs(auth.HashToken(token)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "scope"}).AddRow(1, 2, auth.ScopeRead))
+		mock.ExpectExec(`UPDATE api_tokens SET last_used_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		var userID int
+		h := RequireAPIAuth(scs.New(), db, tt.directory, func(w http.ResponseWriter, r *http.Request) {
+			userID = UserID(r.Context())
+		})
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/documents", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.status {
+			t.Errorf("directory %v: status = %d, want %d", tt.directory, w.Code, tt.status)
+		}
+		if ok := tt.status == http.StatusOK; ok != (userID == 2) {
+			t.Errorf("directory %v: handler ran as user %d", tt.directory, userID)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,23 @@
+package model
+
+// CustomField is a user-defined metadata field such as an invoice number or
+// due date. Key is derived from the name and used in search queries as
+// field.<key>. Options lists the allowed values of a select field.
+type CustomField struct {
+	ID            int      `json:"id"`
+	Name          string   `json:"name"`
+	Key           string   `json:"key"`
+	Type          string   `json:"type"`
+	Options       []string `json:"options,omitempty"`
+	DocumentCount int      `json:"document_count"`
+}
+
+// CustomFieldValue is the value of a custom field on a document, stored in
+// the canonical form for the field's type.
+type CustomFieldValue struct {
+	FieldID int    `json:"field_id"`
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+}
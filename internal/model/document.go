@@ -3,16 +3,32 @@ package model
 import "time"
 
 type Document struct {
-	ID               int
-	Title            string
-	OriginalFilename string
-	FilePath         string
-	Thumbnail        string
-	Content          string
-	Summary          string
-	FileHash         string
-	Status           string
-	StatusMessage    string
-	CreatedDate      time.Time
-	CreatedAt        time.Time
+	ID               int                `json:"id"`
+	Title            string             `json:"title"`
+	OriginalFilename string             `json:"original_filename"`
+	FilePath         string             `json:"file_path"`
+	Thumbnail        string             `json:"thumbnail"`
+	Content          string             `json:"content,omitempty"`
+	Summary          string             `json:"summary"`
+	FileHash         string             `json:"file_hash,omitempty"`
+	Status           string             `json:"status"`
+	StatusMessage    string             `json:"status_message,omitempty"`
+	CorrespondentID  *int               `json:"correspondent_id"`
+	Correspondent    string             `json:"correspondent,omitempty"`
+	DocumentTypeID   *int               `json:"document_type_id"`
+	DocumentType     string             `json:"document_type,omitempty"`
+	CustomFields     []CustomFieldValue `json:"custom_fields,omitempty"`
+	// VersionOf is the document this one was stored as a new version of.
+	VersionOf *int `json:"version_of,omitempty"`
+	// Snippet shows where a search matched, if it was found by one.
+	Snippet     []Highlight `json:"snippet,omitempty"`
+	CreatedDate time.Time   `json:"created_date"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// Highlight is a piece of text shown for a search; Match marks the words
+// that matched the query.
+type Highlight struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
 }
@@ -0,0 +1,83 @@
+package model
+
+import "net/url"
+
+// DocumentFilters narrows a document list in addition to the search query.
+// Empty fields do not filter. From and To are inclusive dates (YYYY-MM-DD)
+// on the document date; FileType is a file extension such as "pdf".
+type DocumentFilters struct {
+	Tags          []string `json:"tags,omitempty"`
+	From          string   `json:"from,omitempty"`
+	To            string   `json:"to,omitempty"`
+	Status        string   `json:"status,omitempty"`
+	FileType      string   `json:"file_type,omitempty"`
+	Correspondent string   `json:"correspondent,omitempty"`
+}
+
+// FiltersFromQuery reads filters from URL parameters: tag (repeatable),
+// from, to, status, file_type and correspondent.
+func FiltersFromQuery(v url.Values) DocumentFilters {
+	f := DocumentFilters{
+		From:          v.Get("from"),
+		To:            v.Get("to"),
+		Status:        v.Get("status"),
+		FileType:      v.Get("file_type"),
+		Correspondent: v.Get("correspondent"),
+	}
+	for _, tag := range v["tag"] {
+		if tag != "" {
+			f.Tags = append(f.Tags, tag)
+		}
+	}
+	return f
+}
+
+// Encode adds the filters to URL parameters, the reverse of
+// FiltersFromQuery.
+func (f DocumentFilters) Encode(v url.Values) {
+	for _, tag := range f.Tags {
+		v.Add("tag", tag)
+	}
+	for name, value := range map[string]string{"from": f.From, "to": f.To, "status": f.Status, "file_type": f.FileType, "correspondent": f.Correspondent} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+}
+
+// IsEmpty reports whether no filter is set.
+func (f DocumentFilters) IsEmpty() bool {
+	return len(f.Tags) == 0 && f.From == "" && f.To == "" && f.Status == "" && f.FileType == "" && f.Correspondent == ""
+}
+
+// Facet is a value found among a document list with the number of matching
+// documents.
+type Facet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets summarize a document list by tag and by year of the document date.
+type Facets struct {
+	Tags  []Facet `json:"tags"`
+	Years []Facet `json:"years"`
+}
+
+// DocumentList is one page of a filtered, sorted document list. With a
+// cursor-capable sort order, NextCursor and PrevCursor continue the list
+// after the last or before the first document; otherwise pages are numbered.
+type DocumentList struct {
+	Documents  []Document      `json:"documents"`
+	Total      int             `json:"total"`
+	Page       int             `json:"page"`
+	PerPage    int             `json:"per_page"`
+	TotalPages int             `json:"total_pages"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+	PrevCursor string          `json:"prev_cursor,omitempty"`
+	Query      string          `json:"query"`
+	Sort       string          `json:"sort"`
+	Filters    DocumentFilters `json:"filters"`
+	Facets     *Facets         `json:"facets,omitempty"`
+	// Suggestion is a corrected query offered when nothing was found.
+	Suggestion string `json:"suggestion,omitempty"`
+}
@@ -0,0 +1,39 @@
+package model
+
+import "time"
+
+// SimilarDocument is a document whose text resembles another one's.
+// Similarity is between 0 and 1; Duplicate marks a likely second copy of
+// the same paper that the user has not yet decided to keep.
+type SimilarDocument struct {
+	ID          int       `json:"id"`
+	Title       string    `json:"title"`
+	Thumbnail   string    `json:"thumbnail"`
+	CreatedDate time.Time `json:"created_date"`
+	Similarity  float64   `json:"similarity"`
+	Duplicate   bool      `json:"duplicate"`
+}
+
+// DuplicatePair is two documents that are probably the same paper, listed
+// for review.
+type DuplicatePair struct {
+	Document   Document `json:"document"`
+	Other      Document `json:"other"`
+	Similarity float64  `json:"similarity"`
+}
+
+// RejectedUpload is an upload that was not stored because the user already
+// had a file with the same content. It stays pending until the user discards
+// it or stores it anyway as a new version of the existing document.
+type RejectedUpload struct {
+	ID                 int        `json:"id"`
+	Title              string     `json:"title"`
+	OriginalFilename   string     `json:"original_filename"`
+	FileHash           string     `json:"file_hash"`
+	ExistingDocumentID *int       `json:"existing_document_id"`
+	ExistingTitle      string     `json:"existing_title,omitempty"`
+	Status             string     `json:"status"`
+	DocumentID         *int       `json:"document_id"`
+	CreatedAt          time.Time  `json:"created_at"`
+	ResolvedAt         *time.Time `json:"resolved_at"`
+}
@@ -0,0 +1,8 @@
+package model
+
+// Entity is a correspondent or document type owned by a user.
+type Entity struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	DocumentCount int    `json:"document_count"`
+}
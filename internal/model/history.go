@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// StatusEvent is an entry in a document's processing history. Username is
+// empty for changes made by the background worker.
+type StatusEvent struct {
+	ID        int64     `json:"id"`
+	Action    string    `json:"action"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,56 @@
+package model
+
+import "time"
+
+// LoginAttempt is a recorded sign-in attempt. Kind is the step that was
+// attempted, e.g. "password" or "totp".
+type LoginAttempt struct {
+	Kind      string    `json:"kind"`
+	IP        string    `json:"ip"`
+	Success   bool      `json:"success"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TwoFactorStatus describes a user's two-factor authentication setup.
+type TwoFactorStatus struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+}
+
+// Passkey is a WebAuthn credential registered by a user.
+type Passkey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// LinkedIdentity is an account at the single sign-on provider linked to a
+// user.
+type LinkedIdentity struct {
+	Subject    string
+	Email      string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// SingleSignOnStatus describes single sign-on for the settings page.
+type SingleSignOnStatus struct {
+	Enabled bool
+	// Name is the provider's display name.
+	Name string
+	// Identity is the linked account, or nil.
+	Identity *LinkedIdentity
+}
+
+// UserAccount is a user as listed on the Users page.
+type UserAccount struct {
+	ID       int
+	Username string
+	// Directory is set for accounts whose password the LDAP directory
+	// checks.
+	Directory bool
+	Admin     bool
+	TwoFactor bool
+	Passkeys  int
+}
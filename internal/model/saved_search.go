@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// SavedSearch is a named dashboard query with its sort order and filters. Pinned
+// searches are listed in the sidebar; those shown on the dashboard appear
+// there as a widget with their latest documents.
+type SavedSearch struct {
+	ID              int             `json:"id"`
+	Name            string          `json:"name"`
+	Query           string          `json:"query"`
+	Sort            string          `json:"sort"`
+	Filters         DocumentFilters `json:"filters"`
+	Pinned          bool            `json:"pinned"`
+	ShowOnDashboard bool            `json:"show_on_dashboard"`
+	DocumentCount   int             `json:"document_count"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+// SavedView is a saved search shown as a dashboard widget.
+type SavedView struct {
+	SavedSearch
+	Documents []Document
+}
@@ -2,7 +2,8 @@ package model
 
 // QueueStats holds the counts for various document statuses in the queue.
 type QueueStats struct {
-	Waiting    int
-	Processing int
-	Failed     int
+	Waiting    int `json:"waiting"`
+	Processing int `json:"processing"`
+	Failed     int `json:"failed"`
+	Cancelled  int `json:"cancelled"`
 }
@@ -1,6 +1,33 @@
 package model
 
+import "strings"
+
+// Tag is a label a user attaches to their documents. Tags belong to a single
+// user and form a tree: Name is the full path such as "finance/tax/2023",
+// unique per user, and ParentID points at the tag one level up.
 type Tag struct {
-	ID   int
-	Name string
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	ParentID    *int   `json:"parent_id"`
+	Color       string `json:"color,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Leaf returns the last segment of the tag's path.
+func (t Tag) Leaf() string {
+	return t.Name[strings.LastIndex(t.Name, "/")+1:]
+}
+
+// TagUsage is a tag with the number of documents it is attached to.
+// TotalCount also includes documents carrying any of its descendants.
+type TagUsage struct {
+	Tag
+	DocumentCount int `json:"document_count"`
+	TotalCount    int `json:"total_count"`
+}
+
+// TagNode is a tag with its child tags.
+type TagNode struct {
+	TagUsage
+	Children []TagNode `json:"children"`
 }
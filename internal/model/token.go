@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// APIToken is a personal access token used by non-browser clients. Only a
+// hash of the secret is stored; Prefix is kept so users can tell tokens apart.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scope      string     `json:"scope"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Active reports whether the token can still be used.
+func (t APIToken) Active() bool {
+	if t.RevokedAt != nil {
+		return false
+	}
+	return t.ExpiresAt == nil || t.ExpiresAt.After(time.Now())
+}
@@ -0,0 +1,287 @@
+// Package passkey registers WebAuthn credentials ("passkeys") and verifies
+// them at sign-in, either as the second factor after a password or on their
+// own for passwordless sign-in. Each ceremony has a Begin step, whose
+// options are passed to navigator.credentials in the browser and whose
+// session data the caller keeps, and a Finish step that checks the
+// browser's response against that session data.
+package passkey
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"dokeep/internal/config"
+	"dokeep/internal/model"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var (
+	// ErrNotFound is returned when a passkey does not exist or is not owned
+	// by the user.
+	ErrNotFound = errors.New("passkey not found")
+	// ErrNoPasskeys is returned when a sign-in is started for a user who has
+	// not registered a passkey.
+	ErrNoPasskeys = errors.New("no passkeys registered")
+	// ErrCloned is returned when an authenticator's signature counter went
+	// backwards, which suggests the credential was copied.
+	ErrCloned = errors.New("the authenticator may have been cloned")
+)
+
+// Service runs WebAuthn ceremonies and stores the credentials.
+type Service struct {
+	DB       *sql.DB
+	WebAuthn *webauthn.WebAuthn
+}
+
+// New returns a Service for the relying party described by cfg.
+func New(db *sql.DB, cfg config.WebAuthnConfig) (*Service, error) {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: cfg.DisplayName,
+		RPOrigins:     cfg.Origins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Service{DB: db, WebAuthn: w}, nil
+}
+
+// user adapts an account to webauthn.User.
+type user struct {
+	id          int
+	handle      []byte
+	name        string
+	credentials []webauthn.Credential
+}
+
+func (u *user) WebAuthnID() []byte                         { return u.handle }
+func (u *user) WebAuthnName() string                       { return u.name }
+func (u *user) WebAuthnDisplayName() string                { return u.name }
+func (u *user) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// loadUser returns the account with its credentials. With create set, a user
+// handle is assigned if the account does not have one yet.
+func (s *Service) loadUser(userID int, create bool) (*user, error) {
+	u := &user{id: userID}
+	err := s.DB.QueryRow("SELECT username, webauthn_id FROM users WHERE id = $1", userID).Scan(&u.name, &u.handle)
+	if err != nil {
+		return nil, err
+	}
+	if u.handle == nil && create {
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			return nil, err
+		}
+		if _, err := s.DB.Exec("UPDATE users SET webauthn_id = $1 WHERE id = $2 AND webauthn_id IS NULL", handle, userID); err != nil {
+			return nil, err
+		}
+		// Another request may have assigned one first
+		if err := s.DB.QueryRow("SELECT webauthn_id FROM users WHERE id = $1", userID).Scan(&u.handle); err != nil {
+			return nil, err
+		}
+	}
+	u.credentials, err = s.credentials(userID)
+	return u, err
+}
+
+func (s *Service) credentials(userID int) ([]webauthn.Credential, error) {
+	rows, err := s.DB.Query("SELECT credential FROM passkeys WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []webauthn.Credential
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var c webauthn.Credential
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// BeginRegistration starts registering a new passkey for the user. Passkeys
+// the user already has are excluded, so an authenticator is not registered
+// twice.
+func (s *Service) BeginRegistration(userID int) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	u, err := s.loadUser(userID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.WebAuthn.BeginRegistration(u,
+		webauthn.WithExclusions(webauthn.Credentials(u.credentials).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred))
+}
+
+// FinishRegistration verifies the browser's response and stores the new
+// passkey under the given name.
+func (s *Service) FinishRegistration(userID int, name string, session webauthn.SessionData, r *http.Request) (model.Passkey, error) {
+	var p model.Passkey
+	u, err := s.loadUser(userID, false)
+	if err != nil {
+		return p, err
+	}
+	credential, err := s.WebAuthn.FinishRegistration(u, session, r)
+	if err != nil {
+		return p, err
+	}
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return p, err
+	}
+	p.Name = cleanName(name)
+	err = s.DB.QueryRow(`
+		INSERT INTO passkeys (user_id, name, credential_id, credential) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`, userID, p.Name, credential.ID, data).Scan(&p.ID, &p.CreatedAt)
+	return p, err
+}
+
+// BeginLogin starts checking one of the user's passkeys as the second factor
+// after their password.
+func (s *Service) BeginLogin(userID int) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	u, err := s.loadUser(userID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(u.credentials) == 0 {
+		return nil, nil, ErrNoPasskeys
+	}
+	return s.WebAuthn.BeginLogin(u)
+}
+
+// FinishLogin verifies the browser's response to BeginLogin.
+func (s *Service) FinishLogin(userID int, session webauthn.SessionData, r *http.Request) error {
+	u, err := s.loadUser(userID, false)
+	if err != nil {
+		return err
+	}
+	credential, err := s.WebAuthn.FinishLogin(u, session, r)
+	if err != nil {
+		return err
+	}
+	return s.used(credential)
+}
+
+// BeginDiscoverableLogin starts a passwordless sign-in, in which the
+// authenticator chooses the account. It must verify the user, e.g. with a
+// PIN or fingerprint, since no password is asked for.
+func (s *Service) BeginDiscoverableLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	return s.WebAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+}
+
+// FinishDiscoverableLogin verifies the browser's response to
+// BeginDiscoverableLogin and returns the ID of the account signed in to.
+func (s *Service) FinishDiscoverableLogin(session webauthn.SessionData, r *http.Request) (int, error) {
+	found, credential, err := s.WebAuthn.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		var userID int
+		err := s.DB.QueryRow("SELECT id FROM users WHERE webauthn_id = $1", userHandle).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s.loadUser(userID, false)
+	}, session, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.used(credential); err != nil {
+		return 0, err
+	}
+	return found.(*user).id, nil
+}
+
+// used stores the credential's new signature counter and records when it
+// was last used.
+func (s *Service) used(credential *webauthn.Credential) error {
+	if credential.Authenticator.CloneWarning {
+		return ErrCloned
+	}
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec("UPDATE passkeys SET credential = $1, last_used_at = CURRENT_TIMESTAMP WHERE credential_id = $2", data, credential.ID)
+	return err
+}
+
+// List returns the user's passkeys in the order they were registered.
+func (s *Service) List(userID int) ([]model.Passkey, error) {
+	rows, err := s.DB.Query("SELECT id, name, created_at, last_used_at FROM passkeys WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []model.Passkey
+	for rows.Next() {
+		var p model.Passkey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			p.LastUsedAt = &lastUsed.Time
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// Count returns the number of passkeys the user has registered.
+func (s *Service) Count(userID int) (int, error) {
+	var n int
+	err := s.DB.QueryRow("SELECT count(*) FROM passkeys WHERE user_id = $1", userID).Scan(&n)
+	return n, err
+}
+
+// Rename changes the name of one of the user's passkeys.
+func (s *Service) Rename(userID, id int, name string) error {
+	res, err := s.DB.Exec("UPDATE passkeys SET name = $1 WHERE id = $2 AND user_id = $3", cleanName(name), id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes one of the user's passkeys.
+func (s *Service) Delete(userID, id int) error {
+	res, err := s.DB.Exec("DELETE FROM passkeys WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RemoveAll deletes all of the user's passkeys.
+func RemoveAll(db *sql.DB, userID int) error {
+	_, err := db.Exec("DELETE FROM passkeys WHERE user_id = $1", userID)
+	return err
+}
+
+func cleanName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return "Passkey"
+	}
+	return name
+}
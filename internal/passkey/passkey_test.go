@@ -0,0 +1,382 @@
+package passkey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"dokeep/internal/config"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:8081"
+)
+
+// authenticator is a software authenticator holding a single ES256
+// credential, standing in for the browser and security key.
+type authenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	counter uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &authenticator{key: key, id: id}
+}
+
+var b64 = base64.RawURLEncoding
+
+// Authenticator data flags: user present, user verified and attested
+// credential data included.
+const (
+	flagUP = 0x01
+	flagUV = 0x04
+	flagAT = 0x40
+)
+
+func (a *authenticator) authData(flags byte, extra []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, extra...)
+}
+
+func clientData(t *testing.T, kind string, challenge []byte, origin string) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": b64.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func post(t *testing.T, body interface{}) *http.Request {
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+}
+
+// create answers navigator.credentials.create with a "none" attestation.
+func (a *authenticator) create(t *testing.T, challenge []byte) *http.Request {
+	pub, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(append(attested, a.id...), pub...)
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(flagUP|flagUV|flagAT, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return post(t, map[string]interface{}{
+		"id":    b64.EncodeToString(a.id),
+		"rawId": b64.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData(t, "webauthn.create", challenge, testOrigin)),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	})
+}
+
+// get answers navigator.credentials.get, signing the challenge. userHandle
+// is only returned by discoverable credentials.
+func (a *authenticator) get(t *testing.T, challenge, userHandle []byte) *http.Request {
+	a.counter++
+	authData := a.authData(flagUP|flagUV, nil)
+	client := clientData(t, "webauthn.get", challenge, testOrigin)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(authData, clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := map[string]string{
+		"clientDataJSON":    b64.EncodeToString(client),
+		"authenticatorData": b64.EncodeToString(authData),
+		"signature":         b64.EncodeToString(sig),
+	}
+	if userHandle != nil {
+		response["userHandle"] = b64.EncodeToString(userHandle)
+	}
+	return post(t, map[string]interface{}{
+		"id":       b64.EncodeToString(a.id),
+		"rawId":    b64.EncodeToString(a.id),
+		"type":     "public-key",
+		"response": response,
+	})
+}
+
+// capture matches any argument and keeps it.
+type capture struct {
+	value driver.Value
+}
+
+func (c *capture) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+func newTestService(t *testing.T) (*Service, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	s, err := New(db, config.WebAuthnConfig{RPID: testRPID, DisplayName: "Dokeep", Origins: []string{testOrigin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, mock
+}
+
+var testHandle = []byte("0123456789abcdef0123456789abcdef")
+
+func expectUser(mock sqlmock.Sqlmock, handle []byte, credentials ...[]byte) {
+	mock.ExpectQuery(`SELECT username, webauthn_id FROM users WHERE id = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "webauthn_id"}).AddRow("alice", handle))
+	rows := sqlmock.NewRows([]string{"credential"})
+	for _, c := range credentials {
+		rows.AddRow(c)
+	}
+	mock.ExpectQuery(`SELECT credential FROM passkeys WHERE user_id = \$1`).WithArgs(1).WillReturnRows(rows)
+}
+
+// register runs a registration ceremony and returns the stored credential.
+func register(t *testing.T, s *Service, mock sqlmock.Sqlmock, a *authenticator) []byte {
+	t.Helper()
+	mock.ExpectQuery(`SELECT username, webauthn_id FROM users WHERE id = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "webauthn_id"}).AddRow("alice", nil))
+	mock.ExpectExec(`UPDATE users SET webauthn_id = \$1 WHERE id = \$2 AND webauthn_id IS NULL`).
+		WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT webauthn_id FROM users WHERE id = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"webauthn_id"}).AddRow(testHandle))
+	mock.ExpectQuery(`SELECT credential FROM passkeys WHERE user_id = \$1`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"credential"}))
+
+	options, session, err := s.BeginRegistration(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := options.Response.User.ID.(protocol.URLEncodedBase64); !bytes.Equal(id, testHandle) {
+		t.Errorf("user handle = %v, want %v", options.Response.User.ID, testHandle)
+	}
+
+	expectUser(mock, testHandle)
+	stored := &capture{}
+	mock.ExpectQuery(`INSERT INTO passkeys`).WithArgs(1, "My key", a.id, stored).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+	p, err := s.FinishRegistration(1, "  My   key ", *session, a.create(t, options.Response.Challenge))
+	if err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+	if p.ID != 7 || p.Name != "My key" {
+		t.Errorf("FinishRegistration = %+v", p)
+	}
+	return stored.value.([]byte)
+}
+
+func TestRegistration(t *testing.T) {
+	s, mock := newTestService(t)
+	a := newAuthenticator(t)
+	credential := register(t, s, mock, a)
+
+	var c struct {
+		ID        []byte `json:"id"`
+		PublicKey []byte `json:"publicKey"`
+	}
+	if err := json.Unmarshal(credential, &c); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.ID, a.id) || len(c.PublicKey) == 0 {
+		t.Errorf("stored credential = %s", credential)
+	}
+}
+
+func TestRegistrationWrongChallenge(t *testing.T) {
+	s, mock := newTestService(t)
+	expectUser(mock, testHandle)
+	_, session, err := s.BeginRegistration(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUser(mock, testHandle)
+	if _, err := s.FinishRegistration(1, "", *session, newAuthenticator(t).create(t, []byte("not the challenge"))); err == nil {
+		t.Error("FinishRegistration accepted a response to another challenge")
+	}
+}
+
+func TestSecondFactorLogin(t *testing.T) {
+	s, mock := newTestService(t)
+	a := newAuthenticator(t)
+	credential := register(t, s, mock, a)
+
+	expectUser(mock, testHandle, credential)
+	options, session, err := s.BeginLogin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options.Response.AllowedCredentials) != 1 || !bytes.Equal(options.Response.AllowedCredentials[0].CredentialID, a.id) {
+		t.Errorf("allowed credentials = %+v", options.Response.AllowedCredentials)
+	}
+
+	expectUser(mock, testHandle, credential)
+	mock.ExpectExec(`UPDATE passkeys SET credential = \$1, last_used_at = CURRENT_TIMESTAMP WHERE credential_id = \$2`).
+		WithArgs(sqlmock.AnyArg(), a.id).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := s.FinishLogin(1, *session, a.get(t, options.Response.Challenge, nil)); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+}
+
+func TestSecondFactorLoginRejected(t *testing.T) {
+	s, mock := newTestService(t)
+	a := newAuthenticator(t)
+	credential := register(t, s, mock, a)
+
+	expectUser(mock, testHandle, credential)
+	options, session, err := s.BeginLogin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A signature over another challenge, e.g. a replayed response
+	expectUser(mock, testHandle, credential)
+	if err := s.FinishLogin(1, *session, a.get(t, []byte("an old challenge"), nil)); err == nil {
+		t.Error("FinishLogin accepted a response to another challenge")
+	}
+
+	// Another authenticator's signature for the same credential ID
+	forged := newAuthenticator(t)
+	forged.id = a.id
+	expectUser(mock, testHandle, credential)
+	if err := s.FinishLogin(1, *session, forged.get(t, options.Response.Challenge, nil)); err == nil {
+		t.Error("FinishLogin accepted a signature from another key")
+	}
+}
+
+func TestSecondFactorLoginClonedCounter(t *testing.T) {
+	s, mock := newTestService(t)
+	a := newAuthenticator(t)
+	credential := register(t, s, mock, a)
+
+	// The server has seen the authenticator at a higher counter than the
+	// one it now presents, as when a copy of the key is used.
+	var c map[string]interface{}
+	json.Unmarshal(credential, &c)
+	c["authenticator"].(map[string]interface{})["signCount"] = 10
+	credential, _ = json.Marshal(c)
+
+	expectUser(mock, testHandle, credential)
+	options, session, err := s.BeginLogin(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUser(mock, testHandle, credential)
+	if err := s.FinishLogin(1, *session, a.get(t, options.Response.Challenge, nil)); !errors.Is(err, ErrCloned) {
+		t.Errorf("FinishLogin error = %v, want ErrCloned", err)
+	}
+}
+
+func TestBeginLoginWithoutPasskeys(t *testing.T) {
+	s, mock := newTestService(t)
+	expectUser(mock, testHandle)
+	if _, _, err := s.BeginLogin(1); !errors.Is(err, ErrNoPasskeys) {
+		t.Errorf("BeginLogin error = %v, want ErrNoPasskeys", err)
+	}
+}
+
+func TestDiscoverableLogin(t *testing.T) {
+	s, mock := newTestService(t)
+	a := newAuthenticator(t)
+	credential := register(t, s, mock, a)
+
+	options, session, err := s.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options.Response.AllowedCredentials) != 0 || options.Response.UserVerification != "required" {
+		t.Errorf("options = %+v", options.Response)
+	}
+
+	mock.ExpectQuery(`SELECT id FROM users WHERE webauthn_id = \$1`).WithArgs(testHandle).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	expectUser(mock, testHandle, credential)
+	mock.ExpectExec(`UPDATE passkeys SET credential`).WithArgs(sqlmock.AnyArg(), a.id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	userID, err := s.FinishDiscoverableLogin(*session, a.get(t, options.Response.Challenge, testHandle))
+	if err != nil {
+		t.Fatalf("FinishDiscoverableLogin: %v", err)
+	}
+	if userID != 1 {
+		t.Errorf("FinishDiscoverableLogin = %d, want 1", userID)
+	}
+}
+
+func TestDiscoverableLoginUnknownUser(t *testing.T) {
+	s, mock := newTestService(t)
+	a := newAuthenticator(t)
+
+	options, session, err := s.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`SELECT id FROM users WHERE webauthn_id = \$1`).WithArgs([]byte("unknown")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	if _, err := s.FinishDiscoverableLogin(*session, a.get(t, options.Response.Challenge, []byte("unknown"))); err == nil {
+		t.Error("FinishDiscoverableLogin accepted an unknown user handle")
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	for in, want := range map[string]string{"": "Passkey", "  ": "Passkey", " Phone\t key ": "Phone key"} {
+		if got := cleanName(in); got != want {
+			t.Errorf("cleanName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+// Package search implements the query language accepted by the dashboard
+// search box, for example:
+//
+//	tag:invoice -tag:paid created:>2023-01-01 title:"lease" (water OR power)
+//
+// Bare words and "quoted phrases" are matched against the full-text index.
+// Bare words of four or more letters also match similar spellings (see
+// package pg_trgm), as do the values of title:, summary: and content:.
+// field:value terms filter on a specific attribute. Terms are combined with
+// an implicit AND; OR, AND and NOT (or a leading "-") can be used explicitly
+// and grouped with parentheses. Keywords must be written in upper case so
+// that "or" and "not" remain searchable words. A user's custom fields are
+// searched as field.<key>:value, e.g. field.invoice_number:"INV-1" or
+// field.amount:>100.
+package search
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"dokeep/internal/model"
+)
+
+// Node is an element of a parsed query.
+type Node interface {
+	node()
+}
+
+// And matches documents matching both sides.
+type And struct {
+	Left, Right Node
+}
+
+// Or matches documents matching either side.
+type Or struct {
+	Left, Right Node
+}
+
+// Not matches documents that do not match X.
+type Not struct {
+	X Node
+}
+
+// Term is a single search term. Field is empty for free text. Op is one of
+// ":", ">", ">=", "<" or "<=" and is only meaningful for range fields.
+// Custom is set for field.<key> terms.
+type Term struct {
+	Field  string
+	Op     string
+	Value  string
+	Phrase bool
+	Custom *model.CustomField
+}
+
+func (And) node()  {}
+func (Or) node()   {}
+func (Not) node()  {}
+func (Term) node() {}
+
+// Error describes a malformed query. Pos is the zero-based byte offset of
+// the problem in the input, or -1 for an invalid Filter.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	if e.Pos < 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s (at position %d)", e.Msg, e.Pos+1)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+	tokTerm
+)
+
+type token struct {
+	kind tokenKind
+	pos  int
+	term Term
+}
+
+// customPrefix introduces a custom field name in a query.
+const customPrefix = "field."
+
+// Parse parses a query string. fields holds the user's custom fields by key
+// and may be nil. An empty or whitespace-only query returns a nil Node and
+// no error.
+func Parse(input string, fields map[string]model.CustomField) (Node, error) {
+	tokens, err := lex(input, fields)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		if t.kind == tokRParen {
+			return nil, &Error{Pos: t.pos, Msg: "unexpected ')'"}
+		}
+		return nil, &Error{Pos: t.pos, Msg: "unexpected input"}
+	}
+	return n, nil
+}
+
+// Filter returns a term for a field, such as one chosen in a form rather than
+// typed into the query, after validating it like a parsed term. It is
+// combined with a parsed query using And.
+func Filter(field, op, value string) (Node, error) {
+	field = strings.ToLower(field)
+	if !knownField(field) {
+		return nil, &Error{Pos: -1, Msg: fmt.Sprintf("unknown field %q", field)}
+	}
+	t := Term{Field: field, Op: op, Value: value, Phrase: true}
+	if err := validateTerm(t, -1); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func lex(input string, fields map[string]model.CustomField) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, pos: i})
+			i++
+		case c == '-' && i+1 < len(input) && !isSpace(input[i+1]) && input[i+1] != ')':
+			tokens = append(tokens, token{kind: tokNot, pos: i})
+			i++
+		default:
+			start := i
+			term, next, err := lexTerm(input, i, fields)
+			if err != nil {
+				return nil, err
+			}
+			i = next
+			kind := tokTerm
+			if term.Field == "" && !term.Phrase {
+				switch term.Value {
+				case "AND":
+					kind = tokAnd
+				case "OR":
+					kind = tokOr
+				case "NOT":
+					kind = tokNot
+				}
+			}
+			tokens = append(tokens, token{kind: kind, pos: start, term: term})
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+// lexTerm reads a word, a quoted phrase or a field:value pair starting at i.
+func lexTerm(input string, i int, fields map[string]model.CustomField) (Term, int, error) {
+	if input[i] == '"' {
+		value, next, err := lexQuoted(input, i)
+		if err != nil {
+			return Term{}, 0, err
+		}
+		return Term{Value: value, Phrase: true}, next, nil
+	}
+
+	start := i
+	for i < len(input) && !isSpace(input[i]) && input[i] != '(' && input[i] != ')' && input[i] != '"' && input[i] != ':' {
+		i++
+	}
+	word := input[start:i]
+
+	// A field is a purely alphabetic word, or field.<key>, directly followed
+	// by a colon. Anything else containing a colon (times, URLs) is plain
+	// text.
+	if i < len(input) && input[i] == ':' && isFieldName(word) && !strings.HasPrefix(input[i+1:], "//") {
+		field := strings.ToLower(word)
+		var custom *model.CustomField
+		if key, ok := strings.CutPrefix(field, customPrefix); ok {
+			f, ok := fields[key]
+			if !ok {
+				return Term{}, 0, &Error{Pos: start, Msg: fmt.Sprintf("unknown custom field %q", key)}
+			}
+			custom = &f
+		} else if !knownField(field) {
+			return Term{}, 0, &Error{Pos: start, Msg: fmt.Sprintf("unknown field %q", word)}
+		}
+		i++
+		op := ":"
+		for _, candidate := range []string{">=", "<=", ">", "<"} {
+			if strings.HasPrefix(input[i:], candidate) {
+				op = candidate
+				i += len(candidate)
+				break
+			}
+		}
+		if i < len(input) && input[i] == '"' {
+			value, next, err := lexQuoted(input, i)
+			if err != nil {
+				return Term{}, 0, err
+			}
+			if strings.TrimSpace(value) == "" {
+				return Term{}, 0, &Error{Pos: start, Msg: fmt.Sprintf("missing value for %s:", field)}
+			}
+			return Term{Field: field, Op: op, Value: value, Phrase: true, Custom: custom}, next, nil
+		}
+		valueStart := i
+		for i < len(input) && !isSpace(input[i]) && input[i] != '(' && input[i] != ')' {
+			i++
+		}
+		if i == valueStart {
+			return Term{}, 0, &Error{Pos: start, Msg: fmt.Sprintf("missing value for %s:", field)}
+		}
+		return Term{Field: field, Op: op, Value: input[valueStart:i], Custom: custom}, i, nil
+	}
+
+	// Swallow the rest of a word that merely contains a colon.
+	for i < len(input) && !isSpace(input[i]) && input[i] != '(' && input[i] != ')' && input[i] != '"' {
+		i++
+	}
+	return Term{Value: input[start:i]}, i, nil
+}
+
+func lexQuoted(input string, i int) (string, int, error) {
+	start := i
+	i++ // opening quote
+	end := strings.IndexByte(input[i:], '"')
+	if end < 0 {
+		return "", 0, &Error{Pos: start, Msg: "unterminated quoted phrase"}
+	}
+	return input[i : i+end], i + end + 1, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isFieldName(word string) bool {
+	if key, ok := strings.CutPrefix(strings.ToLower(word), customPrefix); ok {
+		if key == "" {
+			return false
+		}
+		for _, r := range key {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+				return false
+			}
+		}
+		return true
+	}
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		op := p.next()
+		if k := p.peek().kind; k == tokEOF || k == tokRParen || k == tokOr || k == tokAnd {
+			return nil, &Error{Pos: op.pos, Msg: "OR must be followed by a search term"}
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	if t := p.peek(); t.kind == tokOr || t.kind == tokAnd {
+		return nil, &Error{Pos: t.pos, Msg: "expected a search term before " + t.term.Value}
+	}
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch t.kind {
+		case tokAnd:
+			p.next()
+			if k := p.peek().kind; k == tokEOF || k == tokRParen || k == tokOr || k == tokAnd {
+				return nil, &Error{Pos: t.pos, Msg: "AND must be followed by a search term"}
+			}
+		case tokTerm, tokNot, tokLParen:
+			// implicit AND
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = And{Left: left, Right: right}
+	}
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	t := p.peek()
+	if t.kind == tokNot {
+		p.next()
+		if k := p.peek().kind; k == tokEOF || k == tokRParen || k == tokOr || k == tokAnd {
+			return nil, &Error{Pos: t.pos, Msg: "NOT must be followed by a search term"}
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{X: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokTerm:
+		if err := validateTerm(t.term, t.pos); err != nil {
+			return nil, err
+		}
+		return t.term, nil
+	case tokLParen:
+		if p.peek().kind == tokRParen {
+			return nil, &Error{Pos: t.pos, Msg: "empty parentheses"}
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, &Error{Pos: t.pos, Msg: "missing closing ')'"}
+		}
+		p.next()
+		return n, nil
+	case tokRParen:
+		return nil, &Error{Pos: t.pos, Msg: "unexpected ')'"}
+	case tokEOF:
+		return nil, &Error{Pos: t.pos, Msg: "unexpected end of query"}
+	default:
+		return nil, &Error{Pos: t.pos, Msg: "unexpected " + t.term.Value}
+	}
+}
+
+// Rewrite returns the input with each bare word that is not negated replaced
+// by replace(word), keeping everything else as typed. It is used to suggest
+// a corrected query.
+func Rewrite(input string, fields map[string]model.CustomField, replace func(string) string) (string, error) {
+	tokens, err := lex(input, fields)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	last := 0
+	for i, t := range tokens {
+		if t.kind != tokTerm || t.term.Field != "" || t.term.Phrase || (i > 0 && tokens[i-1].kind == tokNot) {
+			continue
+		}
+		b.WriteString(input[last:t.pos])
+		b.WriteString(replace(t.term.Value))
+		last = t.pos + len(t.term.Value)
+	}
+	b.WriteString(input[last:])
+	return b.String(), nil
+}
+
+// FreeText returns the positive free-text terms of a query joined into a
+// string suitable for websearch_to_tsquery, so results can be ranked by
+// relevance. Terms under a NOT are ignored.
+func FreeText(n Node) string {
+	var parts []string
+	var walk func(Node)
+	walk = func(n Node) {
+		switch n := n.(type) {
+		case And:
+			walk(n.Left)
+			walk(n.Right)
+		case Or:
+			walk(n.Left)
+			walk(n.Right)
+		case Term:
+			if n.Field != "" {
+				return
+			}
+			if n.Phrase {
+				parts = append(parts, `"`+n.Value+`"`)
+			} else {
+				parts = append(parts, n.Value)
+			}
+		}
+	}
+	walk(n)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,155 @@
+package search
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dokeep/internal/customfield"
+	"dokeep/internal/model"
+)
+
+var testFields = map[string]model.CustomField{
+	"amount":  {ID: 1, Name: "Amount", Key: "amount", Type: customfield.Number},
+	"due":     {ID: 2, Name: "Due", Key: "due", Type: customfield.Date},
+	"paid":    {ID: 3, Name: "Paid", Key: "paid", Type: customfield.Boolean},
+	"invoice": {ID: 4, Name: "Invoice", Key: "invoice", Type: customfield.Text},
+}
+
+func word(v string) Term   { return Term{Value: v} }
+func phrase(v string) Term { return Term{Value: v, Phrase: true} }
+
+func TestParse(t *testing.T) {
+	amount := testFields["amount"]
+	tests := []struct {
+		input string
+		want  Node
+	}{
+		{"", nil},
+		{"   \t", nil},
+		{"lease", word("lease")},
+		{`"water bill"`, phrase("water bill")},
+		{"water bill", And{word("water"), word("bill")}},
+		{"water AND bill", And{word("water"), word("bill")}},
+		{"water OR power", Or{word("water"), word("power")}},
+		{"a b OR c", Or{And{word("a"), word("b")}, word("c")}},
+		{"a (b OR c)", And{word("a"), Or{word("b"), word("c")}}},
+		{"-paid", Not{word("paid")}},
+		{"NOT paid", Not{word("paid")}},
+		{"- paid", And{word("-"), word("paid")}},
+		{"not or and", And{And{word("not"), word("or")}, word("and")}},
+		{"tag:invoice", Term{Field: "tag", Op: ":", Value: "invoice"}},
+		{"-tag:paid", Not{Term{Field: "tag", Op: ":", Value: "paid"}}},
+		{"TAG:Invoice", Term{Field: "tag", Op: ":", Value: "Invoice"}},
+		{`title:"lease agreement"`, Term{Field: "title", Op: ":", Value: "lease agreement", Phrase: true}},
+		{"created:>2023-01-01", Term{Field: "created", Op: ">", Value: "2023-01-01"}},
+		{"created:<=2023", Term{Field: "created", Op: "<=", Value: "2023"}},
+		{"date:2023-01..2023-06", Term{Field: "date", Op: ":", Value: "2023-01..2023-06"}},
+		{"field.amount:>100", Term{Field: "field.amount", Op: ">", Value: "100", Custom: &amount}},
+		{"10:30", word("10:30")},
+		{"https://example.com", word("https://example.com")},
+		{"tag:a(b)", And{Term{Field: "tag", Op: ":", Value: "a"}, word("b")}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.input, testFields)
+		if err != nil {
+			t.Errorf("Parse(%q) error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+		msg   string
+	}{
+		{`"unterminated`, 0, "unterminated quoted phrase"},
+		{`title:"open`, 6, "unterminated quoted phrase"},
+		{"a (b", 2, "missing closing ')'"},
+		{"a)", 1, "unexpected ')'"},
+		{"()", 0, "empty parentheses"},
+		{"OR a", 0, "expected a search term before OR"},
+		{"a OR", 2, "OR must be followed by a search term"},
+		{"a AND", 2, "AND must be followed by a search term"},
+		{"a NOT", 2, "NOT must be followed by a search term"},
+		{"a -)", 3, "unexpected ')'"},
+		{"colour:red", 0, `unknown field "colour"`},
+		{"x field.nope:1", 2, `unknown custom field "nope"`},
+		{"tag:", 0, "missing value for tag:"},
+		{`tag:""`, 0, "missing value for tag:"},
+		{"status:lost", 0, `unknown status "lost"`},
+		{"tag:>a", 0, "tag: does not support > comparisons"},
+		{"created:yesterday", 0, `invalid date "yesterday"`},
+		{"created:2024..2023", 0, `invalid date "2024..2023"`},
+		{"ext:p.df", 0, `invalid file type "p.df"`},
+		{"field.amount:lots", 0, `invalid number "lots"`},
+		{"field.paid:maybe", 0, `invalid value "maybe"`},
+		{"field.invoice:>1", 0, "field.invoice: does not support > comparisons"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.input, testFields)
+		var perr *Error
+		if !errors.As(err, &perr) {
+			t.Errorf("Parse(%q) error = %v, want *Error", tt.input, err)
+			continue
+		}
+		if perr.Pos != tt.pos || !strings.HasPrefix(perr.Msg, tt.msg) {
+			t.Errorf("Parse(%q) error = %d %q, want %d %q", tt.input, perr.Pos, perr.Msg, tt.pos, tt.msg)
+		}
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	err := &Error{Pos: 4, Msg: "unexpected ')'"}
+	if got, want := err.Error(), "unexpected ')' (at position 5)"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	err = &Error{Pos: -1, Msg: `unknown field "x"`}
+	if got, want := err.Error(), `unknown field "x"`; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	n, err := Filter("Status", ":", "completed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Term{Field: "status", Op: ":", Value: "completed", Phrase: true}); n != want {
+		t.Errorf("Filter = %#v, want %#v", n, want)
+	}
+
+	var perr *Error
+	if _, err := Filter("colour", ":", "red"); !errors.As(err, &perr) || perr.Pos != -1 {
+		t.Errorf("Filter(colour) error = %v, want *Error without position", err)
+	}
+	if _, err := Filter("created", ":", "soon"); !errors.As(err, &perr) || perr.Pos != -1 {
+		t.Errorf("Filter(created) error = %v, want *Error without position", err)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	got, err := Rewrite(`invioce -recept tag:recept "invioce" (invioce OR x)`, nil, strings.ToUpper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `INVIOCE -recept tag:recept "invioce" (INVIOCE OR X)`; got != want {
+		t.Errorf("Rewrite = %q, want %q", got, want)
+	}
+}
+
+func TestFreeText(t *testing.T) {
+	n, err := Parse(`water "power bill" -gas tag:home (OR_ OR heat)`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := FreeText(n), `water "power bill" OR_ heat`; got != want {
+		t.Errorf("FreeText = %q, want %q", got, want)
+	}
+}
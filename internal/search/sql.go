@@ -0,0 +1,323 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"dokeep/internal/customfield"
+	"dokeep/internal/model"
+	"dokeep/internal/tagpath"
+)
+
+// Statuses that can be used with status:.
+var statuses = map[string]bool{
+	"queued":     true,
+	"processing": true,
+	"completed":  true,
+	"failed":     true,
+	"cancelled":  true,
+}
+
+// fieldAliases maps every accepted field name to its canonical name.
+var fieldAliases = map[string]string{
+	"tag":      "tag",
+	"tags":     "tag",
+	"title":    "title",
+	"summary":  "summary",
+	"content":  "content",
+	"text":     "content",
+	"status":   "status",
+	"created":  "created",
+	"date":     "created",
+	"uploaded": "uploaded",
+	"added":    "uploaded",
+
+	"correspondent": "correspondent",
+	"from":          "correspondent",
+	"type":          "type",
+	"filetype":      "filetype",
+	"ext":           "filetype",
+}
+
+func knownField(field string) bool {
+	_, ok := fieldAliases[field]
+	return ok
+}
+
+func isRangeField(field string) bool {
+	return field == "created" || field == "uploaded"
+}
+
+// validateTerm checks a term's value before any SQL is generated so that
+// errors can point at the offending position.
+func validateTerm(t Term, pos int) error {
+	if t.Custom != nil {
+		return validateCustomTerm(t, pos)
+	}
+	field := fieldAliases[t.Field]
+	if t.Op != ":" && t.Op != "" && !isRangeField(field) {
+		return &Error{Pos: pos, Msg: fmt.Sprintf("%s: does not support %s comparisons", t.Field, t.Op)}
+	}
+	switch field {
+	case "status":
+		if !statuses[strings.ToLower(t.Value)] {
+			return &Error{Pos: pos, Msg: fmt.Sprintf("unknown status %q (expected queued, processing, completed, failed or cancelled)", t.Value)}
+		}
+	case "created", "uploaded":
+		if _, _, err := parseDateRange(t.Value); err != nil {
+			return &Error{Pos: pos, Msg: fmt.Sprintf("invalid date %q for %s: (use YYYY, YYYY-MM, YYYY-MM-DD or a range like 2023-01..2023-06)", t.Value, t.Field)}
+		}
+	case "filetype":
+		ext := strings.TrimPrefix(t.Value, ".")
+		if ext == "" || strings.IndexFunc(ext, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) >= 0 {
+			return &Error{Pos: pos, Msg: fmt.Sprintf("invalid file type %q (use an extension such as pdf)", t.Value)}
+		}
+	}
+	return nil
+}
+
+// validateCustomTerm checks a field.<key> term against the field's type.
+// Numbers, amounts and dates can be compared; other types only match.
+func validateCustomTerm(t Term, pos int) error {
+	f := t.Custom
+	switch f.Type {
+	case customfield.Number, customfield.Money:
+		if _, err := customfield.Value(model.CustomField{Name: t.Field, Type: customfield.Number}, amountOf(t.Value)); err != nil {
+			return &Error{Pos: pos, Msg: fmt.Sprintf("invalid number %q for %s:", t.Value, t.Field)}
+		}
+		return nil
+	case customfield.Date:
+		if _, _, err := parseDateRange(t.Value); err != nil {
+			return &Error{Pos: pos, Msg: fmt.Sprintf("invalid date %q for %s: (use YYYY, YYYY-MM, YYYY-MM-DD or a range like 2023-01..2023-06)", t.Value, t.Field)}
+		}
+		return nil
+	}
+	if t.Op != ":" && t.Op != "" {
+		return &Error{Pos: pos, Msg: fmt.Sprintf("%s: does not support %s comparisons", t.Field, t.Op)}
+	}
+	if f.Type == customfield.Boolean {
+		if _, err := customfield.Value(*f, t.Value); err != nil {
+			return &Error{Pos: pos, Msg: fmt.Sprintf("invalid value %q for %s: (use yes or no)", t.Value, t.Field)}
+		}
+	}
+	return nil
+}
+
+// amountOf strips a currency code from a money value so that
+// field.total:>100 and field.total:>"100 EUR" compare the same amount.
+func amountOf(value string) string {
+	parts := strings.Fields(value)
+	for _, p := range parts {
+		if len(p) != 3 || strings.ContainsAny(p, "0123456789") {
+			return p
+		}
+	}
+	return value
+}
+
+// Columns used in generated SQL. The generated clauses assume the documents
+// table is aliased as "d".
+var (
+	dateColumns = map[string]string{
+		"created":  "d.created_date",
+		"uploaded": "d.created_at",
+	}
+	textColumns = map[string]string{
+		"title":   "d.title",
+		"summary": "d.summary",
+		"content": "d.content",
+	}
+	entityColumns = map[string][2]string{
+		"correspondent": {"d.correspondent_id", "correspondents"},
+		"type":          {"d.document_type_id", "document_types"},
+	}
+)
+
+// SQL converts a parsed query into a boolean SQL expression. Parameters are
+// appended to args and referenced positionally, so the result can be added
+// to an existing WHERE clause built with the same args slice.
+func SQL(n Node, args []interface{}) (string, []interface{}) {
+	switch n := n.(type) {
+	case And:
+		left, args := SQL(n.Left, args)
+		right, args := SQL(n.Right, args)
+		return "(" + left + " AND " + right + ")", args
+	case Or:
+		left, args := SQL(n.Left, args)
+		right, args := SQL(n.Right, args)
+		return "(" + left + " OR " + right + ")", args
+	case Not:
+		inner, args := SQL(n.X, args)
+		return "NOT " + inner, args
+	case Term:
+		return termSQL(n, args)
+	}
+	return "TRUE", args
+}
+
+func placeholder(args []interface{}, v interface{}) (string, []interface{}) {
+	args = append(args, v)
+	return fmt.Sprintf("$%d", len(args)), args
+}
+
+func termSQL(t Term, args []interface{}) (string, []interface{}) {
+	if t.Custom != nil {
+		return customTermSQL(t, args)
+	}
+	var p string
+	field := fieldAliases[t.Field]
+	switch field {
+	case "":
+		fn := "plainto_tsquery"
+		if t.Phrase {
+			fn = "phraseto_tsquery"
+		}
+		p, args = placeholder(args, t.Value)
+		// A term made only of stop words produces an empty tsquery, which
+		// would otherwise match nothing; treat it as always true instead.
+		q := fmt.Sprintf("%s('english', %s)", fn, p)
+		exact := fmt.Sprintf("(numnode(%s) = 0 OR d.search_vector @@ %s)", q, q)
+		if t.Phrase || !fuzzy(t.Value) {
+			return exact, args
+		}
+		// Words are also matched by trigram similarity against the title,
+		// content and tag names, so misspellings and OCR errors still
+		// find the document.
+		return fmt.Sprintf("(%s OR %s <%% d.title OR %s <%% d.content OR EXISTS (SELECT 1 FROM document_tags dt JOIN tags t ON t.id = dt.tag_id WHERE dt.document_id = d.id AND %s <%% t.name))", exact, p, p, p), args
+	case "tag":
+		// A tag also matches documents carrying any of its descendants.
+		p, args = placeholder(args, tagpath.Normalize(t.Value))
+		return fmt.Sprintf("EXISTS (SELECT 1 FROM document_tags dt JOIN tags t ON t.id = dt.tag_id WHERE dt.document_id = d.id AND (t.name = %s OR starts_with(t.name, %s || '/')))", p, p), args
+	case "status":
+		p, args = placeholder(args, strings.ToLower(t.Value))
+		return "d.status = " + p, args
+	case "correspondent", "type":
+		col := entityColumns[field]
+		p, args = placeholder(args, strings.Join(strings.Fields(t.Value), " "))
+		return fmt.Sprintf("%s IN (SELECT id FROM %s WHERE lower(name) = lower(%s))", col[0], col[1], p), args
+	case "filetype":
+		// Stored files are named after the document ID with the original,
+		// lower-cased extension.
+		p, args = placeholder(args, "%."+strings.ToLower(strings.TrimPrefix(t.Value, ".")))
+		return "d.file_path LIKE " + p, args
+	case "title", "summary", "content":
+		column := textColumns[field]
+		p, args = placeholder(args, "%"+EscapeLike(t.Value)+"%")
+		cond := fmt.Sprintf("coalesce(%s, '') ILIKE %s", column, p)
+		if !fuzzy(t.Value) {
+			return cond, args
+		}
+		p, args = placeholder(args, t.Value)
+		return fmt.Sprintf("(%s OR %s <%% %s)", cond, p, column), args
+	case "created", "uploaded":
+		return dateSQL(dateColumns[field], t, args)
+	}
+	return "TRUE", args
+}
+
+// customTermSQL matches documents with a value for a custom field. Values are
+// only cast for rows of the field itself, since other fields may hold text
+// that is not valid for this type.
+func customTermSQL(t Term, args []interface{}) (string, []interface{}) {
+	f := t.Custom
+	var id, p, cond string
+	id, args = placeholder(args, f.ID)
+	value := fmt.Sprintf("CASE WHEN v.field_id = %s THEN v.value END", id)
+	switch f.Type {
+	case customfield.Number, customfield.Money:
+		n, _ := customfield.Value(model.CustomField{Type: customfield.Number}, amountOf(t.Value))
+		op := t.Op
+		if op == ":" || op == "" {
+			op = "="
+		}
+		p, args = placeholder(args, n)
+		cond = fmt.Sprintf("%s %s %s::numeric", customfield.SortExpr(f.Type, value), op, p)
+	case customfield.Date:
+		cond, args = dateSQL(fmt.Sprintf("(%s)::date", value), t, args)
+	case customfield.Boolean:
+		b, _ := customfield.Value(*f, t.Value)
+		p, args = placeholder(args, b)
+		cond = "v.value = " + p
+	case customfield.Select:
+		p, args = placeholder(args, t.Value)
+		cond = fmt.Sprintf("lower(v.value) = lower(%s)", p)
+	default:
+		p, args = placeholder(args, "%"+EscapeLike(t.Value)+"%")
+		cond = "v.value ILIKE " + p
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM custom_field_values v WHERE v.document_id = d.id AND v.field_id = %s AND %s)", id, cond), args
+}
+
+// dateSQL turns a date term into a half-open range comparison. A value such
+// as "2024" covers the whole year, so created:2024 means
+// 2024-01-01 <= date < 2025-01-01 and created:>2024 means date >= 2025-01-01.
+func dateSQL(column string, t Term, args []interface{}) (string, []interface{}) {
+	from, to, _ := parseDateRange(t.Value)
+	var lo, hi string
+	switch t.Op {
+	case ">":
+		lo, args = placeholder(args, to)
+		return fmt.Sprintf("%s >= %s", column, lo), args
+	case ">=":
+		lo, args = placeholder(args, from)
+		return fmt.Sprintf("%s >= %s", column, lo), args
+	case "<":
+		hi, args = placeholder(args, from)
+		return fmt.Sprintf("%s < %s", column, hi), args
+	case "<=":
+		hi, args = placeholder(args, to)
+		return fmt.Sprintf("%s < %s", column, hi), args
+	}
+	lo, args = placeholder(args, from)
+	hi, args = placeholder(args, to)
+	return fmt.Sprintf("(%s >= %s AND %s < %s)", column, lo, column, hi), args
+}
+
+// parseDateRange parses YYYY, YYYY-MM, YYYY-MM-DD or "a..b" into the half-open
+// interval [from, to).
+func parseDateRange(value string) (time.Time, time.Time, error) {
+	if a, b, ok := strings.Cut(value, ".."); ok {
+		from, _, err := parseDate(a)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		_, to, err := parseDate(b)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if !to.After(from) {
+			return time.Time{}, time.Time{}, fmt.Errorf("empty date range")
+		}
+		return from, to, nil
+	}
+	return parseDate(value)
+}
+
+func parseDate(value string) (time.Time, time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, t.AddDate(0, 0, 1), nil
+	}
+	if t, err := time.Parse("2006-01", value); err == nil {
+		return t, t.AddDate(0, 1, 0), nil
+	}
+	if t, err := time.Parse("2006", value); err == nil {
+		return t, t.AddDate(1, 0, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// minFuzzyLength is the shortest value matched by trigram similarity.
+// Shorter words share too few trigrams to tell a typo from another word.
+const minFuzzyLength = 4
+
+func fuzzy(value string) bool {
+	return utf8.RuneCountInString(value) >= minFuzzyLength
+}
+
+// EscapeLike escapes the wildcards of a LIKE pattern.
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
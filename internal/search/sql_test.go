@@ -0,0 +1,134 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestSQL(t *testing.T) {
+	tests := []struct {
+		input string
+		sql   string
+		args  []interface{}
+	}{
+		{
+			"tax",
+			"(numnode(plainto_tsquery('english', $1)) = 0 OR d.search_vector @@ plainto_tsquery('english', $1))",
+			[]interface{}{"tax"},
+		},
+		{
+			`"water bill"`,
+			"(numnode(phraseto_tsquery('english', $1)) = 0 OR d.search_vector @@ phraseto_tsquery('english', $1))",
+			[]interface{}{"water bill"},
+		},
+		{
+			"lease",
+			"((numnode(plainto_tsquery('english', $1)) = 0 OR d.search_vector @@ plainto_tsquery('english', $1)) OR $1 <% d.title OR $1 <% d.content" +
+				" OR EXISTS (SELECT 1 FROM document_tags dt JOIN tags t ON t.id = dt.tag_id WHERE dt.document_id = d.id AND $1 <% t.name))",
+			[]interface{}{"lease"},
+		},
+		{
+			"-tag:Home/Bills",
+			"NOT EXISTS (SELECT 1 FROM document_tags dt JOIN tags t ON t.id = dt.tag_id WHERE dt.document_id = d.id AND (t.name = $1 OR starts_with(t.name, $1 || '/')))",
+			[]interface{}{"home/bills"},
+		},
+		{
+			"status:Failed OR ext:.PDF",
+			"(d.status = $1 OR d.file_path LIKE $2)",
+			[]interface{}{"failed", "%.pdf"},
+		},
+		{
+			`from:"ACME   Corp"`,
+			"d.correspondent_id IN (SELECT id FROM correspondents WHERE lower(name) = lower($1))",
+			[]interface{}{"ACME Corp"},
+		},
+		{
+			"title:50%",
+			"coalesce(d.title, '') ILIKE $1",
+			[]interface{}{`%50\%%`},
+		},
+		{
+			"summary:lease",
+			"(coalesce(d.summary, '') ILIKE $1 OR $2 <% d.summary)",
+			[]interface{}{"%lease%", "lease"},
+		},
+		{
+			"created:2023",
+			"(d.created_date >= $1 AND d.created_date < $2)",
+			[]interface{}{date("2023-01-01"), date("2024-01-01")},
+		},
+		{
+			"created:>2023-02 uploaded:<=2023-01-31",
+			"(d.created_date >= $1 AND d.created_at < $2)",
+			[]interface{}{date("2023-03-01"), date("2023-02-01")},
+		},
+		{
+			"added:>=2023-01..2023-06",
+			"d.created_at >= $1",
+			[]interface{}{date("2023-01-01")},
+		},
+		{
+			`field.amount:>"1,000.50 EUR"`,
+			"EXISTS (SELECT 1 FROM custom_field_values v WHERE v.document_id = d.id AND v.field_id = $1 AND CASE WHEN v.field_id = $1 THEN v.value END::numeric > $2::numeric)",
+			[]interface{}{1, "1000.5"},
+		},
+		{
+			"field.due:<2024",
+			"EXISTS (SELECT 1 FROM custom_field_values v WHERE v.document_id = d.id AND v.field_id = $1 AND (CASE WHEN v.field_id = $1 THEN v.value END)::date < $2)",
+			[]interface{}{2, date("2024-01-01")},
+		},
+		{
+			"field.paid:yes",
+			"EXISTS (SELECT 1 FROM custom_field_values v WHERE v.document_id = d.id AND v.field_id = $1 AND v.value = $2)",
+			[]interface{}{3, "true"},
+		},
+		{
+			"field.invoice:INV_1",
+			"EXISTS (SELECT 1 FROM custom_field_values v WHERE v.document_id = d.id AND v.field_id = $1 AND v.value ILIKE $2)",
+			[]interface{}{4, `%INV\_1%`},
+		},
+	}
+	for _, tt := range tests {
+		n, err := Parse(tt.input, testFields)
+		if err != nil {
+			t.Errorf("Parse(%q) error: %v", tt.input, err)
+			continue
+		}
+		sql, args := SQL(n, nil)
+		if sql != tt.sql {
+			t.Errorf("SQL(%q) =\n%s\nwant\n%s", tt.input, sql, tt.sql)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("SQL(%q) args = %#v, want %#v", tt.input, args, tt.args)
+		}
+	}
+}
+
+func TestSQLAppendsArgs(t *testing.T) {
+	n, err := Parse("status:queued tag:x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql, args := SQL(n, []interface{}{42})
+	if want := "(d.status = $2 AND EXISTS (SELECT 1 FROM document_tags dt JOIN tags t ON t.id = dt.tag_id WHERE dt.document_id = d.id AND (t.name = $3 OR starts_with(t.name, $3 || '/'))))"; sql != want {
+		t.Errorf("SQL = %s, want %s", sql, want)
+	}
+	if want := []interface{}{42, "queued", "x"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %#v, want %#v", args, want)
+	}
+}
+
+func TestSQLEmpty(t *testing.T) {
+	if sql, args := SQL(nil, nil); sql != "TRUE" || args != nil {
+		t.Errorf("SQL(nil) = %q, %v", sql, args)
+	}
+}
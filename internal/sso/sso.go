@@ -0,0 +1,244 @@
+// Package sso signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE, and maps the provider's accounts to
+// Dokeep users: by a stored link, by a verified email address if configured,
+// or by creating an account at the first sign-in.
+package sso
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"dokeep/internal/config"
+	"dokeep/internal/model"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/lib/pq"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrNoUsername is returned when the ID token has no usable username.
+	ErrNoUsername = errors.New("the identity provider did not return a username")
+	// ErrNoAccount is returned when no account is linked to the identity and
+	// none may be created.
+	ErrNoAccount = errors.New("no Dokeep account is linked to this sign-in")
+	// ErrAlreadyLinked is returned when the identity belongs to another user,
+	// or the user already has an identity at the provider.
+	ErrAlreadyLinked = errors.New("the account is already linked")
+)
+
+// UsernameTakenError is returned when an account would be created for a
+// username that a local account already uses.
+type UsernameTakenError struct {
+	Username string
+}
+
+func (e *UsernameTakenError) Error() string {
+	return fmt.Sprintf("an account named %q already exists; sign in with its password and link it from the settings page", e.Username)
+}
+
+// Identity is the account a user signed in with at the provider.
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Email    string
+	// EmailVerified is the email_verified claim: the provider checked that
+	// the user controls Email.
+	EmailVerified bool
+}
+
+// Provider talks to the identity provider. Its metadata is discovered on
+// first use, so that Dokeep starts while the provider is unreachable.
+type Provider struct {
+	Config config.OIDCConfig
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// New returns a Provider for cfg.
+func New(cfg config.OIDCConfig) *Provider {
+	return &Provider{Config: cfg}
+}
+
+func (p *Provider) discover() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+	// The key set keeps this context for fetching keys later, so it must
+	// not be a request's.
+	provider, err := oidc.NewProvider(context.Background(), p.Config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not discover OpenID Connect provider: %w", err)
+	}
+	p.oauth = &oauth2.Config{
+		ClientID:     p.Config.ClientID,
+		ClientSecret: p.Config.ClientSecret,
+		RedirectURL:  p.Config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.Config.Scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.Config.ClientID})
+	return p.oauth, p.verifier, nil
+}
+
+// AuthCodeURL returns the provider's sign-in page. state and nonce are
+// random values, and verifier one from oauth2.GenerateVerifier, that the
+// caller keeps for Exchange.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	oauth, _, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	return oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange redeems the code the provider redirected back with and returns
+// the identity from the verified ID token.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (Identity, error) {
+	var id Identity
+	oauth, verifierIDToken, err := p.discover()
+	if err != nil {
+		return id, err
+	}
+	token, err := oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return id, fmt.Errorf("could not redeem authorization code: %w", err)
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return id, errors.New("the token response has no ID token")
+	}
+	idToken, err := verifierIDToken.Verify(ctx, raw)
+	if err != nil {
+		return id, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return id, errors.New("the ID token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return id, err
+	}
+	id = Identity{Issuer: idToken.Issuer, Subject: idToken.Subject}
+	id.Username, _ = claims[p.Config.UsernameClaim].(string)
+	id.Email, _ = claims["email"].(string)
+	// Some providers send the claim as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+	if id.Username == "" {
+		return id, ErrNoUsername
+	}
+	return id, nil
+}
+
+// SignIn returns the user the identity signs in as. An identity that is not
+// linked yet is linked to the local account named after its email address
+// if cfg.LinkExisting is set and the provider verified the address, or to a
+// new account if cfg.AutoCreate is set. The username claim alone never
+// links an existing account, since users can often choose it themselves.
+func SignIn(db *sql.DB, cfg config.OIDCConfig, id Identity) (userID int, username string, err error) {
+	err = db.QueryRow(`
+		UPDATE user_identities i SET email = $3, last_used_at = CURRENT_TIMESTAMP
+		FROM users u WHERE u.id = i.user_id AND i.issuer = $1 AND i.subject = $2
+		RETURNING u.id, u.username`, id.Issuer, id.Subject, id.Email).Scan(&userID, &username)
+	if err != sql.ErrNoRows {
+		return userID, username, err
+	}
+
+	if cfg.LinkExisting && id.EmailVerified && id.Email != "" {
+		err = db.QueryRow("SELECT id, username FROM users WHERE username = $1", id.Email).Scan(&userID, &username)
+		if err == nil {
+			if err := Link(db, userID, id); err != nil {
+				return 0, "", err
+			}
+			return userID, username, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, "", err
+		}
+	}
+
+	err = db.QueryRow("SELECT id FROM users WHERE username = $1", id.Username).Scan(&userID)
+	switch {
+	case err == nil:
+		return 0, "", &UsernameTakenError{id.Username}
+	case err != sql.ErrNoRows:
+		return 0, "", err
+	case !cfg.AutoCreate:
+		return 0, "", ErrNoAccount
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+	// An empty hash never matches a password
+	err = tx.QueryRow("INSERT INTO users (username, password_hash) VALUES ($1, '') RETURNING id", id.Username).Scan(&userID)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return 0, "", &UsernameTakenError{id.Username}
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if err := insertIdentity(tx, userID, id); err != nil {
+		return 0, "", err
+	}
+	return userID, id.Username, tx.Commit()
+}
+
+// Link links the identity to a user.
+func Link(db *sql.DB, userID int, id Identity) error {
+	return insertIdentity(db, userID, id)
+}
+
+func insertIdentity(db interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, userID int, id Identity) error {
+	_, err := db.Exec(`
+		INSERT INTO user_identities (user_id, issuer, subject, email, last_used_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)`, userID, id.Issuer, id.Subject, id.Email)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrAlreadyLinked
+	}
+	return err
+}
+
+// Unlink removes the user's link to the provider.
+func Unlink(db *sql.DB, userID int, issuer string) error {
+	_, err := db.Exec("DELETE FROM user_identities WHERE user_id = $1 AND issuer = $2", userID, issuer)
+	return err
+}
+
+// Linked returns the user's identity at the provider, or nil.
+func Linked(db *sql.DB, userID int, issuer string) (*model.LinkedIdentity, error) {
+	var id model.LinkedIdentity
+	var lastUsed sql.NullTime
+	err := db.QueryRow("SELECT subject, email, created_at, last_used_at FROM user_identities WHERE user_id = $1 AND issuer = $2",
+		userID, issuer).Scan(&id.Subject, &id.Email, &id.CreatedAt, &lastUsed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lastUsed.Valid {
+		id.LastUsedAt = &lastUsed.Time
+	}
+	return &id, nil
+}
@@ -0,0 +1,409 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"dokeep/internal/config"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/lib/pq"
+)
+
+// issuer is an OpenID Connect provider serving discovery, its key set and
+// a token endpoint that checks the client secret and PKCE verifier.
+type issuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu          sync.Mutex
+	discoveries int
+	codes       map[string]grant
+}
+
+// grant is an authorization code and what the client sent with it.
+type grant struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newIssuer(t *testing.T) *issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &issuer{key: key, codes: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /keys", idp.keys)
+	mux.HandleFunc("POST /token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	idp.discoveries++
+	idp.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/auth",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *issuer) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &idp.key.PublicKey, KeyID: "k", Algorithm: "RS256", Use: "sig"},
+	}})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (idp *issuer) token(w http.ResponseWriter, r *http.Request) {
+	if id, secret, _ := r.BasicAuth(); id != "dokeep" || secret != "secret" {
+		tokenError(w, "invalid_client")
+		return
+	}
+	idp.mu.Lock()
+	g, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	idp.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   idp.URL,
+		"aud":   "dokeep",
+		"sub":   "u-1",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": g.nonce,
+	}
+	for k, v := range g.claims {
+		claims[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idp.sign(claims, idp.key),
+	})
+}
+
+func (idp *issuer) sign(claims map[string]interface{}, key *rsa.PrivateKey) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "k"}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		panic(err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		panic(err)
+	}
+	raw, _ := jws.CompactSerialize()
+	return raw
+}
+
+// authorize plays the user signing in at the provider's sign-in page, and
+// returns the code and state it redirects back with. claims are added to
+// the ID token.
+func (idp *issuer) authorize(t *testing.T, authURL string, claims map[string]interface{}) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/auth" || q.Get("client_id") != "dokeep" || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("redirect_uri") != "http://localhost:8081/login/oidc/callback" {
+		t.Fatalf("AuthCodeURL = %s", authURL)
+	}
+	code = rand.Text()
+	idp.mu.Lock()
+	idp.codes[code] = grant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	idp.mu.Unlock()
+	return code, q.Get("state")
+}
+
+func newTestProvider(idp *issuer) *Provider {
+	return New(config.OIDCConfig{
+		Issuer:        idp.URL,
+		ClientID:      "dokeep",
+		ClientSecret:  "secret",
+		RedirectURL:   "http://localhost:8081/login/oidc/callback",
+		Scopes:        []string{"openid", "profile", "email"},
+		UsernameClaim: "preferred_username",
+	})
+}
+
+func TestExchange(t *testing.T) {
+	idp := newIssuer(t)
+	p := newTestProvider(idp)
+	ctx := context.Background()
+
+	for _, verified := range []interface{}{true, "true"} {
+		authURL, err := p.AuthCodeURL("state", "nonce", "verifier-0123456789-0123456789-0123456789")
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, state := idp.authorize(t, authURL, map[string]interface{}{
+			"preferred_username": "alice",
+			"email":              "alice@example.com",
+			"email_verified":     verified,
+		})
+		if state != "state" {
+			t.Errorf("state = %q", state)
+		}
+		id, err := p.Exchange(ctx, code, "nonce", "verifier-0123456789-0123456789-0123456789")
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		want := Identity{Issuer: idp.URL, Subject: "u-1", Username: "alice", Email: "alice@example.com", EmailVerified: true}
+		if id != want {
+			t.Errorf("Exchange = %+v, want %+v", id, want)
+		}
+	}
+	if idp.discoveries != 1 {
+		t.Errorf("provider discovered %d times, want once", idp.discoveries)
+	}
+}
+
+func TestExchangeRejected(t *testing.T) {
+	idp := newIssuer(t)
+	p := newTestProvider(idp)
+	ctx := context.Background()
+	const verifier = "verifier-0123456789-0123456789-0123456789"
+	start := func(claims map[string]interface{}) string {
+		authURL, err := p.AuthCodeURL("state", "nonce", verifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _ := idp.authorize(t, authURL, claims)
+		return code
+	}
+	alice := map[string]interface{}{"preferred_username": "alice"}
+
+	if _, err := p.Exchange(ctx, start(alice), "nonce", "another-verifier-0123456789-0123456789"); err == nil {
+		t.Error("Exchange succeeded with the wrong PKCE verifier")
+	}
+	if _, err := p.Exchange(ctx, start(alice), "another nonce", verifier); err == nil {
+		t.Error("Exchange succeeded with the wrong nonce")
+	}
+	if _, err := p.Exchange(ctx, start(map[string]interface{}{"preferred_username": "alice", "aud": "other"}), "nonce", verifier); err == nil {
+		t.Error("Exchange accepted an ID token for another client")
+	}
+	if _, err := p.Exchange(ctx, start(map[string]interface{}{}), "nonce", verifier); !errors.Is(err, ErrNoUsername) {
+		t.Errorf("Exchange without username error = %v, want ErrNoUsername", err)
+	}
+	code := start(alice)
+	if _, err := p.Exchange(ctx, code, "nonce", verifier); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(ctx, code, "nonce", verifier); err == nil {
+		t.Error("Exchange redeemed a code twice")
+	}
+
+	// An ID token signed by another key
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := idp.sign(map[string]interface{}{
+		"iss": idp.URL, "aud": "dokeep", "sub": "u-1", "nonce": "nonce",
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix(),
+	}, other)
+	_, verifierIDToken, err := p.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifierIDToken.Verify(ctx, forged); err == nil {
+		t.Error("an ID token signed by another key was accepted")
+	}
+}
+
+func TestDiscoveryUnavailable(t *testing.T) {
+	idp := newIssuer(t)
+	idp.Close()
+	if _, err := newTestProvider(idp).AuthCodeURL("state", "nonce", "verifier"); err == nil {
+		t.Error("AuthCodeURL succeeded without a provider")
+	}
+}
+
+const (
+	findIdentity = `UPDATE user_identities i SET email = \$3`
+	findUsername = `SELECT id FROM users WHERE username = \$1`
+	findEmail    = `SELECT id, username FROM users WHERE username = \$1`
+	addIdentity  = `INSERT INTO user_identities`
+)
+
+func TestSignIn(t *testing.T) {
+	id := Identity{Issuer: "https://sso.example.com", Subject: "u-1", Username: "alice", Email: "alice@example.com", EmailVerified: true}
+	unverified := id
+	unverified.EmailVerified = false
+	linkExisting := config.OIDCConfig{LinkExisting: true}
+	autoCreate := config.OIDCConfig{AutoCreate: true}
+	unique := &pq.Error{Code: "23505"}
+
+	tests := []struct {
+		name   string
+		cfg    config.OIDCConfig
+		id     Identity
+		expect func(sqlmock.Sqlmock)
+		userID int
+		user   string
+		err    error
+	}{
+		{
+			name: "linked",
+			cfg:  autoCreate,
+			id:   id,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(findIdentity).WithArgs(id.Issuer, id.Subject, id.Email).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(3, "bob"))
+			},
+			userID: 3, user: "bob",
+		},
+		{
+			name: "verified email links the account it names",
+			cfg:  linkExisting,
+			id:   id,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(findIdentity).WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(findEmail).WithArgs("alice@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(4, "alice@example.com"))
+				m.ExpectExec(addIdentity).WithArgs(4, id.Issuer, id.Subject, id.Email).WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			userID: 4, user: "alice@example.com",
+		},
+		{
+			name: "verified email already linked to another identity",
+			cfg:  linkExisting,
+			id:   id,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(findIdentity).WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(findEmail).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(4, "alice@example.com"))
+				m.ExpectExec(addIdentity).WillReturnError(unique)
+			},
+			err: ErrAlreadyLinked,
+		},
+		{
+			name: "unverified email does not link",
+			cfg:  linkExisting,
+			id:   Identity{Issuer: id.Issuer, Subject: id.Subject, Username: "alice@example.com", Email: "alice@example.com"},
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(findIdentity).WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(findUsername).WithArgs("alice@example.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+			},
+			err: &UsernameTakenError{"alice@example.com"},
+		},
+		{
+			name: "username claim does not link",
+			cfg:  config.OIDCConfig{LinkExisting: true, AutoCreate: true},
+			id:   unverified,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(findIdentity).WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(findUsername).WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+			},
+			err: &UsernameTakenError{"alice"},
+		},
+		{
+			name: "no account for the verified email",
+			cfg:  config.OIDCConfig{LinkExisting: true},
+			id:   id,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(findIdentity).WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(findEmail).WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(findUsername).WithArgs("alice").WillReturnError(sql.ErrNoRows)
+			},
+			err: ErrNoAccount,
+		},
+		{
+			name: "created",
+			cfg:  autoCreate,
+			id:   id,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(findIdentity).WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(findUsername).WithArgs("alice").WillReturnError(sql.ErrNoRows)
+				m.ExpectBegin()
+				m.ExpectQuery(`INSERT INTO users \(username, password_hash\) VALUES \(\$1, ''\) RETURNING id`).WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(6))
+				m.ExpectExec(addIdentity).WithArgs(6, id.Issuer, id.Subject, id.Email).WillReturnResult(sqlmock.NewResult(1, 1))
+				m.ExpectCommit()
+			},
+			userID: 6, user: "alice",
+		},
+		{
+			name: "created concurrently",
+			cfg:  autoCreate,
+			id:   id,
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(findIdentity).WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(findUsername).WillReturnError(sql.ErrNoRows)
+				m.ExpectBegin()
+				m.ExpectQuery(`INSERT INTO users`).WillReturnError(unique)
+				m.ExpectRollback()
+			},
+			err: &UsernameTakenError{"alice"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			tt.expect(mock)
+
+			userID, username, err := SignIn(db, tt.cfg, tt.id)
+			var taken *UsernameTakenError
+			switch want := tt.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("SignIn error: %v", err)
+				}
+			case *UsernameTakenError:
+				if !errors.As(err, &taken) || *taken != *want {
+					t.Fatalf("SignIn error = %v, want %v", err, want)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Fatalf("SignIn error = %v, want %v", err, want)
+				}
+			}
+			if userID != tt.userID || username != tt.user {
+				t.Errorf("SignIn = %d %q, want %d %q", userID, username, tt.userID, tt.user)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dokeep/internal/config"
+)
+
+// fakeS3 implements the part of the S3 API the backend uses, with path-style
+// bucket addressing. Requests are not authenticated.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]fakeObject
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	f := &fakeS3{buckets: make(map[string]map[string]fakeObject)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	objects, ok := f.buckets[bucket]
+	if key == "" {
+		switch {
+		case r.Method == http.MethodPut:
+			f.buckets[bucket] = make(map[string]fakeObject)
+		case !ok:
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchBucket")
+		}
+		return
+	}
+	if !ok {
+		s3ErrorResponse(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readPayload(r)
+		if err != nil {
+			s3ErrorResponse(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		objects[key] = fakeObject{data: data, contentType: r.Header.Get("Content-Type"), modTime: time.Now().UTC().Truncate(time.Second)}
+		w.Header().Set("ETag", etag(data))
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objects[key]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(obj.data))
+		w.Header().Set("Content-Type", obj.contentType)
+		http.ServeContent(w, r, "", obj.modTime, bytes.NewReader(obj.data))
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func s3ErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// readPayload reads a PUT body, decoding the aws-chunked encoding that
+// clients use to sign streamed uploads over plain HTTP.
+func readPayload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, n+2) // data and CRLF
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:n]...)
+	}
+}
+
+func newTestS3(t *testing.T) (*S3, *fakeS3) {
+	fake, endpoint := newFakeS3(t)
+	s, err := NewS3(context.Background(), config.S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "dokeep",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+func TestS3(t *testing.T) {
+	s, fake := newTestS3(t)
+	if _, ok := fake.buckets["dokeep"]; !ok {
+		t.Fatal("NewS3 did not create the bucket")
+	}
+	testBackend(t, s)
+
+	put(t, s, "2.pdf", "%PDF-1.4")
+	info, err := s.Stat(context.Background(), "2.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "text/plain" || info.ETag != strings.Trim(etag([]byte("%PDF-1.4")), `"`) {
+		t.Errorf("Stat = %+v", info)
+	}
+}
+
+func TestS3ExistingBucket(t *testing.T) {
+	s, fake := newTestS3(t)
+	put(t, s, "1.txt", "kept")
+	again, err := NewS3(context.Background(), config.S3Config{Endpoint: s.client.EndpointURL().Host, Bucket: "dokeep", Region: "us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, again, "1.txt"); got != "kept" || len(fake.buckets) != 1 {
+		t.Errorf("NewS3 on an existing bucket: read %q, %d buckets", got, len(fake.buckets))
+	}
+}
+
+func TestS3SignedURL(t *testing.T) {
+	s, _ := newTestS3(t)
+	put(t, s, "thumbnails/3.jpg", "jpeg")
+
+	raw, err := s.SignedURL(context.Background(), "thumbnails/3.jpg", 5*time.Minute, "image/jpeg", `attachment; filename="a b.jpg"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/dokeep/thumbnails/3.jpg" || q.Get("X-Amz-Expires") != "300" || q.Get("X-Amz-Signature") == "" {
+		t.Errorf("SignedURL = %s", raw)
+	}
+	if q.Get("response-content-type") != "image/jpeg" || q.Get("response-content-disposition") != `attachment; filename="a b.jpg"` {
+		t.Errorf("SignedURL overrides = %v", q)
+	}
+
+	resp, err := http.Get(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "jpeg" {
+		t.Errorf("GET signed URL = %d %q", resp.StatusCode, body)
+	}
+
+	if _, err := s.SignedURL(context.Background(), "../x", time.Minute, "", ""); err == nil {
+		t.Error("SignedURL(../x) succeeded")
+	}
+}
+
+func TestCopyBetweenBackends(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocal(t.TempDir())
+	s3, _ := newTestS3(t)
+	put(t, local, "1.pdf", "first")
+	put(t, local, "2.pdf", "second")
+	put(t, s3, "2.pdf", "SECOND")
+
+	for _, key := range []string{"1.pdf", "2.pdf"} {
+		copied, err := Copy(ctx, local, s3, key)
+		if err != nil || !copied {
+			t.Fatalf("Copy(%q) = %v, %v", key, copied, err)
+		}
+		if got, want := read(t, s3, key), read(t, local, key); got != want {
+			t.Errorf("after Copy(%q) s3 holds %q, want %q", key, got, want)
+		}
+	}
+	if copied, err := Copy(ctx, local, s3, "1.pdf"); err != nil || copied {
+		t.Errorf("second Copy = %v, %v, want it skipped", copied, err)
+	}
+	if copied, err := Copy(ctx, s3, local, "2.pdf"); err != nil || copied {
+		t.Errorf("Copy back = %v, %v, want it skipped", copied, err)
+	}
+}
@@ -0,0 +1,158 @@
+// Package storage stores uploaded files and thumbnails. Files are addressed by
+// a key such as "42.pdf" or "thumbnails/42_1700000000.jpg" that is the same
+// in every backend, so the database only records keys and files can be moved
+// between backends without touching it.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"dokeep/internal/config"
+)
+
+// Backend names accepted by New.
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+var (
+	// ErrNotExist is returned when a key has no object.
+	ErrNotExist = errors.New("storage: object does not exist")
+	// ErrNotSupported is returned by SignedURL for backends that cannot
+	// hand out direct links; callers stream the object themselves instead.
+	ErrNotSupported = errors.New("storage: operation not supported by backend")
+)
+
+// Info describes a stored object.
+type Info struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	// ETag identifies the object's content; it changes whenever the object
+	// is rewritten.
+	ETag string
+}
+
+// Object is an open stored object. It supports seeking so that it can be
+// served with http.ServeContent.
+type Object interface {
+	io.ReadSeekCloser
+}
+
+// Storage is a blob store.
+type Storage interface {
+	// Put stores the contents of r under key, replacing any existing object.
+	// size is the length of r, or -1 if it is not known.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key.
+	Get(ctx context.Context, key string) (Object, Info, error)
+	// Delete removes the object stored under key. Deleting a missing object
+	// is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stat describes the object stored under key.
+	Stat(ctx context.Context, key string) (Info, error)
+	// SignedURL returns a time-limited URL from which the object can be
+	// downloaded directly, or ErrNotSupported. The download is served with
+	// the given Content-Type and Content-Disposition.
+	SignedURL(ctx context.Context, key string, expiry time.Duration, contentType, disposition string) (string, error)
+}
+
+// New returns the backend selected by cfg.Storage.Backend.
+func New(ctx context.Context, cfg *config.Config) (Storage, error) {
+	return Open(ctx, cfg, cfg.Storage.Backend)
+}
+
+// Open returns the named backend configured from cfg. It is used by the
+// storage migrate command to open a backend other than the active one.
+func Open(ctx context.Context, cfg *config.Config, backend string) (Storage, error) {
+	switch backend {
+	case BackendLocal:
+		return NewLocal(cfg.Uploads.Dir), nil
+	case BackendS3:
+		return NewS3(ctx, cfg.Storage.S3)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// CleanKey validates a key and returns it in canonical form. Keys are
+// slash-separated relative paths that must not leave the storage root.
+func CleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	clean := path.Clean(key)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return clean, nil
+}
+
+// Copy copies the object stored under key from src to dst. It reports false
+// without copying if dst already holds the same content.
+func Copy(ctx context.Context, src, dst Storage, key string) (bool, error) {
+	obj, info, err := src.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer obj.Close()
+
+	existing, err := dst.Stat(ctx, key)
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		return false, err
+	}
+	// Sizes are compared first so that most differing objects need not be
+	// read twice. ETags cannot be compared, as backends compute them
+	// differently.
+	if err == nil && existing.Size == info.Size {
+		same, err := sameContent(ctx, obj, dst, key)
+		if err != nil || same {
+			return false, err
+		}
+		if _, err := obj.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+	}
+
+	if err := dst.Put(ctx, key, obj, info.Size, info.ContentType); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sameContent reports whether dst holds the same bytes under key as obj,
+// which is read to the end.
+func sameContent(ctx context.Context, obj Object, dst Storage, key string) (bool, error) {
+	other, _, err := dst.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer other.Close()
+
+	want, err := digest(obj)
+	if err != nil {
+		return false, err
+	}
+	have, err := digest(other)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(want, have), nil
+}
+
+func digest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
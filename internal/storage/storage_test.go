@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCleanKey(t *testing.T) {
+	valid := map[string]string{
+		"42.pdf":                       "42.pdf",
+		"thumbnails/42_1700000000.jpg": "thumbnails/42_1700000000.jpg",
+		"a//b/./c.txt":                 "a/b/c.txt",
+		"a/../b.txt":                   "b.txt",
+	}
+	for key, want := range valid {
+		got, err := CleanKey(key)
+		if err != nil || got != want {
+			t.Errorf("CleanKey(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	for _, key := range []string{"", "/etc/passwd", "..", "../x", "a/../../x", ".", `a\b`} {
+		if got, err := CleanKey(key); err == nil {
+			t.Errorf("CleanKey(%q) = %q, want error", key, got)
+		}
+	}
+}
+
+func put(t *testing.T, s Storage, key, content string) {
+	t.Helper()
+	if err := s.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+}
+
+func read(t *testing.T, s Storage, key string) string {
+	t.Helper()
+	obj, _, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer obj.Close()
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(b)
+}
+
+// testBackend checks the behaviour every backend must share.
+func testBackend(t *testing.T, s Storage) {
+	ctx := context.Background()
+	put(t, s, "thumbnails/1.txt", "hello")
+	put(t, s, "thumbnails/1.txt", "hello, world")
+	if got := read(t, s, "thumbnails/1.txt"); got != "hello, world" {
+		t.Errorf("Get = %q after overwrite", got)
+	}
+
+	info, err := s.Stat(ctx, "thumbnails/1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 12 || info.ETag == "" || info.ModTime.IsZero() {
+		t.Errorf("Stat = %+v", info)
+	}
+
+	obj, _, err := s.Get(ctx, "thumbnails/1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(obj)
+	obj.Close()
+	if string(rest) != "world" {
+		t.Errorf("read after Seek = %q", rest)
+	}
+
+	if _, _, err := s.Get(ctx, "missing.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Get(missing) error = %v, want ErrNotExist", err)
+	}
+	if _, err := s.Stat(ctx, "missing.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat(missing) error = %v, want ErrNotExist", err)
+	}
+	if err := s.Put(ctx, "../escape.txt", strings.NewReader("x"), 1, ""); err == nil {
+		t.Error("Put(../escape.txt) succeeded")
+	}
+
+	if err := s.Delete(ctx, "thumbnails/1.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "thumbnails/1.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Stat after Delete error = %v, want ErrNotExist", err)
+	}
+	if err := s.Delete(ctx, "thumbnails/1.txt"); err != nil {
+		t.Errorf("Delete(missing) error = %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	testBackend(t, NewLocal(t.TempDir()))
+
+	_, err := NewLocal(t.TempDir()).SignedURL(context.Background(), "1.pdf", 0, "", "")
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("SignedURL error = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	src, dst := NewLocal(t.TempDir()), NewLocal(t.TempDir())
+	put(t, src, "new.txt", "new")
+	put(t, src, "same.txt", "same")
+	put(t, dst, "same.txt", "same")
+	put(t, src, "changed.txt", "abcd")
+	put(t, dst, "changed.txt", "abce")
+	put(t, src, "resized.txt", "longer")
+	put(t, dst, "resized.txt", "short")
+
+	for key, want := range map[string]bool{"new.txt": true, "same.txt": false, "changed.txt": true, "resized.txt": true} {
+		copied, err := Copy(ctx, src, dst, key)
+		if err != nil {
+			t.Fatalf("Copy(%q): %v", key, err)
+		}
+		if copied != want {
+			t.Errorf("Copy(%q) = %v, want %v", key, copied, want)
+		}
+		if got, want := read(t, dst, key), read(t, src, key); got != want {
+			t.Errorf("after Copy(%q) dst holds %q, want %q", key, got, want)
+		}
+	}
+
+	if _, err := Copy(ctx, src, dst, "missing.txt"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Copy(missing) error = %v, want ErrNotExist", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package tagpath resolves hierarchical tag names to tag rows.
+//
+// Tags form a tree per user. A tag's name is its full path, with segments
+// separated by "/", for example "finance/tax/2023"; parent_id points at the
+// tag for the path without its last segment. Every ancestor of a tag exists
+// as a tag of its own.
+package tagpath
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Separator separates the segments of a tag path.
+const Separator = "/"
+
+// queryer is satisfied by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Normalize lowercases a tag path, trims every segment and drops empty ones,
+// so " Finance / Tax//2023 " becomes "finance/tax/2023".
+func Normalize(name string) string {
+	var segments []string
+	for _, s := range strings.Split(strings.ToLower(name), Separator) {
+		if s = strings.TrimSpace(s); s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return strings.Join(segments, Separator)
+}
+
+// Parent returns the path of a tag's parent, or "" for a root tag.
+func Parent(path string) string {
+	if i := strings.LastIndex(path, Separator); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// IsWithin reports whether path is ancestor or one of its descendants.
+func IsWithin(path, ancestor string) bool {
+	return path == ancestor || strings.HasPrefix(path, ancestor+Separator)
+}
+
+// Ensure returns the ID of the user's tag with the given normalized path,
+// creating it and any missing ancestors.
+func Ensure(q queryer, userID int, path string) (int, error) {
+	segments := strings.Split(path, Separator)
+	var id int
+	var parentID interface{}
+	for i := range segments {
+		prefix := strings.Join(segments[:i+1], Separator)
+		err := q.QueryRow(`
+			INSERT INTO tags (user_id, name, parent_id) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, name) DO NOTHING RETURNING id`, userID, prefix, parentID).Scan(&id)
+		if err == sql.ErrNoRows {
+			// The tag exists, possibly committed by another transaction
+			// while the insert waited. Only a new statement sees it.
+			err = q.QueryRow("SELECT id FROM tags WHERE user_id = $1 AND name = $2", userID, prefix).Scan(&id)
+		}
+		if err != nil {
+			return 0, err
+		}
+		parentID = id
+	}
+	return id, nil
+}
+
+// Resolve returns the ID of the user's tag for name, matching it against the
+// existing hierarchy before creating anything. A name such as "electric" or
+// "utilities/electric" attaches to an existing "home/utilities/electric";
+// "utilities/water" is created below an existing "home/utilities". When
+// several tags match, the one closest to the root wins. Only when no part of
+// the name matches is a new root tag created. A leading "/" skips matching
+// and always refers to a root tag.
+func Resolve(q queryer, userID int, name string) (int, error) {
+	path := Normalize(name)
+	if strings.HasPrefix(strings.TrimSpace(name), Separator) {
+		return Ensure(q, userID, path)
+	}
+
+	segments := strings.Split(path, Separator)
+	for i := len(segments); i > 0; i-- {
+		suffix := strings.Join(segments[:i], Separator)
+		var anchor string
+		err := q.QueryRow(`
+			SELECT name FROM tags
+			WHERE user_id = $1 AND (name = $2 OR right(name, length($2) + 1) = '/' || $2)
+			ORDER BY name = $2 DESC, length(name) - length(replace(name, '/', '')), id
+			LIMIT 1`, userID, suffix).Scan(&anchor)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return Ensure(q, userID, strings.Join(append([]string{anchor}, segments[i:]...), Separator))
+	}
+	return Ensure(q, userID, path)
+}
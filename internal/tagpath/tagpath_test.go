@@ -0,0 +1,154 @@
+package tagpath
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"dokeep/internal/database"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"tax", "tax"},
+		{" Finance / Tax//2023 ", "finance/tax/2023"},
+		{"/home/utilities/", "home/utilities"},
+		{"Home Office", "home office"},
+		{" / ", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.name); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParent(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"finance/tax/2023", "finance/tax"},
+		{"finance/tax", "finance"},
+		{"finance", ""},
+	}
+	for _, tt := range tests {
+		if got := Parent(tt.path); got != tt.want {
+			t.Errorf("Parent(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		path, ancestor string
+		want           bool
+	}{
+		{"finance", "finance", true},
+		{"finance/tax", "finance", true},
+		{"finance/tax/2023", "finance", true},
+		{"finances", "finance", false},
+		{"finance", "finance/tax", false},
+		{"home/finance", "finance", false},
+	}
+	for _, tt := range tests {
+		if got := IsWithin(tt.path, tt.ancestor); got != tt.want {
+			t.Errorf("IsWithin(%q, %q) = %v, want %v", tt.path, tt.ancestor, got, tt.want)
+		}
+	}
+}
+
+// openTestDB returns a migrated schema of its own in the scratch database
+// in DOKEEP_TEST_DATABASE_URL, and skips the test when it is not set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("DOKEEP_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("DOKEEP_TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// search_path is per connection, so keep to one
+	db.SetMaxOpenConns(1)
+	schema := fmt.Sprintf("dokeep_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		db.Close()
+	})
+	if _, err := db.Exec("SET search_path TO " + schema + ", public"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestResolve(t *testing.T) {
+	db := openTestDB(t)
+	var userID int
+	if err := db.QueryRow("INSERT INTO users (username, password_hash) VALUES ('alice', '') RETURNING id").Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"home/utilities/electric", "archive/home/utilities/electric", "work/invoices"} {
+		if _, err := Ensure(db, userID, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		// An existing path is used as it is
+		{"Work / Invoices", "work/invoices"},
+		// A name anchors to the tag closest to the root that ends with it
+		{"electric", "home/utilities/electric"},
+		{"utilities/electric", "home/utilities/electric"},
+		{"archive/home/utilities/electric", "archive/home/utilities/electric"},
+		// Unmatched segments are created below the deepest match
+		{"utilities/water", "home/utilities/water"},
+		{"invoices/2023", "work/invoices/2023"},
+		// Nothing matches
+		{"receipts", "receipts"},
+		// A leading "/" always means a root tag
+		{"/electric", "electric"},
+		{"/invoices/2023", "invoices/2023"},
+	}
+	for _, tt := range tests {
+		id, err := Resolve(db, userID, tt.name)
+		if err != nil {
+			t.Fatalf("Resolve(%q): %v", tt.name, err)
+		}
+		var got string
+		if err := db.QueryRow("SELECT name FROM tags WHERE id = $1", id).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Resolve(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Every created tag hangs below its parent
+	var orphans int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM tags c LEFT JOIN tags p ON p.id = c.parent_id
+		WHERE c.user_id = $1 AND c.name LIKE '%/%' AND p.name IS DISTINCT FROM regexp_replace(c.name, '/[^/]*$', '')`, userID).Scan(&orphans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 0 {
+		t.Errorf("%d tags do not hang below their parent", orphans)
+	}
+}
@@ -0,0 +1,625 @@
+// Package worker runs document processing jobs from the jobs table. Each
+// uploaded document goes through two steps: an OCR job that sends the file
+// to py-service, followed by an analyze job that sends the extracted text to
+// llm-service. Results are written to the documents table by the worker.
+package worker
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"dokeep/internal/config"
+	"dokeep/internal/entities"
+	"dokeep/internal/fingerprint"
+	"dokeep/internal/jobs"
+	"dokeep/internal/storage"
+	"dokeep/internal/tagpath"
+)
+
+// recoverLockKey serialises orphan recovery between instances.
+const recoverLockKey = 7201305472
+
+// errDocumentGone is returned when a job's document was deleted.
+var errDocumentGone = errors.New("document no longer exists")
+
+type Worker struct {
+	DB      *sql.DB
+	Queue   *jobs.Queue
+	Config  *config.Config
+	Storage storage.Storage
+	client  *http.Client
+}
+
+// New creates a worker for this process.
+func New(db *sql.DB, cfg *config.Config, store storage.Storage) *Worker {
+	host, _ := os.Hostname()
+	return &Worker{
+		DB: db,
+		Queue: &jobs.Queue{
+			DB:                db,
+			WorkerID:          fmt.Sprintf("%s:%d", host, os.Getpid()),
+			VisibilityTimeout: cfg.Worker.VisibilityTimeout.Std(),
+			BackoffBase:       cfg.Worker.BackoffBase.Std(),
+			BackoffMax:        cfg.Worker.BackoffMax.Std(),
+		},
+		Config:  cfg,
+		Storage: store,
+		client:  &http.Client{},
+	}
+}
+
+// Start recovers orphaned documents and launches the configured number of
+// worker goroutines. It returns immediately.
+func (w *Worker) Start(ctx context.Context) {
+	if w.Config.Worker.Concurrency == 0 {
+		log.Println("Job worker disabled (worker.concurrency is 0)")
+		return
+	}
+	if err := w.RecoverOrphans(); err != nil {
+		log.Printf("Error recovering unqueued documents: %v", err)
+	}
+	go func() {
+		if err := w.BackfillFingerprints(); err != nil {
+			log.Printf("Error fingerprinting documents: %v", err)
+		}
+	}()
+	for i := 0; i < w.Config.Worker.Concurrency; i++ {
+		go w.loop(ctx)
+	}
+	log.Printf("Job worker started with %d goroutines", w.Config.Worker.Concurrency)
+}
+
+// RecoverOrphans queues an OCR job for every document that is waiting for
+// processing but has no active job, such as documents left behind by the
+// previous Python worker or whose upload could not enqueue a job. Documents
+// stuck in "processing" after a crash do not need this: their job's lease
+// expires and the job is picked up again.
+func (w *Worker) RecoverOrphans() error {
+	tx, err := w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", recoverLockKey); err != nil {
+		return err
+	}
+	// Skip very recent uploads, whose job may be about to be inserted.
+	res, err := tx.Exec(`
+		INSERT INTO jobs (document_id, kind, max_attempts)
+		SELECT d.id, $1, $2 FROM documents d
+		WHERE d.status IN ('queued', 'processing')
+		  AND d.created_at < now() - interval '1 minute'
+		  AND NOT EXISTS (SELECT 1 FROM jobs j WHERE j.document_id = d.id AND j.state IN ('pending', 'running'))
+	`, jobs.KindOCR, w.Config.Worker.MaxAttempts)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Queued %d documents that had no processing job", n)
+	}
+	return tx.Commit()
+}
+
+// fingerprintOf returns the content fingerprint to store for a document's
+// text, or nil if it is too short to have one.
+func fingerprintOf(content string) interface{} {
+	fp, ok := fingerprint.Of(content)
+	if !ok {
+		return nil
+	}
+	return int64(fp)
+}
+
+// fingerprintBatchSize is the number of documents fingerprinted per query.
+const fingerprintBatchSize = 100
+
+// BackfillFingerprints fingerprints documents processed before fingerprints
+// were introduced. Documents whose text is too short are looked at again on
+// every start, which is cheap because their text is short.
+func (w *Worker) BackfillFingerprints() error {
+	type doc struct {
+		id      int
+		content string
+	}
+	total, last := 0, 0
+	for {
+		rows, err := w.DB.Query(`
+			SELECT id, content FROM documents
+			WHERE id > $1 AND fingerprint IS NULL AND content <> ''
+			ORDER BY id LIMIT $2`, last, fingerprintBatchSize)
+		if err != nil {
+			return err
+		}
+		var batch []doc
+		for rows.Next() {
+			var d doc
+			if err := rows.Scan(&d.id, &d.content); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, d := range batch {
+			last = d.id
+			fp := fingerprintOf(d.content)
+			if fp == nil {
+				continue
+			}
+			if _, err := w.DB.Exec("UPDATE documents SET fingerprint = $1 WHERE id = $2 AND fingerprint IS NULL", fp, d.id); err != nil {
+				return err
+			}
+			total++
+		}
+	}
+	if total > 0 {
+		log.Printf("Fingerprinted %d documents", total)
+	}
+	return nil
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	for {
+		job, err := w.Queue.Lease(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error leasing job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.Config.Worker.PollInterval.Std()):
+			}
+			continue
+		}
+		w.run(ctx, job)
+	}
+}
+
+// run executes one leased job and records the outcome on the job and the
+// document.
+func (w *Worker) run(ctx context.Context, job *jobs.Job) {
+	log.Printf("Worker picked up %s job %d for document %d (attempt %d/%d)", job.Kind, job.ID, job.DocumentID, job.Attempts, job.MaxAttempts)
+
+	var err error
+	if job.Attempts > job.MaxAttempts {
+		// The lease expired on the final attempt, most likely because the
+		// worker holding it crashed or the step kept timing out.
+		err = jobs.Permanent(fmt.Errorf("gave up after %d attempts that did not finish", job.MaxAttempts))
+	} else {
+		// Stop before the lease runs out so another worker never runs the
+		// same job concurrently.
+		jobCtx, cancel := context.WithTimeout(ctx, w.Queue.VisibilityTimeout-10*time.Second)
+		err = w.process(jobCtx, job)
+		cancel()
+	}
+
+	if err == nil {
+		if err := w.Queue.Complete(job); err != nil && err != jobs.ErrLeaseLost {
+			log.Printf("Error completing job %d: %v", job.ID, err)
+		}
+		return
+	}
+
+	if errors.Is(err, errDocumentGone) {
+		// Deleting the document also deleted the job.
+		log.Printf("Document %d was deleted while %s job %d was running", job.DocumentID, job.Kind, job.ID)
+		return
+	}
+
+	dead, ferr := w.Queue.Fail(job, err)
+	if ferr != nil {
+		if ferr != jobs.ErrLeaseLost {
+			log.Printf("Error recording failure of job %d: %v", job.ID, ferr)
+		}
+		return
+	}
+	if dead {
+		log.Printf("%s job %d for document %d failed permanently: %v", job.Kind, job.ID, job.DocumentID, err)
+		w.setStatus(job.DocumentID, "failed", err.Error())
+		if err := jobs.RecordStatus(w.DB, job.DocumentID, 0, "processed", "failed", err.Error()); err != nil {
+			log.Printf("Error recording status history for document %d: %v", job.DocumentID, err)
+		}
+		return
+	}
+	retry := w.Queue.Backoff(job.Attempts)
+	log.Printf("%s job %d for document %d failed, retrying in %s: %v", job.Kind, job.ID, job.DocumentID, retry, err)
+	w.setStatus(job.DocumentID, "queued", fmt.Sprintf("Attempt %d of %d failed: %v. Retrying in %s.", job.Attempts, job.MaxAttempts, err, retry.Round(time.Second)))
+}
+
+func (w *Worker) process(ctx context.Context, job *jobs.Job) error {
+	switch job.Kind {
+	case jobs.KindOCR:
+		return w.runOCR(ctx, job)
+	case jobs.KindAnalyze:
+		return w.runAnalyze(ctx, job)
+	}
+	return jobs.Permanent(fmt.Errorf("unknown job kind %q", job.Kind))
+}
+
+func (w *Worker) setStatus(documentID int, status, message string) {
+	if _, err := w.DB.Exec("UPDATE documents SET status = $1, status_message = $2 WHERE id = $3", status, message, documentID); err != nil {
+		log.Printf("Error updating status of document %d: %v", documentID, err)
+	}
+}
+
+// OcrResult is the response of py-service's /process endpoint.
+type OcrResult struct {
+	Content string `json:"text"`
+	// Thumbnail is a JPEG image, base64-encoded in the response.
+	Thumbnail     []byte `json:"thumbnail"`
+	ExtractedDate string `json:"extracted_date"`
+	FileHash      string `json:"file_hash"`
+}
+
+// LlmAnalysisResult is the response of llm-service's /analyze endpoint.
+type LlmAnalysisResult struct {
+	Title         string   `json:"title"`
+	ExtractedDate string   `json:"extracted_date"`
+	Tags          []string `json:"tags"`
+	Summary       string   `json:"summary"`
+	// Correspondent and DocumentType are proposed names. They are matched
+	// against the user's existing entries before new ones are created.
+	Correspondent string `json:"correspondent"`
+	DocumentType  string `json:"document_type"`
+}
+
+// runOCR extracts text, a thumbnail and the file hash, then queues analysis.
+func (w *Worker) runOCR(ctx context.Context, job *jobs.Job) error {
+	var payload jobs.OCRPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobs.Permanent(fmt.Errorf("invalid job payload: %w", err))
+	}
+
+	var filePath string
+	var oldThumbnail sql.NullString
+	err := w.DB.QueryRow("SELECT file_path, thumbnail FROM documents WHERE id = $1", job.DocumentID).Scan(&filePath, &oldThumbnail)
+	if err == sql.ErrNoRows {
+		return errDocumentGone
+	}
+	if err != nil {
+		return err
+	}
+	w.setStatus(job.DocumentID, "processing", "")
+
+	result, err := w.callProcessService(ctx, job.DocumentID, filePath)
+	if err != nil {
+		return err
+	}
+	if result.FileHash == "" {
+		return jobs.Permanent(errors.New("could not calculate file hash"))
+	}
+
+	// Thumbnails get a new key each time so that cached copies of an old
+	// thumbnail are never served for a reprocessed document.
+	var thumbnail string
+	if len(result.Thumbnail) > 0 {
+		thumbnail = fmt.Sprintf("thumbnails/%d_%d.jpg", job.DocumentID, time.Now().Unix())
+		if err := w.Storage.Put(ctx, thumbnail, bytes.NewReader(result.Thumbnail), int64(len(result.Thumbnail)), "image/jpeg"); err != nil {
+			return fmt.Errorf("could not store thumbnail: %w", err)
+		}
+	}
+	removeThumbnail := func(key string) {
+		if key == "" {
+			return
+		}
+		if err := w.Storage.Delete(context.Background(), key); err != nil {
+			log.Printf("Error removing thumbnail %s: %v", key, err)
+		}
+	}
+
+	tx, err := w.DB.Begin()
+	if err != nil {
+		removeThumbnail(thumbnail)
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE documents SET content = $1, thumbnail = $2, file_hash = $3, fingerprint = $4 WHERE id = $5",
+		result.Content, thumbnail, result.FileHash, fingerprintOf(result.Content), job.DocumentID)
+	if err != nil {
+		removeThumbnail(thumbnail)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		removeThumbnail(thumbnail)
+		return errDocumentGone
+	}
+
+	if payload.SkipAnalysis {
+		if err := w.complete(tx, job.DocumentID); err != nil {
+			return err
+		}
+	} else {
+		next := jobs.AnalyzePayload{ExtractedDate: result.ExtractedDate, Overwrite: payload.Overwrite}
+		if err := jobs.Enqueue(tx, job.DocumentID, jobs.KindAnalyze, next, w.Config.Worker.MaxAttempts); err != nil {
+			removeThumbnail(thumbnail)
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		removeThumbnail(thumbnail)
+		return err
+	}
+
+	// A reprocessed document gets a new thumbnail.
+	if oldThumbnail.String != thumbnail {
+		removeThumbnail(oldThumbnail.String)
+	}
+	return nil
+}
+
+// complete marks a document as processed.
+func (w *Worker) complete(tx *sql.Tx, documentID int) error {
+	if _, err := tx.Exec("UPDATE documents SET status = 'completed', status_message = '' WHERE id = $1", documentID); err != nil {
+		return err
+	}
+	return jobs.RecordStatus(tx, documentID, 0, "processed", "completed", "")
+}
+
+// callProcessService sends the file to py-service and returns the OCR result.
+func (w *Worker) callProcessService(ctx context.Context, docID int, filePath string) (*OcrResult, error) {
+	file, _, err := w.Storage.Get(ctx, filePath)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, jobs.Permanent(fmt.Errorf("could not open uploaded file: %w", err))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open uploaded file: %w", err)
+	}
+	defer file.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if err := writer.WriteField("doc_id", strconv.Itoa(docID)); err != nil {
+		return nil, fmt.Errorf("could not write doc_id field: %w", err)
+	}
+	part, err := writer.CreateFormFile("file", path.Base(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("could not create form file: %w", err)
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return nil, fmt.Errorf("could not copy file to form: %w", err)
+	}
+	writer.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.Config.Services.ProcessURL+"/process", body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request to process service: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var result OcrResult
+	if err := w.do(req, "process service", &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// runAnalyze asks the LLM service for a title, summary, date, tags,
+// correspondent and document type and completes the document. Unless the job
+// asks to overwrite them, only fields that are still empty are filled in.
+func (w *Worker) runAnalyze(ctx context.Context, job *jobs.Job) error {
+	var payload jobs.AnalyzePayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobs.Permanent(fmt.Errorf("invalid job payload: %w", err))
+	}
+
+	var title string
+	var originalFilename, content, summary sql.NullString
+	var createdDate sql.NullTime
+	var tagCount, userID int
+	var hasCorrespondent, hasDocumentType bool
+	err := w.DB.QueryRow(`
+		SELECT user_id, title, original_filename, content, summary, created_date,
+			(SELECT COUNT(*) FROM document_tags WHERE document_id = d.id),
+			correspondent_id IS NOT NULL, document_type_id IS NOT NULL
+		FROM documents d WHERE id = $1`, job.DocumentID).Scan(&userID, &title, &originalFilename, &content, &summary, &createdDate, &tagCount, &hasCorrespondent, &hasDocumentType)
+	if err == sql.ErrNoRows {
+		return errDocumentGone
+	}
+	if err != nil {
+		return err
+	}
+	w.setStatus(job.DocumentID, "processing", "")
+
+	var analysis LlmAnalysisResult
+	if !w.Config.Services.DisableAI {
+		request := map[string]interface{}{"content": content.String}
+		// Only ask for a title if it is going to be used.
+		if title == "" || payload.Overwrite {
+			request["filename"] = originalFilename.String
+		}
+		// Offer the existing entries so the model can pick one of them.
+		for key, kind := range map[string]entities.Kind{"correspondents": entities.Correspondents, "document_types": entities.DocumentTypes} {
+			names, err := w.entityNames(kind, userID)
+			if err != nil {
+				return err
+			}
+			request[key] = names
+		}
+		data, _ := json.Marshal(request)
+		req, err := http.NewRequestWithContext(ctx, "POST", w.Config.Services.LLMURL+"/analyze", bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("could not create request to LLM service: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := w.do(req, "LLM service", &analysis); err != nil {
+			return err
+		}
+	}
+
+	// Prefer the date found by the LLM, fall back to the one found by OCR.
+	date := parseDate(analysis.ExtractedDate)
+	if date == nil {
+		date = parseDate(payload.ExtractedDate)
+	}
+
+	if analysis.Title != "" && (title == "" || payload.Overwrite) {
+		title = analysis.Title
+	}
+	if analysis.Summary != "" && (payload.Overwrite || summary.String == "") {
+		summary.String = analysis.Summary
+	}
+	if (payload.Overwrite && date != nil) || !createdDate.Valid {
+		createdDate = sql.NullTime{}
+		if date != nil {
+			createdDate = sql.NullTime{Time: *date, Valid: true}
+		}
+	}
+
+	tx, err := w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE documents SET title = $1, summary = $2, created_date = $3 WHERE id = $4",
+		title, summary.String, createdDate, job.DocumentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errDocumentGone
+	}
+	if payload.Overwrite && len(analysis.Tags) > 0 {
+		if _, err := tx.Exec("DELETE FROM document_tags WHERE document_id = $1", job.DocumentID); err != nil {
+			return err
+		}
+		tagCount = 0
+	}
+	if tagCount == 0 {
+		if err := addTags(tx, job.DocumentID, analysis.Tags); err != nil {
+			return err
+		}
+	}
+	if analysis.Correspondent != "" && (payload.Overwrite || !hasCorrespondent) {
+		if err := setEntity(tx, entities.Correspondents, userID, job.DocumentID, analysis.Correspondent); err != nil {
+			return err
+		}
+	}
+	if analysis.DocumentType != "" && (payload.Overwrite || !hasDocumentType) {
+		if err := setEntity(tx, entities.DocumentTypes, userID, job.DocumentID, analysis.DocumentType); err != nil {
+			return err
+		}
+	}
+	if err := w.complete(tx, job.DocumentID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Successfully processed document %d", job.DocumentID)
+	return nil
+}
+
+// do sends req and decodes a JSON response into v. Client errors (4xx) are
+// permanent; network errors and server errors are retried.
+func (w *Worker) do(req *http.Request, service string, v interface{}) error {
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", service, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("%s returned %s: %s", service, resp.Status, strings.TrimSpace(string(respBody)))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return jobs.Permanent(err)
+		}
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", service, err)
+	}
+	return nil
+}
+
+// addTags attaches tags suggested during analysis. Suggestions are matched
+// against the document owner's tag hierarchy before new tags are created.
+func addTags(tx *sql.Tx, documentID int, tags []string) error {
+	var userID int
+	if err := tx.QueryRow("SELECT user_id FROM documents WHERE id = $1", documentID).Scan(&userID); err != nil {
+		return fmt.Errorf("could not look up document owner: %w", err)
+	}
+	for _, tagName := range tags {
+		normalizedTag := tagpath.Normalize(tagName)
+		if normalizedTag == "" {
+			continue
+		}
+		tagID, err := tagpath.Resolve(tx, userID, tagName)
+		if err != nil {
+			return fmt.Errorf("could not create tag %q: %w", normalizedTag, err)
+		}
+		if _, err := tx.Exec("INSERT INTO document_tags (document_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", documentID, tagID); err != nil {
+			return fmt.Errorf("could not add tag %q: %w", normalizedTag, err)
+		}
+	}
+	return nil
+}
+
+// entityNames returns the names of the user's correspondents or document
+// types.
+func (w *Worker) entityNames(kind entities.Kind, userID int) ([]string, error) {
+	rows, err := w.DB.Query("SELECT name FROM "+kind.Table+" WHERE user_id = $1 ORDER BY name", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// setEntity assigns the correspondent or document type proposed during
+// analysis, reusing a matching entry where there is one.
+func setEntity(tx *sql.Tx, kind entities.Kind, userID, documentID int, name string) error {
+	if entities.Normalize(name) == "" {
+		return nil
+	}
+	id, err := entities.Resolve(tx, kind, userID, name)
+	if err != nil {
+		return fmt.Errorf("could not create %s %q: %w", kind.Singular, name, err)
+	}
+	_, err = tx.Exec("UPDATE documents SET "+kind.Column+" = $1 WHERE id = $2", id, documentID)
+	return err
+}
+
+// parseDate accepts the ISO dates and timestamps returned by the services.
+func parseDate(s string) *time.Time {
+	if len(s) < len("2006-01-02") {
+		return nil
+	}
+	t, err := time.Parse("2006-01-02", s[:len("2006-01-02")])
+	if err != nil {
+		return nil
+	}
+	return &t
+}
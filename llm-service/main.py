@@ -34,12 +34,17 @@ class AnalysisRequest(BaseModel):
     content: str
     filename: Optional[str] = None
     initial_tags: List[str] = []
+    # Existing entries the model should prefer over inventing new names
+    correspondents: List[str] = []
+    document_types: List[str] = []
 
 class AnalysisResponse(BaseModel):
     title: Optional[str] = None
     extracted_date: Optional[datetime.datetime] = None
     tags: List[str] = []
     summary: Optional[str] = None
+    correspondent: Optional[str] = None
+    document_type: Optional[str] = None
 
 @app.on_event("startup")
 async def startup_event():
@@ -61,14 +66,20 @@ async def analyze_content(request: AnalysisRequest):
     ]
     
     # JSON keys to expect in the response
-    json_keys = ["extracted_date", "tags", "summary"]
+    json_keys = ["extracted_date", "tags", "summary", "correspondent", "document_type"]
     
     # Instructions list
     instructions = [
         "1. The creation date of the document in YYYY-MM-DD format if a clear date is present.",
         "2. A final, refined list of 3 to 5 relevant tags.",
-        "3. A concise, one or two-sentence summary of the document."
+        "3. A concise, one or two-sentence summary of the document.",
+        "4. The correspondent: the person or organisation that sent or issued the document, such as a bank, utility or employer.",
+        "5. The document type, such as invoice, contract or payslip."
     ]
+    if request.correspondents:
+        instructions.append(f"If one of these known correspondents fits, use its exact name: {json.dumps(request.correspondents)}.")
+    if request.document_types:
+        instructions.append(f"If one of these known document types fits, use its exact name: {json.dumps(request.document_types)}.")
 
     # Conditionally add title generation to the prompt
     if request.filename:
@@ -118,9 +129,15 @@ async def analyze_content(request: AnalysisRequest):
         
         summary = result.get("summary", None)
         title = result.get("title", None)
-
-        logging.info(f"Analysis complete. Found title: {title}, date: {extracted_date}, tags: {tags}, summary: {summary}")
-        return AnalysisResponse(title=title, extracted_date=extracted_date, tags=tags, summary=summary)
+        correspondent = result.get("correspondent") or None
+        document_type = result.get("document_type") or None
+        if not isinstance(correspondent, str):
+            correspondent = None
+        if not isinstance(document_type, str):
+            document_type = None
+
+        logging.info(f"Analysis complete. Found title: {title}, date: {extracted_date}, tags: {tags}, summary: {summary}, correspondent: {correspondent}, document type: {document_type}")
+        return AnalysisResponse(title=title, extracted_date=extracted_date, tags=tags, summary=summary, correspondent=correspondent, document_type=document_type)
         
     except Exception as e:
         logging.error(f"Error during LLM analysis: {e}")
@@ -0,0 +1,42 @@
+// Code generated by templ - DO NOT EDIT.
+
+// templ: version: v0.3.920
+package template
+
+//lint:file-ignore SA4006 This context is only used if a nested component is present.
+
+import "github.com/a-h/templ"
+import templruntime "github.com/a-h/templ/runtime"
+
+// passkeyScript converts between the JSON used by the passkey endpoints, in
+// which binary values are base64url strings, and navigator.credentials.
+func passkeyScript() templ.Component {
+	return templruntime.GeneratedTemplate(func(templ_7745c5c3_Input templruntime.GeneratedComponentInput) (templ_7745c5c3_Err error) {
+		templ_7745c5c3_W, ctx := templ_7745c5c3_Input.Writer, templ_7745c5c3_Input.Context
+		if templ_7745c5c3_CtxErr := ctx.Err(); templ_7745c5c3_CtxErr != nil {
+			return templ_7745c5c3_CtxErr
+		}
+		templ_7745c5c3_Buffer, templ_7745c5c3_IsBuffer := templruntime.GetBuffer(templ_7745c5c3_W)
+		if !templ_7745c5c3_IsBuffer {
+			defer func() {
+				templ_7745c5c3_BufErr := templruntime.ReleaseBuffer(templ_7745c5c3_Buffer)
+				if templ_7745c5c3_Err == nil {
+					templ_7745c5c3_Err = templ_7745c5c3_BufErr
+				}
+			}()
+		}
+		ctx = templ.InitializeContext(ctx)
+		templ_7745c5c3_Var1 := templ.GetChildren(ctx)
+		if templ_7745c5c3_Var1 == nil {
+			templ_7745c5c3_Var1 = templ.NopComponent
+		}
+		ctx = templ.ClearChildren(ctx)
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 1, "<script>\n\t\tfunction passkeyDecode(value) {\n\t\t\tconst base64 = value.replace(/-/g, '+').replace(/_/g, '/');\n\t\t\treturn Uint8Array.from(atob(base64.padEnd(Math.ceil(base64.length / 4) * 4, '=')), c => c.charCodeAt(0));\n\t\t}\n\n\t\tfunction passkeyEncode(buffer) {\n\t\t\treturn btoa(String.fromCharCode(...new Uint8Array(buffer)))\n\t\t\t\t.replace(/\\+/g, '-').replace(/\\//g, '_').replace(/=+$/, '');\n\t\t}\n\n\t\tasync function passkeyFetch(url, body) {\n\t\t\tconst response = await fetch(url, { method: 'POST', body: body });\n\t\t\tif (!response.ok) {\n\t\t\t\tthrow new Error((await response.text()).trim() || response.statusText);\n\t\t\t}\n\t\t\treturn response;\n\t\t}\n\n\t\t// registerPasskey adds a passkey with the name and current password\n\t\t// entered in form.\n\t\tasync function registerPasskey(form) {\n\t\t\tconst data = new FormData(form);\n\t\t\ttry {\n\t\t\t\tconst options = await (await passkeyFetch('/settings/passkeys/register/begin', data)).json();\n\t\t\t\tconst publicKey = options.publicKey;\n\t\t\t\tpublicKey.challenge = passkeyDecode(publicKey.challenge);\n\t\t\t\tpublicKey.user.id = passkeyDecode(publicKey.user.id);\n\t\t\t\t(publicKey.excludeCredentials || []).forEach(c => c.id = passkeyDecode(c.id));\n\n\t\t\t\tconst credential = await navigator.credentials.create({ publicKey });\n\t\t\t\tawait passkeyFetch('/settings/passkeys/register/finish?name=' + encodeURIComponent(data.get('name')), JSON.stringify({\n\t\t\t\t\tid: credential.id,\n\t\t\t\t\trawId: passkeyEncode(credential.rawId),\n\t\t\t\t\ttype: credential.type,\n\t\t\t\t\tresponse: {\n\t\t\t\t\t\tclientDataJSON: passkeyEncode(credential.response.clientDataJSON),\n\t\t\t\t\t\tattestationObject: passkeyEncode(credential.response.attestationObject),\n\t\t\t\t\t\ttransports: credential.response.getTransports ? credential.response.getTransports() : [],\n\t\t\t\t\t},\n\t\t\t\t}));\n\t\t\t\twindow.location.reload();\n\t\t\t} catch (err) {\n\t\t\t\talert('Could not add the passkey: ' + err.message);\n\t\t\t}\n\t\t}\n\n\t\t// signInWithPasskey asks for a passkey, either as the second factor\n\t\t// after a password or to sign in without one.\n\t\tasync function signInWithPasskey() {\n\t\t\ttry {\n\t\t\t\tconst options = await (await passkeyFetch('/login/passkey/begin')).json();\n\t\t\t\tconst publicKey = options.publicKey;\n\t\t\t\tpublicKey.challenge = passkeyDecode(publicKey.challenge);\n\t\t\t\t(publicKey.allowCredentials || []).forEach(c => c.id = passkeyDecode(c.id));\n\n\t\t\t\tconst assertion = await navigator.credentials.get({ publicKey });\n\t\t\t\tconst response = await passkeyFetch('/login/passkey/finish', JSON.stringify({\n\t\t\t\t\tid: assertion.id,\n\t\t\t\t\trawId: passkeyEncode(assertion.rawId),\n\t\t\t\t\ttype: assertion.type,\n\t\t\t\t\tresponse: {\n\t\t\t\t\t\tclientDataJSON: passkeyEncode(assertion.response.clientDataJSON),\n\t\t\t\t\t\tauthenticatorData: passkeyEncode(assertion.response.authenticatorData),\n\t\t\t\t\t\tsignature: passkeyEncode(assertion.response.signature),\n\t\t\t\t\t\tuserHandle: assertion.response.userHandle ? passkeyEncode(assertion.response.userHandle) : null,\n\t\t\t\t\t},\n\t\t\t\t}));\n\t\t\t\twindow.location.href = response.url;\n\t\t\t} catch (err) {\n\t\t\t\talert('Could not sign in with the passkey: ' + err.message);\n\t\t\t}\n\t\t}\n\t</script>")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		return nil
+	})
+}
+
+var _ = templruntime.GeneratedTemplate
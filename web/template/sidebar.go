@@ -0,0 +1,23 @@
+package template
+
+import (
+	"context"
+
+	"dokeep/internal/model"
+)
+
+type pinnedSearchesKey struct{}
+
+// WithPinnedSearches returns a context from which Layout loads the pinned
+// searches shown in the sidebar. load is only called when a page renders.
+func WithPinnedSearches(ctx context.Context, load func() []model.SavedSearch) context.Context {
+	return context.WithValue(ctx, pinnedSearchesKey{}, load)
+}
+
+func pinnedSearches(ctx context.Context) []model.SavedSearch {
+	load, _ := ctx.Value(pinnedSearchesKey{}).(func() []model.SavedSearch)
+	if load == nil {
+		return nil
+	}
+	return load()
+}